@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto"
+	"dynamic-table-backend/models"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTVerifier verifies bearer tokens signed with an HMAC secret or a key from a JWKS file
+type JWTVerifier struct {
+	secret   []byte
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+}
+
+// NewJWTVerifierFromEnv configures JWT verification from AUTH_JWT_SECRET, AUTH_JWKS_FILE,
+// AUTH_JWT_ISSUER and AUTH_JWT_AUDIENCE. It returns nil if neither a secret nor a JWKS file is set.
+func NewJWTVerifierFromEnv() (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		issuer:   os.Getenv("AUTH_JWT_ISSUER"),
+		audience: os.Getenv("AUTH_JWT_AUDIENCE"),
+	}
+	if secret := os.Getenv("AUTH_JWT_SECRET"); secret != "" {
+		v.secret = []byte(secret)
+	}
+	if path := os.Getenv("AUTH_JWKS_FILE"); path != "" {
+		keys, err := LoadJWKS(path)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+	}
+	if v.secret == nil && v.keys == nil {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// Verify checks a token's signature and registered claims and returns its principal
+func (v *JWTVerifier) Verify(tokenString string) (*models.Principal, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+	}
+	if v.issuer != "" {
+		options = append(options, jwt.WithIssuer(v.issuer))
+	}
+	if v.audience != "" {
+		options = append(options, jwt.WithAudience(v.audience))
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, v.key, options...)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, fmt.Errorf("invalid token: missing subject")
+	}
+
+	name := subject
+	for _, claim := range []string{"name", "preferred_username", "email"} {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			name = value
+			break
+		}
+	}
+
+	// A "tenant" claim binds the token to one tenant. A claim that is not a valid tenant name must not
+	// leave the token unbound, so it invalidates the token.
+	var tenant string
+	if claim, ok := claims["tenant"]; ok {
+		tenant, _ = claim.(string)
+		if !models.ValidTenant(tenant) {
+			return nil, fmt.Errorf("invalid token: invalid tenant claim")
+		}
+	}
+
+	return &models.Principal{
+		ID:          subject,
+		Name:        name,
+		Method:      "jwt",
+		Claims:      claims,
+		Tenant:      tenant,
+		TenantBound: tenant != "",
+	}, nil
+}
+
+// key selects the verification key for a token. HMAC tokens only verify against the
+// configured secret and asymmetric tokens only against JWKS keys, so one cannot pass for the other.
+func (v *JWTVerifier) key(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if v.secret == nil {
+			return nil, fmt.Errorf("HMAC tokens are not accepted")
+		}
+		return v.secret, nil
+	}
+
+	if v.keys == nil {
+		return nil, fmt.Errorf("signed tokens are not accepted without a JWKS file")
+	}
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"context"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// principalKey is the gin context key holding the authenticated principal
+const principalKey = "principal"
+
+// TenantHeader selects the tenant of a request for principals not bound to one
+const TenantHeader = "X-Tenant"
+
+// principalContextKey holds the principal in request contexts, e.g. for GraphQL resolvers
+type principalContextKey struct{}
+
+// Authenticator identifies callers by API key or JWT bearer token
+type Authenticator struct {
+	apiKeyRepo repository.APIKeyStore
+	roleRepo   repository.RoleStore
+	jwt        *JWTVerifier
+	disabled   bool
+}
+
+// NewAuthenticator configures authentication from the environment.
+// Setting AUTH_DISABLED=true lets every request through as an anonymous administrator of any tenant.
+func NewAuthenticator(stores *repository.Stores) (*Authenticator, error) {
+	verifier, err := NewJWTVerifierFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Authenticator{
+		apiKeyRepo: stores.APIKeys,
+		roleRepo:   stores.Roles,
+		jwt:        verifier,
+		disabled:   os.Getenv("AUTH_DISABLED") == "true",
+	}
+	if a.disabled {
+		log.Println("Authentication is disabled, all requests are allowed")
+	} else if a.apiKeyRepo == nil || a.roleRepo == nil {
+		return nil, fmt.Errorf("authentication requires API key and role storage, set AUTH_DISABLED=true to run without it")
+	}
+	return a, nil
+}
+
+// Middleware rejects requests without valid credentials and attaches the principal to the context.
+// API keys are accepted in the X-API-Key header or as a bearer token; other bearer tokens are verified as JWTs.
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.disabled {
+			principal := &models.Principal{
+				ID:     "anonymous",
+				Name:   "anonymous",
+				Method: "none",
+				Roles:  []string{"admin"},
+				Grants: []models.Grant{{Permission: models.PermissionAdmin}},
+			}
+			if !resolveTenant(c, principal) {
+				return
+			}
+			SetPrincipal(c, principal)
+			c.Next()
+			return
+		}
+
+		credential := c.GetHeader("X-API-Key")
+		if credential == "" {
+			scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+			if found && strings.EqualFold(scheme, "Bearer") {
+				credential = strings.TrimSpace(token)
+			}
+		}
+		if credential == "" {
+			unauthorized(c, "authentication required")
+			return
+		}
+
+		principal, err := a.authenticate(credential)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if principal == nil {
+			unauthorized(c, "invalid credentials")
+			return
+		}
+
+		// Roles and grants come from the roles bound to the principal and the roles named in a JWT "roles" claim
+		claimed := claimedRoles(principal)
+		principal.Roles, err = a.roleRepo.GetRoleNamesForPrincipal(principal.ID, claimed)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		principal.Grants, err = a.roleRepo.GetGrantsForPrincipal(principal.ID, claimed)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Grants are not scoped to tenants, so the tenant is resolved once they are known
+		if !resolveTenant(c, principal) {
+			return
+		}
+
+		SetPrincipal(c, principal)
+		c.Next()
+	}
+}
+
+// authenticate resolves a credential to a principal, returning nil if it is not valid
+func (a *Authenticator) authenticate(credential string) (*models.Principal, error) {
+	if strings.HasPrefix(credential, repository.APIKeyPrefix) {
+		apiKey, err := a.apiKeyRepo.AuthenticateAPIKey(credential)
+		if err != nil || apiKey == nil {
+			return nil, err
+		}
+		return &models.Principal{
+			ID:          apiKey.ID,
+			Name:        apiKey.Name,
+			Method:      "apikey",
+			Tenant:      apiKey.Tenant,
+			TenantBound: apiKey.Tenant != "",
+		}, nil
+	}
+
+	if a.jwt == nil {
+		return nil, nil
+	}
+	principal, err := a.jwt.Verify(credential)
+	if err != nil {
+		// Invalid tokens are the caller's problem, not a server error
+		return nil, nil
+	}
+	return principal, nil
+}
+
+// resolveTenant sets the tenant of the request: the one the principal is bound to, otherwise the one
+// named by the X-Tenant header, otherwise the default tenant. Roles and grants apply in every tenant the
+// principal reaches, so only global administrators, i.e. unbound principals with the admin permission,
+// may name a tenant other than the default one. It aborts the request and returns false if the header
+// names an invalid tenant or one the principal may not use.
+func resolveTenant(c *gin.Context, principal *models.Principal) bool {
+	requested := c.GetHeader(TenantHeader)
+	if requested != "" && !models.ValidTenant(requested) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid tenant '%s'", requested)})
+		return false
+	}
+
+	if principal.TenantBound {
+		if requested != "" && requested != principal.Tenant {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("credentials are bound to tenant '%s'", principal.Tenant)})
+			return false
+		}
+		return true
+	}
+
+	if requested == "" {
+		requested = models.DefaultTenant
+	}
+	if requested != models.DefaultTenant && !principal.Can(models.PermissionAdmin, "") {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("credentials not bound to a tenant can only use tenant '%s'", models.DefaultTenant)})
+		return false
+	}
+	principal.Tenant = requested
+	return true
+}
+
+// claimedRoles returns the role names listed in a JWT "roles" claim
+func claimedRoles(principal *models.Principal) []string {
+	if principal.Method != "jwt" {
+		return nil
+	}
+	var roles []string
+	switch claim := principal.Claims["roles"].(type) {
+	case []interface{}:
+		for _, role := range claim {
+			if name, ok := role.(string); ok {
+				roles = append(roles, name)
+			}
+		}
+	case string:
+		roles = strings.Fields(claim)
+	}
+	return roles
+}
+
+// unauthorized aborts a request with 401 and a bearer challenge
+func unauthorized(c *gin.Context, message string) {
+	c.Header("WWW-Authenticate", `Bearer realm="api"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// SetPrincipal attaches the authenticated principal to the gin and request contexts
+func SetPrincipal(c *gin.Context, principal *models.Principal) {
+	c.Set(principalKey, principal)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), principalContextKey{}, principal))
+}
+
+// PrincipalFromContext returns the principal attached to a request context, or nil
+func PrincipalFromContext(ctx context.Context) *models.Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*models.Principal)
+	return principal
+}
+
+// TenantFromContext returns the tenant of the principal attached to a request context
+func TenantFromContext(ctx context.Context) string {
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		return principal.Tenant
+	}
+	return models.DefaultTenant
+}
+
+// GetTenant returns the tenant an authenticated request operates in
+func GetTenant(c *gin.Context) string {
+	if principal := GetPrincipal(c); principal != nil {
+		return principal.Tenant
+	}
+	return models.DefaultTenant
+}
+
+// GetPrincipal returns the principal of an authenticated request, or nil
+func GetPrincipal(c *gin.Context) *models.Principal {
+	if value, ok := c.Get(principalKey); ok {
+		if principal, ok := value.(*models.Principal); ok {
+			return principal
+		}
+	}
+	return nil
+}
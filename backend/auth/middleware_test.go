@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dynamic-table-backend/internal/testutil/fakes"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testJWTSecret = "test-secret"
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+	t.Setenv("AUTH_JWT_SECRET", testJWTSecret)
+	stores := &repository.Stores{
+		APIKeys: &fakes.APIKeys{Keys: map[string]*models.APIKey{
+			"dtk_admin":  {ID: "admin"},
+			"dtk_reader": {ID: "reader"},
+			"dtk_acme":   {ID: "acme-admin", Tenant: "acme"},
+		}},
+		Roles: &fakes.Roles{
+			Grants: map[string][]models.Grant{
+				"admin":  {{Permission: models.PermissionAdmin}},
+				"reader": {{Permission: models.PermissionContentRead}},
+			},
+			Members: map[string][]string{
+				"admin":      {"admin"},
+				"reader":     {"reader"},
+				"acme-admin": {"admin"},
+			},
+		},
+	}
+	a, err := NewAuthenticator(stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func signedToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+// authenticateRequest runs the middleware and returns the status and the tenant of the request
+func authenticateRequest(a *Authenticator, header http.Header) (int, string) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	tenant := ""
+	r.GET("/", a.Middleware(), func(c *gin.Context) {
+		tenant = GetTenant(c)
+		c.Status(http.StatusOK)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header = header
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code, tenant
+}
+
+func TestMiddlewareResolvesTenant(t *testing.T) {
+	a := newTestAuthenticator(t)
+	tests := []struct {
+		name       string
+		credential string
+		tenant     string
+		wantStatus int
+		wantTenant string
+	}{
+		{"unbound admin key", "dtk_admin", "", http.StatusOK, models.DefaultTenant},
+		{"unbound admin key choosing a tenant", "dtk_admin", "acme", http.StatusOK, "acme"},
+		{"unbound reader key", "dtk_reader", "", http.StatusOK, models.DefaultTenant},
+		{"unbound reader key naming the default tenant", "dtk_reader", models.DefaultTenant, http.StatusOK, models.DefaultTenant},
+		{"unbound reader key choosing a tenant", "dtk_reader", "acme", http.StatusForbidden, ""},
+		{"bound key", "dtk_acme", "", http.StatusOK, "acme"},
+		{"bound key naming its tenant", "dtk_acme", "acme", http.StatusOK, "acme"},
+		{"bound admin key choosing another tenant", "dtk_acme", "globex", http.StatusForbidden, ""},
+		{"bound admin key choosing the default tenant", "dtk_acme", models.DefaultTenant, http.StatusForbidden, ""},
+		{"invalid tenant", "dtk_admin", "not a tenant", http.StatusBadRequest, ""},
+		{"unknown key", "dtk_unknown", "", http.StatusUnauthorized, ""},
+		{"unbound token without roles", signedToken(t, jwt.MapClaims{"sub": "u1"}), "", http.StatusOK, models.DefaultTenant},
+		{"unbound token without roles choosing a tenant", signedToken(t, jwt.MapClaims{"sub": "u1"}), "acme", http.StatusForbidden, ""},
+		{"unbound token with a reader role choosing a tenant", signedToken(t, jwt.MapClaims{"sub": "u1", "roles": []string{"reader"}}), "acme", http.StatusForbidden, ""},
+		{"unbound token with the admin role choosing a tenant", signedToken(t, jwt.MapClaims{"sub": "u1", "roles": []string{"admin"}}), "acme", http.StatusOK, "acme"},
+		{"bound token", signedToken(t, jwt.MapClaims{"sub": "u1", "tenant": "acme"}), "", http.StatusOK, "acme"},
+		{"bound token choosing another tenant", signedToken(t, jwt.MapClaims{"sub": "u1", "tenant": "acme", "roles": []string{"admin"}}), "globex", http.StatusForbidden, ""},
+		{"token with an invalid tenant claim", signedToken(t, jwt.MapClaims{"sub": "u1", "tenant": "Not A Tenant", "roles": []string{"admin"}}), "", http.StatusUnauthorized, ""},
+		{"token with an empty tenant claim", signedToken(t, jwt.MapClaims{"sub": "u1", "tenant": "", "roles": []string{"admin"}}), "acme", http.StatusUnauthorized, ""},
+		{"token with a tenant claim that is not a string", signedToken(t, jwt.MapClaims{"sub": "u1", "tenant": 7, "roles": []string{"admin"}}), "acme", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.credential[:4] == "dtk_" {
+				header.Set("X-API-Key", tt.credential)
+			} else {
+				header.Set("Authorization", tt.credential)
+			}
+			if tt.tenant != "" {
+				header.Set(TenantHeader, tt.tenant)
+			}
+			status, tenant := authenticateRequest(a, header)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if status == http.StatusOK && tenant != tt.wantTenant {
+				t.Fatalf("tenant = %q, want %q", tenant, tt.wantTenant)
+			}
+		})
+	}
+}
@@ -11,7 +11,55 @@ import (
 
 var DB *sql.DB
 
+// ConnStr is the connection string of DB, for connections that cannot be pooled such as listeners
+var ConnStr string
+
+// Driver is the database DB connects to, selected by DB_DRIVER
+var Driver string
+
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+// InitDB connects to the database selected by DB_DRIVER and applies its pending migrations. With
+// MIGRATE_ON_START=false it only checks that they have been applied, e.g. by "migrate up" in a deploy step.
+// Either way it fails if the database was migrated by a newer release.
 func InitDB() error {
+	if err := Connect(); err != nil {
+		return err
+	}
+
+	migrator := NewMigrator(DB, Driver)
+	if os.Getenv("MIGRATE_ON_START") == "false" {
+		if err := migrator.CheckMigrations(); err != nil {
+			return err
+		}
+	} else {
+		applied, err := migrator.MigrateUp(0)
+		if err != nil {
+			return fmt.Errorf("failed to migrate database: %v", err)
+		}
+		if applied > 0 {
+			log.Printf("Applied %d database migrations", applied)
+		}
+	}
+
+	log.Println("Database initialized successfully")
+	return nil
+}
+
+// Connect opens the database selected by DB_DRIVER without migrating it
+func Connect() error {
+	switch Driver = os.Getenv("DB_DRIVER"); Driver {
+	case "", Postgres:
+		Driver = Postgres
+	case SQLite:
+		return openSQLite()
+	default:
+		return fmt.Errorf("unknown DB_DRIVER %q", Driver)
+	}
+
 	// Database connection string
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		os.Getenv("DB_HOST"),
@@ -22,6 +70,8 @@ func InitDB() error {
 		os.Getenv("DB_SSLMODE"),
 	)
 
+	ConnStr = connStr
+
 	// Open database connection
 	var err error
 	DB, err = sql.Open("postgres", connStr)
@@ -33,60 +83,5 @@ func InitDB() error {
 	if err = DB.Ping(); err != nil {
 		return fmt.Errorf("failed to ping database: %v", err)
 	}
-
-	// Create tables
-	if err = createTables(); err != nil {
-		return fmt.Errorf("failed to create tables: %v", err)
-	}
-
-	log.Println("Database initialized successfully")
-	return nil
-}
-
-func createTables() error {
-	// Create schemas table
-	schemasTable := `
-	CREATE TABLE IF NOT EXISTS schemas (
-		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-		table_slug VARCHAR(255) UNIQUE NOT NULL,
-		table_name VARCHAR(255) NOT NULL,
-		fields JSONB NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	// Create contents table
-	contentsTable := `
-	CREATE TABLE IF NOT EXISTS contents (
-		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-		table_slug VARCHAR(255) NOT NULL,
-		values JSONB NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (table_slug) REFERENCES schemas(table_slug) ON DELETE CASCADE
-	);`
-
-	// Create indexes
-	indexes := []string{
-		"CREATE INDEX IF NOT EXISTS idx_contents_table_slug ON contents(table_slug);",
-		"CREATE INDEX IF NOT EXISTS idx_contents_values ON contents USING GIN(values);",
-	}
-
-	// Execute table creation
-	if _, err := DB.Exec(schemasTable); err != nil {
-		return fmt.Errorf("failed to create schemas table: %v", err)
-	}
-
-	if _, err := DB.Exec(contentsTable); err != nil {
-		return fmt.Errorf("failed to create contents table: %v", err)
-	}
-
-	// Execute indexes
-	for _, index := range indexes {
-		if _, err := DB.Exec(index); err != nil {
-			return fmt.Errorf("failed to create index: %v", err)
-		}
-	}
-
 	return nil
 }
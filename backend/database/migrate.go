@@ -0,0 +1,375 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationFiles holds the migrations of each driver in migrations/<driver>, as
+// <version>_<name>.up.sql and an optional <version>_<name>.down.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migrationLockID keys the PostgreSQL advisory lock held while migrating, so that replicas starting
+// together apply each migration once. On SQLite, migrations take the write lock when they begin.
+const migrationLockID = 4179225081
+
+// migrationsTable records the applied migrations
+const migrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+// Migrator applies the migrations of a driver to a database
+type Migrator struct {
+	db     *sql.DB
+	driver string
+}
+
+// NewMigrator migrates db, which connects to the given driver's database
+func NewMigrator(db *sql.DB, driver string) *Migrator {
+	return &Migrator{db: db, driver: driver}
+}
+
+// Migration is a versioned change of the system tables. Each runs in a transaction of its own.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration of this binary or the database. Known is false for migrations
+// applied by a newer release.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Known     bool
+	AppliedAt *time.Time
+}
+
+// Migrations returns the migrations of the driver, oldest first
+func (m *Migrator) Migrations() ([]Migration, error) {
+	dir := path.Join("migrations", m.driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %v", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %s", entry.Name())
+		}
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %v", entry.Name(), err)
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has files named %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up file", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// MigrationStatuses returns the migrations of this binary and the database, oldest first
+func (m *Migrator) MigrationStatuses() ([]MigrationStatus, error) {
+	migrations, err := m.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied map[int]appliedMigration
+	err = m.withMigrationLock(func(conn *sql.Conn) error {
+		applied, err = appliedMigrations(conn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name, Known: true}
+		if a, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &a.appliedAt
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for version, a := range applied {
+		appliedAt := a.appliedAt
+		statuses = append(statuses, MigrationStatus{Version: version, Name: a.name, AppliedAt: &appliedAt})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// CheckMigrations fails unless the database has exactly the migrations of this binary
+func (m *Migrator) CheckMigrations() error {
+	statuses, err := m.MigrationStatuses()
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, status := range statuses {
+		if !status.Known {
+			return schemaAheadError(status.Version)
+		}
+		if status.AppliedAt == nil {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d database migrations are pending, run \"migrate up\" to apply them", pending)
+	}
+	return nil
+}
+
+// MigrateUp applies the pending migrations up to version target, or all of them if target is 0, and
+// returns how many it applied. It refuses to touch a database with migrations this binary does not know.
+func (m *Migrator) MigrateUp(target int) (int, error) {
+	migrations, err := m.Migrations()
+	if err != nil {
+		return 0, err
+	}
+	if target == 0 {
+		if len(migrations) == 0 {
+			return 0, nil
+		}
+		target = migrations[len(migrations)-1].Version
+	} else if findMigration(migrations, target) == nil {
+		return 0, fmt.Errorf("migration %d not found", target)
+	}
+
+	count := 0
+	err = m.withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		if err := checkKnown(migrations, applied); err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			if migration.Version > target {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			ran, err := runMigration(conn, migration, true)
+			if err != nil {
+				return err
+			}
+			if ran {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrateDown reverts the latest steps applied migrations and returns how many it reverted. Reverting the
+// baseline, i.e. the first migration, drops the system tables with all schemas and records, so it is
+// refused unless dropData is set.
+func (m *Migrator) MigrateDown(steps int, dropData bool) (int, error) {
+	migrations, err := m.Migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = m.withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		if err := checkKnown(migrations, applied); err != nil {
+			return err
+		}
+		// Every migration to revert is checked before the first one runs
+		var reverts []Migration
+		for i := len(migrations) - 1; i >= 0 && len(reverts) < steps; i-- {
+			migration := migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s cannot be reverted", migration.Version, migration.Name)
+			}
+			if i == 0 && !dropData {
+				return fmt.Errorf("reverting migration %d_%s drops all data; pass --drop-data to confirm", migration.Version, migration.Name)
+			}
+			reverts = append(reverts, migration)
+		}
+		for _, migration := range reverts {
+			ran, err := runMigration(conn, migration, false)
+			if err != nil {
+				return err
+			}
+			if ran {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+type appliedMigration struct {
+	name      string
+	appliedAt time.Time
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock, once the bookkeeping table exists
+func (m *Migrator) withMigrationLock(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %v", err)
+	}
+	defer conn.Close()
+
+	if m.driver == Postgres {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %v", err)
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+	}
+
+	if _, err := conn.ExecContext(ctx, migrationsTable); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(conn *sql.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(context.Background(), `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var version int
+		var a appliedMigration
+		if err := rows.Scan(&version, &a.name, &a.appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %v", err)
+		}
+		applied[version] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v", err)
+	}
+	return applied, nil
+}
+
+// runMigration applies or reverts a migration and records it in the same transaction. It reports false if
+// another process got there first, which the transaction detects on SQLite, where there is no advisory lock.
+func runMigration(conn *sql.Conn, migration Migration, up bool) (bool, error) {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var applied int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = $1`, migration.Version).Scan(&applied); err != nil {
+		return false, fmt.Errorf("failed to get migration %d_%s: %v", migration.Version, migration.Name, err)
+	}
+	if (applied > 0) == up {
+		return false, nil
+	}
+
+	if up {
+		if _, err := tx.Exec(migration.Up); err != nil {
+			return false, fmt.Errorf("failed to apply migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name); err != nil {
+			return false, fmt.Errorf("failed to record migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+	} else {
+		if _, err := tx.Exec(migration.Down); err != nil {
+			return false, fmt.Errorf("failed to revert migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, migration.Version); err != nil {
+			return false, fmt.Errorf("failed to record migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit migration %d_%s: %v", migration.Version, migration.Name, err)
+	}
+	return true, nil
+}
+
+// checkKnown fails if the database has a migration this binary does not know, i.e. it was migrated by a newer release
+func checkKnown(migrations []Migration, applied map[int]appliedMigration) error {
+	latest := 0
+	for version := range applied {
+		if findMigration(migrations, version) == nil && version > latest {
+			latest = version
+		}
+	}
+	if latest > 0 {
+		return schemaAheadError(latest)
+	}
+	return nil
+}
+
+func schemaAheadError(version int) error {
+	return fmt.Errorf("database schema is at migration %d, which this binary does not know; upgrade the binary", version)
+}
+
+func findMigration(migrations []Migration, version int) *Migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestMigrator migrates a fresh SQLite database
+func newTestMigrator(t *testing.T) *Migrator {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewMigrator(db, SQLite)
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	m := newTestMigrator(t)
+	migrations, err := m.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no SQLite migrations")
+	}
+
+	if err := m.CheckMigrations(); err == nil {
+		t.Fatal("CheckMigrations of an empty database succeeded")
+	}
+	applied, err := m.MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Fatalf("applied %d migrations, want %d", applied, len(migrations))
+	}
+	if err := m.CheckMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := m.MigrateUp(0); err != nil || applied != 0 {
+		t.Fatalf("MigrateUp of a migrated database = %d, %v", applied, err)
+	}
+
+	// Reverting the baseline is refused, and nothing is reverted, unless data may be dropped
+	if _, err := m.MigrateDown(len(migrations), false); err == nil || !strings.Contains(err.Error(), "--drop-data") {
+		t.Fatalf("MigrateDown of the baseline = %v, want a refusal", err)
+	}
+	if err := m.CheckMigrations(); err != nil {
+		t.Fatalf("refused MigrateDown reverted migrations: %v", err)
+	}
+
+	reverted, err := m.MigrateDown(len(migrations), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted != len(migrations) {
+		t.Fatalf("reverted %d migrations, want %d", reverted, len(migrations))
+	}
+	statuses, err := m.MigrationStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			t.Fatalf("migration %d still applied", status.Version)
+		}
+	}
+}
+
+func TestMigrateRefusesUnknownMigrations(t *testing.T) {
+	m := newTestMigrator(t)
+	if _, err := m.MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.db.Exec(`INSERT INTO schema_migrations (version, name) VALUES (9999, 'future')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.MigrateUp(0); err == nil || !strings.Contains(err.Error(), "9999") {
+		t.Fatalf("MigrateUp with an unknown migration = %v", err)
+	}
+	if err := m.CheckMigrations(); err == nil {
+		t.Fatal("CheckMigrations with an unknown migration succeeded")
+	}
+}
@@ -0,0 +1,17 @@
+-- Drops every system table, and with them all schemas and records
+DROP TABLE IF EXISTS change_events;
+DROP TABLE IF EXISTS change_sequence;
+DROP TABLE IF EXISTS webhook_attempts;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS files;
+DROP TABLE IF EXISTS content_revisions;
+DROP TABLE IF EXISTS audit_log;
+DROP FUNCTION IF EXISTS audit_log_append_only();
+DROP TABLE IF EXISTS row_policies;
+DROP TABLE IF EXISTS role_members;
+DROP TABLE IF EXISTS role_grants;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS contents;
+DROP TABLE IF EXISTS schemas;
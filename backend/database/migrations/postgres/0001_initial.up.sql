@@ -0,0 +1,259 @@
+-- The system tables as createTables left them before versioned migrations. Every statement is
+-- idempotent, so databases created by earlier releases are brought up to date and adopted.
+
+-- Schemas; table slugs are unique within a tenant. Deleted schemas stay in the trash, with
+-- deleted_at set, until they are restored or purged.
+CREATE TABLE IF NOT EXISTS schemas (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	tenant VARCHAR(63) NOT NULL DEFAULT 'default',
+	table_slug VARCHAR(255) NOT NULL,
+	table_name VARCHAR(255) NOT NULL,
+	fields JSONB NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	deleted_at TIMESTAMP,
+	CONSTRAINT schemas_tenant_table_slug_key UNIQUE (tenant, table_slug)
+);
+
+-- Schemas created before tenants existed move to the default tenant, and the tables
+-- referencing them by slug alone are detached until they are upgraded below
+ALTER TABLE schemas ADD COLUMN IF NOT EXISTS tenant VARCHAR(63) NOT NULL DEFAULT 'default';
+ALTER TABLE schemas ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'schemas_table_slug_key') THEN
+		ALTER TABLE IF EXISTS contents DROP CONSTRAINT IF EXISTS contents_table_slug_fkey;
+		ALTER TABLE IF EXISTS row_policies DROP CONSTRAINT IF EXISTS row_policies_table_slug_fkey;
+		ALTER TABLE schemas DROP CONSTRAINT schemas_table_slug_key;
+		ALTER TABLE schemas ADD CONSTRAINT schemas_tenant_table_slug_key UNIQUE (tenant, table_slug);
+	END IF;
+END $$;
+
+-- Records; deleted records stay in the trash like deleted schemas
+CREATE TABLE IF NOT EXISTS contents (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	tenant VARCHAR(63) NOT NULL DEFAULT 'default',
+	table_slug VARCHAR(255) NOT NULL,
+	values JSONB NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	deleted_at TIMESTAMP,
+	CONSTRAINT contents_tenant_table_slug_fkey FOREIGN KEY (tenant, table_slug) REFERENCES schemas(tenant, table_slug) ON DELETE CASCADE
+);
+
+ALTER TABLE contents ADD COLUMN IF NOT EXISTS tenant VARCHAR(63) NOT NULL DEFAULT 'default';
+ALTER TABLE contents ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'contents_tenant_table_slug_fkey') THEN
+		ALTER TABLE contents ADD CONSTRAINT contents_tenant_table_slug_fkey
+			FOREIGN KEY (tenant, table_slug) REFERENCES schemas(tenant, table_slug) ON DELETE CASCADE;
+	END IF;
+END $$;
+
+-- API keys; only a SHA-256 hash of each key is stored. Keys with an empty tenant may operate in any tenant.
+CREATE TABLE IF NOT EXISTS api_keys (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	name VARCHAR(255) NOT NULL,
+	prefix VARCHAR(32) NOT NULL,
+	key_hash CHAR(64) UNIQUE NOT NULL,
+	tenant VARCHAR(63) NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMP,
+	revoked_at TIMESTAMP
+);
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant VARCHAR(63) NOT NULL DEFAULT '';
+
+-- Roles; grants with an empty table_slug apply to every table
+CREATE TABLE IF NOT EXISTS roles (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	name VARCHAR(255) UNIQUE NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS role_grants (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	role_id UUID NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	permission VARCHAR(64) NOT NULL,
+	table_slug VARCHAR(255) NOT NULL DEFAULT '',
+	UNIQUE (role_id, permission, table_slug)
+);
+
+CREATE TABLE IF NOT EXISTS role_members (
+	role_id UUID NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	principal_id VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (role_id, principal_id)
+);
+
+-- The built-in admin role holds every permission
+INSERT INTO roles (name, description) VALUES ('admin', 'Full access') ON CONFLICT (name) DO NOTHING;
+INSERT INTO role_grants (role_id, permission)
+SELECT id, 'admin' FROM roles WHERE name = 'admin'
+ON CONFLICT DO NOTHING;
+
+-- Row policies; one policy expression per table
+CREATE TABLE IF NOT EXISTS row_policies (
+	tenant VARCHAR(63) NOT NULL DEFAULT 'default',
+	table_slug VARCHAR(255) NOT NULL,
+	expression TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (tenant, table_slug),
+	CONSTRAINT row_policies_tenant_table_slug_fkey FOREIGN KEY (tenant, table_slug) REFERENCES schemas(tenant, table_slug) ON DELETE CASCADE
+);
+
+ALTER TABLE row_policies ADD COLUMN IF NOT EXISTS tenant VARCHAR(63) NOT NULL DEFAULT 'default';
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'row_policies_tenant_table_slug_fkey') THEN
+		ALTER TABLE row_policies DROP CONSTRAINT row_policies_pkey;
+		ALTER TABLE row_policies ADD PRIMARY KEY (tenant, table_slug);
+		ALTER TABLE row_policies ADD CONSTRAINT row_policies_tenant_table_slug_fkey
+			FOREIGN KEY (tenant, table_slug) REFERENCES schemas(tenant, table_slug) ON DELETE CASCADE;
+	END IF;
+END $$;
+
+-- Audit log; a trigger rejects updates and deletes so entries cannot be rewritten
+CREATE TABLE IF NOT EXISTS audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	tenant VARCHAR(63) NOT NULL,
+	actor_id VARCHAR(255) NOT NULL,
+	actor_name VARCHAR(255) NOT NULL,
+	action VARCHAR(32) NOT NULL,
+	table_slug VARCHAR(255) NOT NULL,
+	record_id VARCHAR(255) NOT NULL DEFAULT '',
+	changes JSONB NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+-- Content revisions; each row holds the values a record had before an update, numbered from 1
+-- per record. created_at is when those values were written.
+CREATE TABLE IF NOT EXISTS content_revisions (
+	content_id UUID NOT NULL REFERENCES contents(id) ON DELETE CASCADE,
+	tenant VARCHAR(63) NOT NULL,
+	revision INTEGER NOT NULL,
+	values JSONB NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	replaced_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (content_id, revision)
+);
+
+-- Uploaded blobs. The table has no foreign keys, so that files outliving their record or field
+-- are found and their blobs deleted.
+CREATE TABLE IF NOT EXISTS files (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	tenant VARCHAR(63) NOT NULL,
+	table_slug VARCHAR(255) NOT NULL,
+	content_id UUID NOT NULL,
+	field_name VARCHAR(255) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	size BIGINT NOT NULL,
+	mime_type VARCHAR(255) NOT NULL,
+	checksum VARCHAR(80) NOT NULL,
+	variants TEXT[] NOT NULL DEFAULT '{}',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS variants TEXT[] NOT NULL DEFAULT '{}';
+
+-- Webhooks. Deliveries are the outbox: they are written in the transaction of the change they
+-- report and dispatched afterwards, with every attempt logged.
+CREATE TABLE IF NOT EXISTS webhooks (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	tenant VARCHAR(63) NOT NULL,
+	table_slug VARCHAR(255) NOT NULL,
+	url TEXT NOT NULL,
+	events TEXT[] NOT NULL,
+	filter TEXT NOT NULL DEFAULT '',
+	secret VARCHAR(64) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	CONSTRAINT webhooks_tenant_table_slug_fkey FOREIGN KEY (tenant, table_slug) REFERENCES schemas(tenant, table_slug) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id BIGSERIAL PRIMARY KEY,
+	webhook_id UUID NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+	event VARCHAR(32) NOT NULL,
+	payload JSONB NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	delivered_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+	delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+	attempt INTEGER NOT NULL,
+	status_code INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	duration_ms BIGINT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (delivery_id, attempt)
+);
+
+-- Change events. Event IDs come from a single counter row whose lock is held until the change
+-- commits, so they increase in commit order and readers never see a gap filled later.
+CREATE TABLE IF NOT EXISTS change_sequence (
+	id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+	last_id BIGINT NOT NULL,
+	backfilled BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+ALTER TABLE change_sequence ADD COLUMN IF NOT EXISTS backfilled BOOLEAN NOT NULL DEFAULT FALSE;
+INSERT INTO change_sequence (id, last_id) VALUES (TRUE, 0) ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS change_events (
+	id BIGINT PRIMARY KEY,
+	tenant VARCHAR(63) NOT NULL,
+	table_slug VARCHAR(255) NOT NULL,
+	record_id VARCHAR(255) NOT NULL,
+	event VARCHAR(32) NOT NULL,
+	values JSONB,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes
+DROP INDEX IF EXISTS idx_contents_table_slug;
+CREATE INDEX IF NOT EXISTS idx_contents_tenant_table_slug ON contents(tenant, table_slug);
+CREATE INDEX IF NOT EXISTS idx_contents_values ON contents USING GIN(values);
+CREATE INDEX IF NOT EXISTS idx_schemas_deleted_at ON schemas(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_contents_deleted_at ON contents(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_webhooks_tenant_table_slug ON webhooks(tenant, table_slug);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, status);
+CREATE INDEX IF NOT EXISTS idx_change_events_table ON change_events(tenant, table_slug, id);
+CREATE INDEX IF NOT EXISTS idx_files_content ON files(content_id, field_name);
+CREATE INDEX IF NOT EXISTS idx_role_members_principal ON role_members(principal_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_record ON audit_log(tenant, table_slug, record_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(tenant, actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(tenant, created_at);
+
+-- The live schemas and records that predate the change log are appended as schema.create and
+-- insert events, once, so that the log can rebuild the full state of every table
+INSERT INTO change_events (id, tenant, table_slug, record_id, event, values)
+SELECT (SELECT last_id FROM change_sequence) + ROW_NUMBER() OVER (ORDER BY created_at, id),
+	tenant, table_slug, '', 'schema.create', jsonb_build_object('tableName', table_name, 'fields', fields)
+FROM schemas
+WHERE deleted_at IS NULL AND NOT (SELECT backfilled FROM change_sequence);
+UPDATE change_sequence SET last_id = GREATEST(last_id, (SELECT COALESCE(MAX(id), 0) FROM change_events));
+INSERT INTO change_events (id, tenant, table_slug, record_id, event, values)
+SELECT (SELECT last_id FROM change_sequence) + ROW_NUMBER() OVER (ORDER BY created_at, id),
+	tenant, table_slug, id::text, 'insert', values
+FROM contents
+WHERE deleted_at IS NULL AND NOT (SELECT backfilled FROM change_sequence);
+UPDATE change_sequence SET last_id = GREATEST(last_id, (SELECT COALESCE(MAX(id), 0) FROM change_events)), backfilled = TRUE;
@@ -0,0 +1,2 @@
+DROP SCHEMA IF EXISTS materialized CASCADE;
+ALTER TABLE schemas DROP COLUMN IF EXISTS storage;
@@ -0,0 +1,4 @@
+-- Tables may keep their records in a typed table of the materialized schema, named after the schema
+-- ID. storage is jsonb, materializing while the typed table is filled, or materialized.
+ALTER TABLE schemas ADD COLUMN storage VARCHAR(16) NOT NULL DEFAULT 'jsonb';
+CREATE SCHEMA IF NOT EXISTS materialized;
@@ -0,0 +1,5 @@
+-- Drops every table, and with them all schemas and records
+DROP TABLE IF EXISTS row_policies;
+DROP TABLE IF EXISTS content_revisions;
+DROP TABLE IF EXISTS contents;
+DROP TABLE IF EXISTS schemas;
@@ -0,0 +1,46 @@
+-- The tables of the SQLite store. Values and fields are JSON text, and timestamps are UTC text
+-- that sorts chronologically.
+CREATE TABLE IF NOT EXISTS schemas (
+	id TEXT PRIMARY KEY,
+	tenant TEXT NOT NULL DEFAULT 'default',
+	table_slug TEXT NOT NULL,
+	table_name TEXT NOT NULL,
+	fields TEXT NOT NULL CHECK (json_valid(fields)),
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	deleted_at TIMESTAMP,
+	UNIQUE (tenant, table_slug)
+);
+
+CREATE TABLE IF NOT EXISTS contents (
+	id TEXT PRIMARY KEY,
+	tenant TEXT NOT NULL DEFAULT 'default',
+	table_slug TEXT NOT NULL,
+	"values" TEXT NOT NULL CHECK (json_valid("values")),
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	deleted_at TIMESTAMP,
+	FOREIGN KEY (tenant, table_slug) REFERENCES schemas(tenant, table_slug) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS content_revisions (
+	content_id TEXT NOT NULL REFERENCES contents(id) ON DELETE CASCADE,
+	tenant TEXT NOT NULL,
+	revision INTEGER NOT NULL,
+	"values" TEXT NOT NULL CHECK (json_valid("values")),
+	created_at TIMESTAMP NOT NULL,
+	replaced_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (content_id, revision)
+);
+
+CREATE TABLE IF NOT EXISTS row_policies (
+	tenant TEXT NOT NULL DEFAULT 'default',
+	table_slug TEXT NOT NULL,
+	expression TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (tenant, table_slug),
+	FOREIGN KEY (tenant, table_slug) REFERENCES schemas(tenant, table_slug) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_contents_tenant_table_slug ON contents(tenant, table_slug, created_at);
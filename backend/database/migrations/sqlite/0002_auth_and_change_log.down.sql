@@ -0,0 +1,11 @@
+-- Drops the tables of API keys, roles, the audit log, the change log, webhooks and files
+DROP TABLE IF EXISTS change_events;
+DROP TABLE IF EXISTS webhook_attempts;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS files;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS role_members;
+DROP TABLE IF EXISTS role_grants;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS api_keys;
@@ -0,0 +1,140 @@
+-- The tables of the stores beyond schemas and records: API keys, roles, the audit log, the change
+-- log, webhooks and files. IDs are random UUIDs as text, and timestamps UTC text with microseconds
+-- like the other tables, so that they sort and compare chronologically.
+
+-- API keys; only a SHA-256 hash of each key is stored. Keys with an empty tenant may operate in any tenant.
+CREATE TABLE api_keys (
+	id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))),
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL,
+	key_hash TEXT UNIQUE NOT NULL,
+	tenant TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f000', 'now')),
+	last_used_at TIMESTAMP,
+	revoked_at TIMESTAMP
+);
+
+-- Roles; grants with an empty table_slug apply to every table
+CREATE TABLE roles (
+	id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))),
+	name TEXT UNIQUE NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f000', 'now'))
+);
+
+CREATE TABLE role_grants (
+	id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))),
+	role_id TEXT NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	permission TEXT NOT NULL,
+	table_slug TEXT NOT NULL DEFAULT '',
+	UNIQUE (role_id, permission, table_slug)
+);
+
+CREATE TABLE role_members (
+	role_id TEXT NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	principal_id TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f000', 'now')),
+	PRIMARY KEY (role_id, principal_id)
+);
+
+-- The built-in admin role holds every permission
+INSERT INTO roles (name, description) VALUES ('admin', 'Full access');
+INSERT INTO role_grants (role_id, permission) SELECT id, 'admin' FROM roles WHERE name = 'admin';
+
+-- Audit log; triggers reject updates and deletes so entries cannot be rewritten
+CREATE TABLE audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tenant TEXT NOT NULL,
+	actor_id TEXT NOT NULL,
+	actor_name TEXT NOT NULL,
+	action TEXT NOT NULL,
+	table_slug TEXT NOT NULL,
+	record_id TEXT NOT NULL DEFAULT '',
+	changes TEXT NOT NULL CHECK (json_valid(changes)),
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+-- Uploaded blobs. The table has no foreign keys, so that files outliving their record or field
+-- are found and their blobs deleted. variants is a JSON array of blob keys.
+CREATE TABLE files (
+	id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))),
+	tenant TEXT NOT NULL,
+	table_slug TEXT NOT NULL,
+	content_id TEXT NOT NULL,
+	field_name TEXT NOT NULL,
+	name TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	mime_type TEXT NOT NULL,
+	checksum TEXT NOT NULL,
+	variants TEXT NOT NULL DEFAULT '[]' CHECK (json_valid(variants)),
+	created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f000', 'now'))
+);
+
+-- Webhooks, whose events are a JSON array. Deliveries are the outbox: they are written in the
+-- transaction of the change they report and dispatched afterwards, with every attempt logged.
+CREATE TABLE webhooks (
+	id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))),
+	tenant TEXT NOT NULL,
+	table_slug TEXT NOT NULL,
+	url TEXT NOT NULL,
+	events TEXT NOT NULL CHECK (json_valid(events)),
+	filter TEXT NOT NULL DEFAULT '',
+	secret TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f000', 'now')),
+	FOREIGN KEY (tenant, table_slug) REFERENCES schemas(tenant, table_slug) ON DELETE CASCADE
+);
+
+CREATE TABLE webhook_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhook_id TEXT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+	event TEXT NOT NULL,
+	payload TEXT NOT NULL CHECK (json_valid(payload)),
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	delivered_at TIMESTAMP
+);
+
+CREATE TABLE webhook_attempts (
+	delivery_id INTEGER NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+	attempt INTEGER NOT NULL,
+	status_code INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	duration_ms INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (delivery_id, attempt)
+);
+
+-- Change events. Writes hold the database's write lock until they commit, so event IDs increase
+-- in commit order.
+CREATE TABLE change_events (
+	id INTEGER PRIMARY KEY,
+	tenant TEXT NOT NULL,
+	table_slug TEXT NOT NULL,
+	record_id TEXT NOT NULL,
+	event TEXT NOT NULL,
+	"values" TEXT CHECK ("values" IS NULL OR json_valid("values")),
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_webhooks_tenant_table_slug ON webhooks(tenant, table_slug);
+CREATE INDEX idx_webhook_deliveries_pending ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, status);
+CREATE INDEX idx_change_events_table ON change_events(tenant, table_slug, id);
+CREATE INDEX idx_files_content ON files(content_id, field_name);
+CREATE INDEX idx_role_members_principal ON role_members(principal_id);
+CREATE INDEX idx_audit_log_record ON audit_log(tenant, table_slug, record_id);
+CREATE INDEX idx_audit_log_actor ON audit_log(tenant, actor_id);
+CREATE INDEX idx_audit_log_created_at ON audit_log(tenant, created_at);
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+
+	_ "modernc.org/sqlite"
+)
+
+// openSQLite opens the SQLite database file at DB_PATH (default dynamic_tables.db)
+func openSQLite() error {
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		path = "dynamic_tables.db"
+	}
+
+	var err error
+	if DB, err = OpenSQLite(path); err != nil {
+		return err
+	}
+	log.Printf("Using SQLite database %s", path)
+	return nil
+}
+
+// OpenSQLite opens the SQLite database file at path, creating it if needed
+func OpenSQLite(path string) (*sql.DB, error) {
+	// Transactions take the write lock when they begin, so that writers queue up instead of failing when
+	// they upgrade a read lock, and concurrent migrations stay apart. Readers run alongside them in WAL mode.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	return db, nil
+}
@@ -0,0 +1,144 @@
+package formula
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Result types of formula expressions
+const (
+	TypeNumber  = "number"
+	TypeString  = "string"
+	TypeDate    = "date"
+	TypeBoolean = "boolean"
+)
+
+// signature describes a formula function's arity and result type
+type signature struct {
+	minArgs int
+	maxArgs int // -1 for variadic
+	args    string
+	result  func(args []string) string
+}
+
+func fixed(result string) func([]string) string {
+	return func([]string) string { return result }
+}
+
+// functions are the built-in formula functions; args lists the expected type of
+// each argument ("n" number, "s" string, "d" date, "*" any)
+var functions = map[string]signature{
+	"concat":   {minArgs: 1, maxArgs: -1, args: "*", result: fixed(TypeString)},
+	"upper":    {minArgs: 1, maxArgs: 1, args: "*", result: fixed(TypeString)},
+	"lower":    {minArgs: 1, maxArgs: 1, args: "*", result: fixed(TypeString)},
+	"length":   {minArgs: 1, maxArgs: 1, args: "*", result: fixed(TypeNumber)},
+	"round":    {minArgs: 1, maxArgs: 2, args: "nn", result: fixed(TypeNumber)},
+	"abs":      {minArgs: 1, maxArgs: 1, args: "n", result: fixed(TypeNumber)},
+	"floor":    {minArgs: 1, maxArgs: 1, args: "n", result: fixed(TypeNumber)},
+	"ceil":     {minArgs: 1, maxArgs: 1, args: "n", result: fixed(TypeNumber)},
+	"coalesce": {minArgs: 1, maxArgs: -1, args: "*", result: func(args []string) string { return args[0] }},
+	"now":      {minArgs: 0, maxArgs: 0, result: fixed(TypeDate)},
+	"today":    {minArgs: 0, maxArgs: 0, result: fixed(TypeDate)},
+	"dateDiff": {minArgs: 2, maxArgs: 2, args: "dd", result: fixed(TypeNumber)},
+	"dateAdd":  {minArgs: 2, maxArgs: 2, args: "dn", result: fixed(TypeDate)},
+}
+
+// lookupFunction finds a function by case-insensitive name
+func lookupFunction(name string) (string, signature, bool) {
+	for fn, sig := range functions {
+		if strings.EqualFold(fn, name) {
+			return fn, sig, true
+		}
+	}
+	return "", signature{}, false
+}
+
+// accepts reports whether an argument of type actual can be used where the argument kind is expected
+func accepts(kind byte, actual string, arg Node) bool {
+	switch kind {
+	case 'n':
+		return actual == TypeNumber
+	case 'd':
+		// ISO date literals are accepted wherever a date is expected
+		_, literal := arg.(*StringLit)
+		return actual == TypeDate || literal
+	case 's':
+		return actual == TypeString
+	default:
+		return true
+	}
+}
+
+// Check type-checks a formula, resolving field references through typeOf
+func Check(node Node, typeOf func(name string) (string, error)) (string, error) {
+	switch v := node.(type) {
+	case *NumberLit:
+		return TypeNumber, nil
+	case *StringLit:
+		return TypeString, nil
+	case *BoolLit:
+		return TypeBoolean, nil
+	case *FieldRef:
+		return typeOf(v.Name)
+	case *Unary:
+		t, err := Check(v.Operand, typeOf)
+		if err != nil {
+			return "", err
+		}
+		if t != TypeNumber {
+			return "", fmt.Errorf("operator '%s' requires a number, got %s", v.Op, t)
+		}
+		return TypeNumber, nil
+	case *Binary:
+		left, err := Check(v.Left, typeOf)
+		if err != nil {
+			return "", err
+		}
+		right, err := Check(v.Right, typeOf)
+		if err != nil {
+			return "", err
+		}
+		if left != TypeNumber || right != TypeNumber {
+			return "", fmt.Errorf("operator '%s' requires numbers, got %s and %s (use concat to join text)", v.Op, left, right)
+		}
+		return TypeNumber, nil
+	case *Call:
+		name, sig, ok := lookupFunction(v.Name)
+		if !ok {
+			return "", fmt.Errorf("unknown function '%s'", v.Name)
+		}
+		if len(v.Args) < sig.minArgs || (sig.maxArgs >= 0 && len(v.Args) > sig.maxArgs) {
+			return "", fmt.Errorf("wrong number of arguments to %s", name)
+		}
+
+		types := make([]string, 0, len(v.Args))
+		for i, arg := range v.Args {
+			t, err := Check(arg, typeOf)
+			if err != nil {
+				return "", err
+			}
+			kind := byte('*')
+			if i < len(sig.args) {
+				kind = sig.args[i]
+			} else if len(sig.args) > 0 {
+				kind = sig.args[len(sig.args)-1]
+			}
+			if !accepts(kind, t, arg) {
+				return "", fmt.Errorf("argument %d of %s has type %s", i+1, name, t)
+			}
+			types = append(types, t)
+		}
+
+		if name == "coalesce" {
+			for _, t := range types[1:] {
+				if t != types[0] {
+					return "", fmt.Errorf("coalesce arguments must share a type, got %s and %s", types[0], t)
+				}
+			}
+		}
+
+		return sig.result(types), nil
+	default:
+		return "", fmt.Errorf("invalid formula")
+	}
+}
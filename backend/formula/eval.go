@@ -0,0 +1,218 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateLayout is the format formula dates are rendered in
+const DateLayout = "2006-01-02T15:04:05Z"
+
+// dateLayouts are the accepted formats when reading dates from record values
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Eval evaluates a formula, resolving field references through valueOf.
+// Missing or malformed operands evaluate to nil rather than failing.
+func Eval(node Node, valueOf func(name string) interface{}, now time.Time) interface{} {
+	switch v := node.(type) {
+	case *NumberLit:
+		return v.Value
+	case *StringLit:
+		return v.Value
+	case *BoolLit:
+		return v.Value
+	case *FieldRef:
+		return valueOf(v.Name)
+	case *Unary:
+		n, ok := toNumber(Eval(v.Operand, valueOf, now))
+		if !ok {
+			return nil
+		}
+		if v.Op == "-" {
+			return -n
+		}
+		return n
+	case *Binary:
+		left, lok := toNumber(Eval(v.Left, valueOf, now))
+		right, rok := toNumber(Eval(v.Right, valueOf, now))
+		if !lok || !rok {
+			return nil
+		}
+		switch v.Op {
+		case "+":
+			return left + right
+		case "-":
+			return left - right
+		case "*":
+			return left * right
+		case "/":
+			if right == 0 {
+				return nil
+			}
+			return left / right
+		case "%":
+			if right == 0 {
+				return nil
+			}
+			return math.Mod(left, right)
+		}
+		return nil
+	case *Call:
+		args := make([]interface{}, len(v.Args))
+		for i, arg := range v.Args {
+			args[i] = Eval(arg, valueOf, now)
+		}
+		return call(v.Name, args, now)
+	}
+	return nil
+}
+
+// call evaluates a built-in function
+func call(name string, args []interface{}, now time.Time) interface{} {
+	name, _, _ = lookupFunction(name)
+	switch name {
+	case "concat":
+		var b strings.Builder
+		for _, arg := range args {
+			b.WriteString(toString(arg))
+		}
+		return b.String()
+	case "upper":
+		if args[0] == nil {
+			return nil
+		}
+		return strings.ToUpper(toString(args[0]))
+	case "lower":
+		if args[0] == nil {
+			return nil
+		}
+		return strings.ToLower(toString(args[0]))
+	case "length":
+		if args[0] == nil {
+			return nil
+		}
+		return float64(len([]rune(toString(args[0]))))
+	case "round":
+		n, ok := toNumber(args[0])
+		if !ok {
+			return nil
+		}
+		digits := 0.0
+		if len(args) > 1 {
+			if digits, ok = toNumber(args[1]); !ok {
+				return nil
+			}
+		}
+		scale := math.Pow(10, math.Trunc(digits))
+		return math.Round(n*scale) / scale
+	case "abs", "floor", "ceil":
+		n, ok := toNumber(args[0])
+		if !ok {
+			return nil
+		}
+		return map[string]func(float64) float64{"abs": math.Abs, "floor": math.Floor, "ceil": math.Ceil}[name](n)
+	case "coalesce":
+		for _, arg := range args {
+			if arg != nil {
+				return arg
+			}
+		}
+		return nil
+	case "now":
+		return now.UTC()
+	case "today":
+		return now.UTC().Truncate(24 * time.Hour)
+	case "dateDiff":
+		a, aok := toDate(args[0])
+		b, bok := toDate(args[1])
+		if !aok || !bok {
+			return nil
+		}
+		return a.Sub(b).Hours() / 24
+	case "dateAdd":
+		d, dok := toDate(args[0])
+		days, nok := toNumber(args[1])
+		if !dok || !nok {
+			return nil
+		}
+		return d.Add(time.Duration(days * float64(24*time.Hour)))
+	}
+	return nil
+}
+
+// Output converts an evaluated value into its JSON representation
+func Output(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok {
+		return t.UTC().Format(DateLayout)
+	}
+	if n, ok := value.(float64); ok && (math.IsNaN(n) || math.IsInf(n, 0)) {
+		return nil
+	}
+	return value
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.UTC().Format(DateLayout)
+	case []interface{}:
+		// Lookup values join like their SQL text form
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			if item != nil {
+				parts = append(parts, toString(item))
+			}
+		}
+		return strings.Join(parts, ", ")
+	}
+	return fmt.Sprint(value)
+}
+
+// ParseDate reads a date value in one of the formats accepted in record values, in UTC
+func ParseDate(value interface{}) (time.Time, bool) {
+	return toDate(value)
+}
+
+func toDate(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UTC(), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
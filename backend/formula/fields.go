@@ -0,0 +1,191 @@
+package formula
+
+import (
+	"fmt"
+	"time"
+
+	"dynamic-table-backend/models"
+)
+
+// DataType is the data type of formula fields
+const DataType = "formula"
+
+// Data types of fields computed from linked rows
+const (
+	LookupDataType = "lookup"
+	RollupDataType = "rollup"
+)
+
+// ReadOnly reports whether a field's values are computed by the server rather than supplied by clients
+func ReadOnly(field models.Field) bool {
+	switch field.DataType {
+	case DataType, LookupDataType, RollupDataType:
+		return true
+	}
+	return false
+}
+
+// FieldType returns the formula type of a field's values
+func FieldType(field models.Field) string {
+	switch field.DataType {
+	case RollupDataType:
+		if field.LinkConfig != nil && field.LinkConfig.ResultType != "" {
+			return field.LinkConfig.ResultType
+		}
+		return TypeString
+	case "number":
+		return TypeNumber
+	case "checkbox":
+		return TypeBoolean
+	case "date", "datetime":
+		return TypeDate
+	case DataType:
+		return field.FormulaType
+	default:
+		return TypeString
+	}
+}
+
+// Validate parses and type-checks every formula field, recording each result type
+// in FormulaType. References to unknown fields and reference cycles are rejected, as are
+// stored formulas depending on lookups or rollups: those are computed on read from other
+// tables, so a stored result would go stale when the linked rows change.
+func Validate(fields []models.Field) error {
+	index := make(map[string]int)
+	for i, field := range fields {
+		index[field.Name] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	// linked records the formula fields depending on lookups or rollups
+	linked := make(map[string]bool)
+
+	var resolve func(name string) (string, error)
+	resolve = func(name string) (string, error) {
+		i, ok := index[name]
+		if !ok {
+			return "", fmt.Errorf("formula references unknown field '%s'", name)
+		}
+		field := &fields[i]
+		if field.DataType != DataType {
+			return FieldType(*field), nil
+		}
+
+		switch state[name] {
+		case done:
+			return field.FormulaType, nil
+		case visiting:
+			return "", fmt.Errorf("formula field '%s' references itself", name)
+		}
+		state[name] = visiting
+
+		if field.Formula == "" {
+			return "", fmt.Errorf("formula field '%s' has no formula", name)
+		}
+		node, err := Parse(field.Formula)
+		if err != nil {
+			return "", fmt.Errorf("formula field '%s': %v", name, err)
+		}
+		t, err := Check(node, resolve)
+		if err != nil {
+			return "", fmt.Errorf("formula field '%s': %v", name, err)
+		}
+
+		for _, ref := range References(node) {
+			if j, ok := index[ref]; ok {
+				dataType := fields[j].DataType
+				linked[name] = linked[name] || linked[ref] || dataType == LookupDataType || dataType == RollupDataType
+			}
+		}
+
+		field.FormulaType = t
+		state[name] = done
+		return t, nil
+	}
+
+	for _, field := range fields {
+		if field.DataType == DataType {
+			if _, err := resolve(field.Name); err != nil {
+				return err
+			}
+			if field.StoreFormula && linked[field.Name] {
+				return fmt.Errorf("formula field '%s' depends on a lookup or rollup and cannot be stored", field.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyComputed evaluates the formula fields that are computed on read into values
+func ApplyComputed(fields []models.Field, values map[string]interface{}, now time.Time) {
+	apply(fields, values, now, false)
+}
+
+// ApplyStored evaluates the formula fields that are stored on write into values
+func ApplyStored(fields []models.Field, values map[string]interface{}, now time.Time) {
+	apply(fields, values, now, true)
+}
+
+// StripFormulas removes client-supplied values for formula, lookup and rollup fields
+func StripFormulas(fields []models.Field, values map[string]interface{}) {
+	for _, field := range fields {
+		if ReadOnly(field) {
+			delete(values, field.Name)
+		}
+	}
+}
+
+// apply evaluates the selected formula fields, resolving formula references on demand
+func apply(fields []models.Field, values map[string]interface{}, now time.Time, stored bool) {
+	if values == nil {
+		return
+	}
+
+	// Stored values are trusted on read, but computed formulas must be evaluated
+	// on write when a stored formula depends on them
+	formulas := make(map[string]Node)
+	for _, field := range fields {
+		if field.DataType != DataType || (!stored && field.StoreFormula) {
+			continue
+		}
+		node, err := Parse(field.Formula)
+		if err != nil {
+			continue
+		}
+		formulas[field.Name] = node
+	}
+	if len(formulas) == 0 {
+		return
+	}
+
+	results := make(map[string]interface{})
+	evaluating := make(map[string]bool)
+	var valueOf func(name string) interface{}
+	valueOf = func(name string) interface{} {
+		node, ok := formulas[name]
+		if !ok {
+			return values[name]
+		}
+		if result, ok := results[name]; ok {
+			return result
+		}
+		if evaluating[name] {
+			return nil
+		}
+		evaluating[name] = true
+		result := Eval(node, valueOf, now)
+		results[name] = result
+		return result
+	}
+
+	for _, field := range fields {
+		if _, ok := formulas[field.Name]; ok && field.StoreFormula == stored {
+			values[field.Name] = Output(valueOf(field.Name))
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package formula
+
+import (
+	"strings"
+	"testing"
+
+	"dynamic-table-backend/models"
+)
+
+func TestValidate(t *testing.T) {
+	price := models.Field{Name: "price", DataType: "number"}
+	quantity := models.Field{Name: "quantity", DataType: "number"}
+	customer := models.Field{Name: "customer_name", DataType: LookupDataType}
+	tests := []struct {
+		name     string
+		fields   []models.Field
+		wantType string
+		wantErr  string
+	}{
+		{
+			name:     "arithmetic",
+			fields:   []models.Field{price, quantity, {Name: "total", DataType: DataType, Formula: "{price} * {quantity}"}},
+			wantType: TypeNumber,
+		},
+		{
+			name: "stored formula over a computed formula",
+			fields: []models.Field{price, quantity,
+				{Name: "subtotal", DataType: DataType, Formula: "{price} * {quantity}"},
+				{Name: "total", DataType: DataType, Formula: "{subtotal} + 1", StoreFormula: true}},
+			wantType: TypeNumber,
+		},
+		{
+			name:     "computed formula over a lookup",
+			fields:   []models.Field{customer, {Name: "total", DataType: DataType, Formula: "UPPER({customer_name})"}},
+			wantType: TypeString,
+		},
+		{
+			name:    "stored formula over a lookup",
+			fields:  []models.Field{customer, {Name: "total", DataType: DataType, Formula: "UPPER({customer_name})", StoreFormula: true}},
+			wantErr: "cannot be stored",
+		},
+		{
+			name: "stored formula over a lookup through a computed formula",
+			fields: []models.Field{customer,
+				{Name: "label", DataType: DataType, Formula: "UPPER({customer_name})"},
+				{Name: "total", DataType: DataType, Formula: "{label}", StoreFormula: true}},
+			wantErr: "cannot be stored",
+		},
+		{
+			name:    "unknown field",
+			fields:  []models.Field{{Name: "total", DataType: DataType, Formula: "{missing} + 1"}},
+			wantErr: "unknown field 'missing'",
+		},
+		{
+			name: "cycle",
+			fields: []models.Field{
+				{Name: "a", DataType: DataType, Formula: "{total}"},
+				{Name: "total", DataType: DataType, Formula: "{a}"}},
+			wantErr: "references itself",
+		},
+		{
+			name:    "empty formula",
+			fields:  []models.Field{{Name: "total", DataType: DataType}},
+			wantErr: "has no formula",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(test.fields)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Validate = %v, want an error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate = %v", err)
+			}
+			if got := test.fields[len(test.fields)-1].FormulaType; got != test.wantType {
+				t.Errorf("FormulaType = %q, want %q", got, test.wantType)
+			}
+		})
+	}
+}
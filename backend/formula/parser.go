@@ -0,0 +1,290 @@
+package formula
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Node is a parsed formula expression
+type Node interface{}
+
+// NumberLit is a numeric literal
+type NumberLit struct {
+	Value float64
+}
+
+// StringLit is a quoted string literal
+type StringLit struct {
+	Value string
+}
+
+// BoolLit is a true or false literal
+type BoolLit struct {
+	Value bool
+}
+
+// FieldRef references another field of the same row
+type FieldRef struct {
+	Name string
+}
+
+// Unary is a prefix operator applied to an operand
+type Unary struct {
+	Op      string
+	Operand Node
+}
+
+// Binary is an infix arithmetic operator
+type Binary struct {
+	Op          string
+	Left, Right Node
+}
+
+// Call is a function call
+type Call struct {
+	Name string
+	Args []Node
+}
+
+// precedence of the binary operators
+var precedence = map[string]int{
+	"+": 1,
+	"-": 1,
+	"*": 2,
+	"/": 2,
+	"%": 2,
+}
+
+type lexeme struct {
+	kind  string // "num", "str", "field", "ident", "op", "eof"
+	text  string
+	value float64
+}
+
+type parser struct {
+	lexemes []lexeme
+	pos     int
+}
+
+// Parse parses a formula expression such as "price * quantity" or "concat(first, ' ', last)"
+func Parse(src string) (Node, error) {
+	lexemes, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{lexemes: lexemes}
+	node, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != "eof" {
+		return nil, fmt.Errorf("unexpected '%s' in formula", p.peek().text)
+	}
+	return node, nil
+}
+
+// References returns the names of the fields a formula reads
+func References(node Node) []string {
+	var refs []string
+	seen := make(map[string]bool)
+	var walk func(Node)
+	walk = func(n Node) {
+		switch v := n.(type) {
+		case *FieldRef:
+			if !seen[v.Name] {
+				seen[v.Name] = true
+				refs = append(refs, v.Name)
+			}
+		case *Unary:
+			walk(v.Operand)
+		case *Binary:
+			walk(v.Left)
+			walk(v.Right)
+		case *Call:
+			for _, arg := range v.Args {
+				walk(arg)
+			}
+		}
+	}
+	walk(node)
+	return refs
+}
+
+func lex(src string) ([]lexeme, error) {
+	var lexemes []lexeme
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("+-*/%(),", r):
+			lexemes = append(lexemes, lexeme{kind: "op", text: string(r)})
+			i++
+		case r == '\'' || r == '"':
+			quote := r
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string in formula")
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					b.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == quote {
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			lexemes = append(lexemes, lexeme{kind: "str", text: b.String()})
+		case r == '{':
+			// Braces reference fields whose names are not plain identifiers, e.g. {unit price}
+			start := i + 1
+			for i < len(runes) && runes[i] != '}' {
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated field reference in formula")
+			}
+			lexemes = append(lexemes, lexeme{kind: "field", text: string(runes[start:i])})
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			text := string(runes[start:i])
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number '%s' in formula", text)
+			}
+			lexemes = append(lexemes, lexeme{kind: "num", text: text, value: value})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			lexemes = append(lexemes, lexeme{kind: "ident", text: string(runes[start:i])})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' in formula", r)
+		}
+	}
+	return append(lexemes, lexeme{kind: "eof", text: "end of formula"}), nil
+}
+
+func (p *parser) peek() lexeme {
+	return p.lexemes[p.pos]
+}
+
+func (p *parser) next() lexeme {
+	l := p.lexemes[p.pos]
+	if l.kind != "eof" {
+		p.pos++
+	}
+	return l
+}
+
+// parseExpr parses binary operators by precedence climbing
+func (p *parser) parseExpr(minPrec int) (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		l := p.peek()
+		prec, ok := precedence[l.text]
+		if l.kind != "op" || !ok || prec < minPrec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseExpr(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: l.text, Left: left, Right: right}
+	}
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	if l := p.peek(); l.kind == "op" && (l.text == "-" || l.text == "+") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{Op: l.text, Operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	l := p.next()
+	switch l.kind {
+	case "num":
+		return &NumberLit{Value: l.value}, nil
+	case "str":
+		return &StringLit{Value: l.text}, nil
+	case "field":
+		return &FieldRef{Name: l.text}, nil
+	case "ident":
+		switch strings.ToLower(l.text) {
+		case "true":
+			return &BoolLit{Value: true}, nil
+		case "false":
+			return &BoolLit{Value: false}, nil
+		}
+		if p.peek().kind == "op" && p.peek().text == "(" {
+			p.next()
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			return &Call{Name: l.text, Args: args}, nil
+		}
+		return &FieldRef{Name: l.text}, nil
+	case "op":
+		if l.text == "(" {
+			node, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			if r := p.next(); r.kind != "op" || r.text != ")" {
+				return nil, fmt.Errorf("expected ')' in formula")
+			}
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected '%s' in formula", l.text)
+}
+
+func (p *parser) parseArgs() ([]Node, error) {
+	var args []Node
+	if p.peek().kind == "op" && p.peek().text == ")" {
+		p.next()
+		return args, nil
+	}
+	for {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		l := p.next()
+		if l.kind == "op" && l.text == ")" {
+			return args, nil
+		}
+		if l.kind != "op" || l.text != "," {
+			return nil, fmt.Errorf("expected ',' or ')' in formula")
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package formula
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    Node
+		wantErr string
+	}{
+		{src: "42", want: &NumberLit{Value: 42}},
+		{src: "'it\\'s'", want: &StringLit{Value: "it's"}},
+		{src: "TRUE", want: &BoolLit{Value: true}},
+		{src: "price", want: &FieldRef{Name: "price"}},
+		{src: "{unit price}", want: &FieldRef{Name: "unit price"}},
+		{
+			src: "a + b * c",
+			want: &Binary{Op: "+", Left: &FieldRef{Name: "a"},
+				Right: &Binary{Op: "*", Left: &FieldRef{Name: "b"}, Right: &FieldRef{Name: "c"}}},
+		},
+		{
+			src: "a - b - c",
+			want: &Binary{Op: "-", Left: &Binary{Op: "-", Left: &FieldRef{Name: "a"}, Right: &FieldRef{Name: "b"}},
+				Right: &FieldRef{Name: "c"}},
+		},
+		{
+			src:  "(a + b) * c",
+			want: &Binary{Op: "*", Left: &Binary{Op: "+", Left: &FieldRef{Name: "a"}, Right: &FieldRef{Name: "b"}}, Right: &FieldRef{Name: "c"}},
+		},
+		{src: "-a", want: &Unary{Op: "-", Operand: &FieldRef{Name: "a"}}},
+		{src: "now()", want: &Call{Name: "now"}},
+		{
+			src:  "concat(first, ' ', {last name})",
+			want: &Call{Name: "concat", Args: []Node{&FieldRef{Name: "first"}, &StringLit{Value: " "}, &FieldRef{Name: "last name"}}},
+		},
+		{src: "", wantErr: "unexpected 'end of formula'"},
+		{src: "a +", wantErr: "unexpected 'end of formula'"},
+		{src: "a b", wantErr: "unexpected 'b'"},
+		{src: "(a", wantErr: "expected ')'"},
+		{src: "upper(a b)", wantErr: "expected ',' or ')'"},
+		{src: "'open", wantErr: "unterminated string"},
+		{src: "{open", wantErr: "unterminated field reference"},
+		{src: "1.2.3", wantErr: "invalid number"},
+		{src: "a & b", wantErr: "unexpected character '&'"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			got, err := Parse(test.src)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Parse(%q) = %v, want an error containing %q", test.src, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q) = %v", test.src, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Parse(%q) = %#v, want %#v", test.src, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReferences(t *testing.T) {
+	node, err := Parse("round({unit price} * qty, 2) + qty - -discount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := References(node)
+	want := []string{"unit price", "qty", "discount"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("References = %v, want %v", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	types := map[string]string{
+		"price": TypeNumber,
+		"name":  TypeString,
+		"due":   TypeDate,
+		"paid":  TypeBoolean,
+	}
+	typeOf := func(name string) (string, error) {
+		if t, ok := types[name]; ok {
+			return t, nil
+		}
+		return "", fmt.Errorf("unknown field '%s'", name)
+	}
+	tests := []struct {
+		src     string
+		want    string
+		wantErr string
+	}{
+		{src: "price * 2 + 1", want: TypeNumber},
+		{src: "-price", want: TypeNumber},
+		{src: "CONCAT(name, price)", want: TypeString},
+		{src: "upper(name)", want: TypeString},
+		{src: "length(name)", want: TypeNumber},
+		{src: "round(price, 2)", want: TypeNumber},
+		{src: "coalesce(due, now())", want: TypeDate},
+		{src: "dateDiff(due, '2024-01-01')", want: TypeNumber},
+		{src: "dateAdd(today(), 7)", want: TypeDate},
+		{src: "paid", want: TypeBoolean},
+		{src: "name + 1", wantErr: "operator '+' requires numbers"},
+		{src: "-name", wantErr: "operator '-' requires a number"},
+		{src: "missing + 1", wantErr: "unknown field 'missing'"},
+		{src: "sqrt(price)", wantErr: "unknown function 'sqrt'"},
+		{src: "round(price, 2, 3)", wantErr: "wrong number of arguments to round"},
+		{src: "now(1)", wantErr: "wrong number of arguments to now"},
+		{src: "concat()", wantErr: "wrong number of arguments to concat"},
+		{src: "abs(name)", wantErr: "argument 1 of abs has type string"},
+		{src: "dateDiff(due, price)", wantErr: "argument 2 of dateDiff has type number"},
+		{src: "coalesce(price, name)", wantErr: "coalesce arguments must share a type"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			node, err := Parse(test.src)
+			if err != nil {
+				t.Fatalf("Parse(%q) = %v", test.src, err)
+			}
+			got, err := Check(node, typeOf)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Check(%q) = %q, %v, want an error containing %q", test.src, got, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Check(%q) = %v", test.src, err)
+			}
+			if got != test.want {
+				t.Errorf("Check(%q) = %q, want %q", test.src, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package formula
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SQLContext supplies the pieces a formula needs to compile to PostgreSQL
+type SQLContext struct {
+	// Field returns the typed SQL expression for a referenced field
+	Field func(name string) (string, error)
+	// FieldText returns the SQL expression for a referenced field's raw text
+	FieldText func(name string) (string, error)
+	// Arg binds a literal and returns its placeholder
+	Arg func(value interface{}) string
+}
+
+// SQL compiles a formula into a PostgreSQL expression. Numbers compile to float8,
+// dates to timestamp (UTC), matching the values produced by Eval.
+func SQL(node Node, ctx SQLContext) (string, error) {
+	switch v := node.(type) {
+	case *NumberLit:
+		return ctx.Arg(v.Value) + "::float8", nil
+	case *StringLit:
+		return ctx.Arg(v.Value) + "::text", nil
+	case *BoolLit:
+		if v.Value {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case *FieldRef:
+		return ctx.Field(v.Name)
+	case *Unary:
+		operand, err := SQL(v.Operand, ctx)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s%s)", v.Op, operand), nil
+	case *Binary:
+		left, err := SQL(v.Left, ctx)
+		if err != nil {
+			return "", err
+		}
+		right, err := SQL(v.Right, ctx)
+		if err != nil {
+			return "", err
+		}
+		switch v.Op {
+		case "/":
+			return fmt.Sprintf("(%s / NULLIF(%s, 0))", left, right), nil
+		case "%":
+			return fmt.Sprintf("(%s - %s * trunc(%s / NULLIF(%s, 0)))", left, right, left, right), nil
+		default:
+			return fmt.Sprintf("(%s %s %s)", left, v.Op, right), nil
+		}
+	case *Call:
+		return callSQL(v, ctx)
+	}
+	return "", fmt.Errorf("invalid formula")
+}
+
+// textSQL renders an argument as text the same way Eval's toString does
+func textSQL(node Node, ctx SQLContext) (string, error) {
+	if ref, ok := node.(*FieldRef); ok {
+		return ctx.FieldText(ref.Name)
+	}
+	expr, err := SQL(node, ctx)
+	if err != nil {
+		return "", err
+	}
+	if isDateNode(node) {
+		return DateTextSQL(expr), nil
+	}
+	return expr + "::text", nil
+}
+
+// DateTextSQL formats a timestamp expression like DateLayout
+func DateTextSQL(expr string) string {
+	return fmt.Sprintf(`to_char(%s, 'YYYY-MM-DD"T"HH24:MI:SS"Z"')`, expr)
+}
+
+// isDateNode reports whether a node produces a date without needing field types
+func isDateNode(node Node) bool {
+	call, ok := node.(*Call)
+	if !ok {
+		return false
+	}
+	name, sig, ok := lookupFunction(call.Name)
+	return ok && name != "coalesce" && sig.result(nil) == TypeDate
+}
+
+// dateSQL converts an argument to a timestamp, parsing ISO strings
+func dateSQL(node Node, expr string) string {
+	if _, ok := node.(*StringLit); ok {
+		return expr + "::timestamp"
+	}
+	return expr
+}
+
+func callSQL(v *Call, ctx SQLContext) (string, error) {
+	name, _, ok := lookupFunction(v.Name)
+	if !ok {
+		return "", fmt.Errorf("unknown function '%s'", v.Name)
+	}
+
+	// Text functions render their arguments as text, the others take typed operands
+	compile := SQL
+	switch name {
+	case "concat", "upper", "lower", "length":
+		compile = textSQL
+	}
+
+	args := make([]string, len(v.Args))
+	for i, arg := range v.Args {
+		expr, err := compile(arg, ctx)
+		if err != nil {
+			return "", err
+		}
+		args[i] = expr
+	}
+
+	switch name {
+	case "concat":
+		return "concat(" + strings.Join(args, ", ") + ")", nil
+	case "upper", "lower":
+		return fmt.Sprintf("%s(%s)", name, args[0]), nil
+	case "length":
+		return fmt.Sprintf("length(%s)::float8", args[0]), nil
+	case "round":
+		if len(args) > 1 {
+			return fmt.Sprintf("round((%s)::numeric, trunc(%s)::int)::float8", args[0], args[1]), nil
+		}
+		return fmt.Sprintf("round((%s)::numeric)::float8", args[0]), nil
+	case "abs", "floor", "ceil":
+		return fmt.Sprintf("%s(%s)", name, args[0]), nil
+	case "coalesce":
+		return "COALESCE(" + strings.Join(args, ", ") + ")", nil
+	case "now":
+		return "(now() AT TIME ZONE 'UTC')", nil
+	case "today":
+		return "date_trunc('day', now() AT TIME ZONE 'UTC')", nil
+	case "dateDiff":
+		return fmt.Sprintf("(EXTRACT(EPOCH FROM (%s - %s)) / 86400)::float8", dateSQL(v.Args[0], args[0]), dateSQL(v.Args[1], args[1])), nil
+	case "dateAdd":
+		return fmt.Sprintf("(%s + %s * interval '1 day')", dateSQL(v.Args[0], args[0]), args[1]), nil
+	}
+	return "", fmt.Errorf("unknown function '%s'", v.Name)
+}
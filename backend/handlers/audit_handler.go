@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditHandler struct {
+	auditRepo repository.AuditStore
+}
+
+func NewAuditHandler(stores *repository.Stores) *AuditHandler {
+	return &AuditHandler{
+		auditRepo: stores.Audit,
+	}
+}
+
+// GetAuditLog lists the audit entries of the tenant, filtered by table, record, actor and time range
+func (h *AuditHandler) GetAuditLog(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	params := models.AuditQueryParams{
+		TableSlug: c.Query("table"),
+		RecordID:  c.Query("record"),
+		ActorID:   c.Query("actor"),
+	}
+
+	// Parse the time range
+	var ok bool
+	if params.From, ok = queryTime(c, "from"); !ok {
+		return
+	}
+	if params.To, ok = queryTime(c, "to"); !ok {
+		return
+	}
+
+	// Parse pagination
+	if pageStr := c.Query("page"); pageStr != "" {
+		if page, err := strconv.Atoi(pageStr); err == nil && page > 0 {
+			params.Page = page
+		}
+	}
+	if pageSizeStr := c.Query("pageSize"); pageSizeStr != "" {
+		if pageSize, err := strconv.Atoi(pageSizeStr); err == nil && pageSize > 0 {
+			params.PageSize = pageSize
+		}
+	}
+
+	response, err := h.auditRepo.GetAuditEntries(auth.GetTenant(c), &params)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// queryTime parses an optional RFC 3339 timestamp query parameter and responds 400 if it is invalid
+func queryTime(c *gin.Context, name string) (*time.Time, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid '" + name + "' timestamp, expected RFC 3339"})
+		return nil, false
+	}
+	return &t, true
+}
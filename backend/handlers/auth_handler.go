@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuthHandler struct {
+	apiKeyRepo repository.APIKeyStore
+}
+
+func NewAuthHandler(stores *repository.Stores) *AuthHandler {
+	return &AuthHandler{
+		apiKeyRepo: stores.APIKeys,
+	}
+}
+
+// Me returns the principal of the current request with its grants
+func (h *AuthHandler) Me(c *gin.Context) {
+	c.JSON(http.StatusOK, auth.GetPrincipal(c))
+}
+
+// CreateAPIKey issues a new API key, optionally bound to a tenant; the secret is only returned in this response
+func (h *AuthHandler) CreateAPIKey(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	var req models.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Tenant != "" && !models.ValidTenant(req.Tenant) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid tenant '%s'", req.Tenant)})
+		return
+	}
+
+	apiKey, key, err := h.apiKeyRepo.CreateAPIKey(req.Name, req.Tenant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.CreateAPIKeyResponse{APIKey: apiKey, Key: key})
+}
+
+// GetAPIKeys lists the issued API keys without their secrets
+func (h *AuthHandler) GetAPIKeys(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	apiKeys, err := h.apiKeyRepo.GetAllAPIKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, apiKeys)
+}
+
+// RevokeAPIKey revokes an API key
+func (h *AuthHandler) RevokeAPIKey(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	id := c.Param("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id is required"})
+		return
+	}
+
+	err := h.apiKeyRepo.RevokeAPIKey(id)
+	if err != nil {
+		if err.Error() == "api key not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "api key revoked successfully"})
+}
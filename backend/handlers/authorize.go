@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/models"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authorize checks that the caller holds a permission for a table and responds 403 if not
+func authorize(c *gin.Context, permission string, tableSlug string) bool {
+	if auth.GetPrincipal(c).Can(permission, tableSlug) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": permissionError(permission, tableSlug).Error()})
+	return false
+}
+
+// authorizeGlobalAdmin checks that the caller is an administrator not bound to a tenant. API keys and
+// roles are shared by every tenant, so administrators bound to one cannot manage them.
+func authorizeGlobalAdmin(c *gin.Context) bool {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return false
+	}
+	if auth.GetPrincipal(c).TenantBound {
+		c.JSON(http.StatusForbidden, gin.H{"error": "credentials bound to a tenant cannot manage API keys and roles"})
+		return false
+	}
+	return true
+}
+
+// permissionError describes a missing permission
+func permissionError(permission string, tableSlug string) error {
+	if tableSlug == "" {
+		return fmt.Errorf("permission '%s' required", permission)
+	}
+	return fmt.Errorf("permission '%s' required on table '%s'", permission, tableSlug)
+}
+
+// readableSchemas keeps the schemas the principal may see
+func readableSchemas(principal *models.Principal, schemas []*models.Schema) []*models.Schema {
+	readable := []*models.Schema{}
+	for _, schema := range schemas {
+		if principal.CanReadSchema(schema.TableSlug) {
+			readable = append(readable, schema)
+		}
+	}
+	return readable
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ChangeHandler struct {
+	changeRepo repository.ChangeStore
+}
+
+func NewChangeHandler(stores *repository.Stores) *ChangeHandler {
+	return &ChangeHandler{
+		changeRepo: stores.Changes,
+	}
+}
+
+// GetChanges returns the schema and record changes of the tenant committed after the event ID in since,
+// in commit order. Consumers store the returned next ID once they processed a page and resume from it.
+func (h *ChangeHandler) GetChanges(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	var since int64
+	if sinceStr := c.Query("since"); sinceStr != "" {
+		var err error
+		if since, err = strconv.ParseInt(sinceStr, 10, 64); err != nil || since < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a non-negative number"})
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	response, err := h.changeRepo.GetChanges(auth.GetTenant(c), since, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -1,25 +1,32 @@
 package handlers
 
 import (
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/formula"
 	"dynamic-table-backend/models"
 	"dynamic-table-backend/repository"
+	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type ContentHandler struct {
-	contentRepo *repository.ContentRepository
-	schemaRepo  *repository.SchemaRepository
+	contentRepo repository.ContentStore
+	schemaRepo  repository.SchemaStore
+	fileRepo    repository.FileStore
 }
 
-func NewContentHandler() *ContentHandler {
+func NewContentHandler(stores *repository.Stores) *ContentHandler {
 	return &ContentHandler{
-		contentRepo: repository.NewContentRepository(),
-		schemaRepo:  repository.NewSchemaRepository(),
+		contentRepo: stores.Contents,
+		schemaRepo:  stores.Schemas,
+		fileRepo:    stores.Files,
 	}
 }
 
@@ -30,9 +37,12 @@ func (h *ContentHandler) CreateContent(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "table slug is required"})
 		return
 	}
+	if !authorize(c, models.PermissionContentCreate, tableSlug) {
+		return
+	}
 
 	// Verify table exists
-	schema, err := h.schemaRepo.GetSchemaBySlug(tableSlug)
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), tableSlug)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -49,13 +59,17 @@ func (h *ContentHandler) CreateContent(c *gin.Context) {
 	}
 
 	// Validate that keys match schema fields
-	if err := h.validateContentAgainstSchema(req.Values, schema.Fields); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := h.prepareValues(auth.GetTenant(c), "", req.Values, schema, auth.GetPrincipal(c), nil); err != nil {
+		c.JSON(validationStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	content, err := h.contentRepo.CreateContent(tableSlug, &req)
+	content, err := h.contentRepo.CreateContent(auth.GetTenant(c), tableSlug, &req, auth.GetPrincipal(c))
 	if err != nil {
+		if errors.Is(err, repository.ErrPolicyViolation) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -71,7 +85,7 @@ func (h *ContentHandler) GetContent(c *gin.Context) {
 		return
 	}
 
-	content, err := h.contentRepo.GetContentByID(id)
+	content, err := h.contentRepo.GetContentByID(auth.GetTenant(c), id, auth.GetPrincipal(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -82,35 +96,45 @@ func (h *ContentHandler) GetContent(c *gin.Context) {
 		return
 	}
 
+	// Permissions follow the record's table, whatever slug the URL names
+	if !authorize(c, models.PermissionContentRead, content.TableSlug) {
+		return
+	}
+
 	c.JSON(http.StatusOK, content)
 }
 
 // GetContents retrieves all contents for a specific table with search, filter, and sorting
 func (h *ContentHandler) GetContents(c *gin.Context) {
+	h.listContents(c, models.PermissionContentRead, false)
+}
+
+// GetTrashedContents lists the records of a table in the trash with the same parameters as GetContents
+func (h *ContentHandler) GetTrashedContents(c *gin.Context) {
+	h.listContents(c, models.PermissionContentDelete, true)
+}
+
+// listContents responds with a page of a table's live or trashed contents
+func (h *ContentHandler) listContents(c *gin.Context, permission string, trashed bool) {
 	tableSlug := c.Param("tableSlug")
 	if tableSlug == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "table slug is required"})
 		return
 	}
 
-	// Parse query parameters
-	params := &models.ContentQueryParams{}
-
-	// Search parameter
-	if search := c.Query("search"); search != "" {
-		params.Search = search
+	if !authorize(c, permission, tableSlug) {
+		return
 	}
 
-	// Filters parameter (comma-separated key=value pairs)
-	if filtersStr := c.Query("filters"); filtersStr != "" {
-		params.Filters = make(map[string]string)
-		filterPairs := strings.Split(filtersStr, ",")
-		for _, pair := range filterPairs {
-			if strings.Contains(pair, "=") {
-				parts := strings.SplitN(pair, "=", 2)
-				if len(parts) == 2 {
-					params.Filters[parts[0]] = parts[1]
-				}
+	// Parse query parameters
+	params := &models.ContentQueryParams{Principal: auth.GetPrincipal(c), Trashed: trashed}
+	parseFilterParams(c, params)
+
+	// Field projection (comma-separated names, "relation.field" expands a relation)
+	if fieldsStr := c.Query("fields"); fieldsStr != "" {
+		for _, name := range strings.Split(fieldsStr, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				params.Fields = append(params.Fields, name)
 			}
 		}
 	}
@@ -143,7 +167,7 @@ func (h *ContentHandler) GetContents(c *gin.Context) {
 		params.PageSize = 10
 	}
 
-	contents, err := h.contentRepo.GetContentsByTableSlug(tableSlug, params)
+	contents, err := h.contentRepo.GetContentsByTableSlug(auth.GetTenant(c), tableSlug, params)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -156,6 +180,28 @@ func (h *ContentHandler) GetContents(c *gin.Context) {
 	c.JSON(http.StatusOK, contents)
 }
 
+// parseFilterParams reads the search and filters query parameters shared by the list and aggregate endpoints
+func parseFilterParams(c *gin.Context, params *models.ContentQueryParams) {
+	// Search parameter
+	if search := c.Query("search"); search != "" {
+		params.Search = search
+	}
+
+	// Filters parameter (comma-separated key=value pairs)
+	if filtersStr := c.Query("filters"); filtersStr != "" {
+		params.Filters = make(map[string]string)
+		filterPairs := strings.Split(filtersStr, ",")
+		for _, pair := range filterPairs {
+			if strings.Contains(pair, "=") {
+				parts := strings.SplitN(pair, "=", 2)
+				if len(parts) == 2 {
+					params.Filters[parts[0]] = parts[1]
+				}
+			}
+		}
+	}
+}
+
 // UpdateContent updates an existing content record
 func (h *ContentHandler) UpdateContent(c *gin.Context) {
 	id := c.Param("id")
@@ -165,7 +211,7 @@ func (h *ContentHandler) UpdateContent(c *gin.Context) {
 	}
 
 	// Get existing content to verify table
-	existingContent, err := h.contentRepo.GetContentByID(id)
+	existingContent, err := h.contentRepo.GetContentByID(auth.GetTenant(c), id, auth.GetPrincipal(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -174,36 +220,66 @@ func (h *ContentHandler) UpdateContent(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "content not found"})
 		return
 	}
+	if !authorize(c, models.PermissionContentUpdate, existingContent.TableSlug) {
+		return
+	}
+
+	var req models.UpdateContentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.saveValues(c, existingContent, req.Values)
+}
+
+// saveValues validates new values for an existing record against its schema and stores them
+func (h *ContentHandler) saveValues(c *gin.Context, existingContent *models.Content, values map[string]interface{}) {
+	id := existingContent.ID
 
 	// Get schema for validation
-	schema, err := h.schemaRepo.GetSchemaBySlug(existingContent.TableSlug)
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), existingContent.TableSlug)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	var req models.UpdateContentRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	// Fields the principal cannot see or write are validated against the unredacted record
+	stored, err := h.contentRepo.GetContentByID(auth.GetTenant(c), id, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if stored == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "content not found"})
 		return
 	}
 
 	// Validate that keys match schema fields
-	if err := h.validateContentAgainstSchema(req.Values, schema.Fields); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := h.prepareValues(auth.GetTenant(c), id, values, schema, auth.GetPrincipal(c), stored.Values); err != nil {
+		c.JSON(validationStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	content, err := h.contentRepo.UpdateContent(id, &req)
+	req := models.UpdateContentRequest{Values: values}
+	content, err := h.contentRepo.UpdateContent(auth.GetTenant(c), id, &req, auth.GetPrincipal(c))
 	if err != nil {
+		if errors.Is(err, repository.ErrPolicyViolation) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if content == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "content not found"})
+		return
+	}
 
 	c.JSON(http.StatusOK, content)
 }
 
-// DeleteContent deletes a content record
+// DeleteContent moves a content record to the trash
 func (h *ContentHandler) DeleteContent(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -211,8 +287,26 @@ func (h *ContentHandler) DeleteContent(c *gin.Context) {
 		return
 	}
 
-	err := h.contentRepo.DeleteContent(id)
+	// Permissions follow the record's table, whatever slug the URL names
+	existingContent, err := h.contentRepo.GetContentByID(auth.GetTenant(c), id, auth.GetPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if existingContent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "content not found"})
+		return
+	}
+	if !authorize(c, models.PermissionContentDelete, existingContent.TableSlug) {
+		return
+	}
+
+	err = h.contentRepo.DeleteContent(auth.GetTenant(c), id, auth.GetPrincipal(c))
 	if err != nil {
+		if err.Error() == "content not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -220,11 +314,216 @@ func (h *ContentHandler) DeleteContent(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "content deleted successfully"})
 }
 
-// validateContentAgainstSchema validates that content values match the schema
-func (h *ContentHandler) validateContentAgainstSchema(values map[string]interface{}, fields []models.Field) error {
-	// Check if all required fields are present
+// RestoreContent moves a record of the table out of the trash
+func (h *ContentHandler) RestoreContent(c *gin.Context) {
+	tableSlug := c.Param("tableSlug")
+	if !authorize(c, models.PermissionContentDelete, tableSlug) {
+		return
+	}
+
+	content, err := h.contentRepo.RestoreContent(auth.GetTenant(c), tableSlug, c.Param("id"), auth.GetPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if content == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "content not found in trash"})
+		return
+	}
+
+	c.JSON(http.StatusOK, content)
+}
+
+// GetRevisions lists the revisions of a record, oldest first and ending with its current values
+func (h *ContentHandler) GetRevisions(c *gin.Context) {
+	content, ok := h.revisionedContent(c, models.PermissionContentRead)
+	if !ok {
+		return
+	}
+
+	revisions, err := h.contentRepo.GetRevisions(auth.GetTenant(c), content.ID, auth.GetPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if revisions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "content not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, revisions)
+}
+
+// DiffRevisions compares two revisions of a record; to defaults to the current values
+func (h *ContentHandler) DiffRevisions(c *gin.Context) {
+	content, ok := h.revisionedContent(c, models.PermissionContentRead)
+	if !ok {
+		return
+	}
+
+	from, err := strconv.Atoi(c.Query("from"))
+	if err != nil || from < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a revision number"})
+		return
+	}
+	to := 0
+	if toStr := c.Query("to"); toStr != "" {
+		if to, err = strconv.Atoi(toStr); err != nil || to < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a revision number"})
+			return
+		}
+	}
+
+	diff, err := h.contentRepo.DiffRevisions(auth.GetTenant(c), content.ID, from, to, auth.GetPrincipal(c))
+	if err != nil {
+		if errors.Is(err, repository.ErrRevisionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if diff == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "content not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, diff)
+}
+
+// RestoreRevision sets a record's values back to those of a revision. The restore is an update
+// like any other, so the replaced values become a new revision and history is kept.
+func (h *ContentHandler) RestoreRevision(c *gin.Context) {
+	content, ok := h.revisionedContent(c, models.PermissionContentUpdate)
+	if !ok {
+		return
+	}
+
+	number, err := strconv.Atoi(c.Param("revision"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "revision must be a number"})
+		return
+	}
+
+	revision, err := h.contentRepo.GetRevision(auth.GetTenant(c), content.ID, number, auth.GetPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if revision == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "revision not found"})
+		return
+	}
+	if revision.Current {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "revision is already the current version"})
+		return
+	}
+
+	// Fields removed from the schema since the revision was written are not restored
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), content.TableSlug)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	values := make(map[string]interface{})
+	for _, field := range schema.Fields {
+		if value, exists := revision.Values[field.Name]; exists {
+			values[field.Name] = value
+		}
+	}
+
+	h.saveValues(c, content, values)
+}
+
+// revisionedContent loads the record named in the URL and checks the caller's permission on its table
+func (h *ContentHandler) revisionedContent(c *gin.Context, permission string) (*models.Content, bool) {
+	content, err := h.contentRepo.GetContentByID(auth.GetTenant(c), c.Param("id"), auth.GetPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if content == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "content not found"})
+		return nil, false
+	}
+	if !authorize(c, permission, content.TableSlug) {
+		return nil, false
+	}
+	return content, true
+}
+
+// fieldAccessError reports a write to a field the principal may not write
+type fieldAccessError struct {
+	field string
+}
+
+func (e *fieldAccessError) Error() string {
+	return fmt.Sprintf("not allowed to write field '%s'", e.field)
+}
+
+// validationStatus returns the HTTP status for an error from prepareValues
+func validationStatus(err error) int {
+	if _, ok := err.(*fieldAccessError); ok {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// prepareValues validates client values against the schema and fills in stored formula fields.
+// recordID and current identify and hold the stored values of the record being updated; they are
+// empty on create.
+func (h *ContentHandler) prepareValues(tenant string, recordID string, values map[string]interface{}, schema *models.Schema, principal *models.Principal, current map[string]interface{}) error {
+	fields := schema.Fields
+	// Formula, lookup and rollup values are always computed by the server
+	formula.StripFormulas(fields, values)
+
+	if err := h.validateContentAgainstSchema(values, fields, principal, current); err != nil {
+		return err
+	}
+	if err := h.prepareFiles(tenant, recordID, values, fields, current); err != nil {
+		return err
+	}
+
+	formula.ApplyStored(fields, values, time.Now())
+
+	// Values of materialized tables must fit their typed columns
+	if schema.Storage != "" && schema.Storage != models.StorageJSONB {
+		return repository.CheckMaterializedValues(fields, values)
+	}
+	return nil
+}
+
+// validateContentAgainstSchema validates that content values match the schema and that the principal
+// may write them. Fields it cannot write or read keep their current values.
+func (h *ContentHandler) validateContentAgainstSchema(values map[string]interface{}, fields []models.Field, principal *models.Principal, current map[string]interface{}) error {
+	if principal != nil {
+		for _, field := range fields {
+			if formula.ReadOnly(field) {
+				continue
+			}
+			writable, readable := principal.CanWriteField(field), principal.CanReadField(field)
+			value, sent := values[field.Name]
+			if sent && !writable {
+				// Sending back an unchanged visible value is allowed, so clients can replace whole records
+				stored, exists := current[field.Name]
+				if !readable || !exists || !reflect.DeepEqual(value, stored) {
+					return &fieldAccessError{field: field.Name}
+				}
+			}
+			if !sent && (!writable || !readable) {
+				if stored, exists := current[field.Name]; exists {
+					values[field.Name] = stored
+				}
+			}
+		}
+	}
+
+	// Check if all required fields are present; files can only be uploaded once the record exists
 	for _, field := range fields {
-		if field.Required {
+		if field.DataType == models.FileDataType && current == nil {
+			continue
+		}
+		if field.Required && !formula.ReadOnly(field) && (principal == nil || principal.CanWriteField(field)) {
 			if _, exists := values[field.Name]; !exists {
 				return fmt.Errorf("required field '%s' is missing", field.Name)
 			}
@@ -257,9 +556,12 @@ func (h *ContentHandler) GetRelatedData(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "table slug and field name are required"})
 		return
 	}
+	if !authorize(c, models.PermissionContentRead, tableSlug) {
+		return
+	}
 
 	// Get schema to find the field
-	schema, err := h.schemaRepo.GetSchemaBySlug(tableSlug)
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), tableSlug)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -273,13 +575,16 @@ func (h *ContentHandler) GetRelatedData(c *gin.Context) {
 		}
 	}
 
-	if targetField == nil {
+	if targetField == nil || targetField.RelationConfig == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "relation field not found"})
 		return
 	}
+	if !authorize(c, models.PermissionContentRead, targetField.RelationConfig.RelatedTable) {
+		return
+	}
 
 	// Get related data
-	relatedData, err := h.contentRepo.GetRelatedDataForField(targetField.RelationConfig)
+	relatedData, err := h.contentRepo.GetRelatedDataForField(auth.GetTenant(c), targetField.RelationConfig, auth.GetPrincipal(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -287,3 +592,127 @@ func (h *ContentHandler) GetRelatedData(c *gin.Context) {
 
 	c.JSON(http.StatusOK, relatedData)
 }
+
+// aggregateFuncs are the supported aggregate functions
+var aggregateFuncs = map[string]bool{
+	"count":         true,
+	"sum":           true,
+	"avg":           true,
+	"min":           true,
+	"max":           true,
+	"countDistinct": true,
+}
+
+// dateBuckets are the supported date bucketing granularities
+var dateBuckets = map[string]bool{
+	"day":   true,
+	"week":  true,
+	"month": true,
+	"year":  true,
+}
+
+// AggregateContents computes grouped metrics over the contents of a table
+func (h *ContentHandler) AggregateContents(c *gin.Context) {
+	tableSlug := c.Param("tableSlug")
+	if tableSlug == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "table slug is required"})
+		return
+	}
+	if !authorize(c, models.PermissionContentRead, tableSlug) {
+		return
+	}
+
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), tableSlug)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if schema == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "table not found"})
+		return
+	}
+
+	aggregate, err := parseAggregateRequest(c.Query("metrics"), c.Query("groupBy"), schema.Fields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	params := &models.ContentQueryParams{Principal: auth.GetPrincipal(c)}
+	parseFilterParams(c, params)
+
+	result, err := h.contentRepo.AggregateContents(auth.GetTenant(c), tableSlug, params, aggregate)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// parseAggregateRequest parses "func:field" metrics and "field[:bucket]" group keys and checks them against the schema
+func parseAggregateRequest(metricsStr, groupByStr string, fields []models.Field) (*models.AggregateRequest, error) {
+	fieldTypes := map[string]string{
+		"createdAt": "datetime",
+		"updatedAt": "datetime",
+	}
+	for _, field := range fields {
+		fieldTypes[field.Name] = field.DataType
+		if formula.ReadOnly(field) {
+			// Computed fields aggregate like the type they produce
+			switch formula.FieldType(field) {
+			case formula.TypeNumber:
+				fieldTypes[field.Name] = "number"
+			case formula.TypeDate:
+				fieldTypes[field.Name] = "datetime"
+			}
+		}
+	}
+
+	aggregate := &models.AggregateRequest{}
+
+	if metricsStr == "" {
+		metricsStr = "count"
+	}
+	for _, item := range strings.Split(metricsStr, ",") {
+		fn, fieldName, _ := strings.Cut(strings.TrimSpace(item), ":")
+		if !aggregateFuncs[fn] {
+			return nil, fmt.Errorf("unsupported aggregate function '%s'", fn)
+		}
+		if fn == "count" {
+			if fieldName != "" {
+				return nil, fmt.Errorf("count does not take a field, use countDistinct:%s", fieldName)
+			}
+		} else {
+			dataType, ok := fieldTypes[fieldName]
+			if !ok {
+				return nil, fmt.Errorf("field '%s' is not defined in schema", fieldName)
+			}
+			if (fn == "sum" || fn == "avg") && dataType != "number" {
+				return nil, fmt.Errorf("%s requires a number field, '%s' is %s", fn, fieldName, dataType)
+			}
+		}
+		aggregate.Metrics = append(aggregate.Metrics, models.AggregateMetric{Func: fn, Field: fieldName})
+	}
+
+	if groupByStr != "" {
+		for _, item := range strings.Split(groupByStr, ",") {
+			fieldName, bucket, _ := strings.Cut(strings.TrimSpace(item), ":")
+			dataType, ok := fieldTypes[fieldName]
+			if !ok {
+				return nil, fmt.Errorf("field '%s' is not defined in schema", fieldName)
+			}
+			if bucket != "" {
+				if !dateBuckets[bucket] {
+					return nil, fmt.Errorf("unsupported date bucket '%s'", bucket)
+				}
+				if dataType != "date" && dataType != "datetime" {
+					return nil, fmt.Errorf("date bucketing requires a date or datetime field, '%s' is %s", fieldName, dataType)
+				}
+			}
+			aggregate.GroupBy = append(aggregate.GroupBy, models.AggregateGroup{Field: fieldName, Bucket: bucket})
+		}
+	}
+
+	return aggregate, nil
+}
@@ -0,0 +1,389 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/imaging"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+	"dynamic-table-backend/storage"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FileHandler uploads and downloads the files of file fields and the image variants declared by their
+// FileConfig. Blobs live in a BlobStore; the values of a record hold the file's id, name, size, MIME type
+// and checksum.
+type FileHandler struct {
+	contentHandler *ContentHandler
+	contentRepo    repository.ContentStore
+	schemaRepo     repository.SchemaStore
+	fileRepo       repository.FileStore
+	store          storage.BlobStore
+	// MaxSize is the largest accepted file in bytes, set by FILE_MAX_SIZE (default 32 MiB)
+	MaxSize int64
+}
+
+func NewFileHandler(stores *repository.Stores, store storage.BlobStore) *FileHandler {
+	maxSize := int64(32 << 20)
+	if size, err := strconv.ParseInt(os.Getenv("FILE_MAX_SIZE"), 10, 64); err == nil && size > 0 {
+		maxSize = size
+	}
+
+	return &FileHandler{
+		contentHandler: NewContentHandler(stores),
+		contentRepo:    stores.Contents,
+		schemaRepo:     stores.Schemas,
+		fileRepo:       stores.Files,
+		store:          store,
+		MaxSize:        maxSize,
+	}
+}
+
+// UploadFile stores the "file" part of a multipart upload as the value of a record's file field. The file
+// it replaces is kept while a revision of the record refers to it.
+func (h *FileHandler) UploadFile(c *gin.Context) {
+	content, schema, field, ok := h.fileField(c, models.PermissionContentUpdate)
+	if !ok {
+		return
+	}
+	principal := auth.GetPrincipal(c)
+	if !principal.CanWriteField(*field) || !principal.CanReadField(*field) {
+		c.JSON(http.StatusForbidden, gin.H{"error": (&fieldAccessError{field: field.Name}).Error()})
+		return
+	}
+
+	// Leave room for the multipart headers around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.MaxSize+1<<20)
+	upload, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file exceeds %d bytes", h.MaxSize)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "multipart form with a 'file' part is required"})
+		return
+	}
+	config := field.FileConfig
+	maxSize := h.MaxSize
+	if config != nil && config.MaxSize > 0 && config.MaxSize < maxSize {
+		maxSize = config.MaxSize
+	}
+	if upload.Size > maxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file exceeds %d bytes", maxSize)})
+		return
+	}
+
+	src, err := upload.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer src.Close()
+
+	// Read the file once for its checksum and MIME type before storing it
+	hash := sha256.New()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(src, head)
+	hash.Write(head[:n])
+	if _, err := io.Copy(hash, src); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The type is detected from the content; the one the client declares cannot be trusted against the field's limits
+	mimeType := http.DetectContentType(head[:n])
+	if !imaging.AcceptsMimeType(config, mimeType) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": fmt.Sprintf("field '%s' does not accept files of type '%s'", field.Name, mimeType)})
+		return
+	}
+
+	// Dimension limits apply to images
+	if config != nil && (config.MaxWidth > 0 || config.MaxHeight > 0) && imaging.Supported(mimeType) {
+		width, height, err := imaging.Dimensions(src)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if (config.MaxWidth > 0 && width > config.MaxWidth) || (config.MaxHeight > 0 && height > config.MaxHeight) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("image of %dx%d pixels exceeds the limits of field '%s'", width, height, field.Name)})
+			return
+		}
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	name := upload.Filename
+	if len(name) > 255 {
+		name = name[len(name)-255:]
+	}
+
+	file, err := h.fileRepo.CreateFile(&models.File{
+		Tenant:    auth.GetTenant(c),
+		TableSlug: content.TableSlug,
+		ContentID: content.ID,
+		FieldName: field.Name,
+		Name:      name,
+		Size:      upload.Size,
+		MimeType:  mimeType,
+		Checksum:  "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.store.Put(file.Key(), src, file.Size, file.MimeType); err != nil {
+		if err := h.fileRepo.DeleteFile(file.ID); err != nil {
+			log.Println("Failed to delete file of failed upload:", err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Eager variants are generated now; a failure leaves them to be generated on request
+	if config != nil && imaging.Supported(file.MimeType) {
+		for _, variant := range config.Variants {
+			if variant.Eager {
+				if _, _, err := h.generateVariant(file, variant); err != nil {
+					log.Printf("Failed to generate variant %s of file %s: %v", variant.Name, file.ID, err)
+				}
+			}
+		}
+	}
+
+	// Save the record with the new file; other fields keep their stored values
+	stored, err := h.contentRepo.GetContentByID(auth.GetTenant(c), content.ID, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if stored == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "content not found"})
+		return
+	}
+	values := make(map[string]interface{})
+	for _, f := range schema.Fields {
+		value, exists := stored.Values[f.Name]
+		if exists && !formula.ReadOnly(f) && principal.CanReadField(f) && principal.CanWriteField(f) {
+			values[f.Name] = value
+		}
+	}
+	values[field.Name] = file.Value()
+
+	h.contentHandler.saveValues(c, content, values)
+}
+
+// DownloadFile responds with the file currently held by a record's file field
+func (h *FileHandler) DownloadFile(c *gin.Context) {
+	file, _, ok := h.currentFile(c)
+	if !ok {
+		return
+	}
+
+	body, err := h.store.Get(file.Key())
+	if err != nil {
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	// Uploaded files are always downloaded rather than rendered, so they cannot run scripts in the API's origin
+	c.DataFromReader(http.StatusOK, file.Size, file.MimeType, body, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}),
+		"X-Content-Type-Options": "nosniff",
+		"ETag":                   `"` + file.Checksum + `"`,
+	})
+}
+
+// DownloadVariant responds with an image variant of the file held by a record's file field, generating
+// it on the first request
+func (h *FileHandler) DownloadVariant(c *gin.Context) {
+	file, field, ok := h.currentFile(c)
+	if !ok {
+		return
+	}
+
+	var variant *models.ImageVariant
+	if field.FileConfig != nil {
+		for i := range field.FileConfig.Variants {
+			if field.FileConfig.Variants[i].Name == c.Param("variant") {
+				variant = &field.FileConfig.Variants[i]
+			}
+		}
+	}
+	if variant == nil || !imaging.Supported(file.MimeType) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("variant '%s' not found", c.Param("variant"))})
+		return
+	}
+
+	headers := map[string]string{
+		"Content-Disposition":    mime.FormatMediaType("inline", map[string]string{"filename": file.Name}),
+		"X-Content-Type-Options": "nosniff",
+		"ETag":                   `"` + file.Checksum + "/" + imaging.Key("", *variant) + `"`,
+	}
+
+	body, err := h.store.Get(imaging.Key(file.Key(), *variant))
+	if err == nil {
+		defer body.Close()
+		c.DataFromReader(http.StatusOK, -1, imaging.VariantType(file.MimeType), body, headers)
+		return
+	}
+	if err != storage.ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	data, mimeType, err := h.generateVariant(file, *variant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.DataFromReader(http.StatusOK, int64(len(data)), mimeType, bytes.NewReader(data), headers)
+}
+
+// generateVariant resizes a file to an image variant and stores the result
+func (h *FileHandler) generateVariant(file *models.File, variant models.ImageVariant) ([]byte, string, error) {
+	src, err := h.store.Get(file.Key())
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+
+	data, mimeType, err := imaging.Generate(src, variant)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The key is recorded first, so that the blob cannot outlive the file
+	key := imaging.Key(file.Key(), variant)
+	if err := h.fileRepo.AddVariant(file.ID, key); err != nil {
+		return nil, "", err
+	}
+	if err := h.store.Put(key, bytes.NewReader(data), int64(len(data)), mimeType); err != nil {
+		return nil, "", err
+	}
+	return data, mimeType, nil
+}
+
+// currentFile looks up the file held by the file field of a download request
+func (h *FileHandler) currentFile(c *gin.Context) (*models.File, *models.Field, bool) {
+	content, _, field, ok := h.fileField(c, models.PermissionContentRead)
+	if !ok {
+		return nil, nil, false
+	}
+
+	// Fields the principal may not read are redacted from the record, so their files are not found
+	value, _ := content.Values[field.Name].(map[string]interface{})
+	id, _ := value["id"].(string)
+	if id == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return nil, nil, false
+	}
+
+	file, err := h.fileRepo.GetFile(auth.GetTenant(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+	if file == nil || file.ContentID != content.ID || file.FieldName != field.Name {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return nil, nil, false
+	}
+	return file, field, true
+}
+
+// fileField looks up the record and file field of a file request and checks the permission on the record's table
+func (h *FileHandler) fileField(c *gin.Context, permission string) (*models.Content, *models.Schema, *models.Field, bool) {
+	content, ok := h.contentHandler.revisionedContent(c, permission)
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), content.TableSlug)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil, nil, false
+	}
+	if schema != nil {
+		for i, field := range schema.Fields {
+			if field.Name == c.Param("fieldName") && field.DataType == models.FileDataType {
+				return content, schema, &schema.Fields[i], true
+			}
+		}
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("file field '%s' not found", c.Param("fieldName"))})
+	return nil, nil, nil, false
+}
+
+// prepareFiles checks the values of file fields. Files are set by uploading them, so a value must be null,
+// unchanged, or a file uploaded to the same record and field earlier, e.g. when restoring a revision.
+// Such values are replaced by the file's recorded metadata, and the URLs added on read are dropped.
+func (h *ContentHandler) prepareFiles(tenant string, recordID string, values map[string]interface{}, fields []models.Field, current map[string]interface{}) error {
+	for _, field := range fields {
+		if field.DataType != models.FileDataType {
+			continue
+		}
+		value, sent := values[field.Name]
+		if !sent || value == nil {
+			continue
+		}
+		value = storedFile(value)
+		if reflect.DeepEqual(value, storedFile(current[field.Name])) {
+			values[field.Name] = value
+			continue
+		}
+
+		var file *models.File
+		ref, _ := value.(map[string]interface{})
+		// Without a file repository, e.g. on the memory or SQLite backend, no file can have been uploaded
+		if id, _ := ref["id"].(string); id != "" && recordID != "" && h.fileRepo != nil {
+			var err error
+			if file, err = h.fileRepo.GetFile(tenant, id); err != nil {
+				return err
+			}
+		}
+		if file == nil || file.ContentID != recordID || file.FieldName != field.Name {
+			return fmt.Errorf("field '%s' can only be set by uploading a file", field.Name)
+		}
+		values[field.Name] = file.Value()
+	}
+	return nil
+}
+
+// storedFile returns the value of a file field without the URLs added on read
+func storedFile(value interface{}) interface{} {
+	ref, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	stored := make(map[string]interface{}, len(ref))
+	for key, v := range ref {
+		if key != "url" && key != "variants" {
+			stored[key] = v
+		}
+	}
+	return stored
+}
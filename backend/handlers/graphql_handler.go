@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/repository"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+const (
+	// graphQLSchemaTTL bounds how long a replica serves a generated schema that another replica's schema
+	// change made stale, should the change notification be missed
+	graphQLSchemaTTL = time.Minute
+	// maxGraphQLSchemas bounds how many tenants' generated schemas are cached at once
+	maxGraphQLSchemas = 256
+)
+
+type GraphQLHandler struct {
+	schemaRepo     repository.SchemaStore
+	contentRepo    repository.ContentStore
+	contentHandler *ContentHandler
+
+	mu sync.Mutex
+	// schemas caches the generated GraphQL schema of each tenant
+	schemas map[string]*cachedGraphQLSchema
+	// builds are the schema builds in progress by tenant, which other requests of the tenant wait for
+	builds map[string]*graphQLSchemaBuild
+}
+
+// cachedGraphQLSchema is a generated GraphQL schema and when it was built
+type cachedGraphQLSchema struct {
+	schema  *graphql.Schema
+	builtAt time.Time
+}
+
+// graphQLSchemaBuild is a schema build in progress; done is closed once schema or err is set
+type graphQLSchemaBuild struct {
+	done   chan struct{}
+	schema *graphql.Schema
+	err    error
+}
+
+// GraphQLRequest represents a GraphQL request body
+type GraphQLRequest struct {
+	Query         string                 `json:"query" form:"query"`
+	OperationName string                 `json:"operationName" form:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func NewGraphQLHandler(stores *repository.Stores) *GraphQLHandler {
+	return &GraphQLHandler{
+		schemaRepo:     stores.Schemas,
+		contentRepo:    stores.Contents,
+		contentHandler: NewContentHandler(stores),
+		schemas:        make(map[string]*cachedGraphQLSchema),
+		builds:         make(map[string]*graphQLSchemaBuild),
+	}
+}
+
+// Invalidate discards the generated GraphQL schemas so the next request of each tenant rebuilds its schema.
+// Builds in progress finish for the requests waiting on them but are not cached.
+func (h *GraphQLHandler) Invalidate() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.schemas = make(map[string]*cachedGraphQLSchema)
+	h.builds = make(map[string]*graphQLSchemaBuild)
+}
+
+// InvalidateTenant discards the generated GraphQL schema of a tenant
+func (h *GraphQLHandler) InvalidateTenant(tenant string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.schemas, tenant)
+	delete(h.builds, tenant)
+}
+
+// currentSchema returns the generated GraphQL schema of a tenant, rebuilding it from the tenant's table schemas
+// if needed. Schemas are built without holding the lock, once per tenant however many requests need them.
+func (h *GraphQLHandler) currentSchema(tenant string) (*graphql.Schema, error) {
+	h.mu.Lock()
+	if cached, ok := h.schemas[tenant]; ok && time.Since(cached.builtAt) < graphQLSchemaTTL {
+		h.mu.Unlock()
+		return cached.schema, nil
+	}
+	if build, ok := h.builds[tenant]; ok {
+		h.mu.Unlock()
+		<-build.done
+		return build.schema, build.err
+	}
+	build := &graphQLSchemaBuild{done: make(chan struct{})}
+	h.builds[tenant] = build
+	h.mu.Unlock()
+
+	defer close(build.done)
+	builtAt := time.Now()
+	schemas, err := h.schemaRepo.GetAllSchemas(tenant)
+	if err == nil {
+		var schema graphql.Schema
+		if schema, err = h.buildGraphQLSchema(schemas); err == nil {
+			build.schema = &schema
+		}
+	}
+	build.err = err
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Invalidation meanwhile leaves the build out of the cache
+	if h.builds[tenant] != build {
+		return build.schema, build.err
+	}
+	delete(h.builds, tenant)
+
+	// Tenants without tables are not cached, so requests naming arbitrary tenants cannot fill the cache
+	if err != nil || len(schemas) == 0 {
+		return build.schema, build.err
+	}
+	if _, ok := h.schemas[tenant]; !ok && len(h.schemas) >= maxGraphQLSchemas {
+		h.evictOldestSchema(builtAt)
+	}
+	h.schemas[tenant] = &cachedGraphQLSchema{schema: build.schema, builtAt: builtAt}
+	return build.schema, nil
+}
+
+// evictOldestSchema drops the expired schemas, or the oldest one if none has expired; the caller holds the lock
+func (h *GraphQLHandler) evictOldestSchema(now time.Time) {
+	var oldest *cachedGraphQLSchema
+	oldestTenant := ""
+	for tenant, cached := range h.schemas {
+		if now.Sub(cached.builtAt) >= graphQLSchemaTTL {
+			delete(h.schemas, tenant)
+		} else if oldest == nil || cached.builtAt.Before(oldest.builtAt) {
+			oldest, oldestTenant = cached, tenant
+		}
+	}
+	if len(h.schemas) >= maxGraphQLSchemas {
+		delete(h.schemas, oldestTenant)
+	}
+}
+
+// Query executes a GraphQL query or mutation
+func (h *GraphQLHandler) Query(c *gin.Context) {
+	var req GraphQLRequest
+	if c.Request.Method == http.MethodGet {
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+	// GET requests must not change data, since links and prefetches can send them
+	if c.Request.Method == http.MethodGet && isMutation(req.Query, req.OperationName) {
+		c.Header("Allow", http.MethodPost)
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "mutations require POST"})
+		return
+	}
+
+	schema, err := h.currentSchema(auth.GetTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         *schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        withRelationLoader(c.Request.Context()),
+	})
+
+	c.JSON(http.StatusOK, result)
+}
+
+// isMutation reports whether the operation of a query document that would be executed is a mutation.
+// Documents that do not parse are left to the executor to reject.
+func isMutation(query string, operationName string) bool {
+	document, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return false
+	}
+	for _, definition := range document.Definitions {
+		operation, ok := definition.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		name := ""
+		if operation.Name != nil {
+			name = operation.Name.Value
+		}
+		if (operationName == "" || name == operationName) && operation.Operation == ast.OperationTypeMutation {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"dynamic-table-backend/models"
+)
+
+// relationLoaderKey is the context key of a GraphQL request's relation loader
+type relationLoaderKey struct{}
+
+// relationLoader batches the relation lookups of a GraphQL request or an OData $expand. Records resolved
+// together, such as the contents of a page or the records one relation field fetched for them, form a
+// level, and each relation field is fetched once per level rather than once per record.
+type relationLoader struct {
+	mu     sync.Mutex
+	levels map[*models.Content]*relationLevel
+}
+
+// relationLevel is a set of records resolved together and the relations fetched for them by field name
+type relationLevel struct {
+	contents []*models.Content
+	fetched  map[string]*relationBatch
+}
+
+// relationBatch holds the related records fetched for the keys of every record in a level
+type relationBatch struct {
+	related []*models.Content
+	keys    []string // the key of each related record
+	err     error
+	// unmatched is set when the related field is hidden from the principal, so that related records
+	// cannot be told apart by key and each record fetches its own
+	unmatched bool
+}
+
+// newRelationLoader returns a relation loader with no levels
+func newRelationLoader() *relationLoader {
+	return &relationLoader{levels: make(map[*models.Content]*relationLevel)}
+}
+
+// withRelationLoader returns a context carrying a new relation loader
+func withRelationLoader(ctx context.Context) context.Context {
+	return context.WithValue(ctx, relationLoaderKey{}, newRelationLoader())
+}
+
+// relationLoaderFrom returns the relation loader of a request, or a new one if it has none
+func relationLoaderFrom(ctx context.Context) *relationLoader {
+	if loader, ok := ctx.Value(relationLoaderKey{}).(*relationLoader); ok {
+		return loader
+	}
+	return newRelationLoader()
+}
+
+// register records contents resolved together as a level
+func (l *relationLoader) register(contents []*models.Content) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.registerLocked(contents)
+}
+
+func (l *relationLoader) registerLocked(contents []*models.Content) {
+	level := &relationLevel{contents: contents, fetched: make(map[string]*relationBatch)}
+	for _, content := range contents {
+		l.levels[content] = level
+	}
+}
+
+// load returns the records a relation field of a record links to. fetch returns the related records
+// holding any of the given keys in the related field.
+func (l *relationLoader) load(content *models.Content, field models.Field, fetch func(keys []string) ([]*models.Content, error)) ([]*models.Content, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	level, ok := l.levels[content]
+	if !ok {
+		l.registerLocked([]*models.Content{content})
+		level = l.levels[content]
+	}
+
+	batch, ok := level.fetched[field.Name]
+	if !ok {
+		batch = &relationBatch{}
+		level.fetched[field.Name] = batch
+
+		var keys []string
+		seen := make(map[string]bool)
+		for _, sibling := range level.contents {
+			for _, key := range relationKeys(sibling.Values[field.Name]) {
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+		}
+		if len(keys) > 0 {
+			batch.related, batch.err = fetch(keys)
+		}
+		for _, related := range batch.related {
+			value, ok := related.Values[field.RelationConfig.RelatedField]
+			if !ok || value == nil {
+				batch.unmatched = true
+			}
+			batch.keys = append(batch.keys, relationKeyText(value))
+		}
+		if !batch.unmatched {
+			l.registerLocked(batch.related)
+		}
+	}
+	if batch.err != nil {
+		return nil, batch.err
+	}
+
+	keys := relationKeys(content.Values[field.Name])
+	if batch.unmatched {
+		related, err := fetch(keys)
+		if err == nil {
+			l.registerLocked(related)
+		}
+		return related, err
+	}
+
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	var related []*models.Content
+	for i, record := range batch.related {
+		if wanted[batch.keys[i]] {
+			related = append(related, record)
+		}
+	}
+	return related, nil
+}
+
+// relationKeyText returns a related field's value as the text relation keys are compared with
+func relationKeyText(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
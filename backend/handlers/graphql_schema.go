@@ -0,0 +1,640 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+var graphQLNamePattern = regexp.MustCompile(`[^_0-9A-Za-z]`)
+
+// reservedGraphQLFields are the record fields every generated object type exposes
+var reservedGraphQLFields = map[string]bool{
+	"id":        true,
+	"tableSlug": true,
+	"values":    true,
+	"createdAt": true,
+	"updatedAt": true,
+}
+
+// reservedGraphQLTypes are the type names used by the generated schema itself
+var reservedGraphQLTypes = map[string]bool{
+	"Query":         true,
+	"Mutation":      true,
+	"JSON":          true,
+	"SortDirection": true,
+}
+
+// builtinGraphQLNames are the names of the built-in types and the root field of a schema without tables
+var builtinGraphQLNames = []string{"String", "Int", "Float", "Boolean", "ID", "DateTime", "_empty"}
+
+// jsonScalar passes arbitrary JSON values through unchanged
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Arbitrary JSON value",
+	Serialize: func(value interface{}) interface{} {
+		return value
+	},
+	ParseValue: func(value interface{}) interface{} {
+		return value
+	},
+	ParseLiteral: parseJSONLiteral,
+})
+
+var sortDirectionEnum = graphql.NewEnum(graphql.EnumConfig{
+	Name: "SortDirection",
+	Values: graphql.EnumValueConfigMap{
+		"ASC":  &graphql.EnumValueConfig{Value: "asc"},
+		"DESC": &graphql.EnumValueConfig{Value: "desc"},
+	},
+})
+
+// parseJSONLiteral converts an inline GraphQL literal to its Go value
+func parseJSONLiteral(valueAST ast.Value) interface{} {
+	switch v := valueAST.(type) {
+	case *ast.ObjectValue:
+		obj := make(map[string]interface{})
+		for _, f := range v.Fields {
+			obj[f.Name.Value] = parseJSONLiteral(f.Value)
+		}
+		return obj
+	case *ast.ListValue:
+		list := make([]interface{}, 0, len(v.Values))
+		for _, item := range v.Values {
+			list = append(list, parseJSONLiteral(item))
+		}
+		return list
+	case *ast.IntValue, *ast.FloatValue:
+		var f float64
+		fmt.Sscan(v.GetValue().(string), &f)
+		return f
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.StringValue:
+		return v.Value
+	case *ast.EnumValue:
+		return v.Value
+	}
+	return nil
+}
+
+// graphQLName converts an arbitrary identifier into a valid GraphQL name. Names starting with
+// two underscores are reserved for introspection, so leading underscores are reduced to one.
+func graphQLName(name string) string {
+	name = graphQLNamePattern.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	for strings.HasPrefix(name, "__") {
+		name = name[1:]
+	}
+	return name
+}
+
+// uniqueGraphQLName returns name, or name with the smallest numeric suffix, such that none of the names
+// derive returns for it is taken, and marks those names taken
+func uniqueGraphQLName(name string, taken map[string]bool, derive func(name string) []string) string {
+	candidate := name
+	for i := 2; ; i++ {
+		names := derive(candidate)
+		free := true
+		for _, derived := range names {
+			if taken[derived] {
+				free = false
+				break
+			}
+		}
+		if free {
+			for _, derived := range names {
+				taken[derived] = true
+			}
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s_%d", name, i)
+	}
+}
+
+// graphQLTableNames returns the type and root field names generated for a table named typeName
+func graphQLTableNames(typeName string) []string {
+	fieldName := graphQLRootFieldName(typeName)
+	return []string{
+		typeName, typeName + "Page", typeName + "Input", typeName + "Filter",
+		fieldName, fieldName + "List", "create" + typeName, "update" + typeName, "delete" + typeName,
+	}
+}
+
+// graphQLRootFieldName returns the name of the query field fetching a record of a type
+func graphQLRootFieldName(typeName string) string {
+	return strings.ToLower(typeName[:1]) + typeName[1:]
+}
+
+// graphQLTypeName converts a table slug into a PascalCase GraphQL type name
+func graphQLTypeName(tableSlug string) string {
+	parts := strings.FieldsFunc(tableSlug, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+	var b strings.Builder
+	for _, part := range parts {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	name := graphQLName(b.String())
+	if reservedGraphQLTypes[name] {
+		name += "Table"
+	}
+	return name
+}
+
+// graphQLFieldName returns the GraphQL name for a schema field, avoiding the reserved record fields and
+// the names of the fields before it
+func graphQLFieldName(field models.Field, taken map[string]bool) string {
+	name := graphQLName(field.Name)
+	if reservedGraphQLFields[name] {
+		name += "_"
+	}
+	return uniqueGraphQLName(name, taken, func(name string) []string { return []string{name} })
+}
+
+// graphQLScalarType maps a field data type to the GraphQL scalar used to expose it
+func graphQLScalarType(field models.Field) graphql.Output {
+	switch field.DataType {
+	case "number":
+		return graphql.Float
+	case "checkbox":
+		return graphql.Boolean
+	case formula.DataType:
+		switch field.FormulaType {
+		case formula.TypeNumber:
+			return graphql.Float
+		case formula.TypeBoolean:
+			return graphql.Boolean
+		}
+		return graphql.String
+	case formula.LookupDataType, formula.RollupDataType:
+		var item graphql.Output = graphql.String
+		if field.LinkConfig != nil {
+			switch field.LinkConfig.ResultType {
+			case formula.TypeNumber:
+				item = graphql.Float
+			case formula.TypeBoolean:
+				item = graphql.Boolean
+			}
+		}
+		if field.DataType == formula.LookupDataType {
+			return graphql.NewList(item)
+		}
+		return item
+	case "relation":
+		if field.RelationConfig != nil && field.RelationConfig.AllowMultiple {
+			return graphql.NewList(graphql.String)
+		}
+		return graphql.String
+	default:
+		return graphql.String
+	}
+}
+
+// graphQLInputType maps a field data type to the GraphQL input type accepted by mutations
+func graphQLInputType(field models.Field) graphql.Input {
+	switch field.DataType {
+	case "number":
+		return graphql.Float
+	case "checkbox":
+		return graphql.Boolean
+	case "relation":
+		if field.RelationConfig != nil && field.RelationConfig.AllowMultiple {
+			return graphql.NewList(graphql.String)
+		}
+		return graphql.String
+	default:
+		return graphql.String
+	}
+}
+
+// graphQLTable holds the generated types for a single table
+type graphQLTable struct {
+	schema   *models.Schema
+	typeName string
+	object   *graphql.Object
+	page     *graphql.Object
+	input    *graphql.InputObject
+	filter   *graphql.InputObject
+	// fieldNames maps GraphQL field names back to schema field names
+	fieldNames map[string]string
+	// graphQLNames maps schema field names to GraphQL field names
+	graphQLNames map[string]string
+}
+
+// buildGraphQLSchema generates a GraphQL schema exposing every table's records. Tables and fields whose
+// generated names collide with earlier ones get a numeric suffix; tables are named in the order they
+// were created, so adding a table does not rename the others.
+func (h *GraphQLHandler) buildGraphQLSchema(schemas []*models.Schema) (graphql.Schema, error) {
+	schemas = append([]*models.Schema(nil), schemas...)
+	sort.SliceStable(schemas, func(i, j int) bool {
+		return schemas[i].CreatedAt.Before(schemas[j].CreatedAt)
+	})
+
+	taken := make(map[string]bool)
+	for name := range reservedGraphQLTypes {
+		taken[name] = true
+	}
+	for _, name := range builtinGraphQLNames {
+		taken[name] = true
+	}
+
+	tables := make(map[string]*graphQLTable)
+	for _, schema := range schemas {
+		table := &graphQLTable{
+			schema:       schema,
+			typeName:     uniqueGraphQLName(graphQLTypeName(schema.TableSlug), taken, graphQLTableNames),
+			fieldNames:   make(map[string]string),
+			graphQLNames: make(map[string]string),
+		}
+		takenFields := make(map[string]bool)
+		for name := range reservedGraphQLFields {
+			takenFields[name] = true
+		}
+		for _, field := range schema.Fields {
+			name := graphQLFieldName(field, takenFields)
+			table.fieldNames[name] = field.Name
+			table.graphQLNames[field.Name] = name
+		}
+		tables[schema.TableSlug] = table
+	}
+
+	for _, schema := range schemas {
+		table := tables[schema.TableSlug]
+		typeName := table.typeName
+
+		inputFields := graphql.InputObjectConfigFieldMap{}
+		filterFields := graphql.InputObjectConfigFieldMap{}
+		for _, field := range schema.Fields {
+			name := table.graphQLNames[field.Name]
+			filterFields[name] = &graphql.InputObjectFieldConfig{Type: graphql.String}
+			// Formula, lookup and rollup values are computed by the server
+			if !formula.ReadOnly(field) {
+				inputFields[name] = &graphql.InputObjectFieldConfig{Type: graphQLInputType(field)}
+			}
+		}
+
+		table.object = graphql.NewObject(graphql.ObjectConfig{
+			Name:        typeName,
+			Description: schema.TableName,
+			Fields:      h.objectFields(table, tables),
+		})
+		table.page = graphql.NewObject(graphql.ObjectConfig{
+			Name: typeName + "Page",
+			Fields: graphql.Fields{
+				"contents":   &graphql.Field{Type: graphql.NewList(table.object)},
+				"total":      &graphql.Field{Type: graphql.Int},
+				"page":       &graphql.Field{Type: graphql.Int},
+				"pageSize":   &graphql.Field{Type: graphql.Int},
+				"totalPages": &graphql.Field{Type: graphql.Int},
+			},
+		})
+		table.input = graphql.NewInputObject(graphql.InputObjectConfig{
+			Name:   typeName + "Input",
+			Fields: inputFields,
+		})
+		table.filter = graphql.NewInputObject(graphql.InputObjectConfig{
+			Name:   typeName + "Filter",
+			Fields: filterFields,
+		})
+	}
+
+	query := graphql.Fields{}
+	mutation := graphql.Fields{}
+	for _, schema := range schemas {
+		table := tables[schema.TableSlug]
+		typeName := table.typeName
+		fieldName := graphQLRootFieldName(typeName)
+
+		query[fieldName] = h.getField(table)
+		query[fieldName+"List"] = h.listField(table)
+		mutation["create"+typeName] = h.createField(table)
+		mutation["update"+typeName] = h.updateField(table)
+		mutation["delete"+typeName] = h.deleteField(table)
+	}
+
+	// GraphQL requires at least one field on the root types
+	if len(query) == 0 {
+		query["_empty"] = &graphql.Field{Type: graphql.Boolean}
+	}
+
+	config := graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: query}),
+	}
+	if len(mutation) > 0 {
+		config.Mutation = graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutation})
+	}
+
+	return graphql.NewSchema(config)
+}
+
+// objectFields returns the fields of a table's object type, resolving relations lazily
+func (h *GraphQLHandler) objectFields(table *graphQLTable, tables map[string]*graphQLTable) graphql.FieldsThunk {
+	return func() graphql.Fields {
+		fields := graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"tableSlug": &graphql.Field{Type: graphql.String},
+			"values":    &graphql.Field{Type: jsonScalar},
+			"createdAt": &graphql.Field{Type: graphql.DateTime},
+			"updatedAt": &graphql.Field{Type: graphql.DateTime},
+		}
+
+		for _, field := range table.schema.Fields {
+			field := field
+			name := table.graphQLNames[field.Name]
+
+			if field.DataType == "relation" && field.RelationConfig != nil {
+				if related, ok := tables[field.RelationConfig.RelatedTable]; ok {
+					var relatedType graphql.Output = related.object
+					if field.RelationConfig.AllowMultiple {
+						relatedType = graphql.NewList(related.object)
+					}
+					fields[name] = &graphql.Field{
+						Type:        relatedType,
+						Description: field.Label,
+						Resolve:     h.resolveRelation(field),
+					}
+					continue
+				}
+			}
+
+			fields[name] = &graphql.Field{
+				Type:        graphQLScalarType(field),
+				Description: field.Label,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					content, ok := p.Source.(*models.Content)
+					if !ok {
+						return nil, nil
+					}
+					return content.Values[field.Name], nil
+				},
+			}
+		}
+
+		return fields
+	}
+}
+
+// resolveRelation follows a relation field to the related table's records, fetching them for all the
+// records resolved alongside the source at once
+func (h *GraphQLHandler) resolveRelation(field models.Field) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		content, ok := p.Source.(*models.Content)
+		if !ok {
+			return nil, nil
+		}
+
+		keys := relationKeys(content.Values[field.Name])
+		if len(keys) == 0 {
+			return nil, nil
+		}
+
+		config := field.RelationConfig
+		if err := requirePermission(p, models.PermissionContentRead, config.RelatedTable); err != nil {
+			return nil, err
+		}
+		related, err := relationLoaderFrom(p.Context).load(content, field, func(keys []string) ([]*models.Content, error) {
+			return h.contentRepo.GetContentsByFieldValues(auth.TenantFromContext(p.Context), config.RelatedTable, config.RelatedField, keys, auth.PrincipalFromContext(p.Context))
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if config.AllowMultiple {
+			return related, nil
+		}
+		if len(related) == 0 {
+			return nil, nil
+		}
+		return related[0], nil
+	}
+}
+
+// requirePermission fails unless the principal of a resolver's request holds a permission for a table
+func requirePermission(p graphql.ResolveParams, permission string, tableSlug string) error {
+	if auth.PrincipalFromContext(p.Context).Can(permission, tableSlug) {
+		return nil
+	}
+	return permissionError(permission, tableSlug)
+}
+
+// relationKeys normalizes a stored relation value into the list of related keys
+func relationKeys(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		keys := make([]string, 0, len(v))
+		for _, item := range v {
+			if item != nil && item != "" {
+				keys = append(keys, fmt.Sprint(item))
+			}
+		}
+		return keys
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// schemaValues converts GraphQL input values back to schema field names
+func (t *graphQLTable) schemaValues(input map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{})
+	for name, value := range input {
+		if fieldName, ok := t.fieldNames[name]; ok {
+			values[fieldName] = value
+		}
+	}
+	return values
+}
+
+// getField builds the query field that fetches a single record by id
+func (h *GraphQLHandler) getField(table *graphQLTable) *graphql.Field {
+	return &graphql.Field{
+		Type: table.object,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if err := requirePermission(p, models.PermissionContentRead, table.schema.TableSlug); err != nil {
+				return nil, err
+			}
+			content, err := h.contentRepo.GetContentByID(auth.TenantFromContext(p.Context), p.Args["id"].(string), auth.PrincipalFromContext(p.Context))
+			if err != nil {
+				return nil, err
+			}
+			if content == nil || content.TableSlug != table.schema.TableSlug {
+				return nil, nil
+			}
+			relationLoaderFrom(p.Context).register([]*models.Content{content})
+			return content, nil
+		},
+	}
+}
+
+// listField builds the query field that lists records with filtering, sorting and pagination
+func (h *GraphQLHandler) listField(table *graphQLTable) *graphql.Field {
+	return &graphql.Field{
+		Type: table.page,
+		Args: graphql.FieldConfigArgument{
+			"search":   &graphql.ArgumentConfig{Type: graphql.String},
+			"filter":   &graphql.ArgumentConfig{Type: table.filter},
+			"sortBy":   &graphql.ArgumentConfig{Type: graphql.String},
+			"sortDir":  &graphql.ArgumentConfig{Type: sortDirectionEnum},
+			"page":     &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+			"pageSize": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if err := requirePermission(p, models.PermissionContentRead, table.schema.TableSlug); err != nil {
+				return nil, err
+			}
+			params := &models.ContentQueryParams{Principal: auth.PrincipalFromContext(p.Context)}
+			if search, ok := p.Args["search"].(string); ok {
+				params.Search = search
+			}
+			if filter, ok := p.Args["filter"].(map[string]interface{}); ok {
+				params.Filters = make(map[string]string)
+				for name, value := range table.schemaValues(filter) {
+					params.Filters[name] = fmt.Sprint(value)
+				}
+			}
+			if sortBy, ok := p.Args["sortBy"].(string); ok {
+				if fieldName, ok := table.fieldNames[sortBy]; ok {
+					sortBy = fieldName
+				}
+				params.SortBy = sortBy
+			}
+			if sortDir, ok := p.Args["sortDir"].(string); ok {
+				params.SortDir = sortDir
+			}
+			if page, ok := p.Args["page"].(int); ok {
+				params.Page = page
+			}
+			if pageSize, ok := p.Args["pageSize"].(int); ok {
+				params.PageSize = pageSize
+			}
+
+			response, err := h.contentRepo.GetContentsByTableSlug(auth.TenantFromContext(p.Context), table.schema.TableSlug, params)
+			if err != nil {
+				return nil, err
+			}
+			if response.Contents == nil {
+				response.Contents = []*models.Content{}
+			}
+			relationLoaderFrom(p.Context).register(response.Contents)
+			return response, nil
+		},
+	}
+}
+
+// createField builds the mutation that creates a record
+func (h *GraphQLHandler) createField(table *graphQLTable) *graphql.Field {
+	return &graphql.Field{
+		Type: table.object,
+		Args: graphql.FieldConfigArgument{
+			"values": &graphql.ArgumentConfig{Type: graphql.NewNonNull(table.input)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if err := requirePermission(p, models.PermissionContentCreate, table.schema.TableSlug); err != nil {
+				return nil, err
+			}
+			input, _ := p.Args["values"].(map[string]interface{})
+			req := &models.CreateContentRequest{Values: table.schemaValues(input)}
+
+			if err := h.contentHandler.prepareValues(auth.TenantFromContext(p.Context), "", req.Values, table.schema, auth.PrincipalFromContext(p.Context), nil); err != nil {
+				return nil, err
+			}
+
+			return h.contentRepo.CreateContent(auth.TenantFromContext(p.Context), table.schema.TableSlug, req, auth.PrincipalFromContext(p.Context))
+		},
+	}
+}
+
+// updateField builds the mutation that replaces a record's values
+func (h *GraphQLHandler) updateField(table *graphQLTable) *graphql.Field {
+	return &graphql.Field{
+		Type: table.object,
+		Args: graphql.FieldConfigArgument{
+			"id":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			"values": &graphql.ArgumentConfig{Type: graphql.NewNonNull(table.input)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if err := requirePermission(p, models.PermissionContentUpdate, table.schema.TableSlug); err != nil {
+				return nil, err
+			}
+			id := p.Args["id"].(string)
+			existing, err := h.contentRepo.GetContentByID(auth.TenantFromContext(p.Context), id, auth.PrincipalFromContext(p.Context))
+			if err != nil {
+				return nil, err
+			}
+			if existing == nil || existing.TableSlug != table.schema.TableSlug {
+				return nil, fmt.Errorf("content not found")
+			}
+
+			input, _ := p.Args["values"].(map[string]interface{})
+			req := &models.UpdateContentRequest{Values: table.schemaValues(input)}
+
+			stored, err := h.contentRepo.GetContentByID(auth.TenantFromContext(p.Context), id, nil)
+			if err != nil {
+				return nil, err
+			}
+			if stored == nil {
+				return nil, fmt.Errorf("content not found")
+			}
+			if err := h.contentHandler.prepareValues(auth.TenantFromContext(p.Context), id, req.Values, table.schema, auth.PrincipalFromContext(p.Context), stored.Values); err != nil {
+				return nil, err
+			}
+
+			content, err := h.contentRepo.UpdateContent(auth.TenantFromContext(p.Context), id, req, auth.PrincipalFromContext(p.Context))
+			if err != nil {
+				return nil, err
+			}
+			if content == nil {
+				return nil, fmt.Errorf("content not found")
+			}
+			return content, nil
+		},
+	}
+}
+
+// deleteField builds the mutation that deletes a record
+func (h *GraphQLHandler) deleteField(table *graphQLTable) *graphql.Field {
+	return &graphql.Field{
+		Type: graphql.Boolean,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if err := requirePermission(p, models.PermissionContentDelete, table.schema.TableSlug); err != nil {
+				return nil, err
+			}
+			id := p.Args["id"].(string)
+			existing, err := h.contentRepo.GetContentByID(auth.TenantFromContext(p.Context), id, auth.PrincipalFromContext(p.Context))
+			if err != nil {
+				return nil, err
+			}
+			if existing == nil || existing.TableSlug != table.schema.TableSlug {
+				return nil, fmt.Errorf("content not found")
+			}
+
+			if err := h.contentRepo.DeleteContent(auth.TenantFromContext(p.Context), id, auth.PrincipalFromContext(p.Context)); err != nil {
+				return nil, err
+			}
+			return true, nil
+		},
+	}
+}
@@ -0,0 +1,557 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/odata"
+	"dynamic-table-backend/repository"
+
+	"github.com/gin-gonic/gin"
+)
+
+// odataMaxPageSize is the server-driven page size for entity set requests
+const odataMaxPageSize = 100
+
+// odataKeyPattern matches an entity set name with an optional key, e.g. orders('id') or orders(id)
+var odataKeyPattern = regexp.MustCompile(`^([^()]+)(?:\('?([^()']*)'?\))?$`)
+
+type ODataHandler struct {
+	schemaRepo  repository.SchemaStore
+	contentRepo repository.ContentStore
+}
+
+func NewODataHandler(stores *repository.Stores) *ODataHandler {
+	return &ODataHandler{
+		schemaRepo:  stores.Schemas,
+		contentRepo: stores.Contents,
+	}
+}
+
+// odataError writes an error in the OData JSON error format
+func odataError(c *gin.Context, status int, message string) {
+	c.Header("OData-Version", "4.0")
+	c.JSON(status, gin.H{"error": gin.H{"code": strconv.Itoa(status), "message": message}})
+}
+
+// serviceRoot returns the absolute URL of the OData service root
+func serviceRoot(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if forwarded := c.GetHeader("X-Forwarded-Proto"); forwarded != "" {
+		scheme = forwarded
+	}
+	return scheme + "://" + c.Request.Host + "/odata"
+}
+
+// odataAuthorize checks that the caller may read a table and writes an OData error if not
+func odataAuthorize(c *gin.Context, tableSlug string) bool {
+	if auth.GetPrincipal(c).Can(models.PermissionContentRead, tableSlug) {
+		return true
+	}
+	odataError(c, http.StatusForbidden, permissionError(models.PermissionContentRead, tableSlug).Error())
+	return false
+}
+
+// ServiceDocument lists every readable table as an entity set
+func (h *ODataHandler) ServiceDocument(c *gin.Context) {
+	schemas, err := h.schemaRepo.GetAllSchemas(auth.GetTenant(c))
+	if err != nil {
+		odataError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	names := odata.EntitySetNames(schemas)
+	schemas = readableSchemas(auth.GetPrincipal(c), schemas)
+
+	sets := make([]gin.H, 0, len(schemas))
+	for _, schema := range schemas {
+		name := names[schema.TableSlug]
+		sets = append(sets, gin.H{
+			"name":  name,
+			"kind":  "EntitySet",
+			"url":   name,
+			"title": schema.TableName,
+		})
+	}
+
+	c.Header("OData-Version", "4.0")
+	c.JSON(http.StatusOK, gin.H{
+		"@odata.context": serviceRoot(c) + "/$metadata",
+		"value":          sets,
+	})
+}
+
+// Resource serves $metadata, entity set collections and single entities
+func (h *ODataHandler) Resource(c *gin.Context) {
+	resource := c.Param("resource")
+	if resource == "$metadata" {
+		h.metadata(c)
+		return
+	}
+
+	match := odataKeyPattern.FindStringSubmatch(resource)
+	if match == nil {
+		odataError(c, http.StatusNotFound, "resource not found")
+		return
+	}
+
+	schema, name, err := h.findSchema(auth.GetTenant(c), match[1])
+	if err != nil {
+		odataError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if schema == nil {
+		odataError(c, http.StatusNotFound, "entity set not found")
+		return
+	}
+	if !odataAuthorize(c, schema.TableSlug) {
+		return
+	}
+
+	if strings.Contains(resource, "(") {
+		h.entity(c, schema, name, match[2])
+		return
+	}
+	h.entitySet(c, schema, name)
+}
+
+// Count returns the number of entities matching $filter and $search as plain text
+func (h *ODataHandler) Count(c *gin.Context) {
+	schema, _, err := h.findSchema(auth.GetTenant(c), c.Param("resource"))
+	if err != nil {
+		odataError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if schema == nil {
+		odataError(c, http.StatusNotFound, "entity set not found")
+		return
+	}
+	if !odataAuthorize(c, schema.TableSlug) {
+		return
+	}
+
+	params, err := h.queryParams(c, schema)
+	if err != nil {
+		odataError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	params.PageSize = 1
+
+	response, err := h.contentRepo.GetContentsByTableSlug(auth.GetTenant(c), schema.TableSlug, params)
+	if err != nil {
+		odataError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Header("OData-Version", "4.0")
+	c.String(http.StatusOK, strconv.Itoa(response.Total))
+}
+
+// metadata serves the CSDL document describing every readable entity set
+func (h *ODataHandler) metadata(c *gin.Context) {
+	schemas, err := h.schemaRepo.GetAllSchemas(auth.GetTenant(c))
+	if err != nil {
+		odataError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sets := odata.EntitySetNames(schemas)
+	schemas = readableSchemas(auth.GetPrincipal(c), schemas)
+
+	doc, err := odata.Metadata(schemas, sets)
+	if err != nil {
+		odataError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Header("OData-Version", "4.0")
+	c.Data(http.StatusOK, "application/xml", doc)
+}
+
+// findSchema resolves an entity set name to a table schema of the tenant
+func (h *ODataHandler) findSchema(tenant string, name string) (*models.Schema, string, error) {
+	schemas, err := h.schemaRepo.GetAllSchemas(tenant)
+	if err != nil {
+		return nil, "", err
+	}
+	sets := odata.EntitySetNames(schemas)
+	for _, schema := range schemas {
+		if sets[schema.TableSlug] == name {
+			return schema, name, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// queryParams translates OData system query options into content query parameters
+func (h *ODataHandler) queryParams(c *gin.Context, schema *models.Schema) (*models.ContentQueryParams, error) {
+	params := &models.ContentQueryParams{
+		Page:      1,
+		PageSize:  odataMaxPageSize,
+		Search:    c.Query("$search"),
+		Principal: auth.GetPrincipal(c),
+	}
+
+	props := odata.TableProperties(schema)
+
+	if filter := c.Query("$filter"); filter != "" {
+		expr, err := odata.ParseFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		if err := filterFields(expr, schema, props); err != nil {
+			return nil, err
+		}
+		params.Filter = expr
+	}
+
+	if orderBy := c.Query("$orderby"); orderBy != "" {
+		sorts, err := odata.ParseOrderBy(orderBy)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sorts {
+			if sorts[i].Field, err = queryField(schema, props, sorts[i].Field, "$orderby"); err != nil {
+				return nil, err
+			}
+		}
+		params.Sorts = sorts
+	}
+
+	if top := c.Query("$top"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid $top value '%s'", top)
+		}
+		if n < params.PageSize {
+			params.PageSize = n
+		}
+	}
+
+	if skip := c.Query("$skip"); skip != "" {
+		n, err := strconv.Atoi(skip)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid $skip value '%s'", skip)
+		}
+		params.Skip = n
+	}
+
+	return params, nil
+}
+
+// systemFieldNames are the field names the content store resolves to a record's timestamps rather
+// than to a field of that name
+var systemFieldNames = map[string]bool{"createdAt": true, "updatedAt": true, "created_at": true, "updated_at": true}
+
+// queryField returns the name the content store filters and sorts a property by. Properties the store
+// cannot tell apart from another one, such as a field named createdAt or the id of a table with a field
+// named id, are rejected.
+func queryField(schema *models.Schema, props *odata.Properties, name string, option string) (string, error) {
+	switch name {
+	case "createdAt", "updatedAt":
+		return name, nil
+	case "id":
+		for _, field := range schema.Fields {
+			if field.Name == "id" {
+				return "", fmt.Errorf("property 'id' cannot be used in %s", option)
+			}
+		}
+		return name, nil
+	}
+	field, ok := props.Field(name)
+	if !ok {
+		return "", fmt.Errorf("unknown property '%s' in %s", name, option)
+	}
+	if systemFieldNames[field] {
+		return "", fmt.Errorf("property '%s' cannot be used in %s", name, option)
+	}
+	return field, nil
+}
+
+// filterFields replaces the property names of a filter with the field names they refer to
+func filterFields(expr *models.FilterExpr, schema *models.Schema, props *odata.Properties) error {
+	if expr.Field != "" {
+		field, err := queryField(schema, props, expr.Field, "$filter")
+		if err != nil {
+			return err
+		}
+		expr.Field = field
+	}
+	for _, arg := range expr.Args {
+		if err := filterFields(arg, schema, props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entitySet serves a collection of entities
+func (h *ODataHandler) entitySet(c *gin.Context, schema *models.Schema, name string) {
+	params, err := h.queryParams(c, schema)
+	if err != nil {
+		odataError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	shape, err := parseShape(c, schema)
+	if err != nil {
+		odataError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeExpand(c, shape) {
+		return
+	}
+	params.Fields = shape.fields
+
+	// A $top of zero only asks for the count
+	var contents []*models.Content
+	var total int
+	requested := params.PageSize
+	if requested > 0 {
+		response, err := h.contentRepo.GetContentsByTableSlug(auth.GetTenant(c), schema.TableSlug, params)
+		if err != nil {
+			odataError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		contents, total = response.Contents, response.Total
+	} else {
+		params.PageSize = 1
+		response, err := h.contentRepo.GetContentsByTableSlug(auth.GetTenant(c), schema.TableSlug, params)
+		if err != nil {
+			odataError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		total = response.Total
+	}
+
+	entities, err := h.toEntities(contents, schema, shape)
+	if err != nil {
+		odataError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body := gin.H{
+		"@odata.context": serviceRoot(c) + "/$metadata#" + name,
+		"value":          entities,
+	}
+	if strings.EqualFold(c.Query("$count"), "true") {
+		body["@odata.count"] = total
+	}
+
+	// Server-driven paging when more entities remain than fit in one page
+	next := params.Skip + len(contents)
+	limit := total
+	if top, err := strconv.Atoi(c.Query("$top")); err == nil && params.Skip+top < limit {
+		limit = params.Skip + top
+	}
+	if requested > 0 && next < limit {
+		query := c.Request.URL.Query()
+		query.Set("$skip", strconv.Itoa(next))
+		if query.Get("$top") != "" {
+			query.Set("$top", strconv.Itoa(limit-next))
+		}
+		body["@odata.nextLink"] = serviceRoot(c) + "/" + name + "?" + query.Encode()
+	}
+
+	c.Header("OData-Version", "4.0")
+	c.JSON(http.StatusOK, body)
+}
+
+// entity serves a single entity by key
+func (h *ODataHandler) entity(c *gin.Context, schema *models.Schema, name string, id string) {
+	shape, err := parseShape(c, schema)
+	if err != nil {
+		odataError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeExpand(c, shape) {
+		return
+	}
+
+	content, err := h.contentRepo.GetContentByID(auth.GetTenant(c), id, auth.GetPrincipal(c))
+	if err != nil {
+		odataError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if content == nil || content.TableSlug != schema.TableSlug {
+		odataError(c, http.StatusNotFound, "entity not found")
+		return
+	}
+
+	entities, err := h.toEntities([]*models.Content{content}, schema, shape)
+	if err != nil {
+		odataError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	entity := entities[0]
+	entity["@odata.context"] = serviceRoot(c) + "/$metadata#" + name + "/$entity"
+
+	c.Header("OData-Version", "4.0")
+	c.JSON(http.StatusOK, entity)
+}
+
+// entityShape holds the $select and $expand options of a request
+type entityShape struct {
+	props    *odata.Properties
+	selected map[string]bool // property names; nil selects every property
+	// fields lists the fields to fetch for $select and $expand; nil fetches every field
+	fields   []string
+	expanded map[string]models.Field // relation fields by navigation property name
+	// principal limits expanded entities to the rows the caller may access in its tenant
+	principal *models.Principal
+	tenant    string
+}
+
+// parseShape reads $select and $expand, accepting either property or navigation names for expansion
+func parseShape(c *gin.Context, schema *models.Schema) (*entityShape, error) {
+	shape := &entityShape{
+		props:     odata.TableProperties(schema),
+		expanded:  make(map[string]models.Field),
+		principal: auth.GetPrincipal(c),
+		tenant:    auth.GetTenant(c),
+	}
+
+	if sel := c.Query("$select"); sel != "" && sel != "*" {
+		shape.selected = make(map[string]bool)
+		for _, name := range strings.Split(sel, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := shape.props.Field(name); !ok && !isSystemProperty(name) {
+				return nil, fmt.Errorf("unknown property '%s' in $select", name)
+			}
+			shape.selected[name] = true
+		}
+	}
+
+	if exp := c.Query("$expand"); exp != "" {
+		for _, name := range strings.Split(exp, ",") {
+			name = strings.TrimSpace(name)
+			fieldName, ok := shape.props.Relation(name)
+			if !ok {
+				fieldName, _ = shape.props.Field(name)
+			}
+			found := false
+			for _, field := range schema.Fields {
+				if field.Name == fieldName && field.DataType == "relation" && field.RelationConfig != nil {
+					shape.expanded[shape.props.NavigationName(field.Name)] = field
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unknown navigation property '%s' in $expand", name)
+			}
+		}
+	}
+
+	// Fetch only the selected fields and the keys of the expanded relations
+	if shape.selected != nil {
+		shape.fields = []string{}
+		for _, field := range schema.Fields {
+			_, expanded := shape.expanded[shape.props.NavigationName(field.Name)]
+			if shape.selected[shape.props.Name(field.Name)] || (expanded && field.DataType == "relation") {
+				shape.fields = append(shape.fields, field.Name)
+			}
+		}
+	}
+
+	return shape, nil
+}
+
+// isSystemProperty reports whether a name is a record attribute every entity type exposes
+func isSystemProperty(name string) bool {
+	for _, system := range odata.SystemProperties {
+		if name == system {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeExpand checks that the caller may read every table reached by $expand
+func authorizeExpand(c *gin.Context, shape *entityShape) bool {
+	for _, field := range shape.expanded {
+		if !odataAuthorize(c, field.RelationConfig.RelatedTable) {
+			return false
+		}
+	}
+	return true
+}
+
+// toEntities converts content records of a table into OData entities with their expanded relations.
+// Each navigation property is fetched with one lookup for every record.
+func (h *ODataHandler) toEntities(contents []*models.Content, schema *models.Schema, shape *entityShape) ([]map[string]interface{}, error) {
+	entities := make([]map[string]interface{}, 0, len(contents))
+	for _, content := range contents {
+		entities = append(entities, toEntity(content, schema, shape.props, shape.selected))
+	}
+
+	loader := newRelationLoader()
+	loader.register(contents)
+	for navName, field := range shape.expanded {
+		config := field.RelationConfig
+		relatedSchema, err := h.schemaRepo.GetSchemaBySlug(shape.tenant, config.RelatedTable)
+		if err != nil {
+			return nil, err
+		}
+		if relatedSchema == nil {
+			for _, entity := range entities {
+				entity[navName] = nil
+			}
+			continue
+		}
+		relatedProps := odata.TableProperties(relatedSchema)
+		fetch := func(keys []string) ([]*models.Content, error) {
+			return h.contentRepo.GetContentsByFieldValues(shape.tenant, config.RelatedTable, config.RelatedField, keys, shape.principal)
+		}
+
+		for i, content := range contents {
+			related, err := loader.load(content, field, fetch)
+			if err != nil {
+				return nil, err
+			}
+			items := make([]map[string]interface{}, 0, len(related))
+			for _, r := range related {
+				items = append(items, toEntity(r, relatedSchema, relatedProps, nil))
+			}
+
+			if config.AllowMultiple {
+				entities[i][navName] = items
+			} else if len(items) > 0 {
+				entities[i][navName] = items[0]
+			} else {
+				entities[i][navName] = nil
+			}
+		}
+	}
+
+	return entities, nil
+}
+
+// toEntity flattens a content record into an OData entity with the selected properties, or every
+// property if selected is nil
+func toEntity(content *models.Content, schema *models.Schema, props *odata.Properties, selected map[string]bool) map[string]interface{} {
+	include := func(name string) bool {
+		return selected == nil || selected[name] || name == "id"
+	}
+
+	entity := make(map[string]interface{})
+	for _, field := range schema.Fields {
+		if name := props.Name(field.Name); include(name) {
+			entity[name] = content.Values[field.Name]
+		}
+	}
+	entity["id"] = content.ID
+	if include("createdAt") {
+		entity["createdAt"] = content.CreatedAt
+	}
+	if include("updatedAt") {
+		entity["updatedAt"] = content.UpdatedAt
+	}
+	return entity
+}
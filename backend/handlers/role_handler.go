@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RoleHandler manages roles, their grants and their members. Every endpoint requires the admin permission.
+type RoleHandler struct {
+	roleRepo repository.RoleStore
+}
+
+func NewRoleHandler(stores *repository.Stores) *RoleHandler {
+	return &RoleHandler{
+		roleRepo: stores.Roles,
+	}
+}
+
+// GetRoles lists every role with its grants and members
+func (h *RoleHandler) GetRoles(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	roles, err := h.roleRepo.GetAllRoles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, roles)
+}
+
+// CreateRole creates an empty role
+func (h *RoleHandler) CreateRole(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	var req models.CreateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing, err := h.roleRepo.GetRoleByName(req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if existing != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "role with this name already exists"})
+		return
+	}
+
+	role, err := h.roleRepo.CreateRole(&req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, role)
+}
+
+// GetRole retrieves a role by ID
+func (h *RoleHandler) GetRole(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	role, ok := h.findRole(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, role)
+}
+
+// DeleteRole deletes a role with its grants and members
+func (h *RoleHandler) DeleteRole(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	err := h.roleRepo.DeleteRole(c.Param("id"))
+	if err != nil {
+		if err.Error() == "role not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "role deleted successfully"})
+}
+
+// AddGrant gives a role a permission on one table, or on every table when tableSlug is omitted
+func (h *RoleHandler) AddGrant(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	var req models.CreateGrantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateGrant(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	role, ok := h.findRole(c)
+	if !ok {
+		return
+	}
+
+	grant, err := h.roleRepo.AddGrant(role.ID, &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, grant)
+}
+
+// DeleteGrant removes a grant from a role
+func (h *RoleHandler) DeleteGrant(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	err := h.roleRepo.DeleteGrant(c.Param("id"), c.Param("grantId"))
+	if err != nil {
+		if err.Error() == "grant not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "grant deleted successfully"})
+}
+
+// AddMember binds a principal, i.e. an API key ID or a JWT subject, to a role
+func (h *RoleHandler) AddMember(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	var req models.RoleMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	role, ok := h.findRole(c)
+	if !ok {
+		return
+	}
+
+	if err := h.roleRepo.AddMember(role.ID, req.PrincipalID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "role member added successfully"})
+}
+
+// RemoveMember unbinds a principal from a role
+func (h *RoleHandler) RemoveMember(c *gin.Context) {
+	if !authorizeGlobalAdmin(c) {
+		return
+	}
+
+	err := h.roleRepo.RemoveMember(c.Param("id"), c.Param("principalId"))
+	if err != nil {
+		if err.Error() == "role member not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "role member removed successfully"})
+}
+
+// findRole loads the role named by the id path parameter, responding 404 if it does not exist
+func (h *RoleHandler) findRole(c *gin.Context) (*models.Role, bool) {
+	role, err := h.roleRepo.GetRole(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if role == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+		return nil, false
+	}
+	return role, true
+}
+
+// validateGrant checks that a grant names a known permission; admin can only be granted globally
+func validateGrant(req *models.CreateGrantRequest) error {
+	known := false
+	for _, permission := range models.Permissions {
+		if permission == req.Permission {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown permission '%s'", req.Permission)
+	}
+	if req.Permission == models.PermissionAdmin && req.TableSlug != "" {
+		return fmt.Errorf("permission '%s' cannot be scoped to a table", models.PermissionAdmin)
+	}
+	return nil
+}
@@ -1,20 +1,46 @@
 package handlers
 
 import (
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/imaging"
 	"dynamic-table-backend/models"
+	"dynamic-table-backend/policy"
 	"dynamic-table-backend/repository"
+	"dynamic-table-backend/spec"
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
 type SchemaHandler struct {
-	schemaRepo *repository.SchemaRepository
+	schemaRepo repository.SchemaStore
+	policyRepo repository.PolicyStore
+	// storageRepo switches tables to materialized storage; nil when the backend has none
+	storageRepo *repository.StorageRepository
+	// listeners are notified after a schema is created, updated or deleted
+	listeners []func()
 }
 
-func NewSchemaHandler() *SchemaHandler {
+func NewSchemaHandler(stores *repository.Stores) *SchemaHandler {
 	return &SchemaHandler{
-		schemaRepo: repository.NewSchemaRepository(),
+		schemaRepo:  stores.Schemas,
+		policyRepo:  stores.Policies,
+		storageRepo: stores.Storage,
+	}
+}
+
+// OnSchemaChange registers a callback run after every schema mutation
+func (h *SchemaHandler) OnSchemaChange(fn func()) {
+	h.listeners = append(h.listeners, fn)
+}
+
+// notifySchemaChange runs the registered schema change callbacks
+func (h *SchemaHandler) notifySchemaChange() {
+	for _, fn := range h.listeners {
+		fn()
 	}
 }
 
@@ -25,6 +51,9 @@ func (h *SchemaHandler) CreateSchema(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !authorize(c, models.PermissionSchemaWrite, req.TableSlug) {
+		return
+	}
 
 	// Validate fields
 	if len(req.Fields) == 0 {
@@ -46,11 +75,36 @@ func (h *SchemaHandler) CreateSchema(c *gin.Context) {
 		fieldNames[field.Name] = true
 	}
 
-	schema, err := h.schemaRepo.CreateSchema(&req)
+	// Resolve lookup and rollup fields, parse and type-check formula fields and check file fields
+	if err := h.schemaRepo.ResolveLinks(auth.GetTenant(c), req.TableSlug, req.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := formula.Validate(req.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := imaging.Validate(req.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Storage != "" {
+		if err := h.validateStorage(req.Storage, req.Fields); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	schema, err := h.schemaRepo.CreateSchema(auth.GetTenant(c), &req, auth.GetPrincipal(c))
 	if err != nil {
+		if err.Error() == "a table with this slug is in the trash" {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.notifySchemaChange()
 
 	c.JSON(http.StatusCreated, schema)
 }
@@ -62,8 +116,12 @@ func (h *SchemaHandler) GetSchema(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "table slug is required"})
 		return
 	}
+	if !auth.GetPrincipal(c).CanReadSchema(tableSlug) {
+		c.JSON(http.StatusForbidden, gin.H{"error": permissionError(models.PermissionContentRead, tableSlug).Error()})
+		return
+	}
 
-	schema, err := h.schemaRepo.GetSchemaBySlug(tableSlug)
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), tableSlug)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -79,16 +137,13 @@ func (h *SchemaHandler) GetSchema(c *gin.Context) {
 
 // GetAllSchemas retrieves all table schemas
 func (h *SchemaHandler) GetAllSchemas(c *gin.Context) {
-	schemas, err := h.schemaRepo.GetAllSchemas()
+	schemas, err := h.schemaRepo.GetAllSchemas(auth.GetTenant(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if len(schemas) == 0 {
-		schemas = []*models.Schema{}
-	}
 
-	c.JSON(http.StatusOK, schemas)
+	c.JSON(http.StatusOK, readableSchemas(auth.GetPrincipal(c), schemas))
 }
 
 // UpdateSchema updates an existing schema
@@ -99,6 +154,10 @@ func (h *SchemaHandler) UpdateSchema(c *gin.Context) {
 		return
 	}
 
+	if !authorize(c, models.PermissionSchemaWrite, tableSlug) {
+		return
+	}
+
 	var req models.UpdateSchemaRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -125,7 +184,53 @@ func (h *SchemaHandler) UpdateSchema(c *gin.Context) {
 		fieldNames[field.Name] = true
 	}
 
-	schema, err := h.schemaRepo.UpdateSchema(tableSlug, &req)
+	// Resolve lookup and rollup fields, parse and type-check formula fields and check file fields
+	if err := h.schemaRepo.ResolveLinks(auth.GetTenant(c), tableSlug, req.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := formula.Validate(req.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := imaging.Validate(req.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Typed tables need columns for their stored fields
+	current, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), tableSlug)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if current != nil && current.Storage != "" && current.Storage != models.StorageJSONB {
+		if err := repository.ValidateMaterializedFields(req.Fields); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Fields read by the table's row policy must stay stored fields
+	rowPolicy, err := h.policyRepo.GetPolicy(auth.GetTenant(c), tableSlug)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rowPolicy != nil {
+		if node, err := policy.Parse(rowPolicy.Expression); err == nil {
+			if err := policy.Check(node, req.Fields); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "row policy: " + err.Error()})
+				return
+			}
+		}
+	}
+
+	schema, err := h.schemaRepo.UpdateSchema(auth.GetTenant(c), tableSlug, &req, auth.GetPrincipal(c))
+	if errors.Is(err, repository.ErrValuesDoNotFit) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -135,23 +240,245 @@ func (h *SchemaHandler) UpdateSchema(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "schema not found"})
 		return
 	}
+	h.notifySchemaChange()
 
 	c.JSON(http.StatusOK, schema)
 }
 
-// DeleteSchema deletes a schema and all its contents
+// DeleteSchema moves a schema and all its contents to the trash
 func (h *SchemaHandler) DeleteSchema(c *gin.Context) {
 	tableSlug := c.Param("tableSlug")
 	if tableSlug == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "table slug is required"})
 		return
 	}
+	if !authorize(c, models.PermissionSchemaWrite, tableSlug) {
+		return
+	}
 
-	err := h.schemaRepo.DeleteSchema(tableSlug)
+	err := h.schemaRepo.DeleteSchema(auth.GetTenant(c), tableSlug, auth.GetPrincipal(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.notifySchemaChange()
 
 	c.JSON(http.StatusOK, gin.H{"message": "schema deleted successfully"})
 }
+
+// GetTrashedSchemas lists the schemas in the trash that the caller may restore
+func (h *SchemaHandler) GetTrashedSchemas(c *gin.Context) {
+	schemas, err := h.schemaRepo.GetTrashedSchemas(auth.GetTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	principal := auth.GetPrincipal(c)
+	restorable := []*models.Schema{}
+	for _, schema := range schemas {
+		if principal.Can(models.PermissionSchemaWrite, schema.TableSlug) {
+			restorable = append(restorable, schema)
+		}
+	}
+
+	c.JSON(http.StatusOK, restorable)
+}
+
+// RestoreSchema moves a schema out of the trash together with the records deleted with it
+func (h *SchemaHandler) RestoreSchema(c *gin.Context) {
+	tableSlug := c.Param("tableSlug")
+	if !authorize(c, models.PermissionSchemaWrite, tableSlug) {
+		return
+	}
+
+	schema, err := h.schemaRepo.RestoreSchema(auth.GetTenant(c), tableSlug, auth.GetPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if schema == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema not found in trash"})
+		return
+	}
+	h.notifySchemaChange()
+
+	c.JSON(http.StatusOK, schema)
+}
+
+// GetJSONSchema returns the JSON Schema describing a table's record values
+func (h *SchemaHandler) GetJSONSchema(c *gin.Context) {
+	tableSlug := c.Param("tableSlug")
+	if tableSlug == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "table slug is required"})
+		return
+	}
+	if !auth.GetPrincipal(c).CanReadSchema(tableSlug) {
+		c.JSON(http.StatusForbidden, gin.H{"error": permissionError(models.PermissionContentRead, tableSlug).Error()})
+		return
+	}
+
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), tableSlug)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if schema == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, spec.JSONSchema(schema))
+}
+
+// GetOpenAPI returns an OpenAPI document generated from the current table schemas
+func (h *SchemaHandler) GetOpenAPI(c *gin.Context) {
+	schemas, err := h.schemaRepo.GetAllSchemas(auth.GetTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, spec.OpenAPI(readableSchemas(auth.GetPrincipal(c), schemas)))
+}
+
+// GetRowPolicy returns the row policy of a table
+func (h *SchemaHandler) GetRowPolicy(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	rowPolicy, err := h.policyRepo.GetPolicy(auth.GetTenant(c), c.Param("tableSlug"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rowPolicy == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "row policy not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rowPolicy)
+}
+
+// SetRowPolicy sets the expression restricting which rows of a table non-admin principals can access
+func (h *SchemaHandler) SetRowPolicy(c *gin.Context) {
+	tableSlug := c.Param("tableSlug")
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	var req models.SetRowPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), tableSlug)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if schema == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema not found"})
+		return
+	}
+
+	node, err := policy.Parse(req.Expression)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := policy.Check(node, schema.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rowPolicy, err := h.policyRepo.SetPolicy(auth.GetTenant(c), tableSlug, req.Expression)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rowPolicy)
+}
+
+// DeleteRowPolicy removes the row policy of a table, making every row accessible again
+func (h *SchemaHandler) DeleteRowPolicy(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	err := h.policyRepo.DeletePolicy(auth.GetTenant(c), c.Param("tableSlug"))
+	if err != nil {
+		if err.Error() == "row policy not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "row policy deleted successfully"})
+}
+
+// SetStorage switches a table between JSONB and materialized storage. Switching to materialized
+// copies the records in the background, so it is accepted with the table still materializing.
+func (h *SchemaHandler) SetStorage(c *gin.Context) {
+	tableSlug := c.Param("tableSlug")
+	if !authorize(c, models.PermissionSchemaWrite, tableSlug) {
+		return
+	}
+
+	var req models.SetStorageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), tableSlug)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if schema == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema not found"})
+		return
+	}
+	if err := h.validateStorage(req.Storage, schema.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	schema, err = h.storageRepo.SetStorage(auth.GetTenant(c), tableSlug, req.Storage)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if schema == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema not found"})
+		return
+	}
+	h.notifySchemaChange()
+
+	if schema.Storage == models.StorageMaterializing {
+		c.JSON(http.StatusAccepted, schema)
+		return
+	}
+	c.JSON(http.StatusOK, schema)
+}
+
+// validateStorage checks that a table with the given fields can use a storage mode on this backend
+func (h *SchemaHandler) validateStorage(storage string, fields []models.Field) error {
+	switch storage {
+	case models.StorageJSONB:
+		return nil
+	case models.StorageMaterialized:
+		if h.storageRepo == nil {
+			return fmt.Errorf("materialized storage requires PostgreSQL")
+		}
+		return repository.ValidateMaterializedFields(fields)
+	}
+	return fmt.Errorf("storage must be %s or %s", models.StorageJSONB, models.StorageMaterialized)
+}
@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/policy"
+	"dynamic-table-backend/repository"
+	"dynamic-table-backend/stream"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// streamHeartbeat is how often idle streams are kept alive, and how often the access of their client
+// to the table is re-evaluated
+const streamHeartbeat = 15 * time.Second
+
+// StreamHandler streams the changes of a table over server-sent events or WebSocket
+type StreamHandler struct {
+	hub        *stream.Hub
+	changeRepo repository.ChangeStore
+	schemaRepo repository.SchemaStore
+	policyRepo repository.PolicyStore
+}
+
+// NewStreamHandler serves streams from the hub, which reads the change log of the stores
+func NewStreamHandler(stores *repository.Stores, hub *stream.Hub) *StreamHandler {
+	return &StreamHandler{
+		hub:        hub,
+		changeRepo: stores.Changes,
+		schemaRepo: stores.Schemas,
+		policyRepo: stores.Policies,
+	}
+}
+
+// streamAccess decides which events a client receives and which of their fields it may read
+type streamAccess struct {
+	rowPolicy policy.Node
+	blocked   bool
+	filter    policy.Node
+	hidden    map[string]bool
+	principal *models.Principal
+}
+
+// allows reports whether the client may receive an event, i.e. whether the record passes the row
+// policy and the filter. Deletes are matched against the record as it was before.
+func (a *streamAccess) allows(event *models.ChangeEvent) bool {
+	if a.blocked {
+		return false
+	}
+	if a.rowPolicy != nil && !policy.Match(a.rowPolicy, a.principal, event.RecordID, event.Values) {
+		return false
+	}
+	return a.filter == nil || policy.Match(a.filter, a.principal, event.RecordID, event.Values)
+}
+
+// StreamContents streams the inserts, updates and deletes of a table. Clients upgrading to WebSocket
+// receive one JSON event per message, others receive server-sent events. The optional filter query
+// uses the row policy language; a Last-Event-ID header or lastEventId query resumes after an event.
+func (h *StreamHandler) StreamContents(c *gin.Context) {
+	tableSlug := c.Param("tableSlug")
+	if !authorize(c, models.PermissionContentRead, tableSlug) {
+		return
+	}
+	tenant := auth.GetTenant(c)
+
+	var filter policy.Node
+	if expression := c.Query("filter"); expression != "" {
+		schema, err := h.schemaRepo.GetSchemaBySlug(tenant, tableSlug)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if schema == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "table not found"})
+			return
+		}
+		if filter, err = policy.Parse(expression); err == nil {
+			err = policy.Check(filter, schema.Fields)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "filter: " + err.Error()})
+			return
+		}
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	var since int64 = -1
+	if lastEventID != "" {
+		var err error
+		if since, err = strconv.ParseInt(lastEventID, 10, 64); err != nil || since < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "last event id must be a non-negative number"})
+			return
+		}
+	}
+
+	access, err := h.access(c, tableSlug, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if access == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "table not found"})
+		return
+	}
+	// Which events arrive would reveal the values of fields the client may not read
+	if name := hiddenFilterField(filter, access.hidden); name != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("filter: cannot read field '%s'", name)})
+		return
+	}
+
+	// Subscribe before replaying so that no event committed in between is missed
+	sub, err := h.hub.Subscribe(tenant, tableSlug)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer sub.Close()
+
+	if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		// Credentials are sent in headers rather than cookies, so cross-origin connections are as safe as any other request
+		server := websocket.Server{Handler: func(conn *websocket.Conn) {
+			go discardMessages(conn)
+			h.serve(c, sub, access, filter, since, func(event *models.ChangeEvent) error {
+				if event == nil {
+					conn.PayloadType = websocket.PingFrame
+					_, err := conn.Write(nil)
+					conn.PayloadType = websocket.TextFrame
+					return err
+				}
+				return websocket.JSON.Send(conn, event)
+			})
+		}}
+		server.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	h.serve(c, sub, access, filter, since, func(event *models.ChangeEvent) error {
+		if event == nil {
+			_, err := fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+			return err
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Event, data); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+}
+
+// serve replays the events after since, when resuming, then sends live events until the client goes
+// away or falls too far behind. send writes an event, or a heartbeat (an SSE comment or a WebSocket
+// ping) when passed nil.
+func (h *StreamHandler) serve(c *gin.Context, sub *stream.Subscription, access *streamAccess, filter policy.Node, since int64, send func(*models.ChangeEvent) error) {
+	sent := since
+	deliver := func(event *models.ChangeEvent) error {
+		if event.ID <= sent {
+			return nil
+		}
+		sent = event.ID
+		// Schema events are only part of the change feed
+		if event.RecordID == "" || !access.allows(event) {
+			return nil
+		}
+		return send(redactEvent(event, access.hidden))
+	}
+
+	if since >= 0 {
+		for {
+			events, err := h.changeRepo.GetTableEvents(sub.Tenant, sub.TableSlug, sent, 500)
+			if err != nil {
+				log.Println("Failed to replay change events:", err)
+				return
+			}
+			for _, event := range events {
+				if err := deliver(event); err != nil {
+					return
+				}
+			}
+			if len(events) < 500 {
+				break
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			if err := deliver(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			// Roles, the row policy and field restrictions may have changed since the stream started
+			refreshed, err := h.access(c, sub.TableSlug, filter)
+			if err != nil {
+				log.Println("Failed to refresh stream access:", err)
+			} else if refreshed == nil {
+				return
+			} else {
+				access = refreshed
+			}
+			if err := send(nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// access loads the row policy and hidden fields applying to the client, or nil if the table is gone
+func (h *StreamHandler) access(c *gin.Context, tableSlug string, filter policy.Node) (*streamAccess, error) {
+	tenant, principal := auth.GetTenant(c), auth.GetPrincipal(c)
+	schema, err := h.schemaRepo.GetSchemaBySlug(tenant, tableSlug)
+	if err != nil || schema == nil {
+		return nil, err
+	}
+
+	access := &streamAccess{filter: filter, principal: principal, hidden: map[string]bool{}}
+	for _, field := range schema.Fields {
+		if !principal.CanReadField(field) {
+			access.hidden[field.Name] = true
+		}
+	}
+	// A stream whose filter reads a field that has become hidden receives nothing more
+	if hiddenFilterField(filter, access.hidden) != "" {
+		access.blocked = true
+	}
+	if principal.Can(models.PermissionAdmin, "") {
+		return access, nil
+	}
+
+	rowPolicy, err := h.policyRepo.GetPolicy(tenant, tableSlug)
+	if err != nil {
+		return nil, err
+	}
+	if rowPolicy != nil {
+		if access.rowPolicy, err = policy.Parse(rowPolicy.Expression); err != nil {
+			// A broken policy must hide rows rather than expose them
+			log.Printf("Failed to parse row policy of table %s: %v", tableSlug, err)
+			access.blocked = true
+		}
+	}
+	return access, nil
+}
+
+// hiddenFilterField returns the first field a stream filter reads that the client may not read, or ""
+func hiddenFilterField(filter policy.Node, hidden map[string]bool) string {
+	if filter == nil {
+		return ""
+	}
+	for _, name := range policy.Fields(filter) {
+		if hidden[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// redactEvent copies an event without the fields the client may not read; events are shared by every subscriber
+func redactEvent(event *models.ChangeEvent, hidden map[string]bool) *models.ChangeEvent {
+	redacted := *event
+	redacted.Values = make(map[string]interface{}, len(event.Values))
+	for name, value := range event.Values {
+		if !hidden[name] {
+			redacted.Values[name] = value
+		}
+	}
+	return &redacted
+}
+
+// discardMessages reads and ignores what a WebSocket client sends, which lets the connection notice when the client goes away
+func discardMessages(conn *websocket.Conn) {
+	var message string
+	for websocket.Message.Receive(conn, &message) == nil {
+	}
+	conn.Close()
+}
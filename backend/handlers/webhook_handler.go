@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/policy"
+	"dynamic-table-backend/repository"
+	"dynamic-table-backend/webhook"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookEvents are the audit actions webhooks can subscribe to
+var webhookEvents = map[string]bool{
+	models.AuditContentCreate:  true,
+	models.AuditContentUpdate:  true,
+	models.AuditContentDelete:  true,
+	models.AuditContentRestore: true,
+	models.AuditSchemaUpdate:   true,
+	models.AuditSchemaDelete:   true,
+	models.AuditSchemaRestore:  true,
+}
+
+// WebhookHandler manages the webhooks of a tenant and their deliveries. Every endpoint requires the admin permission.
+type WebhookHandler struct {
+	webhookRepo repository.WebhookStore
+	schemaRepo  repository.SchemaStore
+	// AllowPrivateAddresses accepts URLs of loopback, private and link-local hosts, set by WEBHOOK_ALLOW_PRIVATE
+	AllowPrivateAddresses bool
+}
+
+func NewWebhookHandler(stores *repository.Stores) *WebhookHandler {
+	return &WebhookHandler{
+		webhookRepo:           stores.Webhooks,
+		schemaRepo:            stores.Schemas,
+		AllowPrivateAddresses: webhook.AllowPrivateAddresses(),
+	}
+}
+
+// CreateWebhook subscribes a URL to events of a table; the response holds the signing secret, which is shown only once
+func (h *WebhookHandler) CreateWebhook(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	var req models.CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https URL"})
+		return
+	}
+	if !h.AllowPrivateAddresses {
+		if err := webhook.CheckURL(c.Request.Context(), target); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if len(req.Events) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one event is required"})
+		return
+	}
+	for _, event := range req.Events {
+		if !webhookEvents[event] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown event '%s'", event)})
+			return
+		}
+	}
+
+	schema, err := h.schemaRepo.GetSchemaBySlug(auth.GetTenant(c), req.TableSlug)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if schema == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema not found"})
+		return
+	}
+
+	// Filters use the row policy language, without user attributes since changes are not read by a user
+	if req.Filter != "" {
+		node, err := policy.Parse(req.Filter)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "filter: " + err.Error()})
+			return
+		}
+		if err := policy.Check(node, schema.Fields); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "filter: " + err.Error()})
+			return
+		}
+		if policy.UsesUser(node) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "filter: $user is not available in webhook filters"})
+			return
+		}
+	}
+
+	webhook, err := h.webhookRepo.CreateWebhook(auth.GetTenant(c), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, webhook)
+}
+
+// GetWebhooks lists the webhooks of the tenant
+func (h *WebhookHandler) GetWebhooks(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	webhooks, err := h.webhookRepo.GetWebhooks(auth.GetTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// GetWebhook returns a webhook
+func (h *WebhookHandler) GetWebhook(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	webhook, err := h.webhookRepo.GetWebhook(auth.GetTenant(c), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if webhook == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhook)
+}
+
+// DeleteWebhook removes a webhook and its deliveries
+func (h *WebhookHandler) DeleteWebhook(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	err := h.webhookRepo.DeleteWebhook(auth.GetTenant(c), c.Param("id"))
+	if err != nil {
+		if err.Error() == "webhook not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "webhook deleted successfully"})
+}
+
+// PingWebhook queues a test delivery, e.g. to try a webhook against a local stub
+func (h *WebhookHandler) PingWebhook(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	delivery, err := h.webhookRepo.Ping(auth.GetTenant(c), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if delivery == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+// GetDeliveries returns the delivery log of a webhook, optionally filtered by status
+func (h *WebhookHandler) GetDeliveries(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	webhook, err := h.webhookRepo.GetWebhook(auth.GetTenant(c), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if webhook == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+
+	h.respondDeliveries(c, webhook.ID, c.Query("status"))
+}
+
+// GetDeadLetters lists the deliveries of every webhook of the tenant that ran out of attempts
+func (h *WebhookHandler) GetDeadLetters(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	h.respondDeliveries(c, "", models.DeliveryDead)
+}
+
+// RetryDelivery queues a dead delivery again
+func (h *WebhookHandler) RetryDelivery(c *gin.Context) {
+	if !authorize(c, models.PermissionAdmin, "") {
+		return
+	}
+
+	deliveryID, err := strconv.ParseInt(c.Param("deliveryId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "delivery id must be a number"})
+		return
+	}
+
+	delivery, err := h.webhookRepo.RetryDelivery(auth.GetTenant(c), c.Param("id"), deliveryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if delivery == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dead delivery not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, delivery)
+}
+
+// respondDeliveries responds with a page of deliveries
+func (h *WebhookHandler) respondDeliveries(c *gin.Context, webhookID string, status string) {
+	if status != "" && status != models.DeliveryPending && status != models.DeliveryDelivered && status != models.DeliveryDead {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown status '%s'", status)})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.Query("page"))
+	pageSize, _ := strconv.Atoi(c.Query("pageSize"))
+
+	response, err := h.webhookRepo.GetDeliveries(auth.GetTenant(c), webhookID, status, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
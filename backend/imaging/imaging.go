@@ -0,0 +1,247 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"regexp"
+	"strings"
+
+	"dynamic-table-backend/models"
+)
+
+// Fits of image variants
+const (
+	FitContain = "contain" // Scale down to fit inside the box, keeping the aspect ratio
+	FitCover   = "cover"   // Scale to fill the box, cropping the overflow around the center
+)
+
+// MaxPixels bounds the images that are decoded to generate variants, so that small files expanding
+// to huge images cannot exhaust memory
+const MaxPixels = 40_000_000
+
+var variantName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Supported reports whether variants can be generated from images of a MIME type
+func Supported(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Validate checks the file configuration of the file fields of a schema
+func Validate(fields []models.Field) error {
+	for _, field := range fields {
+		config := field.FileConfig
+		if config == nil {
+			continue
+		}
+		if field.DataType != models.FileDataType {
+			return fmt.Errorf("field '%s': fileConfig is only allowed on file fields", field.Name)
+		}
+		if config.MaxSize < 0 || config.MaxWidth < 0 || config.MaxHeight < 0 {
+			return fmt.Errorf("field '%s': file limits cannot be negative", field.Name)
+		}
+		for _, mimeType := range config.MimeTypes {
+			if typ, sub, ok := strings.Cut(mimeType, "/"); !ok || typ == "" || typ == "*" || sub == "" {
+				return fmt.Errorf("field '%s': invalid MIME type '%s'", field.Name, mimeType)
+			}
+		}
+
+		names := make(map[string]bool)
+		for _, variant := range config.Variants {
+			if !variantName.MatchString(variant.Name) {
+				return fmt.Errorf("field '%s': variant names must consist of letters, digits, '-' and '_'", field.Name)
+			}
+			if names[variant.Name] {
+				return fmt.Errorf("field '%s': duplicate variant '%s'", field.Name, variant.Name)
+			}
+			names[variant.Name] = true
+
+			switch variant.Fit {
+			case "", FitContain:
+				if variant.Width <= 0 && variant.Height <= 0 {
+					return fmt.Errorf("field '%s': variant '%s' needs a width or height", field.Name, variant.Name)
+				}
+			case FitCover:
+				if variant.Width <= 0 || variant.Height <= 0 {
+					return fmt.Errorf("field '%s': variant '%s' needs a width and height to cover", field.Name, variant.Name)
+				}
+			default:
+				return fmt.Errorf("field '%s': variant '%s' has unknown fit '%s'", field.Name, variant.Name, variant.Fit)
+			}
+			if variant.Width < 0 || variant.Height < 0 || variant.Width > 10000 || variant.Height > 10000 {
+				return fmt.Errorf("field '%s': variant '%s' dimensions must be between 1 and 10000", field.Name, variant.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// AcceptsMimeType reports whether a file field accepts files of a MIME type; patterns such as
+// "image/*" match every subtype
+func AcceptsMimeType(config *models.FileConfig, mimeType string) bool {
+	if config == nil || len(config.MimeTypes) == 0 {
+		return true
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	mimeType = strings.TrimSpace(strings.ToLower(mimeType))
+	for _, pattern := range config.MimeTypes {
+		pattern = strings.ToLower(pattern)
+		if pattern == mimeType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dimensions returns the width and height of an image without decoding it
+func Dimensions(r io.Reader) (int, int, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read image: %v", err)
+	}
+	return config.Width, config.Height, nil
+}
+
+// Key returns the blob key of a variant of a file. It depends on the variant's dimensions and fit, so
+// that changing them generates the variant anew.
+func Key(fileKey string, variant models.ImageVariant) string {
+	fit := variant.Fit
+	if fit == "" {
+		fit = FitContain
+	}
+	return fmt.Sprintf("%s.%dx%d-%s", fileKey, variant.Width, variant.Height, fit)
+}
+
+// Generate decodes an image and encodes the resized variant. JPEG images stay JPEG; PNG and GIF,
+// of which only the first frame is kept, become PNG. It returns the encoded variant and its MIME type.
+func Generate(r io.Reader, variant models.ImageVariant) ([]byte, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image: %v", err)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image: %v", err)
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, "", fmt.Errorf("image of %dx%d pixels is too large to resize", config.Width, config.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	resized := Resize(src, variant.Width, variant.Height, variant.Fit)
+
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, resized, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&out, resized)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode image: %v", err)
+	}
+	return out.Bytes(), VariantType("image/" + format), nil
+}
+
+// VariantType returns the MIME type of the variants of images of a MIME type
+func VariantType(mimeType string) string {
+	if mimeType == "image/jpeg" {
+		return mimeType
+	}
+	return "image/png"
+}
+
+// Resize scales an image into a box of width by height pixels. With FitContain the result fits inside
+// the box and is never larger than the source; a zero dimension is unconstrained. With FitCover it
+// fills the box exactly, cropping the source around its center.
+func Resize(src image.Image, width int, height int, fit string) image.Image {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if sw == 0 || sh == 0 {
+		return src
+	}
+
+	crop := bounds
+	var dw, dh int
+	if fit == FitCover {
+		dw, dh = width, height
+		// Crop the source to the aspect ratio of the box
+		if sw*height > sh*width {
+			cw := sh * width / height
+			crop.Min.X += (sw - cw) / 2
+			crop.Max.X = crop.Min.X + cw
+		} else {
+			ch := sw * height / width
+			crop.Min.Y += (sh - ch) / 2
+			crop.Max.Y = crop.Min.Y + ch
+		}
+	} else {
+		scale := 1.0
+		if width > 0 && float64(width)/float64(sw) < scale {
+			scale = float64(width) / float64(sw)
+		}
+		if height > 0 && float64(height)/float64(sh) < scale {
+			scale = float64(height) / float64(sh)
+		}
+		dw, dh = max(1, int(float64(sw)*scale+0.5)), max(1, int(float64(sh)*scale+0.5))
+	}
+
+	return resample(toRGBA(src), crop, dw, dh)
+}
+
+// toRGBA converts an image to RGBA pixels that can be read directly
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(src.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// resample scales a rectangle of an image to width by height pixels with a box filter: every
+// destination pixel averages the source pixels it covers, or takes the nearest one when enlarging
+func resample(src *image.RGBA, rect image.Rectangle, width int, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	rw, rh := rect.Dx(), rect.Dy()
+
+	for y := 0; y < height; y++ {
+		y0 := rect.Min.Y + y*rh/height
+		y1 := max(y0+1, rect.Min.Y+(y+1)*rh/height)
+		for x := 0; x < width; x++ {
+			x0 := rect.Min.X + x*rw/width
+			x1 := max(x0+1, rect.Min.X+(x+1)*rw/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[offset])
+					g += uint64(src.Pix[offset+1])
+					b += uint64(src.Pix[offset+2])
+					a += uint64(src.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,38 @@
+// Package fakes provides in-memory stand-ins for the stores authentication reads, shared by the tests
+// of the auth middleware and the routes.
+package fakes
+
+import (
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+)
+
+// APIKeys authenticates the keys it holds
+type APIKeys struct {
+	repository.APIKeyStore
+	Keys map[string]*models.APIKey
+}
+
+func (f *APIKeys) AuthenticateAPIKey(key string) (*models.APIKey, error) {
+	return f.Keys[key], nil
+}
+
+// Roles binds principals to roles given by name with their grants. Principals also hold the roles
+// they claim.
+type Roles struct {
+	repository.RoleStore
+	Grants  map[string][]models.Grant
+	Members map[string][]string
+}
+
+func (f *Roles) GetRoleNamesForPrincipal(principalID string, claimed []string) ([]string, error) {
+	return append(append([]string{}, f.Members[principalID]...), claimed...), nil
+}
+
+func (f *Roles) GetGrantsForPrincipal(principalID string, roleNames []string) ([]models.Grant, error) {
+	grants := []models.Grant{}
+	for _, name := range append(f.Members[principalID], roleNames...) {
+		grants = append(grants, f.Grants[name]...)
+	}
+	return grants, nil
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"dynamic-table-backend/database"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
 	"dynamic-table-backend/routes"
+	"dynamic-table-backend/storage"
+	"dynamic-table-backend/stream"
+	"dynamic-table-backend/webhook"
 
 	"github.com/joho/godotenv"
 )
@@ -16,13 +25,77 @@ func main() {
 		log.Println("No .env file found, using system environment variables")
 	}
 
-	// Initialize database
-	if err := database.InitDB(); err != nil {
-		log.Fatal("Failed to initialize database:", err)
+	// "migrate [status | up [version] | down [steps] [--drop-data]]" manages the database migrations without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := database.Connect(); err != nil {
+			log.Fatal("Failed to connect to database:", err)
+		}
+		runMigrateCommand(database.NewMigrator(database.DB, database.Driver), os.Args[2:])
+		return
+	}
+
+	// STORAGE=memory keeps schemas, records and row policies in memory instead of the database
+	var stores *repository.Stores
+	switch backend := os.Getenv("STORAGE"); backend {
+	case "", "database":
+		if err := database.InitDB(); err != nil {
+			log.Fatal("Failed to initialize database:", err)
+		}
+		if database.Driver == database.SQLite {
+			stores = repository.NewSQLiteStores(database.DB)
+		} else {
+			stores = repository.NewStores(database.DB)
+		}
+	case "memory":
+		log.Println("Using in-memory storage, data is lost on restart")
+		stores = repository.NewMemoryStores()
+	default:
+		log.Fatalf("Unknown STORAGE %q", backend)
+	}
+
+	// "apikey create [--role <role>] [--tenant <tenant>] <name>" issues a key from the command line, e.g. to bootstrap access
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		if stores.APIKeys == nil {
+			log.Fatal("API keys require a database")
+		}
+		runAPIKeyCommand(stores, os.Args[2:])
+		return
+	}
+
+	// Uploaded files are kept in the blob store selected by BLOB_STORE
+	blobStore, err := storage.NewBlobStore()
+	if err != nil {
+		log.Fatal("Failed to open blob store:", err)
+	}
+
+	// Changes are streamed as the database notifies of them; SQLite has no notifications, so its log is polled
+	var hub *stream.Hub
+	if stores.Changes != nil {
+		hub = stream.NewHub(stores.Changes, database.ConnStr)
+		if database.ConnStr == "" {
+			hub.PollInterval = time.Second
+		}
 	}
 
 	// Setup routes
-	r := routes.SetupRoutes()
+	r, err := routes.SetupRoutes(stores, blobStore, hub)
+	if err != nil {
+		log.Fatal("Failed to setup routes:", err)
+	}
+
+	// Purge the trash, delete unreferenced files, materialize tables and deliver webhooks in the background
+	if stores.Trash != nil {
+		startTrashPurge(stores.Trash)
+	}
+	if stores.Storage != nil {
+		startMaterializer(stores.Storage)
+	}
+	if stores.Files != nil {
+		startFileCleanup(stores.Files, blobStore)
+	}
+	if stores.Webhooks != nil {
+		webhook.NewDispatcher(stores.Webhooks).Start()
+	}
 
 	// Get port from environment
 	port := os.Getenv("PORT")
@@ -35,3 +108,220 @@ func main() {
 		log.Fatal("Failed to start server:", err)
 	}
 }
+
+// runAPIKeyCommand handles the apikey subcommand; --role binds the new key to a role and --tenant to a tenant
+func runAPIKeyCommand(stores *repository.Stores, args []string) {
+	const usage = "Usage: apikey create [--role <role>] [--tenant <tenant>] <name>"
+	if len(args) < 2 || args[0] != "create" {
+		log.Fatal(usage)
+	}
+	args = args[1:]
+
+	var roleName, tenant string
+	for len(args) > 0 && (args[0] == "--role" || args[0] == "--tenant") {
+		if len(args) < 3 {
+			log.Fatal(usage)
+		}
+		if args[0] == "--role" {
+			roleName = args[1]
+		} else {
+			tenant = args[1]
+		}
+		args = args[2:]
+	}
+	if tenant != "" && !models.ValidTenant(tenant) {
+		log.Fatalf("Invalid tenant %s", tenant)
+	}
+
+	roleRepo := stores.Roles
+	var role *models.Role
+	if roleName != "" {
+		var err error
+		role, err = roleRepo.GetRoleByName(roleName)
+		if err != nil {
+			log.Fatal("Failed to look up role:", err)
+		}
+		if role == nil {
+			log.Fatalf("Role %s not found", roleName)
+		}
+	}
+
+	apiKey, key, err := stores.APIKeys.CreateAPIKey(strings.Join(args, " "), tenant)
+	if err != nil {
+		log.Fatal("Failed to create API key:", err)
+	}
+
+	if role != nil {
+		if err := roleRepo.AddMember(role.ID, apiKey.ID); err != nil {
+			log.Fatal("Failed to bind API key to role:", err)
+		}
+	}
+
+	fmt.Printf("Created API key %s (%s)\n%s\n", apiKey.Name, apiKey.ID, key)
+}
+
+// runMigrateCommand handles the migrate subcommand. "up" applies the pending migrations, up to version if given,
+// "down" reverts the latest steps (default 1) applied ones, and "status" lists them all. Reverting the first
+// migration drops all data and requires --drop-data.
+func runMigrateCommand(migrator *database.Migrator, args []string) {
+	const usage = "Usage: migrate [status | up [version] | down [steps] [--drop-data]]"
+	dropData := false
+	if len(args) > 0 && args[len(args)-1] == "--drop-data" {
+		dropData = true
+		args = args[:len(args)-1]
+	}
+	if len(args) > 2 || (dropData && (len(args) == 0 || args[0] != "down")) {
+		log.Fatal(usage)
+	}
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	number := 0
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			log.Fatal(usage)
+		}
+		number = n
+	}
+
+	switch command {
+	case "status":
+		if len(args) > 1 {
+			log.Fatal(usage)
+		}
+		statuses, err := migrator.MigrationStatuses()
+		if err != nil {
+			log.Fatal("Failed to get migrations:", err)
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			if !status.Known {
+				state += ", unknown to this binary"
+			}
+			fmt.Printf("%04d %-30s %s\n", status.Version, status.Name, state)
+		}
+	case "up":
+		applied, err := migrator.MigrateUp(number)
+		if err != nil {
+			log.Fatal("Failed to migrate database:", err)
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+	case "down":
+		if number == 0 {
+			number = 1
+		}
+		reverted, err := migrator.MigrateDown(number, dropData)
+		if err != nil {
+			log.Fatal("Failed to migrate database:", err)
+		}
+		fmt.Printf("Reverted %d migrations\n", reverted)
+	default:
+		log.Fatal(usage)
+	}
+}
+
+// startTrashPurge periodically deletes schemas and records that have been in the trash longer than
+// TRASH_RETENTION (default 720h), checking every TRASH_PURGE_INTERVAL (default 1h). A retention of 0 keeps them forever.
+func startTrashPurge(trashRepo repository.TrashStore) {
+	retention := durationEnv("TRASH_RETENTION", 720*time.Hour)
+	interval := durationEnv("TRASH_PURGE_INTERVAL", time.Hour)
+	if retention == 0 {
+		log.Println("Trash purge disabled")
+		return
+	}
+	if interval <= 0 {
+		log.Fatal("TRASH_PURGE_INTERVAL must be positive")
+	}
+
+	go func() {
+		for {
+			schemas, contents, err := trashRepo.PurgeTrash(retention)
+			if err != nil {
+				log.Println("Failed to purge trash:", err)
+			} else if schemas > 0 || contents > 0 {
+				log.Printf("Purged %d schemas and %d records from the trash", schemas, contents)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// startMaterializer periodically copies the records of tables switching to materialized storage into their
+// typed tables, checking every MATERIALIZE_INTERVAL (default 10s). An interrupted copy resumes on the next check.
+func startMaterializer(storageRepo *repository.StorageRepository) {
+	interval := durationEnv("MATERIALIZE_INTERVAL", 10*time.Second)
+	if interval <= 0 {
+		log.Fatal("MATERIALIZE_INTERVAL must be positive")
+	}
+	go func() {
+		for {
+			tables, err := storageRepo.MaterializePending(1000)
+			if err != nil {
+				log.Println("Failed to materialize tables:", err)
+			}
+			if tables > 0 {
+				log.Printf("Materialized %d tables", tables)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// startFileCleanup periodically deletes the blobs of files no record, field or revision refers to anymore,
+// checking every FILE_CLEANUP_INTERVAL (default 1h). Files are kept for an hour after their upload.
+func startFileCleanup(fileRepo repository.FileStore, store storage.BlobStore) {
+	interval := durationEnv("FILE_CLEANUP_INTERVAL", time.Hour)
+	if interval <= 0 {
+		log.Fatal("FILE_CLEANUP_INTERVAL must be positive")
+	}
+	go func() {
+		for {
+			files, err := fileRepo.GetUnreferencedFiles(time.Hour, 500)
+			if err != nil {
+				log.Println("Failed to find unreferenced files:", err)
+			}
+			deleted := 0
+			for _, file := range files {
+				// The blobs go first, so that a failure leaves the file to be retried
+				keys := append(file.Variants, file.Key())
+				var err error
+				for _, key := range keys {
+					if err = store.Delete(key); err != nil {
+						break
+					}
+				}
+				if err != nil {
+					log.Printf("Failed to delete blobs of file %s: %v", file.ID, err)
+					continue
+				}
+				if err := fileRepo.DeleteFile(file.ID); err != nil {
+					log.Printf("Failed to delete file %s: %v", file.ID, err)
+					continue
+				}
+				deleted++
+			}
+			if deleted > 0 {
+				log.Printf("Deleted %d unreferenced files", deleted)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// durationEnv reads a duration such as "72h" from the environment
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		log.Fatalf("Invalid %s %q", name, value)
+	}
+	return duration
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"regexp"
 	"time"
 )
 
@@ -13,8 +14,22 @@ type Schema struct {
 	Fields    []Field   `json:"fields" db:"fields"`
 	CreatedAt time.Time `json:"createdAt" db:"created_at"`
 	UpdatedAt time.Time `json:"updatedAt" db:"updated_at"`
+	// DeletedAt is set on schemas in the trash
+	DeletedAt *time.Time `json:"deletedAt,omitempty" db:"deleted_at"`
+	// Storage is how PostgreSQL keeps the table's records, see StorageJSONB
+	Storage string `json:"storage,omitempty" db:"storage"`
 }
 
+// Storage modes of a table. Records always live as JSONB in the contents table; materialized tables
+// also keep their values in a typed PostgreSQL table of their own, whose columns enforce the types and
+// rules of their fields, and which queries read.
+// Tables switching to materialized storage are materializing until their records have been copied.
+const (
+	StorageJSONB         = "jsonb"
+	StorageMaterializing = "materializing"
+	StorageMaterialized  = "materialized"
+)
+
 // Field represents a dynamic form field
 type Field struct {
 	Name           string   `json:"name"`
@@ -25,6 +40,17 @@ type Field struct {
 	Options        []string `json:"options,omitempty"`
 	// New relational field properties
 	RelationConfig *RelationConfig `json:"relationConfig,omitempty"`
+	// Formula field properties
+	Formula      string `json:"formula,omitempty"`      // Expression over other fields, e.g. "price * quantity"
+	StoreFormula bool   `json:"storeFormula,omitempty"` // Store the value on write instead of evaluating on read
+	FormulaType  string `json:"formulaType,omitempty"`  // Result type inferred when the schema is saved
+	// Lookup and rollup field properties
+	LinkConfig *LinkConfig `json:"linkConfig,omitempty"`
+	// File field properties
+	FileConfig *FileConfig `json:"fileConfig,omitempty"`
+	// Field-level access; empty lists allow everyone with access to the table
+	ReadRoles  []string `json:"readRoles,omitempty"`  // Roles that may read the field's values
+	WriteRoles []string `json:"writeRoles,omitempty"` // Roles that may set the field's values
 }
 
 // RelationConfig represents configuration for relational fields
@@ -36,6 +62,34 @@ type RelationConfig struct {
 	AllowMultiple bool   `json:"allowMultiple"` // For one-to-many and many-to-many
 }
 
+// LinkConfig represents how lookup and rollup fields reach their linked rows
+type LinkConfig struct {
+	RelationField string `json:"relationField"`          // Relation field linking the rows
+	Reverse       bool   `json:"reverse,omitempty"`      // Follow a relation field of RelatedTable that points at this table
+	RelatedTable  string `json:"relatedTable,omitempty"` // Table holding RelationField when Reverse is set
+	TargetField   string `json:"targetField,omitempty"`  // Field read from the linked rows
+	Aggregate     string `json:"aggregate,omitempty"`    // Rollup function: "count", "countDistinct", "sum", "avg", "min", "max"
+	ResultType    string `json:"resultType,omitempty"`   // Value type inferred when the schema is saved
+}
+
+// FileConfig limits the files of a file field and declares the image variants generated from them
+type FileConfig struct {
+	MaxSize   int64          `json:"maxSize,omitempty"`   // Largest accepted file in bytes
+	MimeTypes []string       `json:"mimeTypes,omitempty"` // Accepted MIME types, e.g. "application/pdf" or "image/*"
+	MaxWidth  int            `json:"maxWidth,omitempty"`  // Largest accepted image width in pixels
+	MaxHeight int            `json:"maxHeight,omitempty"` // Largest accepted image height in pixels
+	Variants  []ImageVariant `json:"variants,omitempty"`  // Resized copies of uploaded images
+}
+
+// ImageVariant represents a resized copy of the images uploaded to a file field
+type ImageVariant struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width,omitempty"`  // Width of the bounding box; 0 leaves it unconstrained when containing
+	Height int    `json:"height,omitempty"` // Height of the bounding box; 0 leaves it unconstrained when containing
+	Fit    string `json:"fit,omitempty"`    // "contain" (default) scales down to fit inside, "cover" fills and crops
+	Eager  bool   `json:"eager,omitempty"`  // Generate on upload instead of on the first request
+}
+
 // Content represents a table record
 type Content struct {
 	ID        string                 `json:"id" db:"id"`
@@ -43,6 +97,8 @@ type Content struct {
 	Values    map[string]interface{} `json:"values" db:"values"`
 	CreatedAt time.Time              `json:"createdAt" db:"created_at"`
 	UpdatedAt time.Time              `json:"updatedAt" db:"updated_at"`
+	// DeletedAt is set on records in the trash
+	DeletedAt *time.Time `json:"deletedAt,omitempty" db:"deleted_at"`
 }
 
 // CreateSchemaRequest represents the request to create a new table schema
@@ -50,6 +106,12 @@ type CreateSchemaRequest struct {
 	TableName string  `json:"tableName" binding:"required"`
 	TableSlug string  `json:"tableSlug" binding:"required"`
 	Fields    []Field `json:"fields" binding:"required"`
+	Storage   string  `json:"storage,omitempty"` // StorageJSONB (default) or StorageMaterialized
+}
+
+// SetStorageRequest represents the request to switch a table between JSONB and materialized storage
+type SetStorageRequest struct {
+	Storage string `json:"storage" binding:"required"`
 }
 
 // UpdateSchemaRequest represents the request to update a table schema
@@ -76,6 +138,31 @@ type ContentQueryParams struct {
 	SortDir  string            `form:"sortDir"` // "asc" or "desc"
 	Page     int               `form:"page"`
 	PageSize int               `form:"pageSize"`
+	// Structured filtering, sorting and offsets used by the query protocols (OData, GraphQL)
+	Filter *FilterExpr  `form:"-"`
+	Sorts  []SortOption `form:"-"`
+	Skip   int          `form:"-"` // overrides the page-derived offset when positive
+	// Fields projects the returned values; "relation.field" paths expand only the named relations
+	Fields []string `form:"-"`
+	// Principal limits relation expansion to the tables the caller can read; nil allows every table
+	Principal *Principal `form:"-"`
+	// Trashed lists the deleted records in the trash instead of the live ones
+	Trashed bool `form:"-"`
+}
+
+// FilterExpr represents a boolean filter expression over record fields
+type FilterExpr struct {
+	Op     string        // "and", "or", "not", "eq", "ne", "gt", "ge", "lt", "le", "contains", "startswith", "endswith", "in"
+	Field  string        // Field name for comparison operators
+	Value  interface{}   // Comparison value, nil compares against null
+	Values []interface{} // Candidate values for "in"
+	Args   []*FilterExpr // Operands for "and", "or" and "not"
+}
+
+// SortOption represents a single sort key
+type SortOption struct {
+	Field string
+	Desc  bool
 }
 
 // ContentResponse represents the paginated content response
@@ -87,6 +174,261 @@ type ContentResponse struct {
 	TotalPages int        `json:"totalPages"`
 }
 
+// AggregateMetric represents an aggregate function applied to a field
+type AggregateMetric struct {
+	Func  string // "count", "sum", "avg", "min", "max", "countDistinct"
+	Field string // Empty for count
+}
+
+// Key returns the name the metric is reported under
+func (m AggregateMetric) Key() string {
+	if m.Field == "" {
+		return m.Func
+	}
+	return m.Func + "_" + m.Field
+}
+
+// AggregateGroup represents a group-by key, optionally bucketed by date
+type AggregateGroup struct {
+	Field  string
+	Bucket string // "", "day", "week", "month" or "year" for date fields
+}
+
+// AggregateRequest represents the metrics and grouping of an aggregate query
+type AggregateRequest struct {
+	Metrics []AggregateMetric
+	GroupBy []AggregateGroup
+}
+
+// AggregateRow represents the metrics computed for one group
+type AggregateRow struct {
+	Key     map[string]interface{} `json:"key"`
+	Metrics map[string]interface{} `json:"metrics"`
+}
+
+// AggregateResponse represents the result of an aggregate query
+type AggregateResponse struct {
+	Groups []AggregateRow `json:"groups"`
+}
+
+// Principal identifies the authenticated caller of a request
+type Principal struct {
+	ID     string                 `json:"id"`     // API key ID or JWT subject
+	Name   string                 `json:"name"`   // API key name or the token's display name
+	Method string                 `json:"method"` // "apikey" or "jwt"
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	Roles  []string               `json:"roles"`  // Names of the roles bound to the principal or claimed by its token
+	Grants []Grant                `json:"grants"` // Permissions granted through the principal's roles
+	Tenant string                 `json:"tenant"` // Tenant the request operates in
+	// Set when the API key or token fixes the tenant; other principals choose it with the X-Tenant header
+	TenantBound bool `json:"tenantBound"`
+}
+
+// DefaultTenant holds the schemas of requests that name no tenant, and every schema created before tenants existed
+const DefaultTenant = "default"
+
+// tenantPattern restricts tenant names to lowercase slugs
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ValidTenant reports whether a tenant name is well formed
+func ValidTenant(tenant string) bool {
+	return tenantPattern.MatchString(tenant)
+}
+
+// Permissions that can be granted to a role
+const (
+	PermissionAdmin         = "admin" // Every permission, plus managing roles and API keys
+	PermissionSchemaWrite   = "schema:write"
+	PermissionContentRead   = "content:read"
+	PermissionContentCreate = "content:create"
+	PermissionContentUpdate = "content:update"
+	PermissionContentDelete = "content:delete"
+)
+
+// Permissions lists every permission that can be granted
+var Permissions = []string{
+	PermissionAdmin,
+	PermissionSchemaWrite,
+	PermissionContentRead,
+	PermissionContentCreate,
+	PermissionContentUpdate,
+	PermissionContentDelete,
+}
+
+// Can reports whether the principal holds a permission for a table
+func (p *Principal) Can(permission string, tableSlug string) bool {
+	if p == nil {
+		return false
+	}
+	for _, grant := range p.Grants {
+		if grant.Permission == PermissionAdmin {
+			return true
+		}
+		if grant.Permission == permission && (grant.TableSlug == "" || grant.TableSlug == tableSlug) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanReadSchema reports whether the principal may see a table's schema
+func (p *Principal) CanReadSchema(tableSlug string) bool {
+	return p.Can(PermissionContentRead, tableSlug) || p.Can(PermissionSchemaWrite, tableSlug)
+}
+
+// CanReadField reports whether the principal may see a field's values
+func (p *Principal) CanReadField(field Field) bool {
+	return p.hasAnyRole(field.ReadRoles)
+}
+
+// CanWriteField reports whether the principal may set a field's values
+func (p *Principal) CanWriteField(field Field) bool {
+	return p.hasAnyRole(field.WriteRoles)
+}
+
+// hasAnyRole reports whether the principal holds one of the roles; an empty list allows everyone
+// and administrators hold every role
+func (p *Principal) hasAnyRole(roles []string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	if p.Can(PermissionAdmin, "") {
+		return true
+	}
+	for _, role := range roles {
+		for _, held := range p.Roles {
+			if role == held {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Role represents a named set of grants bound to principals
+type Role struct {
+	ID          string    `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	Grants      []Grant   `json:"grants"`
+	Members     []string  `json:"members"` // Principal IDs bound to the role
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+}
+
+// Grant gives a role a permission on one table, or on every table when TableSlug is empty
+type Grant struct {
+	ID         string `json:"id" db:"id"`
+	RoleID     string `json:"roleId" db:"role_id"`
+	Permission string `json:"permission" db:"permission"`
+	TableSlug  string `json:"tableSlug,omitempty" db:"table_slug"`
+}
+
+// CreateRoleRequest represents the request to create a role
+type CreateRoleRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+// CreateGrantRequest represents the request to add a grant to a role
+type CreateGrantRequest struct {
+	Permission string `json:"permission" binding:"required"`
+	TableSlug  string `json:"tableSlug"`
+}
+
+// RoleMemberRequest represents the request to bind a principal to a role
+type RoleMemberRequest struct {
+	PrincipalID string `json:"principalId" binding:"required"`
+}
+
+// RowPolicy restricts the rows of a table that principals without the admin permission can see and change
+type RowPolicy struct {
+	TableSlug  string    `json:"tableSlug" db:"table_slug"`
+	Expression string    `json:"expression" db:"expression"`
+	CreatedAt  time.Time `json:"createdAt" db:"created_at"`
+	UpdatedAt  time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+// SetRowPolicyRequest represents the request to set a table's row policy
+type SetRowPolicyRequest struct {
+	Expression string `json:"expression" binding:"required"`
+}
+
+// Audit actions
+const (
+	AuditSchemaCreate   = "schema.create"
+	AuditSchemaUpdate   = "schema.update"
+	AuditSchemaDelete   = "schema.delete"
+	AuditSchemaRestore  = "schema.restore"
+	AuditContentCreate  = "content.create"
+	AuditContentUpdate  = "content.update"
+	AuditContentDelete  = "content.delete"
+	AuditContentRestore = "content.restore"
+)
+
+// AuditEntry records who changed a schema or record, when, and how
+type AuditEntry struct {
+	ID        int64                  `json:"id" db:"id"`
+	ActorID   string                 `json:"actorId" db:"actor_id"`     // Principal ID, "system" for internal changes
+	ActorName string                 `json:"actorName" db:"actor_name"` // Principal name at the time of the change
+	Action    string                 `json:"action" db:"action"`
+	TableSlug string                 `json:"tableSlug" db:"table_slug"`
+	RecordID  string                 `json:"recordId,omitempty" db:"record_id"` // Empty for schema changes
+	Changes   map[string]FieldChange `json:"changes" db:"changes"`
+	CreatedAt time.Time              `json:"createdAt" db:"created_at"`
+}
+
+// FieldChange holds the values of a field or schema property before and after a change; null when absent
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditQueryParams filters the audit log
+type AuditQueryParams struct {
+	TableSlug string
+	RecordID  string
+	ActorID   string
+	From      *time.Time
+	To        *time.Time
+	Page      int
+	PageSize  int
+}
+
+// AuditResponse represents a page of audit entries, newest first
+type AuditResponse struct {
+	Entries    []*AuditEntry `json:"entries"`
+	Total      int           `json:"total"`
+	Page       int           `json:"page"`
+	PageSize   int           `json:"pageSize"`
+	TotalPages int           `json:"totalPages"`
+}
+
+// APIKey represents an issued API key; only a hash of the secret is stored
+type APIKey struct {
+	ID         string     `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`           // First characters of the secret, to recognise a key
+	Tenant     string     `json:"tenant,omitempty" db:"tenant"` // Tenant the key is bound to, empty for keys that may use any tenant
+	CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" db:"last_used_at"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" db:"revoked_at"`
+}
+
+// CreateAPIKeyRequest represents the request to issue a new API key
+type CreateAPIKeyRequest struct {
+	Name   string `json:"name" binding:"required"`
+	Tenant string `json:"tenant"`
+}
+
+// CreateAPIKeyResponse returns a newly issued key together with its secret, which is shown only once
+type CreateAPIKeyResponse struct {
+	*APIKey
+	Key string `json:"key"`
+}
+
 // SchemaScan is used for scanning database results
 type SchemaScan struct {
 	ID        string          `db:"id"`
@@ -95,6 +437,23 @@ type SchemaScan struct {
 	Fields    json.RawMessage `db:"fields"`
 	CreatedAt time.Time       `db:"created_at"`
 	UpdatedAt time.Time       `db:"updated_at"`
+	Storage   string          `db:"storage"`
+}
+
+// Revision is a version of a record's values. Every update keeps the values it replaces
+// as a new revision; the record's current values are the latest revision.
+type Revision struct {
+	Revision  int                    `json:"revision"`
+	Values    map[string]interface{} `json:"values"`
+	CreatedAt time.Time              `json:"createdAt"`
+	Current   bool                   `json:"current"`
+}
+
+// RevisionDiff lists the fields that differ between two revisions of a record
+type RevisionDiff struct {
+	From    int                    `json:"from"`
+	To      int                    `json:"to"`
+	Changes map[string]FieldChange `json:"changes"`
 }
 
 // ContentScan is used for scanning database results
@@ -104,4 +463,137 @@ type ContentScan struct {
 	Values    json.RawMessage `db:"values"`
 	CreatedAt time.Time       `db:"created_at"`
 	UpdatedAt time.Time       `db:"updated_at"`
+	DeletedAt *time.Time      `db:"deleted_at"`
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// WebhookPing is the event of the test deliveries sent on request
+const WebhookPing = "ping"
+
+// Webhook subscribes a URL to events of a table. Events are audit actions such as content.create.
+type Webhook struct {
+	ID        string    `json:"id" db:"id"`
+	TableSlug string    `json:"tableSlug" db:"table_slug"`
+	URL       string    `json:"url" db:"url"`
+	Events    []string  `json:"events" db:"events"`
+	Filter    string    `json:"filter,omitempty" db:"filter"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	// Secret signs the deliveries; it is only returned when the webhook is created
+	Secret string `json:"secret,omitempty" db:"secret"`
+}
+
+// CreateWebhookRequest represents the request to subscribe to events of a table
+type CreateWebhookRequest struct {
+	TableSlug string   `json:"tableSlug" binding:"required"`
+	URL       string   `json:"url" binding:"required"`
+	Events    []string `json:"events" binding:"required"`
+	Filter    string   `json:"filter"`
+}
+
+// WebhookEvent is the JSON body posted to a webhook
+type WebhookEvent struct {
+	Event      string          `json:"event"`
+	Tenant     string          `json:"tenant"`
+	TableSlug  string          `json:"tableSlug"`
+	RecordID   string          `json:"recordId,omitempty"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	OccurredAt time.Time       `json:"occurredAt"`
+}
+
+// WebhookDelivery is an event queued in the outbox for one webhook, with the log of its attempts
+type WebhookDelivery struct {
+	ID            int64             `json:"id" db:"id"`
+	WebhookID     string            `json:"webhookId" db:"webhook_id"`
+	Event         string            `json:"event" db:"event"`
+	Payload       json.RawMessage   `json:"payload" db:"payload"`
+	Status        string            `json:"status" db:"status"`
+	Attempts      int               `json:"attempts" db:"attempts"`
+	NextAttemptAt *time.Time        `json:"nextAttemptAt,omitempty" db:"next_attempt_at"`
+	LastError     string            `json:"lastError,omitempty" db:"last_error"`
+	CreatedAt     time.Time         `json:"createdAt" db:"created_at"`
+	DeliveredAt   *time.Time        `json:"deliveredAt,omitempty" db:"delivered_at"`
+	AttemptLog    []*WebhookAttempt `json:"attemptLog,omitempty"`
+	// URL and Secret of the webhook, loaded for dispatching
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookAttempt records one try to deliver an event
+type WebhookAttempt struct {
+	Attempt    int       `json:"attempt" db:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty" db:"status_code"`
+	Error      string    `json:"error,omitempty" db:"error"`
+	DurationMs int64     `json:"durationMs" db:"duration_ms"`
+	CreatedAt  time.Time `json:"createdAt" db:"created_at"`
+}
+
+// WebhookDeliveryResponse represents a page of webhook deliveries
+type WebhookDeliveryResponse struct {
+	Deliveries []*WebhookDelivery `json:"deliveries"`
+	Total      int                `json:"total"`
+	Page       int                `json:"page"`
+	PageSize   int                `json:"pageSize"`
+	TotalPages int                `json:"totalPages"`
+}
+
+// ChangeEvent is a committed change of a schema or record, as streamed to subscribers and read from
+// the change feed. Values hold the record, or the schema's tableName and fields, after the change, or
+// before it for deletes. RecordID is empty for schema events.
+type ChangeEvent struct {
+	ID        int64                  `json:"id" db:"id"`
+	Tenant    string                 `json:"-" db:"tenant"`
+	TableSlug string                 `json:"tableSlug" db:"table_slug"`
+	RecordID  string                 `json:"recordId" db:"record_id"`
+	Event     string                 `json:"event" db:"event"`
+	Values    map[string]interface{} `json:"values" db:"values"`
+	CreatedAt time.Time              `json:"createdAt" db:"created_at"`
+}
+
+// ChangeFeedResponse is a page of the change log. Next is the ID to pass as since for the following page.
+type ChangeFeedResponse struct {
+	Changes []*ChangeEvent `json:"changes"`
+	Next    int64          `json:"next"`
+	HasMore bool           `json:"hasMore"`
+}
+
+// FileDataType is the data type of fields holding an uploaded file
+const FileDataType = "file"
+
+// File is an uploaded file of a record's file field. Its blob is stored under Key.
+type File struct {
+	ID        string    `json:"id" db:"id"`
+	Tenant    string    `json:"-" db:"tenant"`
+	TableSlug string    `json:"-" db:"table_slug"`
+	ContentID string    `json:"-" db:"content_id"`
+	FieldName string    `json:"-" db:"field_name"`
+	Name      string    `json:"name" db:"name"`
+	Size      int64     `json:"size" db:"size"`
+	MimeType  string    `json:"mimeType" db:"mime_type"`
+	Checksum  string    `json:"checksum" db:"checksum"`
+	CreatedAt time.Time `json:"-" db:"created_at"`
+	// Variants are the blob keys of the image variants generated from the file
+	Variants []string `json:"-" db:"variants"`
+}
+
+// Key returns the blob key of the file
+func (f *File) Key() string {
+	return f.Tenant + "/" + f.ID
+}
+
+// Value returns the metadata stored in the values of the file's record
+func (f *File) Value() map[string]interface{} {
+	return map[string]interface{}{
+		"id":       f.ID,
+		"name":     f.Name,
+		"size":     float64(f.Size),
+		"mimeType": f.MimeType,
+		"checksum": f.Checksum,
+	}
 }
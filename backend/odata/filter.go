@@ -0,0 +1,389 @@
+package odata
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"dynamic-table-backend/models"
+)
+
+// token kinds produced by the $filter lexer
+const (
+	tokenIdent = iota
+	tokenString
+	tokenNumber
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenEOF
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+// comparisonOps maps OData comparison operators to filter operators
+var comparisonOps = map[string]string{
+	"eq": "eq",
+	"ne": "ne",
+	"gt": "gt",
+	"ge": "ge",
+	"lt": "lt",
+	"le": "le",
+}
+
+// flippedOps mirrors comparison operators when the literal is on the left side
+var flippedOps = map[string]string{
+	"eq": "eq",
+	"ne": "ne",
+	"gt": "lt",
+	"ge": "le",
+	"lt": "gt",
+	"le": "ge",
+}
+
+// stringFunctions are the supported boolean string functions
+var stringFunctions = map[string]bool{
+	"contains":   true,
+	"startswith": true,
+	"endswith":   true,
+}
+
+// literal is a parsed constant operand
+type literal struct {
+	value interface{}
+}
+
+// filterParser is a recursive descent parser for the OData $filter grammar subset
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+// ParseFilter parses an OData $filter expression into a filter expression tree
+func ParseFilter(input string) (*models.FilterExpr, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected '%s' in $filter", p.peek().text)
+	}
+	return expr, nil
+}
+
+// ParseOrderBy parses an OData $orderby list
+func ParseOrderBy(input string) ([]models.SortOption, error) {
+	var sorts []models.SortOption
+	for _, item := range strings.Split(input, ",") {
+		parts := strings.Fields(item)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, fmt.Errorf("invalid $orderby item '%s'", strings.TrimSpace(item))
+		}
+
+		sort := models.SortOption{Field: parts[0]}
+		if len(parts) == 2 {
+			switch strings.ToLower(parts[1]) {
+			case "asc":
+			case "desc":
+				sort.Desc = true
+			default:
+				return nil, fmt.Errorf("invalid $orderby direction '%s'", parts[1])
+			}
+		}
+		sorts = append(sorts, sort)
+	}
+	return sorts, nil
+}
+
+// tokenize splits a $filter expression into tokens
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")"})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ","})
+			i++
+		case r == '\'':
+			// Strings are single quoted, with '' escaping a quote
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string in $filter")
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						b.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenString, text: b.String()})
+		case r == '-' || unicode.IsDigit(r):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune(".eE+-:TZ", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i])})
+		case unicode.IsLetter(r) || r == '_' || r == '$':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '/' || runes[i] == '$') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i])})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' in $filter", r)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) expect(kind int, what string) error {
+	if p.next().kind != kind {
+		return fmt.Errorf("expected %s in $filter", what)
+	}
+	return nil
+}
+
+// isKeyword reports whether the next token is the given case-insensitive keyword
+func (p *filterParser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (p *filterParser) parseOr() (*models.FilterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &models.FilterExpr{Op: "or", Args: []*models.FilterExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (*models.FilterExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &models.FilterExpr{Op: "and", Args: []*models.FilterExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (*models.FilterExpr, error) {
+	if p.isKeyword("not") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &models.FilterExpr{Op: "not", Args: []*models.FilterExpr{operand}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (*models.FilterExpr, error) {
+	t := p.peek()
+
+	// Parenthesized boolean expression
+	if t.kind == tokenLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+
+	// Boolean string functions
+	if t.kind == tokenIdent && stringFunctions[strings.ToLower(t.text)] {
+		p.next()
+		return p.parseFunction(strings.ToLower(t.text))
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := strings.ToLower(p.peek().text)
+	if p.peek().kind != tokenIdent {
+		return nil, fmt.Errorf("expected operator in $filter")
+	}
+	p.next()
+
+	if op == "in" {
+		field, ok := left.(string)
+		if !ok {
+			return nil, fmt.Errorf("left side of 'in' must be a property")
+		}
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return &models.FilterExpr{Op: "in", Field: field, Values: values}, nil
+	}
+
+	if _, ok := comparisonOps[op]; !ok {
+		return nil, fmt.Errorf("unsupported operator '%s' in $filter", op)
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	// Normalize to property op literal
+	field, fieldLeft := left.(string)
+	lit, litRight := right.(literal)
+	if !fieldLeft || !litRight {
+		field, fieldLeft = right.(string)
+		lit, litRight = left.(literal)
+		if !fieldLeft || !litRight {
+			return nil, fmt.Errorf("comparisons must be between a property and a literal")
+		}
+		op = flippedOps[op]
+	}
+
+	return &models.FilterExpr{Op: comparisonOps[op], Field: field, Value: lit.value}, nil
+}
+
+// parseFunction parses the arguments of contains, startswith and endswith
+func (p *filterParser) parseFunction(name string) (*models.FilterExpr, error) {
+	if err := p.expect(tokenLParen, "'('"); err != nil {
+		return nil, err
+	}
+	first, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenComma, "','"); err != nil {
+		return nil, err
+	}
+	second, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenRParen, "')'"); err != nil {
+		return nil, err
+	}
+
+	field, ok := first.(string)
+	lit, isLit := second.(literal)
+	if !ok || !isLit {
+		return nil, fmt.Errorf("%s expects a property and a literal", name)
+	}
+	return &models.FilterExpr{Op: name, Field: field, Value: lit.value}, nil
+}
+
+// parseList parses a parenthesized list of literals
+func (p *filterParser) parseList() ([]interface{}, error) {
+	if err := p.expect(tokenLParen, "'('"); err != nil {
+		return nil, err
+	}
+	var values []interface{}
+	for {
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := operand.(literal)
+		if !ok {
+			return nil, fmt.Errorf("'in' lists must contain literals")
+		}
+		values = append(values, lit.value)
+
+		t := p.next()
+		if t.kind == tokenRParen {
+			return values, nil
+		}
+		if t.kind != tokenComma {
+			return nil, fmt.Errorf("expected ',' or ')' in $filter list")
+		}
+	}
+}
+
+// parseOperand parses a property path (returned as string) or a literal
+func (p *filterParser) parseOperand() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return literal{value: t.text}, nil
+	case tokenNumber:
+		if n, err := strconv.ParseFloat(t.text, 64); err == nil {
+			return literal{value: n}, nil
+		}
+		// Unquoted date and time literals compare as ISO strings
+		return literal{value: t.text}, nil
+	case tokenIdent:
+		switch strings.ToLower(t.text) {
+		case "null":
+			return literal{value: nil}, nil
+		case "true":
+			return literal{value: true}, nil
+		case "false":
+			return literal{value: false}, nil
+		}
+		// Navigation paths are not supported, only direct properties
+		if strings.Contains(t.text, "/") {
+			return nil, fmt.Errorf("property paths are not supported in $filter")
+		}
+		return t.text, nil
+	default:
+		return nil, fmt.Errorf("unexpected '%s' in $filter", t.text)
+	}
+}
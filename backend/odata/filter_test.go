@@ -0,0 +1,105 @@
+package odata
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"dynamic-table-backend/models"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    *models.FilterExpr
+		wantErr string
+	}{
+		{input: "price gt 10", want: &models.FilterExpr{Op: "gt", Field: "price", Value: 10.0}},
+		{input: "10 lt price", want: &models.FilterExpr{Op: "gt", Field: "price", Value: 10.0}},
+		{input: "name eq 'O''Brien'", want: &models.FilterExpr{Op: "eq", Field: "name", Value: "O'Brien"}},
+		{input: "name NE null", want: &models.FilterExpr{Op: "ne", Field: "name"}},
+		{input: "done eq true", want: &models.FilterExpr{Op: "eq", Field: "done", Value: true}},
+		{input: "due ge 2024-01-31T10:00:00Z", want: &models.FilterExpr{Op: "ge", Field: "due", Value: "2024-01-31T10:00:00Z"}},
+		{input: "price eq -1.5e2", want: &models.FilterExpr{Op: "eq", Field: "price", Value: -150.0}},
+		{input: "status in ('open', 2)", want: &models.FilterExpr{Op: "in", Field: "status", Values: []interface{}{"open", 2.0}}},
+		{input: "contains(name, 'lamp')", want: &models.FilterExpr{Op: "contains", Field: "name", Value: "lamp"}},
+		{input: "StartsWith(name, 'L')", want: &models.FilterExpr{Op: "startswith", Field: "name", Value: "L"}},
+		{
+			input: "a eq 1 or b eq 2 and not c eq 3",
+			want: &models.FilterExpr{Op: "or", Args: []*models.FilterExpr{
+				{Op: "eq", Field: "a", Value: 1.0},
+				{Op: "and", Args: []*models.FilterExpr{
+					{Op: "eq", Field: "b", Value: 2.0},
+					{Op: "not", Args: []*models.FilterExpr{{Op: "eq", Field: "c", Value: 3.0}}},
+				}},
+			}},
+		},
+		{
+			input: "(a eq 1 or b eq 2) and c eq 3",
+			want: &models.FilterExpr{Op: "and", Args: []*models.FilterExpr{
+				{Op: "or", Args: []*models.FilterExpr{
+					{Op: "eq", Field: "a", Value: 1.0},
+					{Op: "eq", Field: "b", Value: 2.0},
+				}},
+				{Op: "eq", Field: "c", Value: 3.0},
+			}},
+		},
+		{input: "price", wantErr: "expected operator"},
+		{input: "price has 1", wantErr: "unsupported operator 'has'"},
+		{input: "a eq b", wantErr: "between a property and a literal"},
+		{input: "1 eq 1", wantErr: "between a property and a literal"},
+		{input: "1 in (1)", wantErr: "left side of 'in'"},
+		{input: "status in (open)", wantErr: "'in' lists must contain literals"},
+		{input: "status in ('a' 'b')", wantErr: "expected ',' or ')'"},
+		{input: "contains('lamp', name)", wantErr: "contains expects a property and a literal"},
+		{input: "contains(name 'lamp')", wantErr: "expected ','"},
+		{input: "customer/name eq 'x'", wantErr: "property paths are not supported"},
+		{input: "(a eq 1", wantErr: "expected ')'"},
+		{input: "a eq 1 b", wantErr: "unexpected 'b'"},
+		{input: "name eq 'open", wantErr: "unterminated string"},
+		{input: "a eq 1 & b eq 2", wantErr: "unexpected character '&'"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := ParseFilter(test.input)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseFilter(%q) = %v, want an error containing %q", test.input, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFilter(%q) = %v", test.input, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseFilter(%q) = %+v, want %+v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseOrderBy(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []models.SortOption
+		wantErr string
+	}{
+		{input: "name", want: []models.SortOption{{Field: "name"}}},
+		{input: "price DESC, name asc", want: []models.SortOption{{Field: "price", Desc: true}, {Field: "name"}}},
+		{input: "price down", wantErr: "invalid $orderby direction"},
+		{input: "price,", wantErr: "invalid $orderby item"},
+		{input: "price desc extra", wantErr: "invalid $orderby item"},
+	}
+	for _, test := range tests {
+		got, err := ParseOrderBy(test.input)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ParseOrderBy(%q) = %v, want an error containing %q", test.input, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseOrderBy(%q) = %v, %v, want %v", test.input, got, err, test.want)
+		}
+	}
+}
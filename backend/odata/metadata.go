@@ -0,0 +1,295 @@
+package odata
+
+import (
+	"encoding/xml"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+)
+
+// Namespace is the schema namespace used in the $metadata document
+const Namespace = "DynamicTables"
+
+var identifierPattern = regexp.MustCompile(`[^_0-9A-Za-z]`)
+
+// maxIdentifierLength is the longest simple identifier CSDL allows
+const maxIdentifierLength = 128
+
+// SystemProperties are the record attributes every entity type exposes
+var SystemProperties = []string{"id", "createdAt", "updatedAt"}
+
+// identifier converts a table slug or field name into a valid OData identifier
+func identifier(name string) string {
+	name = identifierPattern.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	if len(name) > maxIdentifierLength {
+		name = name[:maxIdentifierLength]
+	}
+	return name
+}
+
+// unique returns name, or name with the lowest numeric suffix not in taken, and marks it as taken
+func unique(name string, taken map[string]bool) string {
+	candidate := name
+	for i := 2; taken[candidate]; i++ {
+		suffix := "_" + strconv.Itoa(i)
+		base := name
+		if len(base)+len(suffix) > maxIdentifierLength {
+			base = base[:maxIdentifierLength-len(suffix)]
+		}
+		candidate = base + suffix
+	}
+	taken[candidate] = true
+	return candidate
+}
+
+// EntitySetNames returns the entity set name of each table by slug. Slugs that convert to the same
+// identifier get a numeric suffix in the order the tables were created, so adding a table does not
+// rename the others.
+func EntitySetNames(schemas []*models.Schema) map[string]string {
+	schemas = append([]*models.Schema(nil), schemas...)
+	sort.SliceStable(schemas, func(i, j int) bool {
+		return schemas[i].CreatedAt.Before(schemas[j].CreatedAt)
+	})
+
+	names := make(map[string]string, len(schemas))
+	taken := make(map[string]bool)
+	for _, schema := range schemas {
+		names[schema.TableSlug] = unique(identifier(schema.TableSlug), taken)
+	}
+	return names
+}
+
+// Properties maps the fields of a table to their OData property and navigation property names.
+// Field names are converted into identifiers that are unique within the entity type and do not
+// collide with the system properties.
+type Properties struct {
+	names      map[string]string // field name to property name
+	navigation map[string]string // relation field name to navigation property name
+	fields     map[string]string // property name to field name
+	relations  map[string]string // navigation property name to field name
+}
+
+// TableProperties names the fields of a table. Fields keep the names of earlier fields, and
+// navigation properties are named "_<property>_related" after every property is named.
+func TableProperties(schema *models.Schema) *Properties {
+	p := &Properties{
+		names:      make(map[string]string),
+		navigation: make(map[string]string),
+		fields:     make(map[string]string),
+		relations:  make(map[string]string),
+	}
+	taken := make(map[string]bool)
+	for _, name := range SystemProperties {
+		taken[name] = true
+	}
+	for _, field := range schema.Fields {
+		name := unique(identifier(field.Name), taken)
+		p.names[field.Name] = name
+		p.fields[name] = field.Name
+	}
+	for _, field := range schema.Fields {
+		if field.DataType == "relation" && field.RelationConfig != nil {
+			name := unique(identifier("_"+p.names[field.Name]+"_related"), taken)
+			p.navigation[field.Name] = name
+			p.relations[name] = field.Name
+		}
+	}
+	return p
+}
+
+// Name returns the property name of a field
+func (p *Properties) Name(fieldName string) string {
+	return p.names[fieldName]
+}
+
+// NavigationName returns the navigation property name of a relation field
+func (p *Properties) NavigationName(fieldName string) string {
+	return p.navigation[fieldName]
+}
+
+// Field returns the field a property name refers to; system properties are not fields
+func (p *Properties) Field(name string) (string, bool) {
+	field, ok := p.fields[name]
+	return field, ok
+}
+
+// Relation returns the relation field a navigation property name refers to
+func (p *Properties) Relation(name string) (string, bool) {
+	field, ok := p.relations[name]
+	return field, ok
+}
+
+// EdmType maps a field data type to its EDM primitive type
+func EdmType(field models.Field) string {
+	switch field.DataType {
+	case "number":
+		return "Edm.Double"
+	case "checkbox":
+		return "Edm.Boolean"
+	case "date":
+		return "Edm.Date"
+	case "time":
+		return "Edm.TimeOfDay"
+	case "datetime":
+		return "Edm.DateTimeOffset"
+	case "relation":
+		if field.RelationConfig != nil && field.RelationConfig.AllowMultiple {
+			return "Collection(Edm.String)"
+		}
+		return "Edm.String"
+	case formula.DataType:
+		switch field.FormulaType {
+		case formula.TypeNumber:
+			return "Edm.Double"
+		case formula.TypeBoolean:
+			return "Edm.Boolean"
+		case formula.TypeDate:
+			return "Edm.DateTimeOffset"
+		}
+		return "Edm.String"
+	case formula.LookupDataType, formula.RollupDataType:
+		item := "Edm.String"
+		if field.LinkConfig != nil {
+			switch field.LinkConfig.ResultType {
+			case formula.TypeNumber:
+				item = "Edm.Double"
+			case formula.TypeBoolean:
+				item = "Edm.Boolean"
+			}
+		}
+		if field.DataType == formula.LookupDataType {
+			return "Collection(" + item + ")"
+		}
+		return item
+	default:
+		return "Edm.String"
+	}
+}
+
+type edmx struct {
+	XMLName      xml.Name     `xml:"edmx:Edmx"`
+	Version      string       `xml:"Version,attr"`
+	XmlnsEdmx    string       `xml:"xmlns:edmx,attr"`
+	DataServices dataServices `xml:"edmx:DataServices"`
+}
+
+type dataServices struct {
+	Schema edmSchema `xml:"Schema"`
+}
+
+type edmSchema struct {
+	Xmlns           string          `xml:"xmlns,attr"`
+	Namespace       string          `xml:"Namespace,attr"`
+	EntityTypes     []entityType    `xml:"EntityType"`
+	EntityContainer entityContainer `xml:"EntityContainer"`
+}
+
+type entityType struct {
+	Name       string               `xml:"Name,attr"`
+	Key        entityKey            `xml:"Key"`
+	Properties []property           `xml:"Property"`
+	Navigation []navigationProperty `xml:"NavigationProperty"`
+}
+
+type entityKey struct {
+	PropertyRef propertyRef `xml:"PropertyRef"`
+}
+
+type propertyRef struct {
+	Name string `xml:"Name,attr"`
+}
+
+type property struct {
+	Name     string `xml:"Name,attr"`
+	Type     string `xml:"Type,attr"`
+	Nullable string `xml:"Nullable,attr,omitempty"`
+}
+
+type navigationProperty struct {
+	Name string `xml:"Name,attr"`
+	Type string `xml:"Type,attr"`
+}
+
+type entityContainer struct {
+	Name       string      `xml:"Name,attr"`
+	EntitySets []entitySet `xml:"EntitySet"`
+}
+
+type entitySet struct {
+	Name       string `xml:"Name,attr"`
+	EntityType string `xml:"EntityType,attr"`
+}
+
+// Metadata builds the CSDL $metadata document describing the given tables, named by EntitySetNames
+// of every table of the tenant
+func Metadata(schemas []*models.Schema, sets map[string]string) ([]byte, error) {
+	doc := edmx{
+		Version:   "4.0",
+		XmlnsEdmx: "http://docs.oasis-open.org/odata/ns/edmx",
+		DataServices: dataServices{
+			Schema: edmSchema{
+				Xmlns:     "http://docs.oasis-open.org/odata/ns/edm",
+				Namespace: Namespace,
+				EntityContainer: entityContainer{
+					Name: "Container",
+				},
+			},
+		},
+	}
+
+	known := make(map[string]bool)
+	for _, schema := range schemas {
+		known[schema.TableSlug] = true
+	}
+
+	for _, schema := range schemas {
+		name := sets[schema.TableSlug]
+		props := TableProperties(schema)
+		et := entityType{
+			Name: name,
+			Key:  entityKey{PropertyRef: propertyRef{Name: "id"}},
+			Properties: []property{
+				{Name: "id", Type: "Edm.Guid", Nullable: "false"},
+				{Name: "createdAt", Type: "Edm.DateTimeOffset"},
+				{Name: "updatedAt", Type: "Edm.DateTimeOffset"},
+			},
+		}
+
+		for _, field := range schema.Fields {
+			prop := property{Name: props.Name(field.Name), Type: EdmType(field)}
+			if field.Required {
+				prop.Nullable = "false"
+			}
+			et.Properties = append(et.Properties, prop)
+
+			if field.DataType == "relation" && field.RelationConfig != nil && known[field.RelationConfig.RelatedTable] {
+				target := Namespace + "." + sets[field.RelationConfig.RelatedTable]
+				if field.RelationConfig.AllowMultiple {
+					target = "Collection(" + target + ")"
+				}
+				et.Navigation = append(et.Navigation, navigationProperty{
+					Name: props.NavigationName(field.Name),
+					Type: target,
+				})
+			}
+		}
+
+		doc.DataServices.Schema.EntityTypes = append(doc.DataServices.Schema.EntityTypes, et)
+		doc.DataServices.Schema.EntityContainer.EntitySets = append(doc.DataServices.Schema.EntityContainer.EntitySets, entitySet{
+			Name:       name,
+			EntityType: Namespace + "." + name,
+		})
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
@@ -0,0 +1,70 @@
+package odata
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"dynamic-table-backend/models"
+)
+
+func TestEntitySetNames(t *testing.T) {
+	now := time.Now()
+	schemas := []*models.Schema{
+		{TableSlug: "order_items", CreatedAt: now.Add(time.Second)},
+		{TableSlug: "order-items", CreatedAt: now},
+		{TableSlug: "2024-sales", CreatedAt: now},
+	}
+	names := EntitySetNames(schemas)
+	want := map[string]string{"order-items": "order_items", "order_items": "order_items_2", "2024-sales": "_2024_sales"}
+	for slug, name := range want {
+		if names[slug] != name {
+			t.Errorf("EntitySetNames[%s] = %q, want %q", slug, names[slug], name)
+		}
+	}
+}
+
+func TestTableProperties(t *testing.T) {
+	relation := &models.RelationConfig{RelatedTable: "customers", RelatedField: "code"}
+	schema := &models.Schema{Fields: []models.Field{
+		{Name: "updatedAt"},
+		{Name: "unit price"},
+		{Name: "unit_price"},
+		{Name: "customer", DataType: "relation", RelationConfig: relation},
+		{Name: "_customer_related"},
+		{Name: strings.Repeat("x", 200)},
+		{Name: strings.Repeat("x", 201)},
+	}}
+	props := TableProperties(schema)
+
+	tests := []struct {
+		field string
+		name  string
+	}{
+		{"updatedAt", "updatedAt_2"},
+		{"unit price", "unit_price"},
+		{"unit_price", "unit_price_2"},
+		{"customer", "customer"},
+		{"_customer_related", "_customer_related"},
+		{strings.Repeat("x", 200), strings.Repeat("x", 128)},
+		{strings.Repeat("x", 201), strings.Repeat("x", 126) + "_2"},
+	}
+	for _, test := range tests {
+		if got := props.Name(test.field); got != test.name {
+			t.Errorf("Name(%.10s) = %q, want %q", test.field, got, test.name)
+		}
+		if field, ok := props.Field(test.name); !ok || field != test.field {
+			t.Errorf("Field(%.10s) = %.10q, %v, want %.10q", test.name, field, ok, test.field)
+		}
+	}
+
+	if got := props.NavigationName("customer"); got != "_customer_related_2" {
+		t.Errorf("NavigationName(customer) = %q, want %q", got, "_customer_related_2")
+	}
+	if field, ok := props.Relation("_customer_related_2"); !ok || field != "customer" {
+		t.Errorf("Relation(_customer_related_2) = %q, %v, want customer", field, ok)
+	}
+	if _, ok := props.Field("createdAt"); ok {
+		t.Error("Field(createdAt) refers to a field, want the system property")
+	}
+}
@@ -0,0 +1,267 @@
+package policy
+
+import (
+	"fmt"
+
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+)
+
+// flippedOps mirrors comparison operators when the record field is on the right side
+var flippedOps = map[string]string{
+	"==": "==",
+	"!=": "!=",
+	"<":  ">",
+	"<=": ">=",
+	">":  "<",
+	">=": "<=",
+}
+
+// filterOps maps policy comparison operators to filter operators
+var filterOps = map[string]string{
+	"==": "eq",
+	"!=": "ne",
+	"<":  "lt",
+	"<=": "le",
+	">":  "gt",
+	">=": "ge",
+}
+
+// Check rejects policies reading fields a table does not store.
+// Computed fields are not allowed because policies also filter rows inside lookups and rollups.
+func Check(node Node, fields []models.Field) error {
+	for _, name := range Fields(node) {
+		var field *models.Field
+		for i := range fields {
+			if fields[i].Name == name {
+				field = &fields[i]
+				break
+			}
+		}
+		if field == nil {
+			return fmt.Errorf("policy references unknown field '%s'", name)
+		}
+		if formula.ReadOnly(*field) && !(field.DataType == formula.DataType && field.StoreFormula) {
+			return fmt.Errorf("policy cannot read computed field '%s'", name)
+		}
+	}
+	return nil
+}
+
+// Bind substitutes the attributes of a principal into a policy, producing a filter over record fields.
+// Comparisons against a user attribute the principal does not have match no rows.
+func Bind(node Node, principal *models.Principal) *models.FilterExpr {
+	switch v := node.(type) {
+	case *Logical:
+		args := make([]*models.FilterExpr, 0, len(v.Args))
+		for _, arg := range v.Args {
+			args = append(args, Bind(arg, principal))
+		}
+		return &models.FilterExpr{Op: v.Op, Args: args}
+	case *Not:
+		return &models.FilterExpr{Op: "not", Args: []*models.FilterExpr{Bind(v.Operand, principal)}}
+	case *Compare:
+		return bindCompare(v, principal)
+	}
+	return Never()
+}
+
+// Never matches no row; the query builder compiles an empty "in" to FALSE
+func Never() *models.FilterExpr {
+	return &models.FilterExpr{Op: "in"}
+}
+
+// always matches every row; the query builder compiles an empty "and" to TRUE
+func always() *models.FilterExpr {
+	return &models.FilterExpr{Op: "and"}
+}
+
+func bindCompare(v *Compare, principal *models.Principal) *models.FilterExpr {
+	op, left, right := v.Op, v.Left, v.Right
+	if _, ok := right.(*FieldRef); ok {
+		op, left, right = flippedOps[op], right, left
+	}
+
+	value, known := resolve(right, principal)
+	if !known {
+		return Never()
+	}
+
+	field, ok := left.(*FieldRef)
+	if !ok {
+		// Both sides are constant for this principal
+		constant, known := resolve(left, principal)
+		if known && evaluate(op, constant, value) {
+			return always()
+		}
+		return Never()
+	}
+
+	if op == "in" {
+		var values []interface{}
+		for _, item := range toList(value) {
+			if item != nil {
+				values = append(values, item)
+			}
+		}
+		return &models.FilterExpr{Op: "in", Field: field.Name, Values: values}
+	}
+
+	switch value.(type) {
+	case []interface{}:
+		return Never()
+	case nil:
+		if op != "==" && op != "!=" {
+			return Never()
+		}
+	}
+	return &models.FilterExpr{Op: filterOps[op], Field: field.Name, Value: value}
+}
+
+// Match evaluates a policy in memory against the values of a record with the given ID, for records
+// that are not queried from the database. Like bound policies, comparisons with unknown operands fail;
+// createdAt and updatedAt are unknown.
+func Match(node Node, principal *models.Principal, id string, values map[string]interface{}) bool {
+	switch v := node.(type) {
+	case *Logical:
+		for _, arg := range v.Args {
+			matched := Match(arg, principal, id, values)
+			if v.Op == "and" && !matched {
+				return false
+			}
+			if v.Op == "or" && matched {
+				return true
+			}
+		}
+		return v.Op == "and"
+	case *Not:
+		return !Match(v.Operand, principal, id, values)
+	case *Compare:
+		left, lknown := resolveRecord(v.Left, principal, id, values)
+		right, rknown := resolveRecord(v.Right, principal, id, values)
+		if !lknown || !rknown {
+			return false
+		}
+		return evaluate(v.Op, left, right)
+	}
+	return false
+}
+
+// resolveRecord returns the value of an operand for a record in memory and whether it is known
+func resolveRecord(operand Operand, principal *models.Principal, id string, values map[string]interface{}) (interface{}, bool) {
+	ref, ok := operand.(*FieldRef)
+	if !ok {
+		return resolve(operand, principal)
+	}
+	switch ref.Name {
+	case "id":
+		return id, true
+	case "createdAt", "updatedAt":
+		return nil, false
+	}
+	return values[ref.Name], true
+}
+
+// resolve returns the value of a literal or user attribute and whether it is known
+func resolve(operand Operand, principal *models.Principal) (interface{}, bool) {
+	switch v := operand.(type) {
+	case *Literal:
+		return v.Value, true
+	case *UserRef:
+		return userAttribute(principal, v.Attr)
+	}
+	return nil, false
+}
+
+// userAttribute returns id, name and method from the principal and other attributes from its token claims
+func userAttribute(principal *models.Principal, attr string) (interface{}, bool) {
+	if principal == nil {
+		return nil, false
+	}
+	switch attr {
+	case "id":
+		return principal.ID, true
+	case "name":
+		return principal.Name, true
+	case "method":
+		return principal.Method, true
+	}
+	value, ok := principal.Claims[attr]
+	if !ok || value == nil {
+		return nil, false
+	}
+	if list, ok := value.([]string); ok {
+		items := make([]interface{}, len(list))
+		for i, item := range list {
+			items[i] = item
+		}
+		return items, true
+	}
+	return value, true
+}
+
+// toList treats a scalar as a list of one
+func toList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		return v
+	case nil:
+		return nil
+	}
+	return []interface{}{value}
+}
+
+// evaluate compares two constants
+func evaluate(op string, left, right interface{}) bool {
+	switch op {
+	case "in":
+		for _, item := range toList(right) {
+			if equal(left, item) {
+				return true
+			}
+		}
+		return false
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	}
+
+	if l, ok := left.(float64); ok {
+		if r, ok := right.(float64); ok {
+			switch op {
+			case "<":
+				return l < r
+			case "<=":
+				return l <= r
+			case ">":
+				return l > r
+			case ">=":
+				return l >= r
+			}
+		}
+	}
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			switch op {
+			case "<":
+				return l < r
+			case "<=":
+				return l <= r
+			case ">":
+				return l > r
+			case ">=":
+				return l >= r
+			}
+		}
+	}
+	return false
+}
+
+// equal compares constants by their text, so that 5 and "5" match like record values do
+func equal(left, right interface{}) bool {
+	if left == nil || right == nil {
+		return left == nil && right == nil
+	}
+	return fmt.Sprint(left) == fmt.Sprint(right)
+}
@@ -0,0 +1,116 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+)
+
+func TestBind(t *testing.T) {
+	principal := &models.Principal{
+		ID:     "u1",
+		Method: "jwt",
+		Claims: map[string]interface{}{"regions": []string{"eu", "us"}, "level": 3.0},
+	}
+	never := Never()
+	tests := []struct {
+		src       string
+		principal *models.Principal
+		want      *models.FilterExpr
+	}{
+		{src: "values.owner == $user.id", principal: principal,
+			want: &models.FilterExpr{Op: "eq", Field: "owner", Value: "u1"}},
+		{src: "$user.level > values.rank", principal: principal,
+			want: &models.FilterExpr{Op: "lt", Field: "rank", Value: 3.0}},
+		{src: "values.region in $user.regions", principal: principal,
+			want: &models.FilterExpr{Op: "in", Field: "region", Values: []interface{}{"eu", "us"}}},
+		{src: "values.region in ['eu', null]", principal: principal,
+			want: &models.FilterExpr{Op: "in", Field: "region", Values: []interface{}{"eu"}}},
+		{src: "values.owner != null", principal: principal,
+			want: &models.FilterExpr{Op: "ne", Field: "owner"}},
+		{src: "values.owner == $user.team", principal: principal, want: never},
+		{src: "values.owner == $user.id", principal: nil, want: never},
+		{src: "values.owner < null", principal: principal, want: never},
+		{src: "values.owner == $user.regions", principal: principal, want: never},
+		{src: "$user.method == 'jwt'", principal: principal, want: &models.FilterExpr{Op: "and"}},
+		{src: "$user.method == 'apikey'", principal: principal, want: never},
+		{
+			src: "not (values.a == 1 || values.b == $user.id)", principal: principal,
+			want: &models.FilterExpr{Op: "not", Args: []*models.FilterExpr{{Op: "or", Args: []*models.FilterExpr{
+				{Op: "eq", Field: "a", Value: 1.0},
+				{Op: "eq", Field: "b", Value: "u1"},
+			}}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			node, err := Parse(test.src)
+			if err != nil {
+				t.Fatalf("Parse(%q) = %v", test.src, err)
+			}
+			if got := Bind(node, test.principal); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Bind(%q) = %+v, want %+v", test.src, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	principal := &models.Principal{ID: "u1", Claims: map[string]interface{}{"regions": []string{"eu"}}}
+	values := map[string]interface{}{"owner": "u1", "region": "eu", "amount": 5.0, "code": "5"}
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"values.owner == $user.id", true},
+		{"values.region in $user.regions && values.amount < 10", true},
+		{"values.code == 5", true},
+		{"values.amount > 5 || values.missing == null", true},
+		{"not values.owner == $user.id", false},
+		{"values.owner == $user.team", false},
+		{"id == 'r1'", true},
+		{"createdAt > '2024-01-01'", false},
+	}
+	for _, test := range tests {
+		node, err := Parse(test.src)
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", test.src, err)
+		}
+		if got := Match(node, principal, "r1", values); got != test.want {
+			t.Errorf("Match(%q) = %v, want %v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fields := []models.Field{
+		{Name: "owner", DataType: "text"},
+		{Name: "total", DataType: formula.DataType, Formula: "1"},
+		{Name: "stored", DataType: formula.DataType, Formula: "1", StoreFormula: true},
+	}
+	tests := []struct {
+		src     string
+		wantErr string
+	}{
+		{src: "values.owner == $user.id && id != 'x'"},
+		{src: "values.stored > 0"},
+		{src: "values.missing == 1", wantErr: "unknown field 'missing'"},
+		{src: "values.total > 0", wantErr: "cannot read computed field 'total'"},
+	}
+	for _, test := range tests {
+		node, err := Parse(test.src)
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", test.src, err)
+		}
+		err = Check(node, fields)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("Check(%q) = %v", test.src, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("Check(%q) = %v, want an error containing %q", test.src, err, test.wantErr)
+		}
+	}
+}
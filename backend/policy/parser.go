@@ -0,0 +1,406 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Node is a parsed policy expression
+type Node interface{}
+
+// Logical combines conditions with "and" or "or"
+type Logical struct {
+	Op   string
+	Args []Node
+}
+
+// Not negates a condition
+type Not struct {
+	Operand Node
+}
+
+// Compare compares two operands with ==, !=, <, <=, >, >= or in
+type Compare struct {
+	Op          string
+	Left, Right Operand
+}
+
+// Operand is a record field, an attribute of the current user or a literal
+type Operand interface{}
+
+// FieldRef references a record value, e.g. values.owner, or a system attribute such as id
+type FieldRef struct {
+	Name string
+}
+
+// UserRef references an attribute of the current user, e.g. $user.id or $user.regions
+type UserRef struct {
+	Attr string
+}
+
+// Literal is a string, number, boolean, null or list constant
+type Literal struct {
+	Value interface{}
+}
+
+// comparisons are the comparison operators besides in
+var comparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// systemAttributes are the record attributes usable without the values prefix
+var systemAttributes = map[string]bool{
+	"id":        true,
+	"createdAt": true,
+	"updatedAt": true,
+}
+
+type lexeme struct {
+	kind string // "str", "num", "ident", "op", "eof"
+	text string
+}
+
+type parser struct {
+	lexemes []lexeme
+	pos     int
+}
+
+// Parse parses a policy expression such as "values.owner == $user.id || values.region in $user.regions"
+func Parse(src string) (Node, error) {
+	lexemes, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{lexemes: lexemes}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != "eof" {
+		return nil, fmt.Errorf("unexpected '%s' in policy", p.peek().text)
+	}
+	return node, nil
+}
+
+// Fields returns the names of the record values a policy reads, without system attributes
+func Fields(node Node) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(operand Operand) {
+		if ref, ok := operand.(*FieldRef); ok && !systemAttributes[ref.Name] && !seen[ref.Name] {
+			seen[ref.Name] = true
+			names = append(names, ref.Name)
+		}
+	}
+	var walk func(Node)
+	walk = func(n Node) {
+		switch v := n.(type) {
+		case *Logical:
+			for _, arg := range v.Args {
+				walk(arg)
+			}
+		case *Not:
+			walk(v.Operand)
+		case *Compare:
+			add(v.Left)
+			add(v.Right)
+		}
+	}
+	walk(node)
+	return names
+}
+
+// UsesUser reports whether a policy reads attributes of the current user
+func UsesUser(node Node) bool {
+	switch v := node.(type) {
+	case *Logical:
+		for _, arg := range v.Args {
+			if UsesUser(arg) {
+				return true
+			}
+		}
+	case *Not:
+		return UsesUser(v.Operand)
+	case *Compare:
+		_, left := v.Left.(*UserRef)
+		_, right := v.Right.(*UserRef)
+		return left || right
+	}
+	return false
+}
+
+func lex(src string) ([]lexeme, error) {
+	var lexemes []lexeme
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("()[],.", r):
+			lexemes = append(lexemes, lexeme{kind: "op", text: string(r)})
+			i++
+		case strings.ContainsRune("=!<>&|", r):
+			// Two character operators first, then the single character ones
+			if i+1 < len(runes) {
+				two := string(runes[i : i+2])
+				switch two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					lexemes = append(lexemes, lexeme{kind: "op", text: two})
+					i += 2
+					continue
+				}
+			}
+			if r != '!' && r != '<' && r != '>' {
+				return nil, fmt.Errorf("unexpected character '%c' in policy", r)
+			}
+			lexemes = append(lexemes, lexeme{kind: "op", text: string(r)})
+			i++
+		case r == '\'' || r == '"':
+			quote := r
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string in policy")
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					b.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == quote {
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			lexemes = append(lexemes, lexeme{kind: "str", text: b.String()})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			lexemes = append(lexemes, lexeme{kind: "num", text: string(runes[start:i])})
+		case unicode.IsLetter(r) || r == '_' || r == '$':
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			lexemes = append(lexemes, lexeme{kind: "ident", text: string(runes[start:i])})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' in policy", r)
+		}
+	}
+	return append(lexemes, lexeme{kind: "eof", text: "end of policy"}), nil
+}
+
+func (p *parser) peek() lexeme {
+	return p.lexemes[p.pos]
+}
+
+func (p *parser) next() lexeme {
+	l := p.lexemes[p.pos]
+	if l.kind != "eof" {
+		p.pos++
+	}
+	return l
+}
+
+// accept consumes the next lexeme if it is one of the given operators or case-insensitive keywords
+func (p *parser) accept(texts ...string) bool {
+	l := p.peek()
+	for _, text := range texts {
+		if (l.kind == "op" && l.text == text) || (l.kind == "ident" && strings.EqualFold(l.text, text)) {
+			p.next()
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return fmt.Errorf("expected '%s' in policy", text)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||", "or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "or", Args: []Node{left, right}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&", "and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "and", Args: []Node{left, right}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (Node, error) {
+	if p.accept("!", "not") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Operand: operand}, nil
+	}
+	if p.accept("(") {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (Node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	switch {
+	case op.kind == "op" && comparisons[op.text]:
+	case op.kind == "ident" && strings.EqualFold(op.text, "in"):
+		op.text = "in"
+	default:
+		return nil, fmt.Errorf("expected a comparison operator in policy, got '%s'", op.text)
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	_, leftField := left.(*FieldRef)
+	_, rightField := right.(*FieldRef)
+	if leftField && rightField {
+		return nil, fmt.Errorf("policies cannot compare two record fields")
+	}
+	if op.text == "in" && rightField {
+		return nil, fmt.Errorf("the right side of 'in' must be a list or a user attribute")
+	}
+
+	return &Compare{Op: op.text, Left: left, Right: right}, nil
+}
+
+// parseOperand parses values.<name>, values["name"], $user.<attr>, a system attribute or a literal
+func (p *parser) parseOperand() (Operand, error) {
+	l := p.next()
+	switch l.kind {
+	case "str":
+		return &Literal{Value: l.text}, nil
+	case "num":
+		n, err := strconv.ParseFloat(l.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' in policy", l.text)
+		}
+		return &Literal{Value: n}, nil
+	case "ident":
+		switch {
+		case strings.EqualFold(l.text, "true"):
+			return &Literal{Value: true}, nil
+		case strings.EqualFold(l.text, "false"):
+			return &Literal{Value: false}, nil
+		case strings.EqualFold(l.text, "null"):
+			return &Literal{Value: nil}, nil
+		case l.text == "values":
+			name, err := p.parseMember()
+			if err != nil {
+				return nil, err
+			}
+			return &FieldRef{Name: name}, nil
+		case l.text == "$user":
+			attr, err := p.parseMember()
+			if err != nil {
+				return nil, err
+			}
+			return &UserRef{Attr: attr}, nil
+		case systemAttributes[l.text]:
+			return &FieldRef{Name: l.text}, nil
+		}
+		return nil, fmt.Errorf("unknown name '%s' in policy, use values.%s for record fields", l.text, l.text)
+	case "op":
+		if l.text == "[" {
+			return p.parseList()
+		}
+	}
+	return nil, fmt.Errorf("unexpected '%s' in policy", l.text)
+}
+
+// parseMember parses the .name or ["name"] following values or $user
+func (p *parser) parseMember() (string, error) {
+	if p.accept(".") {
+		l := p.next()
+		if l.kind != "ident" {
+			return "", fmt.Errorf("expected a name after '.' in policy")
+		}
+		return l.text, nil
+	}
+	if p.accept("[") {
+		l := p.next()
+		if l.kind != "str" {
+			return "", fmt.Errorf("expected a quoted name after '[' in policy")
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		return l.text, nil
+	}
+	return "", fmt.Errorf("expected '.' or '[' in policy")
+}
+
+// parseList parses a bracketed list of literals, the opening bracket already consumed
+func (p *parser) parseList() (Operand, error) {
+	values := []interface{}{}
+	if p.accept("]") {
+		return &Literal{Value: values}, nil
+	}
+	for {
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := operand.(*Literal)
+		if !ok {
+			return nil, fmt.Errorf("policy lists must contain literals")
+		}
+		values = append(values, lit.Value)
+
+		if p.accept("]") {
+			return &Literal{Value: values}, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
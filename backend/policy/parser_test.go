@@ -0,0 +1,96 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	owner := &FieldRef{Name: "owner"}
+	userID := &UserRef{Attr: "id"}
+	tests := []struct {
+		src     string
+		want    Node
+		wantErr string
+	}{
+		{src: "values.owner == $user.id", want: &Compare{Op: "==", Left: owner, Right: userID}},
+		{src: `values["first name"] != 'x'`, want: &Compare{Op: "!=", Left: &FieldRef{Name: "first name"}, Right: &Literal{Value: "x"}}},
+		{src: "$user['tenant id'] == id", want: &Compare{Op: "==", Left: &UserRef{Attr: "tenant id"}, Right: &FieldRef{Name: "id"}}},
+		{src: "values.amount >= -1.5", want: &Compare{Op: ">=", Left: &FieldRef{Name: "amount"}, Right: &Literal{Value: -1.5}}},
+		{src: "values.done == TRUE", want: &Compare{Op: "==", Left: &FieldRef{Name: "done"}, Right: &Literal{Value: true}}},
+		{src: "values.owner == null", want: &Compare{Op: "==", Left: owner, Right: &Literal{Value: nil}}},
+		{src: "values.region IN ['eu', 2]", want: &Compare{Op: "in", Left: &FieldRef{Name: "region"}, Right: &Literal{Value: []interface{}{"eu", 2.0}}}},
+		{src: "values.region in []", want: &Compare{Op: "in", Left: &FieldRef{Name: "region"}, Right: &Literal{Value: []interface{}{}}}},
+		{
+			src: "values.a == 1 || values.b == 2 && values.c == 3",
+			want: &Logical{Op: "or", Args: []Node{
+				&Compare{Op: "==", Left: &FieldRef{Name: "a"}, Right: &Literal{Value: 1.0}},
+				&Logical{Op: "and", Args: []Node{
+					&Compare{Op: "==", Left: &FieldRef{Name: "b"}, Right: &Literal{Value: 2.0}},
+					&Compare{Op: "==", Left: &FieldRef{Name: "c"}, Right: &Literal{Value: 3.0}},
+				}},
+			}},
+		},
+		{
+			src: "not (values.a == 1 or values.b == 2)",
+			want: &Not{Operand: &Logical{Op: "or", Args: []Node{
+				&Compare{Op: "==", Left: &FieldRef{Name: "a"}, Right: &Literal{Value: 1.0}},
+				&Compare{Op: "==", Left: &FieldRef{Name: "b"}, Right: &Literal{Value: 2.0}},
+			}}},
+		},
+		{src: "owner == $user.id", wantErr: "use values.owner"},
+		{src: "values.a == values.b", wantErr: "cannot compare two record fields"},
+		{src: "$user.id in values.owners", wantErr: "right side of 'in'"},
+		{src: "values.a = 1", wantErr: "unexpected character '='"},
+		{src: "values.a", wantErr: "expected a comparison operator"},
+		{src: "values.a == 1 values.b", wantErr: "unexpected 'values'"},
+		{src: "(values.a == 1", wantErr: "expected ')'"},
+		{src: "values.a in [values.b]", wantErr: "lists must contain literals"},
+		{src: "values[1] == 1", wantErr: "expected a quoted name"},
+		{src: "values.a == 'open", wantErr: "unterminated string"},
+		{src: "values.a == 1.2.3", wantErr: "invalid number"},
+		{src: "values.a == 1 ; x", wantErr: "unexpected character ';'"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			got, err := Parse(test.src)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Parse(%q) = %v, want an error containing %q", test.src, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q) = %v", test.src, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Parse(%q) = %#v, want %#v", test.src, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFields(t *testing.T) {
+	tests := []struct {
+		src      string
+		fields   []string
+		usesUser bool
+	}{
+		{"values.owner == $user.id || $user.region == values.region", []string{"owner", "region"}, true},
+		{"id == 'x' && createdAt > '2024-01-01'", nil, false},
+		{"!(values.a == 1) and values.a != 2", []string{"a"}, false},
+	}
+	for _, test := range tests {
+		node, err := Parse(test.src)
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", test.src, err)
+		}
+		if got := Fields(node); !reflect.DeepEqual(got, test.fields) {
+			t.Errorf("Fields(%q) = %v, want %v", test.src, got, test.fields)
+		}
+		if got := UsesUser(node); got != test.usesUser {
+			t.Errorf("UsesUser(%q) = %v, want %v", test.src, got, test.usesUser)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"dynamic-table-backend/models"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every issued API key so keys can be told apart from JWTs
+const APIKeyPrefix = "dtk_"
+
+// apiKeyUseInterval is how precisely the last use of an API key is recorded
+const apiKeyUseInterval = time.Minute
+
+type APIKeyRepository struct {
+	db DB
+}
+
+func NewAPIKeyRepository(db DB) *APIKeyRepository {
+	return &APIKeyRepository{db: db}
+}
+
+// hashAPIKey returns the hex SHA-256 digest stored for a key
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey issues a new random API key and returns it with its secret.
+// A key bound to a tenant can only operate in that tenant; an empty tenant allows any.
+func (r *APIKeyRepository) CreateAPIKey(name string, tenant string) (*models.APIKey, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", fmt.Errorf("failed to generate api key: %v", err)
+	}
+	key := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	query := `
+		INSERT INTO api_keys (name, prefix, key_hash, tenant)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, name, prefix, tenant, created_at, last_used_at, revoked_at`
+
+	apiKey, err := r.scanAPIKey(r.db.QueryRow(query, name, key[:len(APIKeyPrefix)+6], hashAPIKey(key), tenant))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create api key: %v", err)
+	}
+
+	return apiKey, key, nil
+}
+
+// GetAllAPIKeys retrieves all issued API keys
+func (r *APIKeyRepository) GetAllAPIKeys() ([]*models.APIKey, error) {
+	query := `
+		SELECT id, name, prefix, tenant, created_at, last_used_at, revoked_at
+		FROM api_keys
+		ORDER BY created_at DESC`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query api keys: %v", err)
+	}
+	defer rows.Close()
+
+	apiKeys := []*models.APIKey{}
+	for rows.Next() {
+		apiKey, err := r.scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %v", err)
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, nil
+}
+
+// AuthenticateAPIKey returns the active key matching a secret and records its use.
+// It returns nil if the key is unknown or revoked.
+func (r *APIKeyRepository) AuthenticateAPIKey(key string) (*models.APIKey, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, nil
+	}
+
+	query := `
+		SELECT id, name, prefix, tenant, created_at, last_used_at, revoked_at
+		FROM api_keys
+		WHERE key_hash = $1 AND revoked_at IS NULL`
+
+	apiKey, err := r.scanAPIKey(r.db.QueryRow(query, hashAPIKey(key)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to authenticate api key: %v", err)
+	}
+
+	// Every request authenticates, so the use is only recorded when the last one is older than
+	// apiKeyUseInterval rather than writing the row on each request
+	if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) >= apiKeyUseInterval {
+		now := time.Now().UTC()
+		if _, err := r.db.Exec(`UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1`, apiKey.ID); err != nil {
+			return nil, fmt.Errorf("failed to record api key use: %v", err)
+		}
+		apiKey.LastUsedAt = &now
+	}
+
+	return apiKey, nil
+}
+
+// RevokeAPIKey revokes an API key so it can no longer be used
+func (r *APIKeyRepository) RevokeAPIKey(id string) error {
+	query := `UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL`
+	result, err := r.db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("api key not found")
+	}
+
+	return nil
+}
+
+// scanAPIKey scans an api_keys row
+func (r *APIKeyRepository) scanAPIKey(row interface{ Scan(...interface{}) error }) (*models.APIKey, error) {
+	var apiKey models.APIKey
+	err := row.Scan(
+		&apiKey.ID,
+		&apiKey.Name,
+		&apiKey.Prefix,
+		&apiKey.Tenant,
+		&apiKey.CreatedAt,
+		&apiKey.LastUsedAt,
+		&apiKey.RevokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &apiKey, nil
+}
@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type AuditRepository struct {
+	db DB
+	// timeArg converts a time to the query argument compared with created_at
+	timeArg func(t time.Time) interface{}
+}
+
+func NewAuditRepository(db DB) *AuditRepository {
+	return &AuditRepository{db: db, timeArg: func(t time.Time) interface{} { return t }}
+}
+
+// NewSQLiteAuditRepository reads the audit log of a SQLite database, whose timestamps are UTC text
+func NewSQLiteAuditRepository(db DB) *AuditRepository {
+	return &AuditRepository{db: db, timeArg: func(t time.Time) interface{} { return sqliteTime(&t) }}
+}
+
+// recordAudit appends an audit entry inside the transaction making the change, so that the change
+// and its entry are committed together. before and after hold the JSON object of the record values
+// or schema before and after the change, nil when it did not exist.
+func recordAudit(tx *sql.Tx, tenant string, actor *models.Principal, action string, tableSlug string, recordID string, before, after json.RawMessage) error {
+	changes, err := auditChanges(before, after)
+	if err != nil {
+		return err
+	}
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit changes: %v", err)
+	}
+
+	actorID, actorName := "system", "system"
+	if actor != nil {
+		actorID, actorName = actor.ID, actor.Name
+	}
+
+	query := `
+		INSERT INTO audit_log (tenant, actor_id, actor_name, action, table_slug, record_id, changes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	if _, err := tx.Exec(query, tenant, actorID, actorName, action, tableSlug, recordID, changesJSON); err != nil {
+		return fmt.Errorf("failed to record audit entry: %v", err)
+	}
+	return nil
+}
+
+// auditChanges lists the keys whose values differ between two JSON objects
+func auditChanges(before, after json.RawMessage) (map[string]models.FieldChange, error) {
+	var old, updated map[string]interface{}
+	if before != nil {
+		if err := json.Unmarshal(before, &old); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal audit values: %v", err)
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal(after, &updated); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal audit values: %v", err)
+		}
+	}
+
+	return diffValues(old, updated), nil
+}
+
+// diffValues lists the keys whose values differ between two objects
+func diffValues(old, updated map[string]interface{}) map[string]models.FieldChange {
+	changes := make(map[string]models.FieldChange)
+	for key, value := range old {
+		if !reflect.DeepEqual(value, updated[key]) {
+			changes[key] = models.FieldChange{Before: value, After: updated[key]}
+		}
+	}
+	for key, value := range updated {
+		if _, seen := old[key]; !seen {
+			changes[key] = models.FieldChange{After: value}
+		}
+	}
+	return changes
+}
+
+// GetAuditEntries retrieves a page of a tenant's audit log, newest first
+func (r *AuditRepository) GetAuditEntries(tenant string, params *models.AuditQueryParams) (*models.AuditResponse, error) {
+	qb := newQueryBuilder(nil, tenant)
+	conditions := []string{"tenant = $1"}
+	if params.TableSlug != "" {
+		conditions = append(conditions, "table_slug = "+qb.arg(params.TableSlug))
+	}
+	if params.RecordID != "" {
+		conditions = append(conditions, "record_id = "+qb.arg(params.RecordID))
+	}
+	if params.ActorID != "" {
+		conditions = append(conditions, "actor_id = "+qb.arg(params.ActorID))
+	}
+	if params.From != nil {
+		conditions = append(conditions, "created_at >= "+qb.arg(r.timeArg(*params.From)))
+	}
+	if params.To != nil {
+		conditions = append(conditions, "created_at < "+qb.arg(r.timeArg(*params.To)))
+	}
+	where := strings.Join(conditions, " AND ")
+
+	var total int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE "+where, qb.args...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("failed to count audit entries: %v", err)
+	}
+
+	if params.Page < 1 {
+		params.Page = 1
+	}
+	if params.PageSize < 1 {
+		params.PageSize = 50
+	}
+	if params.PageSize > 500 {
+		params.PageSize = 500
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, actor_id, actor_name, action, table_slug, record_id, changes, created_at
+		FROM audit_log
+		WHERE %s
+		ORDER BY id DESC
+		LIMIT %s OFFSET %s`, where, qb.arg(params.PageSize), qb.arg((params.Page-1)*params.PageSize))
+
+	rows, err := r.db.Query(query, qb.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit entries: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []*models.AuditEntry{}
+	for rows.Next() {
+		var entry models.AuditEntry
+		var changesJSON []byte
+		err := rows.Scan(
+			&entry.ID,
+			&entry.ActorID,
+			&entry.ActorName,
+			&entry.Action,
+			&entry.TableSlug,
+			&entry.RecordID,
+			&changesJSON,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %v", err)
+		}
+		if err := json.Unmarshal(changesJSON, &entry.Changes); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal audit changes: %v", err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	return &models.AuditResponse{
+		Entries:    entries,
+		Total:      total,
+		Page:       params.Page,
+		PageSize:   params.PageSize,
+		TotalPages: (total + params.PageSize - 1) / params.PageSize,
+	}, nil
+}
@@ -0,0 +1,249 @@
+package repository
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"dynamic-table-backend/models"
+)
+
+// forEachDatabase runs a test on fresh stores of every backend keeping its data in a database
+func forEachDatabase(t *testing.T, test func(t *testing.T, stores *Stores)) {
+	forEachBackend(t, func(t *testing.T, stores *Stores) {
+		if stores.Audit == nil {
+			t.Skip("the backend does not record changes")
+		}
+		test(t, stores)
+	})
+}
+
+func TestRolesAndAPIKeys(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, stores *Stores) {
+		role, err := stores.Roles.CreateRole(&models.CreateRoleRequest{Name: "clerk"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stores.Roles.AddGrant(role.ID, &models.CreateGrantRequest{Permission: models.PermissionContentRead, TableSlug: "orders"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := stores.Roles.AddMember(role.ID, "key:clerk"); err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := stores.Roles.GetRoleNamesForPrincipal("key:clerk", []string{"admin"})
+		if err != nil || len(names) != 2 {
+			t.Fatalf("GetRoleNamesForPrincipal = %v, %v, want the bound and the claimed role", names, err)
+		}
+		grants, err := stores.Roles.GetGrantsForPrincipal("key:clerk", []string{"clerk"})
+		if err != nil || len(grants) != 1 || grants[0].TableSlug != "orders" {
+			t.Errorf("GetGrantsForPrincipal = %+v, %v, want the grant of the role", grants, err)
+		}
+
+		apiKey, key, err := stores.APIKeys.CreateAPIKey("clerk", "acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authenticated, err := stores.APIKeys.AuthenticateAPIKey(key); err != nil || authenticated == nil || authenticated.Tenant != "acme" {
+			t.Errorf("AuthenticateAPIKey = %+v, %v, want the key bound to its tenant", authenticated, err)
+		}
+		if err := stores.APIKeys.RevokeAPIKey(apiKey.ID); err != nil {
+			t.Fatal(err)
+		}
+		if authenticated, err := stores.APIKeys.AuthenticateAPIKey(key); err != nil || authenticated != nil {
+			t.Errorf("AuthenticateAPIKey of a revoked key = %+v, %v", authenticated, err)
+		}
+	})
+}
+
+// countingDB counts the statements executed on a database
+type countingDB struct {
+	DB
+	execs int
+}
+
+func (d *countingDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	d.execs++
+	return d.DB.Exec(query, args...)
+}
+
+func TestAPIKeyUseIsThrottled(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, stores *Stores) {
+		db := &countingDB{DB: stores.APIKeys.(*APIKeyRepository).db}
+		keys := NewAPIKeyRepository(db)
+		apiKey, key, err := keys.CreateAPIKey("clerk", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			authenticated, err := keys.AuthenticateAPIKey(key)
+			if err != nil || authenticated == nil || authenticated.LastUsedAt == nil {
+				t.Fatalf("AuthenticateAPIKey = %+v, %v, want the key with its last use", authenticated, err)
+			}
+		}
+		if db.execs != 1 {
+			t.Errorf("recorded %d uses of a key used three times within a minute, want 1", db.execs)
+		}
+
+		if _, err := db.DB.Exec(`UPDATE api_keys SET last_used_at = $1 WHERE id = $2`, time.Now().Add(-2*time.Minute).UTC(), apiKey.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keys.AuthenticateAPIKey(key); err != nil {
+			t.Fatal(err)
+		}
+		if db.execs != 2 {
+			t.Errorf("recorded %d uses, want the use after a minute recorded again", db.execs)
+		}
+	})
+}
+
+func TestChangesAreRecorded(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, stores *Stores) {
+		status := models.Field{Name: "status", Label: "Status", DataType: "text"}
+		mustCreateSchema(t, stores, "acme", "orders", status)
+		hook, err := stores.Webhooks.CreateWebhook("acme", &models.CreateWebhookRequest{
+			TableSlug: "orders",
+			URL:       "https://example.com/hook",
+			Events:    []string{models.AuditContentCreate, models.AuditContentUpdate},
+			Filter:    "values.status == 'paid'",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		paid := mustCreateContent(t, stores, "acme", "orders", map[string]interface{}{"status": "paid"})
+		mustCreateContent(t, stores, "acme", "orders", map[string]interface{}{"status": "open"})
+		update := &models.UpdateContentRequest{Values: map[string]interface{}{"status": "refunded"}}
+		if _, err := stores.Contents.UpdateContent("acme", paid.ID, update, testAdmin); err != nil {
+			t.Fatal(err)
+		}
+		if err := stores.Contents.DeleteContent("acme", paid.ID, testAdmin); err != nil {
+			t.Fatal(err)
+		}
+
+		audit, err := stores.Audit.GetAuditEntries("acme", &models.AuditQueryParams{RecordID: paid.ID, Page: 1, PageSize: 10})
+		if err != nil || audit.Total != 3 {
+			t.Fatalf("GetAuditEntries = %+v, %v, want the create, update and delete", audit, err)
+		}
+		if entry := audit.Entries[0]; entry.Action != models.AuditContentDelete || entry.ActorID != testAdmin.ID {
+			t.Errorf("latest audit entry = %+v, want the delete by its actor", entry)
+		}
+		if change := audit.Entries[1].Changes["status"]; change.Before != "paid" || change.After != "refunded" {
+			t.Errorf("audited update = %+v, want the changed status", change)
+		}
+
+		events, err := stores.Changes.GetTableEvents("acme", "orders", 0, 10)
+		if err != nil || len(events) != 5 {
+			t.Fatalf("GetTableEvents = %d events, %v, want the creation of the table and one per record change", len(events), err)
+		}
+		for i := 1; i < len(events); i++ {
+			if events[i].ID <= events[i-1].ID {
+				t.Errorf("event IDs %d and %d do not increase", events[i-1].ID, events[i].ID)
+			}
+		}
+		if latest, err := stores.Changes.LatestEventID(); err != nil || latest != events[len(events)-1].ID {
+			t.Errorf("LatestEventID = %d, %v, want the last event", latest, err)
+		}
+
+		// Only the paid record matched the filter, and deletes are not subscribed to
+		deliveries, err := stores.Webhooks.GetDeliveries("acme", hook.ID, "", 1, 10)
+		if err != nil || deliveries.Total != 1 || deliveries.Deliveries[0].Event != models.AuditContentCreate {
+			t.Fatalf("GetDeliveries = %+v, %v, want the creation of the paid record", deliveries, err)
+		}
+		claimed, err := stores.Webhooks.ClaimDeliveries(10, time.Minute)
+		if err != nil || len(claimed) != 1 || claimed[0].URL != hook.URL || claimed[0].Secret == "" {
+			t.Fatalf("ClaimDeliveries = %+v, %v, want the delivery with its webhook", claimed, err)
+		}
+		if again, err := stores.Webhooks.ClaimDeliveries(10, time.Minute); err != nil || len(again) != 0 {
+			t.Errorf("ClaimDeliveries during the lease = %d deliveries, %v", len(again), err)
+		}
+		attempt := &models.WebhookAttempt{Attempt: 1, StatusCode: 200, DurationMs: 5}
+		if err := stores.Webhooks.RecordAttempt(claimed[0].ID, attempt, "delivered", 0); err != nil {
+			t.Fatal(err)
+		}
+		deliveries, err = stores.Webhooks.GetDeliveries("acme", hook.ID, "delivered", 1, 10)
+		if err != nil || deliveries.Total != 1 || len(deliveries.Deliveries[0].AttemptLog) != 1 || deliveries.Deliveries[0].DeliveredAt == nil {
+			t.Errorf("GetDeliveries = %+v, %v, want the delivered delivery with its attempt", deliveries, err)
+		}
+	})
+}
+
+func TestTrashPurge(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, stores *Stores) {
+		status := models.Field{Name: "status", Label: "Status", DataType: "text"}
+		mustCreateSchema(t, stores, "acme", "orders", status)
+		mustCreateSchema(t, stores, "acme", "invoices", status)
+		order := mustCreateContent(t, stores, "acme", "orders", map[string]interface{}{"status": "open"})
+		mustCreateContent(t, stores, "acme", "orders", map[string]interface{}{"status": "paid"})
+		mustCreateContent(t, stores, "acme", "invoices", map[string]interface{}{"status": "open"})
+		if err := stores.Contents.DeleteContent("acme", order.ID, testAdmin); err != nil {
+			t.Fatal(err)
+		}
+		if err := stores.Schemas.DeleteSchema("acme", "invoices", testAdmin); err != nil {
+			t.Fatal(err)
+		}
+
+		if schemas, contents, err := stores.Trash.PurgeTrash(time.Hour); err != nil || schemas != 0 || contents != 0 {
+			t.Errorf("PurgeTrash of recent deletions = %d schemas, %d contents, %v", schemas, contents, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if schemas, contents, err := stores.Trash.PurgeTrash(time.Millisecond); err != nil || schemas != 1 || contents != 1 {
+			t.Errorf("PurgeTrash = %d schemas, %d contents, %v, want the table and the record deleted on its own", schemas, contents, err)
+		}
+		if schemas, err := stores.Schemas.GetTrashedSchemas("acme"); err != nil || len(schemas) != 0 {
+			t.Errorf("GetTrashedSchemas after the purge = %d schemas, %v", len(schemas), err)
+		}
+		list, err := stores.Contents.GetContentsByTableSlug("acme", "orders", &models.ContentQueryParams{Page: 1, PageSize: 10, Trashed: true, Principal: testAdmin})
+		if err != nil || list.Total != 0 {
+			t.Errorf("trashed orders after the purge = %+v, %v", list, err)
+		}
+	})
+}
+
+func TestUnreferencedFiles(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, stores *Stores) {
+		attachment := models.Field{Name: "attachment", Label: "Attachment", DataType: models.FileDataType}
+		mustCreateSchema(t, stores, "acme", "orders", attachment)
+		order := mustCreateContent(t, stores, "acme", "orders", map[string]interface{}{})
+
+		upload := func() *models.File {
+			file, err := stores.Files.CreateFile(&models.File{
+				Tenant: "acme", TableSlug: "orders", ContentID: order.ID, FieldName: "attachment",
+				Name: "invoice.pdf", Size: 3, MimeType: "application/pdf", Checksum: "abc",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return file
+		}
+		kept, dropped := upload(), upload()
+		update := &models.UpdateContentRequest{Values: map[string]interface{}{"attachment": map[string]interface{}{"id": kept.ID}}}
+		if _, err := stores.Contents.UpdateContent("acme", order.ID, update, testAdmin); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := stores.Files.AddVariant(kept.ID, "variants/thumb"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if file, err := stores.Files.GetFile("acme", kept.ID); err != nil || file == nil || len(file.Variants) != 1 {
+			t.Errorf("GetFile = %+v, %v, want the variant recorded once", file, err)
+		}
+		if file, err := stores.Files.GetFile("globex", kept.ID); err != nil || file != nil {
+			t.Errorf("GetFile of another tenant = %+v, %v", file, err)
+		}
+
+		files, err := stores.Files.GetUnreferencedFiles(0, 10)
+		if err != nil || len(files) != 1 || files[0].ID != dropped.ID {
+			t.Fatalf("GetUnreferencedFiles = %+v, %v, want only the file no record holds", files, err)
+		}
+		if files, err := stores.Files.GetUnreferencedFiles(time.Hour, 10); err != nil || len(files) != 0 {
+			t.Errorf("GetUnreferencedFiles within the grace period = %d files, %v", len(files), err)
+		}
+		if err := stores.Files.DeleteFile(dropped.ID); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
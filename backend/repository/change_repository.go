@@ -0,0 +1,191 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"fmt"
+)
+
+// ChangeChannel is the notification channel announcing committed change events; the payload is the event ID
+const ChangeChannel = "change_events"
+
+// Change events of records; schema changes keep their audit action as event
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// changeEvents maps audit actions to the change events they emit
+var changeEvents = map[string]string{
+	models.AuditContentCreate:  ChangeInsert,
+	models.AuditContentUpdate:  ChangeUpdate,
+	models.AuditContentDelete:  ChangeDelete,
+	models.AuditContentRestore: ChangeInsert,
+	models.AuditSchemaCreate:   models.AuditSchemaCreate,
+	models.AuditSchemaUpdate:   models.AuditSchemaUpdate,
+	models.AuditSchemaDelete:   models.AuditSchemaDelete,
+	models.AuditSchemaRestore:  models.AuditSchemaRestore,
+}
+
+type ChangeRepository struct {
+	db DB
+}
+
+func NewChangeRepository(db DB) *ChangeRepository {
+	return &ChangeRepository{db: db}
+}
+
+// recordEvent appends the change event of a schema or record change inside the transaction making it and
+// notifies listeners once it commits. Taking the next ID locks the counter row until the transaction ends, so
+// IDs become visible in increasing order and readers resuming after an ID never miss an event.
+func recordEvent(tx *sql.Tx, tenant string, action string, tableSlug string, recordID string, before, after json.RawMessage) error {
+	event, ok := changeEvents[action]
+	if !ok {
+		return nil
+	}
+	values := after
+	if after == nil {
+		values = before
+	}
+
+	var id int64
+	if err := tx.QueryRow(`UPDATE change_sequence SET last_id = last_id + 1 RETURNING last_id`).Scan(&id); err != nil {
+		return fmt.Errorf("failed to allocate change event id: %v", err)
+	}
+
+	query := `
+		INSERT INTO change_events (id, tenant, table_slug, record_id, event, values)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	if _, err := tx.Exec(query, id, tenant, tableSlug, recordID, event, []byte(values)); err != nil {
+		return fmt.Errorf("failed to record change event: %v", err)
+	}
+
+	// Notifications are delivered on commit and dropped on rollback
+	if _, err := tx.Exec(`SELECT pg_notify($1, $2)`, ChangeChannel, fmt.Sprint(id)); err != nil {
+		return fmt.Errorf("failed to notify change event: %v", err)
+	}
+	return nil
+}
+
+// recordCascade runs an update moving a table's records in or out of the trash together with their
+// schema and appends a change event for each record it returns as (id, values). Consumers of the
+// change log thus see the records of a deleted table go and those of a restored table come back.
+func recordCascade(tx *sql.Tx, tenant string, action string, tableSlug string, query string, args ...interface{}) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update contents: %v", err)
+	}
+	var contents []models.ContentScan
+	for rows.Next() {
+		var content models.ContentScan
+		if err := rows.Scan(&content.ID, &content.Values); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan content: %v", err)
+		}
+		contents = append(contents, content)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to update contents: %v", err)
+	}
+
+	// The events are written once the rows are read, as a connection runs one statement at a time
+	for _, content := range contents {
+		before, after := content.Values, json.RawMessage(nil)
+		if action != models.AuditContentDelete {
+			before, after = nil, content.Values
+		}
+		if err := recordEvent(tx, tenant, action, tableSlug, content.ID, before, after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetChanges returns a page of the change log of a tenant after the given event ID, oldest first
+func (r *ChangeRepository) GetChanges(tenant string, since int64, limit int) (*models.ChangeFeedResponse, error) {
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+
+	query := `
+		SELECT id, tenant, table_slug, record_id, event, "values", created_at
+		FROM change_events
+		WHERE tenant = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`
+	events, err := r.queryEvents(query, tenant, since, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &models.ChangeFeedResponse{Changes: events, Next: since}
+	if len(events) > limit {
+		response.Changes = events[:limit]
+		response.HasMore = true
+	}
+	if len(response.Changes) > 0 {
+		response.Next = response.Changes[len(response.Changes)-1].ID
+	}
+	return response, nil
+}
+
+// GetEvents returns up to limit change events of every tenant with an ID greater than since, oldest first
+func (r *ChangeRepository) GetEvents(since int64, limit int) ([]*models.ChangeEvent, error) {
+	query := `
+		SELECT id, tenant, table_slug, record_id, event, "values", created_at
+		FROM change_events
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+	return r.queryEvents(query, since, limit)
+}
+
+// GetTableEvents returns up to limit change events of a tenant's table with an ID greater than since, oldest first
+func (r *ChangeRepository) GetTableEvents(tenant string, tableSlug string, since int64, limit int) ([]*models.ChangeEvent, error) {
+	query := `
+		SELECT id, tenant, table_slug, record_id, event, "values", created_at
+		FROM change_events
+		WHERE tenant = $1 AND table_slug = $2 AND id > $3
+		ORDER BY id
+		LIMIT $4`
+	return r.queryEvents(query, tenant, tableSlug, since, limit)
+}
+
+// LatestEventID returns the ID of the last committed change event
+func (r *ChangeRepository) LatestEventID() (int64, error) {
+	var id int64
+	if err := r.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM change_events`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to get latest change event: %v", err)
+	}
+	return id, nil
+}
+
+func (r *ChangeRepository) queryEvents(query string, args ...interface{}) ([]*models.ChangeEvent, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get change events: %v", err)
+	}
+	defer rows.Close()
+
+	events := []*models.ChangeEvent{}
+	for rows.Next() {
+		var event models.ChangeEvent
+		var values []byte
+		if err := rows.Scan(&event.ID, &event.Tenant, &event.TableSlug, &event.RecordID, &event.Event, &values, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan change event: %v", err)
+		}
+		if values != nil {
+			if err := json.Unmarshal(values, &event.Values); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal change event values: %v", err)
+			}
+		}
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get change events: %v", err)
+	}
+	return events, nil
+}
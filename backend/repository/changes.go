@@ -0,0 +1,21 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/models"
+	"encoding/json"
+)
+
+// recordChange records a schema or record change inside the transaction making it: it appends the
+// audit entry and queues the deliveries of the webhooks subscribed to it. action is one of the audit
+// actions, and before and after hold the JSON object of the record values or schema around the change.
+// Record changes are also appended to the change event stream.
+func recordChange(tx *sql.Tx, tenant string, actor *models.Principal, action string, tableSlug string, recordID string, before, after json.RawMessage) error {
+	if err := recordAudit(tx, tenant, actor, action, tableSlug, recordID, before, after); err != nil {
+		return err
+	}
+	if err := recordEvent(tx, tenant, action, tableSlug, recordID, before, after); err != nil {
+		return err
+	}
+	return enqueueWebhooks(tx, tenant, action, tableSlug, recordID, before, after)
+}
@@ -0,0 +1,516 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+)
+
+// The conformance tests run the same cases against every backend, so that the embedded stores keep
+// the query semantics of the PostgreSQL repositories.
+
+var (
+	testReader = &models.Principal{
+		ID:     "reader",
+		Name:   "reader",
+		Roles:  []string{"staff"},
+		Grants: []models.Grant{{Permission: models.PermissionContentRead}},
+	}
+	testManager = &models.Principal{
+		ID:     "manager",
+		Name:   "manager",
+		Roles:  []string{"manager"},
+		Grants: []models.Grant{{Permission: models.PermissionContentRead}},
+	}
+)
+
+// prepareFields resolves links and type-checks formulas like the schema handler does before saving
+func prepareFields(t *testing.T, stores *Stores, tenant string, tableSlug string, fields []models.Field) {
+	t.Helper()
+	if err := stores.Schemas.ResolveLinks(tenant, tableSlug, fields); err != nil {
+		t.Fatal(err)
+	}
+	if err := formula.Validate(fields); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seedOrders creates customers and their orders, one after the other:
+//
+//	O-1  100   paid       2024-01-10  C1  "vip"
+//	O-2  25.5  open       2024-02-01  C2  "call first"
+//	O-3  7     paid       2023-12-31  C1
+//	O-4  300   cancelled  2024-03-15  C2
+//	O-5        open
+//
+// The customers C1 "Acme Corp", C2 "Globex" and C3 "Initech" roll up the count and total of their orders.
+// Orders have a formula net = total * 2, a lookup of their customer's name and notes only managers read.
+func seedOrders(t *testing.T, stores *Stores) map[string]*models.Content {
+	t.Helper()
+	const tenant = "acme"
+
+	customerFields := []models.Field{
+		{Name: "code", Label: "Code", DataType: "text"},
+		{Name: "name", Label: "Name", DataType: "text"},
+	}
+	prepareFields(t, stores, tenant, "customers", customerFields)
+	mustCreateSchema(t, stores, tenant, "customers", customerFields...)
+
+	orderFields := []models.Field{
+		{Name: "number", Label: "Number", DataType: "text"},
+		{Name: "total", Label: "Total", DataType: "number"},
+		{Name: "status", Label: "Status", DataType: "text"},
+		{Name: "placed", Label: "Placed", DataType: "date"},
+		{Name: "customer", Label: "Customer", DataType: "relation", RelationConfig: &models.RelationConfig{
+			RelationType: "many-to-one", RelatedTable: "customers", RelatedField: "code", DisplayField: "name",
+		}},
+		{Name: "notes", Label: "Notes", DataType: "text", ReadRoles: []string{"manager"}},
+		{Name: "net", Label: "Net", DataType: formula.DataType, Formula: "total * 2"},
+		{Name: "customerName", Label: "Customer name", DataType: formula.LookupDataType, LinkConfig: &models.LinkConfig{
+			RelationField: "customer", TargetField: "name",
+		}},
+	}
+	prepareFields(t, stores, tenant, "orders", orderFields)
+	mustCreateSchema(t, stores, tenant, "orders", orderFields...)
+
+	// Rollups following the orders' relation in reverse need the orders table
+	customerFields = append(customerFields,
+		models.Field{Name: "orderCount", Label: "Orders", DataType: formula.RollupDataType, LinkConfig: &models.LinkConfig{
+			RelationField: "customer", Reverse: true, RelatedTable: "orders", Aggregate: "count",
+		}},
+		models.Field{Name: "orderTotal", Label: "Order total", DataType: formula.RollupDataType, LinkConfig: &models.LinkConfig{
+			RelationField: "customer", Reverse: true, RelatedTable: "orders", TargetField: "total", Aggregate: "sum",
+		}},
+	)
+	prepareFields(t, stores, tenant, "customers", customerFields)
+	if _, err := stores.Schemas.UpdateSchema(tenant, "customers", &models.UpdateSchemaRequest{TableName: "customers", Fields: customerFields}, testAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[string]*models.Content{}
+	for _, values := range []map[string]interface{}{
+		{"code": "C1", "name": "Acme Corp"},
+		{"code": "C2", "name": "Globex"},
+		{"code": "C3", "name": "Initech"},
+	} {
+		records[values["code"].(string)] = mustCreateContent(t, stores, tenant, "customers", values)
+	}
+	for _, values := range []map[string]interface{}{
+		{"number": "O-1", "total": 100, "status": "paid", "placed": "2024-01-10", "customer": "C1", "notes": "vip"},
+		{"number": "O-2", "total": 25.5, "status": "open", "placed": "2024-02-01", "customer": "C2", "notes": "call first"},
+		{"number": "O-3", "total": 7, "status": "paid", "placed": "2023-12-31", "customer": "C1"},
+		{"number": "O-4", "total": 300, "status": "cancelled", "placed": "2024-03-15", "customer": "C2"},
+		{"number": "O-5", "status": "open"},
+	} {
+		records[values["number"].(string)] = mustCreateContent(t, stores, tenant, "orders", values)
+	}
+	return records
+}
+
+// numbers returns the order numbers, or customer codes, of records in their order
+func numbers(contents []*models.Content) []string {
+	result := []string{}
+	for _, content := range contents {
+		if number, ok := content.Values["number"].(string); ok {
+			result = append(result, number)
+		} else {
+			result = append(result, fmt.Sprint(content.Values["code"]))
+		}
+	}
+	return result
+}
+
+// scalar normalizes a value scanned by any backend for comparison
+func scalar(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return scalar(string(v))
+	case string:
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n
+		}
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return value
+}
+
+func TestConformance(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, stores *Stores) {
+		records := seedOrders(t, stores)
+		list := func(t *testing.T, tableSlug string, params *models.ContentQueryParams) *models.ContentResponse {
+			t.Helper()
+			if params.Principal == nil {
+				params.Principal = testAdmin
+			}
+			response, err := stores.Contents.GetContentsByTableSlug("acme", tableSlug, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return response
+		}
+		byNumber := []models.SortOption{{Field: "number"}}
+
+		t.Run("pagination", func(t *testing.T) {
+			tests := []struct {
+				params *models.ContentQueryParams
+				want   []string
+				pages  int
+				size   int
+			}{
+				// Newest first by default
+				{&models.ContentQueryParams{}, []string{"O-5", "O-4", "O-3", "O-2", "O-1"}, 1, 10},
+				{&models.ContentQueryParams{Page: 2, PageSize: 2}, []string{"O-3", "O-2"}, 3, 2},
+				{&models.ContentQueryParams{Page: 3, PageSize: 2}, []string{"O-1"}, 3, 2},
+				{&models.ContentQueryParams{Page: 4, PageSize: 2}, []string{}, 3, 2},
+				{&models.ContentQueryParams{Skip: 1, PageSize: 2}, []string{"O-4", "O-3"}, 3, 2},
+				{&models.ContentQueryParams{PageSize: 500}, []string{"O-5", "O-4", "O-3", "O-2", "O-1"}, 1, 100},
+			}
+			for _, tt := range tests {
+				response := list(t, "orders", tt.params)
+				if got := numbers(response.Contents); !reflect.DeepEqual(got, tt.want) || response.Total != 5 || response.TotalPages != tt.pages || response.PageSize != tt.size {
+					t.Errorf("page %d of %d (skip %d) = %v, total %d, %d pages of %d, want %v, total 5, %d pages of %d",
+						tt.params.Page, tt.params.PageSize, tt.params.Skip, got, response.Total, response.TotalPages, response.PageSize, tt.want, tt.pages, tt.size)
+				}
+			}
+		})
+
+		t.Run("sorting", func(t *testing.T) {
+			tests := []struct {
+				sorts []models.SortOption
+				want  []string
+			}{
+				// Numbers compare by value and missing values sort last ascending, first descending
+				{[]models.SortOption{{Field: "total"}}, []string{"O-3", "O-2", "O-1", "O-4", "O-5"}},
+				{[]models.SortOption{{Field: "total", Desc: true}}, []string{"O-5", "O-4", "O-1", "O-2", "O-3"}},
+				{[]models.SortOption{{Field: "placed"}}, []string{"O-3", "O-1", "O-2", "O-4", "O-5"}},
+				{[]models.SortOption{{Field: "net", Desc: true}}, []string{"O-5", "O-4", "O-1", "O-2", "O-3"}},
+				{[]models.SortOption{{Field: "createdAt"}}, []string{"O-1", "O-2", "O-3", "O-4", "O-5"}},
+				{[]models.SortOption{{Field: "status"}, {Field: "total", Desc: true}}, []string{"O-4", "O-5", "O-2", "O-1", "O-3"}},
+			}
+			for _, tt := range tests {
+				response := list(t, "orders", &models.ContentQueryParams{Sorts: tt.sorts})
+				if got := numbers(response.Contents); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("sorted by %+v = %v, want %v", tt.sorts, got, tt.want)
+				}
+			}
+
+			response := list(t, "orders", &models.ContentQueryParams{SortBy: "number", SortDir: "desc"})
+			if got, want := numbers(response.Contents), []string{"O-5", "O-4", "O-3", "O-2", "O-1"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("sorted by number descending = %v, want %v", got, want)
+			}
+			response = list(t, "customers", &models.ContentQueryParams{Sorts: []models.SortOption{{Field: "orderTotal", Desc: true}}})
+			if got, want := numbers(response.Contents), []string{"C2", "C1", "C3"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("customers sorted by order total = %v, want %v", got, want)
+			}
+		})
+
+		t.Run("search", func(t *testing.T) {
+			tests := []struct {
+				search    string
+				principal *models.Principal
+				want      []string
+			}{
+				{"CALL", testAdmin, []string{"O-2"}},
+				{"o-", testAdmin, []string{"O-1", "O-2", "O-3", "O-4", "O-5"}},
+				{"2024-0", testAdmin, []string{"O-1", "O-2", "O-4"}},
+				// Only stored values are searched, and hidden fields are not
+				{"Acme", testAdmin, []string{}},
+				{"call", testReader, []string{}},
+				{"call", testManager, []string{"O-2"}},
+			}
+			for _, tt := range tests {
+				response := list(t, "orders", &models.ContentQueryParams{Search: tt.search, Principal: tt.principal, Sorts: byNumber})
+				if got := numbers(response.Contents); !reflect.DeepEqual(got, tt.want) || response.Total != len(tt.want) {
+					t.Errorf("search %q by %s = %v, total %d, want %v", tt.search, tt.principal.ID, got, response.Total, tt.want)
+				}
+			}
+		})
+
+		t.Run("filters", func(t *testing.T) {
+			response := list(t, "orders", &models.ContentQueryParams{Filters: map[string]string{"status": "paid"}, Sorts: byNumber})
+			if got, want := numbers(response.Contents), []string{"O-1", "O-3"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("filters status=paid = %v, want %v", got, want)
+			}
+			response = list(t, "orders", &models.ContentQueryParams{Filters: map[string]string{"status": "open", "customer": "C2"}, Sorts: byNumber})
+			if got, want := numbers(response.Contents), []string{"O-2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("filters status=open,customer=C2 = %v, want %v", got, want)
+			}
+
+			eq := func(field string, value interface{}) *models.FilterExpr {
+				return &models.FilterExpr{Op: "eq", Field: field, Value: value}
+			}
+			tests := []struct {
+				filter    *models.FilterExpr
+				principal *models.Principal
+				want      []string
+			}{
+				{&models.FilterExpr{Op: "gt", Field: "total", Value: 50}, testAdmin, []string{"O-1", "O-4"}},
+				{&models.FilterExpr{Op: "le", Field: "total", Value: "25.5"}, testAdmin, []string{"O-2", "O-3"}},
+				{eq("total", 100), testAdmin, []string{"O-1"}},
+				// Comparisons with missing values are never true
+				{&models.FilterExpr{Op: "ne", Field: "total", Value: 100}, testAdmin, []string{"O-2", "O-3", "O-4"}},
+				{&models.FilterExpr{Op: "not", Args: []*models.FilterExpr{{Op: "gt", Field: "total", Value: 50}}}, testAdmin, []string{"O-2", "O-3", "O-5"}},
+				{eq("total", nil), testAdmin, []string{"O-5"}},
+				{&models.FilterExpr{Op: "ne", Field: "customer", Value: nil}, testAdmin, []string{"O-1", "O-2", "O-3", "O-4"}},
+				{&models.FilterExpr{Op: "in", Field: "status", Values: []interface{}{"open", "cancelled"}}, testAdmin, []string{"O-2", "O-4", "O-5"}},
+				{&models.FilterExpr{Op: "in", Field: "total", Values: []interface{}{7, "300"}}, testAdmin, []string{"O-3", "O-4"}},
+				{&models.FilterExpr{Op: "in", Field: "status", Values: []interface{}{}}, testAdmin, []string{}},
+				{&models.FilterExpr{Op: "contains", Field: "number", Value: "-"}, testAdmin, []string{"O-1", "O-2", "O-3", "O-4", "O-5"}},
+				{&models.FilterExpr{Op: "contains", Field: "notes", Value: "_"}, testAdmin, []string{}},
+				{&models.FilterExpr{Op: "startswith", Field: "status", Value: "ca"}, testAdmin, []string{"O-4"}},
+				{&models.FilterExpr{Op: "endswith", Field: "notes", Value: "first"}, testAdmin, []string{"O-2"}},
+				// Text compares case-sensitively
+				{eq("status", "Paid"), testAdmin, []string{}},
+				{&models.FilterExpr{Op: "or", Args: []*models.FilterExpr{eq("status", "cancelled"), {Op: "lt", Field: "total", Value: 10}}}, testAdmin, []string{"O-3", "O-4"}},
+				{&models.FilterExpr{Op: "and", Args: []*models.FilterExpr{eq("status", "paid"), {Op: "ge", Field: "placed", Value: "2024-01-01"}}}, testAdmin, []string{"O-1"}},
+				// Computed fields filter like stored ones
+				{&models.FilterExpr{Op: "gt", Field: "net", Value: 100}, testAdmin, []string{"O-1", "O-4"}},
+				{eq("customerName", "Acme Corp"), testAdmin, []string{"O-1", "O-3"}},
+				// Hidden fields behave as if they were empty
+				{eq("notes", "vip"), testReader, []string{}},
+				{eq("notes", nil), testReader, []string{"O-1", "O-2", "O-3", "O-4", "O-5"}},
+				{eq("notes", "vip"), testManager, []string{"O-1"}},
+			}
+			for _, tt := range tests {
+				response := list(t, "orders", &models.ContentQueryParams{Filter: tt.filter, Principal: tt.principal, Sorts: byNumber})
+				if got := numbers(response.Contents); !reflect.DeepEqual(got, tt.want) || response.Total != len(tt.want) {
+					t.Errorf("filter %s %s %v %v by %s = %v, total %d, want %v",
+						tt.filter.Op, tt.filter.Field, tt.filter.Value, tt.filter.Values, tt.principal.ID, got, response.Total, tt.want)
+				}
+			}
+
+			customers := list(t, "customers", &models.ContentQueryParams{
+				Filter: &models.FilterExpr{Op: "ge", Field: "orderCount", Value: 2},
+				Sorts:  []models.SortOption{{Field: "code"}},
+			})
+			if got, want := numbers(customers.Contents), []string{"C1", "C2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("customers with at least 2 orders = %v, want %v", got, want)
+			}
+
+			if _, err := stores.Contents.GetContentsByTableSlug("acme", "orders", &models.ContentQueryParams{
+				Filter: &models.FilterExpr{Op: "gt", Field: "total", Value: "lots"}, Principal: testAdmin,
+			}); err == nil {
+				t.Errorf("comparing a number field with text succeeded")
+			}
+		})
+
+		t.Run("computed fields and relations", func(t *testing.T) {
+			order, err := stores.Contents.GetContentByID("acme", records["O-1"].ID, testAdmin)
+			if err != nil || order == nil {
+				t.Fatalf("GetContentByID = %v, %v", order, err)
+			}
+			if scalar(order.Values["net"]) != float64(200) {
+				t.Errorf("net = %v, want 200", order.Values["net"])
+			}
+			if got := order.Values["customerName"]; !reflect.DeepEqual(got, []interface{}{"Acme Corp"}) {
+				t.Errorf("customerName = %#v, want [Acme Corp]", got)
+			}
+
+			response := list(t, "orders", &models.ContentQueryParams{Sorts: byNumber})
+			first := response.Contents[0]
+			related, ok := first.Values["_customer_related"].(map[string]interface{})
+			if !ok || related["name"] != "Acme Corp" {
+				t.Errorf("related customer of O-1 = %#v", first.Values["_customer_related"])
+			}
+			if _, ok := response.Contents[4].Values["_customer_related"]; ok {
+				t.Errorf("O-5 without a customer has related data %v", response.Contents[4].Values["_customer_related"])
+			}
+
+			customers := list(t, "customers", &models.ContentQueryParams{Sorts: []models.SortOption{{Field: "code"}}})
+			want := [][2]float64{{2, 107}, {2, 325.5}, {0, 0}}
+			for i, customer := range customers.Contents {
+				got := [2]interface{}{scalar(customer.Values["orderCount"]), scalar(customer.Values["orderTotal"])}
+				if got != [2]interface{}{want[i][0], want[i][1]} {
+					t.Errorf("customer %v rolls up %v, want %v", customer.Values["code"], got, want[i])
+				}
+			}
+
+			matches, err := stores.Contents.GetContentsByFieldValues("acme", "customers", "code", []string{"C1", "C3", "C9"}, testAdmin)
+			if err != nil || len(matches) != 2 {
+				t.Errorf("GetContentsByFieldValues = %d records, %v, want 2", len(matches), err)
+			}
+			options, err := stores.Contents.GetRelatedDataForField("acme", &models.RelationConfig{RelatedTable: "customers", RelatedField: "code", DisplayField: "name"}, testAdmin)
+			if err != nil || len(options) != 3 || options[0]["code"] != "C3" {
+				t.Errorf("GetRelatedDataForField = %v, %v, want the 3 customers, newest first", options, err)
+			}
+		})
+
+		t.Run("aggregates", func(t *testing.T) {
+			response, err := stores.Contents.AggregateContents("acme", "orders", &models.ContentQueryParams{Principal: testAdmin}, &models.AggregateRequest{
+				Metrics: []models.AggregateMetric{{Func: "count"}, {Func: "sum", Field: "total"}, {Func: "max", Field: "net"}},
+				GroupBy: []models.AggregateGroup{{Field: "status"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []struct {
+				status string
+				count  float64
+				sum    float64
+				max    float64
+			}{
+				{"cancelled", 1, 300, 600},
+				{"open", 2, 25.5, 51},
+				{"paid", 2, 107, 200},
+			}
+			if len(response.Groups) != len(want) {
+				t.Fatalf("aggregated %d groups, want %d", len(response.Groups), len(want))
+			}
+			for i, group := range response.Groups {
+				got := []interface{}{scalar(group.Key["status"]), scalar(group.Metrics["count"]), scalar(group.Metrics["sum_total"]), scalar(group.Metrics["max_net"])}
+				if expected := []interface{}{want[i].status, want[i].count, want[i].sum, want[i].max}; !reflect.DeepEqual(got, expected) {
+					t.Errorf("group %d = %v, want %v", i, got, expected)
+				}
+			}
+
+			response, err = stores.Contents.AggregateContents("acme", "orders", &models.ContentQueryParams{Principal: testAdmin}, &models.AggregateRequest{
+				Metrics: []models.AggregateMetric{{Func: "count"}},
+				GroupBy: []models.AggregateGroup{{Field: "placed", Bucket: "year"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var years []interface{}
+			for _, group := range response.Groups {
+				years = append(years, scalar(group.Key["placed"]), scalar(group.Metrics["count"]))
+			}
+			if want := []interface{}{"2023-01-01", float64(1), "2024-01-01", float64(3), nil, float64(1)}; !reflect.DeepEqual(years, want) {
+				t.Errorf("orders by year = %v, want %v", years, want)
+			}
+		})
+
+		t.Run("row policies and hidden fields", func(t *testing.T) {
+			if _, err := stores.Policies.SetPolicy("acme", "orders", "values.status == 'paid'"); err != nil {
+				t.Fatal(err)
+			}
+			defer stores.Policies.DeletePolicy("acme", "orders")
+
+			response := list(t, "orders", &models.ContentQueryParams{Principal: testReader, Sorts: byNumber})
+			if got, want := numbers(response.Contents), []string{"O-1", "O-3"}; !reflect.DeepEqual(got, want) || response.Total != 2 {
+				t.Errorf("reader lists %v, want %v", got, want)
+			}
+			for _, content := range response.Contents {
+				if _, ok := content.Values["notes"]; ok {
+					t.Errorf("reader reads the notes of %v", content.Values["number"])
+				}
+			}
+			if content, err := stores.Contents.GetContentByID("acme", records["O-2"].ID, testReader); err != nil || content != nil {
+				t.Errorf("reader gets a record the policy hides: %v, %v", content, err)
+			}
+			update := &models.UpdateContentRequest{Values: map[string]interface{}{"number": "O-2", "status": "paid"}}
+			if content, err := stores.Contents.UpdateContent("acme", records["O-2"].ID, update, testReader); err == nil && content != nil {
+				t.Errorf("reader updated a record the policy hides")
+			}
+			create := &models.CreateContentRequest{Values: map[string]interface{}{"number": "O-9", "status": "open"}}
+			if content, err := stores.Contents.CreateContent("acme", "orders", create, testReader); !errors.Is(err, ErrPolicyViolation) {
+				t.Errorf("reader created a record the policy hides: %v, %v", content, err)
+			}
+
+			// Rollups only count the linked rows the policy allows
+			customers := list(t, "customers", &models.ContentQueryParams{Principal: testReader, Sorts: []models.SortOption{{Field: "code"}}})
+			var counts []interface{}
+			for _, customer := range customers.Contents {
+				counts = append(counts, scalar(customer.Values["orderCount"]))
+			}
+			if want := []interface{}{float64(2), float64(0), float64(0)}; !reflect.DeepEqual(counts, want) {
+				t.Errorf("reader's customers roll up %v orders, want %v", counts, want)
+			}
+
+			response = list(t, "orders", &models.ContentQueryParams{Principal: testManager, Sorts: byNumber})
+			if len(response.Contents) != 2 || response.Contents[0].Values["notes"] != "vip" {
+				t.Errorf("manager lists %v", response.Contents)
+			}
+			response = list(t, "orders", &models.ContentQueryParams{Principal: testAdmin})
+			if response.Total != 5 {
+				t.Errorf("the policy limits administrators to %d records", response.Total)
+			}
+		})
+
+		t.Run("revisions and trash", func(t *testing.T) {
+			id := records["O-2"].ID
+			update := &models.UpdateContentRequest{Values: map[string]interface{}{"number": "O-2", "total": 30, "status": "paid", "customer": "C2"}}
+			if _, err := stores.Contents.UpdateContent("acme", id, update, testAdmin); err != nil {
+				t.Fatal(err)
+			}
+			revisions, err := stores.Contents.GetRevisions("acme", id, testAdmin)
+			if err != nil || len(revisions) != 2 {
+				t.Fatalf("GetRevisions = %d revisions, %v, want 2", len(revisions), err)
+			}
+			if scalar(revisions[0].Values["total"]) != 25.5 || scalar(revisions[1].Values["total"]) != float64(30) {
+				t.Errorf("revisions hold totals %v and %v, want 25.5 and 30", revisions[0].Values["total"], revisions[1].Values["total"])
+			}
+			diff, err := stores.Contents.DiffRevisions("acme", id, 1, 2, testAdmin)
+			if err != nil || diff == nil {
+				t.Fatalf("DiffRevisions = %v, %v", diff, err)
+			}
+			if _, err := stores.Contents.DiffRevisions("acme", id, 1, 9, testAdmin); !errors.Is(err, ErrRevisionNotFound) {
+				t.Errorf("DiffRevisions to a missing revision = %v, want ErrRevisionNotFound", err)
+			}
+
+			if err := stores.Contents.DeleteContent("acme", id, testAdmin); err != nil {
+				t.Fatal(err)
+			}
+			if response := list(t, "orders", &models.ContentQueryParams{}); response.Total != 4 {
+				t.Errorf("%d records outside the trash, want 4", response.Total)
+			}
+			trashed := list(t, "orders", &models.ContentQueryParams{Trashed: true})
+			if got := numbers(trashed.Contents); !reflect.DeepEqual(got, []string{"O-2"}) || trashed.Contents[0].DeletedAt == nil {
+				t.Errorf("trash holds %v", got)
+			}
+			if content, err := stores.Contents.GetContentByID("acme", id, testAdmin); err != nil || content != nil {
+				t.Errorf("GetContentByID of a record in the trash = %v, %v", content, err)
+			}
+			// Records in the trash are not linked
+			customers := list(t, "customers", &models.ContentQueryParams{Sorts: []models.SortOption{{Field: "code"}}})
+			if total := scalar(customers.Contents[1].Values["orderTotal"]); total != float64(300) {
+				t.Errorf("C2 rolls up a total of %v, want 300", total)
+			}
+
+			restored, err := stores.Contents.RestoreContent("acme", "orders", id, testAdmin)
+			if err != nil || restored == nil {
+				t.Fatalf("RestoreContent = %v, %v", restored, err)
+			}
+			if response := list(t, "orders", &models.ContentQueryParams{}); response.Total != 5 {
+				t.Errorf("%d records after restoring, want 5", response.Total)
+			}
+		})
+
+		t.Run("invalid dates", func(t *testing.T) {
+			undated := func() interface{} {
+				response, err := stores.Contents.AggregateContents("acme", "orders", &models.ContentQueryParams{Principal: testAdmin}, &models.AggregateRequest{
+					Metrics: []models.AggregateMetric{{Func: "count"}},
+					GroupBy: []models.AggregateGroup{{Field: "placed", Bucket: "month"}},
+				})
+				if err != nil {
+					t.Fatalf("AggregateContents = %v", err)
+				}
+				last := response.Groups[len(response.Groups)-1]
+				if scalar(last.Key["placed"]) != nil {
+					t.Fatalf("last group = %v, want the undated orders", last)
+				}
+				return scalar(last.Metrics["count"])
+			}
+			before := undated()
+
+			// Text that only starts like a date is no date, rather than failing the query
+			invalid := mustCreateContent(t, stores, "acme", "orders", map[string]interface{}{"number": "O-7", "placed": "2024-02-30"})
+			defer stores.Contents.DeleteContent("acme", invalid.ID, testAdmin)
+			if after := undated(); after != before.(float64)+1 {
+				t.Errorf("undated orders = %v, want %v", after, before.(float64)+1)
+			}
+			sorted := list(t, "orders", &models.ContentQueryParams{Sorts: []models.SortOption{{Field: "placed"}}})
+			if sorted.Total == 0 {
+				t.Errorf("orders sorted by date = %+v", sorted)
+			}
+		})
+	})
+}
@@ -2,34 +2,62 @@ package repository
 
 import (
 	"database/sql"
-	"dynamic-table-backend/database"
+	"dynamic-table-backend/formula"
 	"dynamic-table-backend/models"
+	"dynamic-table-backend/policy"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
-type ContentRepository struct{}
+// ErrPolicyViolation is returned when a record does not pass the row policy of its table for the principal
+var ErrPolicyViolation = errors.New("content violates the row policy")
+
+type ContentRepository struct {
+	db       DB
+	schemas  SchemaStore
+	policies PolicyStore
+}
 
-func NewContentRepository() *ContentRepository {
-	return &ContentRepository{}
+// NewContentRepository creates a content repository that reads table schemas and row policies from the given stores
+func NewContentRepository(db DB, schemas SchemaStore, policies PolicyStore) *ContentRepository {
+	return &ContentRepository{db: db, schemas: schemas, policies: policies}
 }
 
-// CreateContent creates a new content record
-func (r *ContentRepository) CreateContent(tableSlug string, content *models.CreateContentRequest) (*models.Content, error) {
+// schemaOf returns a function looking up the tables of a tenant by slug
+func (r *ContentRepository) schemaOf(tenant string) func(string) (*models.Schema, error) {
+	return func(tableSlug string) (*models.Schema, error) {
+		return r.schemas.GetSchemaBySlug(tenant, tableSlug)
+	}
+}
+
+// CreateContent creates a new content record in a tenant's table. The record must pass the table's row policy for the principal,
+// who is recorded in the audit log.
+func (r *ContentRepository) CreateContent(tenant string, tableSlug string, content *models.CreateContentRequest, principal *models.Principal) (*models.Content, error) {
 	valuesJSON, err := json.Marshal(content.Values)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal values: %v", err)
 	}
 
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO contents (table_slug, values)
-		VALUES ($1, $2)
+		INSERT INTO contents (tenant, table_slug, values)
+		VALUES ($1, $2, $3)
 		RETURNING id, table_slug, values, created_at, updated_at`
 
 	var contentScan models.ContentScan
-	err = database.DB.QueryRow(query, tableSlug, valuesJSON).Scan(
+	err = tx.QueryRow(query, tenant, tableSlug, valuesJSON).Scan(
 		&contentScan.ID,
 		&contentScan.TableSlug,
 		&contentScan.Values,
@@ -40,18 +68,39 @@ func (r *ContentRepository) CreateContent(tableSlug string, content *models.Crea
 		return nil, fmt.Errorf("failed to create content: %v", err)
 	}
 
-	return r.scanToContent(contentScan)
+	allowed, err := r.rowAllowed(tx, tenant, contentScan.ID, tableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrPolicyViolation
+	}
+
+	if err := syncMaterialized(tx, tenant, tableSlug, contentScan.ID); err != nil {
+		return nil, err
+	}
+
+	err = recordChange(tx, tenant, principal, models.AuditContentCreate, tableSlug, contentScan.ID, nil, contentScan.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit content: %v", err)
+	}
+
+	return r.scanComputed(tenant, contentScan, principal)
 }
 
-// GetContentByID retrieves content by ID
-func (r *ContentRepository) GetContentByID(id string) (*models.Content, error) {
+// GetContentByID retrieves content of a tenant by ID, or nil if it does not exist, is in the trash or the table's row policy hides it from the principal
+func (r *ContentRepository) GetContentByID(tenant string, id string, principal *models.Principal) (*models.Content, error) {
 	query := `
 		SELECT id, table_slug, values, created_at, updated_at
 		FROM contents
-		WHERE id = $1`
+		WHERE tenant = $1 AND id = $2 AND deleted_at IS NULL`
 
 	var contentScan models.ContentScan
-	err := database.DB.QueryRow(query, id).Scan(
+	err := r.db.QueryRow(query, tenant, id).Scan(
 		&contentScan.ID,
 		&contentScan.TableSlug,
 		&contentScan.Values,
@@ -65,62 +114,41 @@ func (r *ContentRepository) GetContentByID(id string) (*models.Content, error) {
 		return nil, fmt.Errorf("failed to get content: %v", err)
 	}
 
-	return r.scanToContent(contentScan)
-}
+	allowed, err := r.rowAllowed(r.db, tenant, contentScan.ID, contentScan.TableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, nil
+	}
 
-// GetContentsByTableSlug retrieves all contents for a specific table with search, filter, and sorting
-func (r *ContentRepository) GetContentsByTableSlug(tableSlug string, params *models.ContentQueryParams) (*models.ContentResponse, error) {
-	// Build the base query
-	baseQuery := `FROM contents WHERE table_slug = $1`
-	args := []interface{}{tableSlug}
-	argIndex := 2
+	return r.scanComputed(tenant, contentScan, principal)
+}
 
-	// Add search functionality
-	if params.Search != "" {
-		searchQuery := ` AND (
-			values::text ILIKE $%d
-		)`
-		searchArg := "%" + params.Search + "%"
-		baseQuery += fmt.Sprintf(searchQuery, argIndex)
-		args = append(args, searchArg)
-		argIndex++
+// GetContentsByTableSlug retrieves all contents for a specific table of a tenant with search, filter, and sorting
+func (r *ContentRepository) GetContentsByTableSlug(tenant string, tableSlug string, params *models.ContentQueryParams) (*models.ContentResponse, error) {
+	// Field types drive typed comparisons and sorting
+	fields, links, err := r.tableFields(tenant, tableSlug, params.Principal)
+	if err != nil {
+		return nil, err
 	}
 
-	// Add field-specific filters
-	if len(params.Filters) > 0 {
-		for fieldName, filterValue := range params.Filters {
-			if filterValue != "" {
-				filterQuery := ` AND values->>$%d = $%d`
-				baseQuery += fmt.Sprintf(filterQuery, argIndex, argIndex+1)
-				args = append(args, fieldName, filterValue)
-				argIndex += 2
-			}
-		}
+	// Build the base query; fields the principal may not read act as if they were empty
+	qb := newQueryBuilder(fields, tenant, tableSlug)
+	qb.links = links
+	qb.hidden = hiddenFields(fields, links, params.Principal)
+	if qb.table, err = r.materialized(tenant, tableSlug); err != nil {
+		return nil, err
 	}
-
-	// Build the complete query with sorting and pagination
-	orderBy := "created_at DESC"
-	if params.SortBy != "" {
-		// Validate sort direction
-		sortDir := "ASC"
-		if strings.ToUpper(params.SortDir) == "DESC" {
-			sortDir = "DESC"
-		}
-
-		// Handle special cases for sorting
-		switch params.SortBy {
-		case "created_at", "updated_at":
-			orderBy = fmt.Sprintf("%s %s", params.SortBy, sortDir)
-		default:
-			// For dynamic fields, sort by JSON value
-			orderBy = fmt.Sprintf("values->>'%s' %s", params.SortBy, sortDir)
-		}
+	baseQuery, err := r.filterClause(qb, tenant, tableSlug, params)
+	if err != nil {
+		return nil, err
 	}
 
 	// Count total records
 	countQuery := fmt.Sprintf("SELECT COUNT(*) %s", baseQuery)
 	var total int
-	err := database.DB.QueryRow(countQuery, args...).Scan(&total)
+	err = r.db.QueryRow(countQuery, qb.args...).Scan(&total)
 	if err != nil {
 		return nil, fmt.Errorf("failed to count contents: %v", err)
 	}
@@ -137,19 +165,50 @@ func (r *ContentRepository) GetContentsByTableSlug(tableSlug string, params *mod
 	}
 
 	offset := (params.Page - 1) * params.PageSize
+	if params.Skip > 0 {
+		offset = params.Skip
+	}
 	totalPages := (total + params.PageSize - 1) / params.PageSize
 
+	// Sort keys are bound after counting so the count query only sees its own arguments
+	orderBy := "created_at DESC"
+	if params.Trashed {
+		orderBy = "deleted_at DESC"
+	}
+	if len(params.Sorts) > 0 {
+		orderBy = qb.orderBy(params.Sorts)
+	} else if params.SortBy != "" {
+		// Validate sort direction
+		desc := strings.ToUpper(params.SortDir) == "DESC"
+		orderBy = qb.orderBy([]models.SortOption{{Field: params.SortBy, Desc: desc}})
+	}
+
+	// Project only the requested value keys
+	valuesExpr := "values"
+	var expand map[string][]string
+	var projected []string
+	if len(params.Fields) > 0 {
+		projected, expand = splitProjection(params.Fields)
+		// Computed formulas need the fields they read even when those are not requested
+		dependencies := formulaDependencies(fields, projected)
+		valuesExpr, err = qb.projection(dependencies)
+		if err != nil {
+			return nil, err
+		}
+		links = onlyLinks(links, dependencies)
+	}
+
 	// Build the final query with pagination
 	selectQuery := fmt.Sprintf(`
-		SELECT id, table_slug, values, created_at, updated_at
+		SELECT id, table_slug, %s, created_at, updated_at, deleted_at
 		%s
 		ORDER BY %s
-		LIMIT $%d OFFSET $%d
-	`, baseQuery, orderBy, argIndex, argIndex+1)
+		LIMIT %s OFFSET %s
+	`, valuesExpr, baseQuery, orderBy, qb.arg(params.PageSize), qb.arg(offset))
 
-	args = append(args, params.PageSize, offset)
+	args := qb.args
 
-	rows, err := database.DB.Query(selectQuery, args...)
+	rows, err := r.db.Query(selectQuery, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query contents: %v", err)
 	}
@@ -164,20 +223,31 @@ func (r *ContentRepository) GetContentsByTableSlug(tableSlug string, params *mod
 			&contentScan.Values,
 			&contentScan.CreatedAt,
 			&contentScan.UpdatedAt,
+			&contentScan.DeletedAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan content: %v", err)
 		}
 
-		content, err := r.scanToContent(contentScan)
+		content, err := scanToContent(contentScan)
 		if err != nil {
 			return nil, err
 		}
 		contents = append(contents, content)
 	}
 
+	if err := r.computeFields(tenant, contents, fields, links); err != nil {
+		return nil, err
+	}
+	if projected != nil {
+		for _, content := range contents {
+			keepKeys(content.Values, projected)
+		}
+	}
+	redact(contents, qb.hidden)
+
 	// Preload related data for relational fields
-	contents, err = r.preloadRelatedData(contents, tableSlug)
+	contents, err = r.preloadRelatedData(tenant, contents, tableSlug, expand, params.Principal)
 	if err != nil {
 		return nil, fmt.Errorf("failed to preload related data: %v", err)
 	}
@@ -191,14 +261,142 @@ func (r *ContentRepository) GetContentsByTableSlug(tableSlug string, params *mod
 	}, nil
 }
 
-// GetContents retrieves all contents for a specific table (backward compatibility)
-func (r *ContentRepository) GetContents(tableSlug string) ([]*models.Content, error) {
+// filterClause builds the FROM and WHERE clause for a table's live or trashed contents from the row
+// policy, search, filters and filter expression of the query parameters. The query builder must hold
+// the tenant and table slug as its first two arguments. Materialized tables join their typed table.
+func (r *ContentRepository) filterClause(qb *queryBuilder, tenant string, tableSlug string, params *models.ContentQueryParams) (string, error) {
+	from := `FROM contents`
+	if qb.table != nil {
+		from += fmt.Sprintf(` JOIN %s %s USING (id)`, qb.table.name, materializedAlias)
+	}
+	baseQuery := from + ` WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL`
+	if params.Trashed {
+		baseQuery = from + ` WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NOT NULL`
+	}
+
+	// Restrict to the rows the principal may access
+	policyClause, err := r.policyClause(qb, tenant, tableSlug, params.Principal)
+	if err != nil {
+		return "", err
+	}
+	baseQuery += policyClause
+
+	// Add search functionality
+	if params.Search != "" {
+		searched := "values"
+		if len(qb.hidden) > 0 {
+			// Hidden fields must not match searches
+			searched = fmt.Sprintf("(values - %s::text[])", qb.arg(pq.Array(hiddenNames(qb.hidden))))
+		}
+		searchQuery := ` AND (
+			%s::text ILIKE %s
+		)`
+		searchArg := "%" + params.Search + "%"
+		baseQuery += fmt.Sprintf(searchQuery, searched, qb.arg(searchArg))
+	}
+
+	// Add field-specific filters
+	if len(params.Filters) > 0 {
+		for fieldName, filterValue := range params.Filters {
+			if filterValue != "" {
+				filterQuery := ` AND %s = %s`
+				baseQuery += fmt.Sprintf(filterQuery, qb.textExpr(fieldName), qb.arg(filterValue))
+			}
+		}
+	}
+
+	// Add structured filter expression
+	if params.Filter != nil {
+		condition, err := qb.where(params.Filter)
+		if err != nil {
+			return "", err
+		}
+		baseQuery += " AND " + condition
+	}
+
+	return baseQuery, nil
+}
+
+// AggregateContents computes grouped metrics over the filtered contents of a tenant's table
+func (r *ContentRepository) AggregateContents(tenant string, tableSlug string, params *models.ContentQueryParams, aggregate *models.AggregateRequest) (*models.AggregateResponse, error) {
+	fields, links, err := r.tableFields(tenant, tableSlug, params.Principal)
+	if err != nil {
+		return nil, err
+	}
+
+	// Select list expressions are bound before the filter so arguments stay in order
+	qb := newQueryBuilder(fields, tenant, tableSlug)
+	qb.links = links
+	qb.hidden = hiddenFields(fields, links, params.Principal)
+	if qb.table, err = r.materialized(tenant, tableSlug); err != nil {
+		return nil, err
+	}
+	var columns []string
+	var positions []string
+	for i, group := range aggregate.GroupBy {
+		if group.Bucket != "" {
+			columns = append(columns, qb.bucketExpr(group.Field, group.Bucket))
+		} else {
+			columns = append(columns, qb.textExpr(group.Field))
+		}
+		positions = append(positions, fmt.Sprint(i+1))
+	}
+	for _, metric := range aggregate.Metrics {
+		columns = append(columns, qb.metricExpr(metric))
+	}
+
+	baseQuery, err := r.filterClause(qb, tenant, tableSlug, params)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("SELECT %s %s", strings.Join(columns, ", "), baseQuery)
+	if len(positions) > 0 {
+		grouping := strings.Join(positions, ", ")
+		query += fmt.Sprintf(" GROUP BY %s ORDER BY %s", grouping, grouping)
+	}
+
+	rows, err := r.db.Query(query, qb.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate contents: %v", err)
+	}
+	defer rows.Close()
+
+	response := &models.AggregateResponse{Groups: []models.AggregateRow{}}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("failed to scan aggregate: %v", err)
+		}
+
+		row := models.AggregateRow{
+			Key:     make(map[string]interface{}),
+			Metrics: make(map[string]interface{}),
+		}
+		for i, group := range aggregate.GroupBy {
+			row.Key[group.Field] = values[i]
+		}
+		for i, metric := range aggregate.Metrics {
+			row.Metrics[metric.Key()] = values[len(aggregate.GroupBy)+i]
+		}
+		response.Groups = append(response.Groups, row)
+	}
+
+	return response, nil
+}
+
+// GetContents retrieves all contents for a specific table of a tenant (backward compatibility)
+func (r *ContentRepository) GetContents(tenant string, tableSlug string) ([]*models.Content, error) {
 	params := &models.ContentQueryParams{
 		Page:     1,
 		PageSize: 1000, // Large number to get all
 	}
 
-	response, err := r.GetContentsByTableSlug(tableSlug, params)
+	response, err := r.GetContentsByTableSlug(tenant, tableSlug, params)
 	if err != nil {
 		return nil, err
 	}
@@ -206,21 +404,34 @@ func (r *ContentRepository) GetContents(tableSlug string) ([]*models.Content, er
 	return response.Contents, nil
 }
 
-// UpdateContent updates an existing content record
-func (r *ContentRepository) UpdateContent(id string, updateReq *models.UpdateContentRequest) (*models.Content, error) {
+// UpdateContent updates an existing content record of a tenant, returning nil if it does not exist or
+// the table's row policy hides it from the principal. The updated record must still pass the policy.
+// The replaced values are kept as a revision and the principal is recorded in the audit log.
+func (r *ContentRepository) UpdateContent(tenant string, id string, updateReq *models.UpdateContentRequest, principal *models.Principal) (*models.Content, error) {
 	valuesJSON, err := json.Marshal(updateReq.Values)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal values: %v", err)
 	}
 
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	existing, err := r.lockRow(tx, tenant, id, principal)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+
 	query := `
 		UPDATE contents
 		SET values = $1, updated_at = CURRENT_TIMESTAMP
-		WHERE id = $2
+		WHERE tenant = $2 AND id = $3
 		RETURNING id, table_slug, values, created_at, updated_at`
 
 	var contentScan models.ContentScan
-	err = database.DB.QueryRow(query, valuesJSON, id).Scan(
+	err = tx.QueryRow(query, valuesJSON, tenant, id).Scan(
 		&contentScan.ID,
 		&contentScan.TableSlug,
 		&contentScan.Values,
@@ -228,39 +439,230 @@ func (r *ContentRepository) UpdateContent(id string, updateReq *models.UpdateCon
 		&contentScan.UpdatedAt,
 	)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
 		return nil, fmt.Errorf("failed to update content: %v", err)
 	}
 
-	return r.scanToContent(contentScan)
+	// Records cannot be moved out of the principal's reach
+	allowed, err := r.rowAllowed(tx, tenant, id, existing.TableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrPolicyViolation
+	}
+
+	if err := recordRevision(tx, tenant, existing); err != nil {
+		return nil, err
+	}
+
+	if err := syncMaterialized(tx, tenant, existing.TableSlug, id); err != nil {
+		return nil, err
+	}
+
+	err = recordChange(tx, tenant, principal, models.AuditContentUpdate, existing.TableSlug, id, existing.Values, contentScan.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit content: %v", err)
+	}
+
+	return r.scanComputed(tenant, contentScan, principal)
 }
 
-// DeleteContent deletes a content record
-func (r *ContentRepository) DeleteContent(id string) error {
-	query := `DELETE FROM contents WHERE id = $1`
-	result, err := database.DB.Exec(query, id)
+// DeleteContent moves a content record of a tenant to the trash, recording the principal in the audit log.
+// Records hidden by the table's row policy are not found.
+func (r *ContentRepository) DeleteContent(tenant string, id string, principal *models.Principal) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	existing, err := r.lockRow(tx, tenant, id, principal)
 	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("content not found")
+	}
+
+	if _, err := tx.Exec(`UPDATE contents SET deleted_at = CURRENT_TIMESTAMP WHERE tenant = $1 AND id = $2`, tenant, id); err != nil {
 		return fmt.Errorf("failed to delete content: %v", err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	err = recordChange(tx, tenant, principal, models.AuditContentDelete, existing.TableSlug, id, existing.Values, nil)
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %v", err)
+		return err
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("content not found")
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit content: %v", err)
 	}
 
 	return nil
 }
 
-// DeleteContentsByTableSlug deletes all contents for a specific table
-func (r *ContentRepository) DeleteContentsByTableSlug(tableSlug string) error {
-	query := `DELETE FROM contents WHERE table_slug = $1`
-	_, err := database.DB.Exec(query, tableSlug)
+// RestoreContent moves a content record of a tenant's table out of the trash, recording the principal in the audit log.
+// It returns nil if the record is not in the table's trash or the table's row policy hides it. Records of a table
+// in the trash are restored with the table.
+func (r *ContentRepository) RestoreContent(tenant string, tableSlug string, id string, principal *models.Principal) (*models.Content, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE contents
+		SET deleted_at = NULL
+		WHERE tenant = $1 AND table_slug = $2 AND id = $3 AND deleted_at IS NOT NULL
+		AND EXISTS (
+			SELECT 1 FROM schemas
+			WHERE schemas.tenant = contents.tenant AND schemas.table_slug = contents.table_slug AND schemas.deleted_at IS NULL
+		)
+		RETURNING id, table_slug, values, created_at, updated_at`
+
+	var contentScan models.ContentScan
+	err = tx.QueryRow(query, tenant, tableSlug, id).Scan(
+		&contentScan.ID,
+		&contentScan.TableSlug,
+		&contentScan.Values,
+		&contentScan.CreatedAt,
+		&contentScan.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to restore content: %v", err)
+	}
+
+	allowed, err := r.rowAllowed(tx, tenant, id, contentScan.TableSlug, principal)
+	if err != nil || !allowed {
+		return nil, err
+	}
+
+	err = recordChange(tx, tenant, principal, models.AuditContentRestore, contentScan.TableSlug, id, nil, contentScan.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit content: %v", err)
+	}
+
+	return r.scanComputed(tenant, contentScan, principal)
+}
+
+// lockRow locks a live record of the tenant for a change and returns it as stored,
+// or nil if it does not exist, is in the trash or does not pass the row policy
+func (r *ContentRepository) lockRow(tx *sql.Tx, tenant string, id string, principal *models.Principal) (*models.ContentScan, error) {
+	query := `
+		SELECT id, table_slug, values, created_at, updated_at
+		FROM contents
+		WHERE tenant = $1 AND id = $2 AND deleted_at IS NULL
+		FOR UPDATE`
+
+	var contentScan models.ContentScan
+	err := tx.QueryRow(query, tenant, id).Scan(
+		&contentScan.ID,
+		&contentScan.TableSlug,
+		&contentScan.Values,
+		&contentScan.CreatedAt,
+		&contentScan.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get content: %v", err)
+	}
+
+	allowed, err := r.rowAllowed(tx, tenant, id, contentScan.TableSlug, principal)
+	if err != nil || !allowed {
+		return nil, err
+	}
+	return &contentScan, nil
+}
+
+// queryRower runs single row queries on the database or in a transaction
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rowAllowed reports whether a record passes its table's row policy for the principal
+func (r *ContentRepository) rowAllowed(q queryRower, tenant string, id string, tableSlug string, principal *models.Principal) (bool, error) {
+	qb := newQueryBuilder(nil, tenant, id)
+	policyClause, err := r.policyClause(qb, tenant, tableSlug, principal)
+	if err != nil {
+		return false, err
+	}
+	if policyClause == "" {
+		return true, nil
+	}
+
+	var allowed bool
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM contents WHERE tenant = $1 AND id = $2%s)`, policyClause)
+	if err := q.QueryRow(query, qb.args...).Scan(&allowed); err != nil {
+		return false, fmt.Errorf("failed to check row policy: %v", err)
+	}
+	return allowed, nil
+}
+
+// rowPolicy returns a table's row policy bound to the principal, or nil when every row is accessible:
+// for internal calls without a principal, for administrators and for tables without a policy.
+func (r *ContentRepository) rowPolicy(tenant string, tableSlug string, principal *models.Principal) (*models.FilterExpr, error) {
+	if principal == nil || principal.Can(models.PermissionAdmin, "") {
+		return nil, nil
+	}
+
+	rowPolicy, err := r.policies.GetPolicy(tenant, tableSlug)
+	if err != nil {
+		return nil, err
+	}
+	if rowPolicy == nil {
+		return nil, nil
+	}
+
+	node, err := policy.Parse(rowPolicy.Expression)
+	if err != nil {
+		// Policies are validated when they are set, but a broken one must hide rows rather than expose them
+		log.Printf("Failed to parse row policy of table %s: %v", tableSlug, err)
+		return policy.Never(), nil
+	}
+	return policy.Bind(node, principal), nil
+}
+
+// policyClause returns an " AND ..." condition restricting a query over a table to the rows
+// the principal may access, or an empty string if the principal may access every row
+func (r *ContentRepository) policyClause(qb *queryBuilder, tenant string, tableSlug string, principal *models.Principal) (string, error) {
+	filter, err := r.rowPolicy(tenant, tableSlug, principal)
+	if err != nil || filter == nil {
+		return "", err
+	}
+
+	var fields []models.Field
+	schema, err := r.schemas.GetSchemaBySlug(tenant, tableSlug)
+	if err != nil {
+		return "", err
+	}
+	if schema != nil {
+		fields = schema.Fields
+	}
+
+	condition, err := qb.policyCondition(fields, filter)
+	if err != nil {
+		return "", err
+	}
+	return " AND " + condition, nil
+}
+
+// DeleteContentsByTableSlug moves all contents for a specific table of a tenant to the trash
+func (r *ContentRepository) DeleteContentsByTableSlug(tenant string, tableSlug string) error {
+	query := `UPDATE contents SET deleted_at = CURRENT_TIMESTAMP WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL`
+	_, err := r.db.Exec(query, tenant, tableSlug)
 	if err != nil {
 		return fmt.Errorf("failed to delete contents: %v", err)
 	}
@@ -268,8 +670,202 @@ func (r *ContentRepository) DeleteContentsByTableSlug(tableSlug string) error {
 	return nil
 }
 
+// scanComputed converts ContentScan to Content and evaluates its computed fields
+func (r *ContentRepository) scanComputed(tenant string, scan models.ContentScan, principal *models.Principal) (*models.Content, error) {
+	content, err := scanToContent(scan)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, links, err := r.tableFields(tenant, content.TableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.computeFields(tenant, []*models.Content{content}, fields, links); err != nil {
+		return nil, err
+	}
+	redactValues(content.Values, hiddenFields(fields, links, principal))
+
+	return content, nil
+}
+
+// tableFields loads the fields of a tenant's table and resolves its lookup and rollup fields, which
+// only read the linked rows the principal may access. Links that no longer resolve, e.g. after a
+// related schema changed, are logged and read as null.
+func (r *ContentRepository) tableFields(tenant string, tableSlug string, principal *models.Principal) ([]models.Field, map[string]*link, error) {
+	schema, err := r.schemas.GetSchemaBySlug(tenant, tableSlug)
+	if err != nil {
+		return nil, nil, err
+	}
+	if schema == nil {
+		return nil, nil, nil
+	}
+
+	links := make(map[string]*link)
+	for _, field := range schema.Fields {
+		if field.DataType != formula.LookupDataType && field.DataType != formula.RollupDataType {
+			continue
+		}
+		l, err := resolveLink(tableSlug, schema.Fields, field, r.schemaOf(tenant))
+		if err != nil {
+			log.Printf("Failed to resolve %s field %s: %v", field.DataType, field.Name, err)
+			continue
+		}
+		if l.policy, err = r.rowPolicy(tenant, l.table, principal); err != nil {
+			return nil, nil, err
+		}
+		links[field.Name] = l
+	}
+
+	return schema.Fields, links, nil
+}
+
+// onlyLinks keeps the links whose fields are listed in keys
+func onlyLinks(links map[string]*link, keys []string) map[string]*link {
+	kept := make(map[string]*link)
+	for _, key := range keys {
+		if l, ok := links[key]; ok {
+			kept[key] = l
+		}
+	}
+	return kept
+}
+
+// computeFields evaluates lookup and rollup fields, then the formulas that may read them
+func (r *ContentRepository) computeFields(tenant string, contents []*models.Content, fields []models.Field, links map[string]*link) error {
+	if err := r.computeLinks(tenant, contents, links); err != nil {
+		return err
+	}
+	computeFormulas(contents, fields)
+	computeFileURLs(contents, fields)
+	return nil
+}
+
+// computeLinks evaluates the lookup and rollup fields of the given contents in a single query.
+// Linked rows are always read from the tenant of the row linking them.
+func (r *ContentRepository) computeLinks(tenant string, contents []*models.Content, links map[string]*link) error {
+	if len(contents) == 0 || len(links) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(links))
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// jsonb_build_object takes at most 100 arguments, so larger sets are merged in chunks
+	qb := newQueryBuilder(nil)
+	var objects []string
+	for start := 0; start < len(names); start += maxProjectedFields {
+		end := start + maxProjectedFields
+		if end > len(names) {
+			end = len(names)
+		}
+		parts := make([]string, 0, end-start)
+		for _, name := range names[start:end] {
+			parts = append(parts, fmt.Sprintf("%s::text, %s", qb.arg(name), qb.linkJSON(links[name])))
+		}
+		objects = append(objects, "jsonb_build_object("+strings.Join(parts, ", ")+")")
+	}
+
+	byID := make(map[string]*models.Content)
+	ids := make([]string, 0, len(contents))
+	for _, content := range contents {
+		byID[content.ID] = content
+		ids = append(ids, content.ID)
+	}
+
+	query := fmt.Sprintf("SELECT id, %s FROM contents WHERE tenant = %s AND id = ANY(%s::uuid[])", strings.Join(objects, " || "), qb.arg(tenant), qb.arg(pq.Array(ids)))
+	rows, err := r.db.Query(query, qb.args...)
+	if err != nil {
+		return fmt.Errorf("failed to compute linked fields: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var valuesJSON json.RawMessage
+		if err := rows.Scan(&id, &valuesJSON); err != nil {
+			return fmt.Errorf("failed to scan linked fields: %v", err)
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal(valuesJSON, &values); err != nil {
+			return fmt.Errorf("failed to unmarshal linked fields: %v", err)
+		}
+
+		content := byID[id]
+		if content == nil {
+			continue
+		}
+		if content.Values == nil {
+			content.Values = make(map[string]interface{})
+		}
+		for key, value := range values {
+			content.Values[key] = value
+		}
+	}
+
+	return rows.Err()
+}
+
+// computeFormulas evaluates the formula fields computed on read for each content
+func computeFormulas(contents []*models.Content, fields []models.Field) {
+	now := time.Now()
+	for _, content := range contents {
+		formula.ApplyComputed(fields, content.Values, now)
+	}
+}
+
+// formulaDependencies adds the fields read by requested computed formulas to a projection
+func formulaDependencies(fields []models.Field, keys []string) []string {
+	byName := make(map[string]models.Field)
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+
+	seen := make(map[string]bool)
+	var result []string
+	var add func(name string)
+	add = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		result = append(result, name)
+
+		field, ok := byName[name]
+		if !ok || field.DataType != formula.DataType || field.StoreFormula {
+			return
+		}
+		if node, err := formula.Parse(field.Formula); err == nil {
+			for _, ref := range formula.References(node) {
+				add(ref)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		add(key)
+	}
+	return result
+}
+
+// keepKeys removes every value not listed in keys
+func keepKeys(values map[string]interface{}, keys []string) {
+	keep := make(map[string]bool)
+	for _, key := range keys {
+		keep[key] = true
+	}
+	for key := range values {
+		if !keep[key] {
+			delete(values, key)
+		}
+	}
+}
+
 // scanToContent converts ContentScan to Content
-func (r *ContentRepository) scanToContent(scan models.ContentScan) (*models.Content, error) {
+func scanToContent(scan models.ContentScan) (*models.Content, error) {
 	var values map[string]interface{}
 	if err := json.Unmarshal(scan.Values, &values); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal values: %v", err)
@@ -281,23 +877,32 @@ func (r *ContentRepository) scanToContent(scan models.ContentScan) (*models.Cont
 		Values:    values,
 		CreatedAt: scan.CreatedAt,
 		UpdatedAt: scan.UpdatedAt,
+		DeletedAt: scan.DeletedAt,
 	}, nil
 }
 
-// preloadRelatedData loads related data for relational fields
-func (r *ContentRepository) preloadRelatedData(contents []*models.Content, tableSlug string) ([]*models.Content, error) {
+// preloadRelatedData loads related data for relational fields.
+// A nil expand map loads every relation; otherwise only the listed relations are
+// loaded, limited to the given subfields when the list is not empty. Relations to
+// tables the principal cannot read are skipped.
+func (r *ContentRepository) preloadRelatedData(tenant string, contents []*models.Content, tableSlug string, expand map[string][]string, principal *models.Principal) ([]*models.Content, error) {
 	// Get schema to identify relational fields
-	schemaRepo := NewSchemaRepository()
-	schema, err := schemaRepo.GetSchemaBySlug(tableSlug)
+	schema, err := r.schemas.GetSchemaBySlug(tenant, tableSlug)
 	if err != nil {
 		return nil, err
 	}
 
 	// Find relational fields
+	hidden := hiddenFields(schema.Fields, nil, principal)
 	var relationFields []models.Field
 	for _, field := range schema.Fields {
-		if field.DataType == "relation" && field.RelationConfig != nil {
-			relationFields = append(relationFields, field)
+		if field.DataType == "relation" && field.RelationConfig != nil && !hidden[field.Name] {
+			if principal != nil && !principal.Can(models.PermissionContentRead, field.RelationConfig.RelatedTable) {
+				continue
+			}
+			if _, requested := expand[field.Name]; expand == nil || requested {
+				relationFields = append(relationFields, field)
+			}
 		}
 	}
 
@@ -305,11 +910,21 @@ func (r *ContentRepository) preloadRelatedData(contents []*models.Content, table
 		return contents, nil
 	}
 
+	// Fields of the related tables the principal may not read
+	relatedHidden := make(map[string]map[string]bool)
+	for _, field := range relationFields {
+		related, err := r.relatedHidden(tenant, field.RelationConfig.RelatedTable, principal)
+		if err != nil {
+			return nil, err
+		}
+		relatedHidden[field.Name] = related
+	}
+
 	// Preload related data for each content
 	for _, content := range contents {
 		for _, field := range relationFields {
 			if fieldValue, exists := content.Values[field.Name]; exists {
-				relatedData, err := r.getRelatedData(field.RelationConfig, fieldValue)
+				relatedData, err := r.getRelatedData(tenant, field.RelationConfig, fieldValue, expand[field.Name], principal, relatedHidden[field.Name])
 				if err != nil {
 					// Log error but continue
 					log.Printf("Failed to load related data for field %s: %v", field.Name, err)
@@ -325,16 +940,46 @@ func (r *ContentRepository) preloadRelatedData(contents []*models.Content, table
 	return contents, nil
 }
 
-// getRelatedData retrieves related data for a specific field
-func (r *ContentRepository) getRelatedData(config *models.RelationConfig, fieldValue interface{}) (interface{}, error) {
-	query := `
-		SELECT values
+// relatedHidden returns the stored fields of a related table the principal may not read
+func (r *ContentRepository) relatedHidden(tenant string, tableSlug string, principal *models.Principal) (map[string]bool, error) {
+	if principal == nil {
+		return nil, nil
+	}
+	schema, err := r.schemas.GetSchemaBySlug(tenant, tableSlug)
+	if err != nil {
+		return nil, err
+	}
+	if schema == nil {
+		return nil, nil
+	}
+	return hiddenFields(schema.Fields, nil, principal), nil
+}
+
+// getRelatedData retrieves related data for a specific field, optionally projected to subfields,
+// without the related fields in hidden
+func (r *ContentRepository) getRelatedData(tenant string, config *models.RelationConfig, fieldValue interface{}, subfields []string, principal *models.Principal, hidden map[string]bool) (interface{}, error) {
+	qb := newQueryBuilder(nil, tenant, config.RelatedTable, config.RelatedField, fieldValue)
+	policyClause, err := r.policyClause(qb, tenant, config.RelatedTable, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	valuesExpr := "values"
+	if len(subfields) > 0 {
+		valuesExpr, err = qb.projection(subfields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM contents 
-		WHERE table_slug = $1 
-		AND values->>$2 = $3
-	`
+		WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL
+		AND values->>$3 = $4%s
+	`, valuesExpr, policyClause)
 	var valuesJSON json.RawMessage
-	err := database.DB.QueryRow(query, config.RelatedTable, config.RelatedField, fieldValue).Scan(&valuesJSON)
+	err = r.db.QueryRow(query, qb.args...).Scan(&valuesJSON)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -346,19 +991,30 @@ func (r *ContentRepository) getRelatedData(config *models.RelationConfig, fieldV
 	if err := json.Unmarshal(valuesJSON, &values); err != nil {
 		return nil, err
 	}
+	redactValues(values, hidden)
 	return values, nil
 }
 
-// GetRelatedDataForField retrieves all related data for a specific field configuration
-func (r *ContentRepository) GetRelatedDataForField(config *models.RelationConfig) ([]map[string]interface{}, error) {
-	query := `
+// GetRelatedDataForField retrieves all related data of a tenant for a specific field configuration that the principal may access
+func (r *ContentRepository) GetRelatedDataForField(tenant string, config *models.RelationConfig, principal *models.Principal) ([]map[string]interface{}, error) {
+	qb := newQueryBuilder(nil, tenant, config.RelatedTable)
+	policyClause, err := r.policyClause(qb, tenant, config.RelatedTable, principal)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := r.relatedHidden(tenant, config.RelatedTable, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
 		SELECT values
 		FROM contents 
-		WHERE table_slug = $1
+		WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL%s
 		ORDER BY created_at DESC
-	`
+	`, policyClause)
 
-	rows, err := database.DB.Query(query, config.RelatedTable)
+	rows, err := r.db.Query(query, qb.args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query related data: %v", err)
 	}
@@ -377,8 +1033,66 @@ func (r *ContentRepository) GetRelatedDataForField(config *models.RelationConfig
 			return nil, fmt.Errorf("failed to unmarshal related data: %v", err)
 		}
 
+		redactValues(values, hidden)
 		results = append(results, values)
 	}
 
 	return results, nil
 }
+
+// GetContentsByFieldValues retrieves the contents of a tenant's table whose field matches any of the given values
+// and that the principal may access
+func (r *ContentRepository) GetContentsByFieldValues(tenant string, tableSlug string, fieldName string, fieldValues []string, principal *models.Principal) ([]*models.Content, error) {
+	fields, links, err := r.tableFields(tenant, tableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	qb := newQueryBuilder(fields, tenant, tableSlug, fieldName, pq.Array(fieldValues))
+	policyClause, err := r.policyClause(qb, tenant, tableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, table_slug, values, created_at, updated_at
+		FROM contents
+		WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL
+		AND values->>$3 = ANY($4)%s
+		ORDER BY created_at DESC
+	`, policyClause)
+
+	rows, err := r.db.Query(query, qb.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query contents: %v", err)
+	}
+	defer rows.Close()
+
+	var contents []*models.Content
+	for rows.Next() {
+		var contentScan models.ContentScan
+		err := rows.Scan(
+			&contentScan.ID,
+			&contentScan.TableSlug,
+			&contentScan.Values,
+			&contentScan.CreatedAt,
+			&contentScan.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan content: %v", err)
+		}
+
+		content, err := scanToContent(contentScan)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, content)
+	}
+
+	if err := r.computeFields(tenant, contents, fields, links); err != nil {
+		return nil, err
+	}
+	redact(contents, hiddenFields(fields, links, principal))
+
+	return contents, nil
+}
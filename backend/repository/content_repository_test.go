@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"testing"
+
+	"dynamic-table-backend/models"
+)
+
+// staticSchemas serves fixed schemas by slug
+type staticSchemas struct {
+	SchemaStore
+	schemas map[string]*models.Schema
+}
+
+func (s staticSchemas) GetSchemaBySlug(tenant string, tableSlug string) (*models.Schema, error) {
+	return s.schemas[tableSlug], nil
+}
+
+// staticPolicies serves fixed row policies by slug
+type staticPolicies struct {
+	PolicyStore
+	policies map[string]*models.RowPolicy
+}
+
+func (p staticPolicies) GetPolicy(tenant string, tableSlug string) (*models.RowPolicy, error) {
+	return p.policies[tableSlug], nil
+}
+
+func TestContentRepositoryStores(t *testing.T) {
+	schemas := staticSchemas{schemas: map[string]*models.Schema{
+		"orders": {ID: "s1", TableSlug: "orders", Storage: models.StorageMaterialized, Fields: []models.Field{{Name: "owner", DataType: "text"}}},
+		"notes":  {ID: "s2", TableSlug: "notes"},
+	}}
+	policies := staticPolicies{policies: map[string]*models.RowPolicy{
+		"orders": {TableSlug: "orders", Expression: "values.owner == $user.id"},
+	}}
+	r := NewContentRepository(nil, schemas, policies)
+	reader := &models.Principal{ID: "u1"}
+
+	tests := []struct {
+		table        string
+		policy       bool
+		materialized bool
+	}{
+		{"orders", true, true},
+		{"notes", false, false},
+	}
+	for _, test := range tests {
+		filter, err := r.rowPolicy(models.DefaultTenant, test.table, reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (filter != nil) != test.policy {
+			t.Errorf("rowPolicy(%s) = %v, want a policy %v", test.table, filter, test.policy)
+		}
+		table, err := r.materialized(models.DefaultTenant, test.table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (table != nil) != test.materialized {
+			t.Errorf("materialized(%s) = %v, want a typed table %v", test.table, table, test.materialized)
+		}
+	}
+}
@@ -0,0 +1,1185 @@
+package repository
+
+import (
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// decodeValues unmarshals stored record values into a new map
+func decodeValues(raw json.RawMessage) (map[string]interface{}, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal values: %v", err)
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	return values, nil
+}
+
+// row evaluates the lookups, rollups and computed formulas of a record for a query
+func (s *EmbeddedStore) row(record *embeddedRecord, fields []models.Field, links map[string]*link) (*embeddedRow, error) {
+	stored, err := decodeValues(record.scan.Values)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(stored))
+	for key, value := range stored {
+		values[key] = value
+	}
+	for name, l := range links {
+		if values[name], err = s.linkValue(record.tenant, l, stored); err != nil {
+			return nil, err
+		}
+	}
+	formula.ApplyComputed(fields, values, time.Now())
+	return &embeddedRow{record: record, stored: stored, values: values}, nil
+}
+
+// linkedRecords returns the live rows linked to a record's values, oldest first, like
+// queryBuilder.linkedRows. Linked rows are always taken from the record's tenant.
+func (s *EmbeddedStore) linkedRecords(tenant string, l *link, stored map[string]interface{}) ([]*embeddedRow, error) {
+	var condition embeddedCondition
+	if l.policy != nil {
+		var err error
+		if condition, err = newEmbeddedQuery(l.fields, nil, nil).where(l.policy); err != nil {
+			// A policy that does not compile hides every linked row
+			return nil, nil
+		}
+	}
+
+	// The keys a linked row must hold: the record's key for reverse links, the elements
+	// of the record's relation value otherwise
+	keys := make(map[string]bool)
+	if l.reverse {
+		key, ok := jsonText(stored[l.localKey]).(string)
+		if !ok {
+			return nil, nil
+		}
+		keys[key] = true
+	} else {
+		elements, ok := stored[l.localKey].([]interface{})
+		if !ok {
+			elements = []interface{}{stored[l.localKey]}
+		}
+		for _, element := range elements {
+			if key, ok := jsonText(element).(string); ok {
+				keys[key] = true
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	match := valueMatch{field: l.remoteKey, elements: l.reverse}
+	for key := range keys {
+		match.values = append(match.values, key)
+	}
+	records, err := s.data.records(tenant, l.table, false, &recordFilter{values: []valueMatch{match}})
+	if err != nil {
+		return nil, err
+	}
+
+	var linked []*embeddedRow
+	for _, record := range records {
+		values, err := decodeValues(record.scan.Values)
+		if err != nil {
+			return nil, err
+		}
+
+		matched := false
+		if l.reverse {
+			// Like jsonb containment, the relation must hold the key as a string or an array of strings containing it
+			switch remote := values[l.remoteKey].(type) {
+			case string:
+				matched = keys[remote]
+			case []interface{}:
+				for _, item := range remote {
+					if text, ok := item.(string); ok && keys[text] {
+						matched = true
+					}
+				}
+			}
+		} else if key, ok := jsonText(values[l.remoteKey]).(string); ok {
+			matched = keys[key]
+		}
+		if !matched {
+			continue
+		}
+
+		if condition != nil {
+			row, err := s.row(record, l.fields, nil)
+			if err != nil {
+				return nil, err
+			}
+			if !passes(condition, row) {
+				continue
+			}
+		}
+		linked = append(linked, &embeddedRow{record: record, stored: values, values: values})
+	}
+
+	sort.SliceStable(linked, func(i, j int) bool {
+		return linked[i].record.scan.CreatedAt.Before(linked[j].record.scan.CreatedAt)
+	})
+	return linked, nil
+}
+
+// linkValue evaluates a lookup or rollup field for a record's values, like queryBuilder.linkJSON:
+// lookups are the array of the linked values, rollups a number, a string or nil
+func (s *EmbeddedStore) linkValue(tenant string, l *link, stored map[string]interface{}) (interface{}, error) {
+	linked, err := s.linkedRecords(tenant, l, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.field.DataType == formula.LookupDataType {
+		values := []interface{}{}
+		for _, row := range linked {
+			values = append(values, row.stored[l.target.Name])
+		}
+		return values, nil
+	}
+
+	config := l.field.LinkConfig
+	switch config.Aggregate {
+	case "count":
+		return float64(len(linked)), nil
+	case "countDistinct":
+		distinct := make(map[string]bool)
+		for _, row := range linked {
+			if text, ok := jsonText(row.stored[l.target.Name]).(string); ok {
+				distinct[text] = true
+			}
+		}
+		return float64(len(distinct)), nil
+	}
+
+	numeric := formula.FieldType(l.target) == formula.TypeNumber
+	var values []interface{}
+	for _, row := range linked {
+		text, ok := jsonText(row.stored[l.target.Name]).(string)
+		if !ok {
+			continue
+		}
+		if !numeric {
+			values = append(values, text)
+			continue
+		}
+		if numericRegexp.MatchString(text) {
+			var n float64
+			fmt.Sscan(strings.TrimSpace(text), &n)
+			values = append(values, n)
+		}
+	}
+
+	switch config.Aggregate {
+	case "sum", "avg":
+		sum := 0.0
+		for _, value := range values {
+			sum += value.(float64)
+		}
+		if config.Aggregate == "sum" {
+			return sum, nil
+		}
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return sum / float64(len(values)), nil
+	default:
+		var result interface{}
+		for _, value := range values {
+			if result == nil {
+				result = value
+				continue
+			}
+			cmp := compareSorted(value, result)
+			if (config.Aggregate == "min" && cmp < 0) || (config.Aggregate == "max" && cmp > 0) {
+				result = value
+			}
+		}
+		return result, nil
+	}
+}
+
+// tableFields loads the fields of a tenant's table and resolves its lookup and rollup fields, which
+// only read the linked rows the principal may access. Links that no longer resolve are logged and read as null.
+func (s *EmbeddedStore) tableFields(tenant string, tableSlug string, principal *models.Principal) ([]models.Field, map[string]*link, error) {
+	schema, err := s.schemaOf(tenant)(tableSlug)
+	if err != nil || schema == nil {
+		return nil, nil, err
+	}
+
+	links := make(map[string]*link)
+	for _, field := range schema.Fields {
+		if field.DataType != formula.LookupDataType && field.DataType != formula.RollupDataType {
+			continue
+		}
+		l, err := resolveLink(tableSlug, schema.Fields, field, s.schemaOf(tenant))
+		if err != nil {
+			log.Printf("Failed to resolve %s field %s: %v", field.DataType, field.Name, err)
+			continue
+		}
+		if l.policy, err = s.rowPolicy(tenant, l.table, principal); err != nil {
+			return nil, nil, err
+		}
+		links[field.Name] = l
+	}
+
+	return schema.Fields, links, nil
+}
+
+// relatedHidden returns the stored fields of a related table the principal may not read
+func (s *EmbeddedStore) relatedHidden(tenant string, tableSlug string, principal *models.Principal) (map[string]bool, error) {
+	if principal == nil {
+		return nil, nil
+	}
+	schema, err := s.schemaOf(tenant)(tableSlug)
+	if err != nil || schema == nil {
+		return nil, err
+	}
+	return hiddenFields(schema.Fields, nil, principal), nil
+}
+
+// computeFields evaluates lookup and rollup fields from the stored values of each record, then
+// the formulas that may read them
+func (s *EmbeddedStore) computeFields(tenant string, contents []*models.Content, fields []models.Field, links map[string]*link) error {
+	for _, content := range contents {
+		if len(links) == 0 {
+			break
+		}
+		record, err := s.data.record(tenant, content.ID)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			continue
+		}
+		stored, err := decodeValues(record.scan.Values)
+		if err != nil {
+			return err
+		}
+		if content.Values == nil {
+			content.Values = make(map[string]interface{})
+		}
+		for name, l := range links {
+			if content.Values[name], err = s.linkValue(tenant, l, stored); err != nil {
+				return err
+			}
+		}
+	}
+	computeFormulas(contents, fields)
+	computeFileURLs(contents, fields)
+	return nil
+}
+
+// contentOf converts a record to a content with its computed fields, without the fields hidden from the principal
+func (s *EmbeddedStore) contentOf(record *embeddedRecord, principal *models.Principal) (*models.Content, error) {
+	content, err := scanToContent(record.scan)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, links, err := s.tableFields(record.tenant, content.TableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.computeFields(record.tenant, []*models.Content{content}, fields, links); err != nil {
+		return nil, err
+	}
+	redactValues(content.Values, hiddenFields(fields, links, principal))
+
+	return content, nil
+}
+
+// CreateContent creates a new content record in a tenant's table. The record must pass the table's
+// row policy for the principal.
+func (s *EmbeddedStore) CreateContent(tenant string, tableSlug string, content *models.CreateContentRequest, principal *models.Principal) (*models.Content, error) {
+	valuesJSON, err := json.Marshal(content.Values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal values: %v", err)
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	var created *models.Content
+	err = s.update(func(s *EmbeddedStore) error {
+		exists, err := s.tableExists(tenant, tableSlug)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("failed to create content: table %s does not exist", tableSlug)
+		}
+
+		now := s.now()
+		record := &embeddedRecord{
+			tenant: tenant,
+			scan: models.ContentScan{
+				ID:        id,
+				TableSlug: tableSlug,
+				Values:    valuesJSON,
+				CreatedAt: now,
+				UpdatedAt: now,
+			},
+		}
+
+		allowed, err := s.rowAllowed(record, principal)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return ErrPolicyViolation
+		}
+		if err := s.data.insertRecord(record); err != nil {
+			return err
+		}
+		err = s.data.recordChange(tenant, &embeddedChange{
+			actor:     principal,
+			action:    models.AuditContentCreate,
+			tableSlug: tableSlug,
+			recordID:  id,
+			after:     valuesJSON,
+			at:        now,
+		}, s.webhookFilter(record))
+		if err != nil {
+			return err
+		}
+
+		created, err = s.contentOf(record, principal)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// GetContentByID retrieves content of a tenant by ID, or nil if it does not exist, is in the trash or the table's row policy hides it from the principal
+func (s *EmbeddedStore) GetContentByID(tenant string, id string, principal *models.Principal) (*models.Content, error) {
+	var content *models.Content
+	err := s.view(func(s *EmbeddedStore) error {
+		record, err := s.liveRecord(tenant, id, principal)
+		if err != nil || record == nil {
+			return err
+		}
+		content, err = s.contentOf(record, principal)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// liveRecord returns a live record of the tenant that passes its table's row policy, or nil
+func (s *EmbeddedStore) liveRecord(tenant string, id string, principal *models.Principal) (*embeddedRecord, error) {
+	record, err := s.data.record(tenant, id)
+	if err != nil || record == nil || record.scan.DeletedAt != nil {
+		return nil, err
+	}
+	allowed, err := s.rowAllowed(record, principal)
+	if err != nil || !allowed {
+		return nil, err
+	}
+	return record, nil
+}
+
+// selectRecords lets the data evaluate a content query if it can, returning the sorted records from
+// offset on, at most limit of them unless limit is negative, and the total. ok is false if the store
+// has to evaluate the query. Invalid queries fail like they do in filterRows.
+func (s *EmbeddedStore) selectRecords(q *embeddedQuery, tenant string, tableSlug string, params *models.ContentQueryParams, sorts []models.SortOption, offset int, limit int) ([]*embeddedRecord, int, bool, error) {
+	selector, ok := s.data.(recordSelector)
+	if !ok {
+		return nil, 0, false, nil
+	}
+
+	policyFilter, policyQuery, _, err := s.policyQuery(tenant, tableSlug, params.Principal)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if policyFilter != nil {
+		if _, err := policyQuery.where(policyFilter); err != nil {
+			return nil, 0, false, err
+		}
+	}
+	if params.Filter != nil {
+		if _, err := q.where(params.Filter); err != nil {
+			return nil, 0, false, err
+		}
+	}
+
+	return selector.selectRecords(tenant, tableSlug, &recordQuery{
+		query:       q,
+		policy:      policyFilter,
+		policyQuery: policyQuery,
+		search:      params.Search,
+		filters:     params.Filters,
+		filter:      params.Filter,
+		sorts:       sorts,
+		trashed:     params.Trashed,
+		offset:      offset,
+		limit:       limit,
+	})
+}
+
+// filterRows returns the live or trashed rows of a tenant's table passing the row policy, search,
+// filters and filter expression of the query parameters, newest first
+func (s *EmbeddedStore) filterRows(q *embeddedQuery, fields []models.Field, tenant string, tableSlug string, params *models.ContentQueryParams) ([]*embeddedRow, error) {
+	records, _, selected, err := s.selectRecords(q, tenant, tableSlug, params, nil, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	if selected {
+		rows := make([]*embeddedRow, 0, len(records))
+		for _, record := range records {
+			row, err := s.row(record, fields, q.links)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+
+	policyCondition, policyFields, err := s.policyCondition(tenant, tableSlug, params.Principal)
+	if err != nil {
+		return nil, err
+	}
+	var filter embeddedCondition
+	if params.Filter != nil {
+		if filter, err = q.where(params.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	// The storage may leave out records not matching the search or the filters on stored values
+	narrow := &recordFilter{search: params.Search}
+	for fieldName, filterValue := range params.Filters {
+		if filterValue != "" && q.stored(fieldName) {
+			narrow.values = append(narrow.values, valueMatch{field: fieldName, values: []string{filterValue}})
+		}
+	}
+	records, err = s.data.records(tenant, tableSlug, params.Trashed, narrow)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []*embeddedRow
+	for _, record := range records {
+		if policyCondition != nil {
+			policyRow, err := s.row(record, policyFields, nil)
+			if err != nil {
+				return nil, err
+			}
+			if !passes(policyCondition, policyRow) {
+				continue
+			}
+		}
+
+		row, err := s.row(record, fields, q.links)
+		if err != nil {
+			return nil, err
+		}
+
+		// Hidden fields must not match searches
+		if params.Search != "" && !like(searchText(row.stored, q.hidden), "%"+params.Search+"%", true) {
+			continue
+		}
+
+		matched := true
+		for fieldName, filterValue := range params.Filters {
+			if filterValue != "" && q.text(row, fieldName) != filterValue {
+				matched = false
+			}
+		}
+		if !matched || (filter != nil && !passes(filter, row)) {
+			continue
+		}
+
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// GetContentsByTableSlug retrieves all contents for a specific table of a tenant with search, filter, and sorting
+func (s *EmbeddedStore) GetContentsByTableSlug(tenant string, tableSlug string, params *models.ContentQueryParams) (*models.ContentResponse, error) {
+	var result *models.ContentResponse
+	err := s.view(func(s *EmbeddedStore) error {
+		var err error
+		result, err = s.queryContents(tenant, tableSlug, params)
+		return err
+	})
+	return result, err
+}
+
+// queryContents runs a content query in a view of the data
+func (s *EmbeddedStore) queryContents(tenant string, tableSlug string, params *models.ContentQueryParams) (*models.ContentResponse, error) {
+	// Field types drive typed comparisons and sorting
+	fields, links, err := s.tableFields(tenant, tableSlug, params.Principal)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fields the principal may not read act as if they were empty
+	q := newEmbeddedQuery(fields, links, hiddenFields(fields, links, params.Principal))
+
+	// Calculate pagination
+	if params.Page < 1 {
+		params.Page = 1
+	}
+	if params.PageSize < 1 {
+		params.PageSize = 10
+	}
+	if params.PageSize > 100 {
+		params.PageSize = 100
+	}
+
+	offset := (params.Page - 1) * params.PageSize
+	if params.Skip > 0 {
+		offset = params.Skip
+	}
+
+	sorts := params.Sorts
+	if len(sorts) == 0 && params.SortBy != "" {
+		sorts = []models.SortOption{{Field: params.SortBy, Desc: strings.ToUpper(params.SortDir) == "DESC"}}
+	}
+
+	records, total, selected, err := s.selectRecords(q, tenant, tableSlug, params, sorts, offset, params.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	if !selected {
+		rows, err := s.filterRows(q, fields, tenant, tableSlug, params)
+		if err != nil {
+			return nil, err
+		}
+		total = len(rows)
+
+		// Rows are newest first; trashed rows are ordered by their deletion
+		if len(sorts) > 0 {
+			sortRows(q, rows, sorts)
+		} else if params.Trashed {
+			sort.SliceStable(rows, func(i, j int) bool {
+				return rows[i].record.scan.DeletedAt.After(*rows[j].record.scan.DeletedAt)
+			})
+		}
+
+		if offset > len(rows) {
+			offset = len(rows)
+		}
+		rows = rows[offset:]
+		if len(rows) > params.PageSize {
+			rows = rows[:params.PageSize]
+		}
+		for _, row := range rows {
+			records = append(records, row.record)
+		}
+	}
+	totalPages := (total + params.PageSize - 1) / params.PageSize
+
+	// Project only the requested value keys
+	var expand map[string][]string
+	var projected, dependencies []string
+	if len(params.Fields) > 0 {
+		projected, expand = splitProjection(params.Fields)
+		// Computed formulas need the fields they read even when those are not requested
+		dependencies = formulaDependencies(fields, projected)
+		if len(dependencies) > maxProjectedFields {
+			return nil, fmt.Errorf("at most %d fields can be selected", maxProjectedFields)
+		}
+		links = onlyLinks(links, dependencies)
+	}
+
+	var contents []*models.Content
+	for _, record := range records {
+		content, err := scanToContent(record.scan)
+		if err != nil {
+			return nil, err
+		}
+		if dependencies != nil {
+			content.Values = projectValues(content.Values, dependencies)
+		}
+		contents = append(contents, content)
+	}
+
+	if err := s.computeFields(tenant, contents, fields, links); err != nil {
+		return nil, err
+	}
+	if projected != nil {
+		for _, content := range contents {
+			keepKeys(content.Values, projected)
+		}
+	}
+	redact(contents, q.hidden)
+
+	// Preload related data for relational fields
+	contents, err = s.preloadRelatedData(tenant, contents, tableSlug, expand, params.Principal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to preload related data: %v", err)
+	}
+
+	return &models.ContentResponse{
+		Contents:   contents,
+		Total:      total,
+		Page:       params.Page,
+		PageSize:   params.PageSize,
+		TotalPages: totalPages,
+	}, nil
+}
+
+// sortRows orders rows by the sort options, with NULLs last ascending and first descending
+func sortRows(q *embeddedQuery, rows []*embeddedRow, sorts []models.SortOption) {
+	keys := make(map[*embeddedRow][]interface{}, len(rows))
+	for _, row := range rows {
+		for _, option := range sorts {
+			keys[row] = append(keys[row], q.value(row, option.Field))
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for k, option := range sorts {
+			if cmp := compareNullable(keys[rows[i]][k], keys[rows[j]][k], option.Desc); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+}
+
+// projectValues selects the given value keys, which are null when a record does not have them
+func projectValues(values map[string]interface{}, keys []string) map[string]interface{} {
+	projected := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		projected[key] = values[key]
+	}
+	return projected
+}
+
+// AggregateContents computes grouped metrics over the filtered contents of a tenant's table
+func (s *EmbeddedStore) AggregateContents(tenant string, tableSlug string, params *models.ContentQueryParams, aggregate *models.AggregateRequest) (*models.AggregateResponse, error) {
+	var result *models.AggregateResponse
+	err := s.view(func(s *EmbeddedStore) error {
+		var err error
+		result, err = s.aggregateContents(tenant, tableSlug, params, aggregate)
+		return err
+	})
+	return result, err
+}
+
+// aggregateContents runs an aggregate query in a view of the data
+func (s *EmbeddedStore) aggregateContents(tenant string, tableSlug string, params *models.ContentQueryParams, aggregate *models.AggregateRequest) (*models.AggregateResponse, error) {
+	fields, links, err := s.tableFields(tenant, tableSlug, params.Principal)
+	if err != nil {
+		return nil, err
+	}
+
+	q := newEmbeddedQuery(fields, links, hiddenFields(fields, links, params.Principal))
+	for _, metric := range aggregate.Metrics {
+		if (metric.Func == "sum" || metric.Func == "avg") && q.kind(metric.Field) != kindNumber && q.kind(metric.Field) != kindNull {
+			return nil, fmt.Errorf("failed to aggregate contents: function %s(%s) does not exist", metric.Func, q.kind(metric.Field))
+		}
+	}
+
+	rows, err := s.filterRows(q, fields, tenant, tableSlug, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the rows by their keys; without grouping every row falls into a single group
+	type group struct {
+		key  []interface{}
+		rows []*embeddedRow
+	}
+	var groups []*group
+	byKey := make(map[string]*group)
+	for _, row := range rows {
+		var key []interface{}
+		for _, g := range aggregate.GroupBy {
+			var value interface{}
+			if g.Bucket != "" {
+				if value, err = q.bucket(row, g.Field, g.Bucket); err != nil {
+					return nil, fmt.Errorf("failed to aggregate contents: %v", err)
+				}
+			} else {
+				value = q.text(row, g.Field)
+			}
+			key = append(key, value)
+		}
+		id := fmt.Sprintf("%#v", key)
+		if byKey[id] == nil {
+			byKey[id] = &group{key: key}
+			groups = append(groups, byKey[id])
+		}
+		byKey[id].rows = append(byKey[id].rows, row)
+	}
+	if len(aggregate.GroupBy) == 0 && len(groups) == 0 {
+		groups = append(groups, &group{})
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		for k := range groups[i].key {
+			if cmp := compareNullable(groups[i].key[k], groups[j].key[k], false); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+
+	response := &models.AggregateResponse{Groups: []models.AggregateRow{}}
+	for _, g := range groups {
+		row := models.AggregateRow{
+			Key:     make(map[string]interface{}),
+			Metrics: make(map[string]interface{}),
+		}
+		for i, group := range aggregate.GroupBy {
+			row.Key[group.Field] = g.key[i]
+		}
+		for _, metric := range aggregate.Metrics {
+			value, err := q.metric(g.rows, metric)
+			if err != nil {
+				return nil, fmt.Errorf("failed to aggregate contents: %v", err)
+			}
+			row.Metrics[metric.Key()] = value
+		}
+		response.Groups = append(response.Groups, row)
+	}
+
+	return response, nil
+}
+
+// UpdateContent updates an existing content record of a tenant, returning nil if it does not exist or
+// the table's row policy hides it from the principal. The updated record must still pass the policy.
+// The replaced values are kept as a revision.
+func (s *EmbeddedStore) UpdateContent(tenant string, id string, updateReq *models.UpdateContentRequest, principal *models.Principal) (*models.Content, error) {
+	valuesJSON, err := json.Marshal(updateReq.Values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal values: %v", err)
+	}
+
+	var content *models.Content
+	err = s.update(func(s *EmbeddedStore) error {
+		existing, err := s.liveRecord(tenant, id, principal)
+		if err != nil || existing == nil {
+			return err
+		}
+
+		updated := &embeddedRecord{tenant: tenant, scan: existing.scan}
+		updated.scan.Values = valuesJSON
+		updated.scan.UpdatedAt = s.now()
+
+		// Records cannot be moved out of the principal's reach
+		allowed, err := s.rowAllowed(updated, principal)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return ErrPolicyViolation
+		}
+
+		values, err := decodeValues(existing.scan.Values)
+		if err != nil {
+			return err
+		}
+		revisions, err := s.data.revisions(existing)
+		if err != nil {
+			return err
+		}
+		replaced := &models.Revision{
+			Revision:  len(revisions) + 1,
+			Values:    values,
+			CreatedAt: existing.scan.UpdatedAt,
+		}
+		if err := s.data.updateRecord(updated, replaced); err != nil {
+			return err
+		}
+		err = s.data.recordChange(tenant, &embeddedChange{
+			actor:     principal,
+			action:    models.AuditContentUpdate,
+			tableSlug: existing.scan.TableSlug,
+			recordID:  id,
+			before:    existing.scan.Values,
+			after:     valuesJSON,
+			at:        updated.scan.UpdatedAt,
+		}, s.webhookFilter(updated))
+		if err != nil {
+			return err
+		}
+
+		content, err = s.contentOf(updated, principal)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// DeleteContent moves a content record of a tenant to the trash.
+// Records hidden by the table's row policy are not found.
+func (s *EmbeddedStore) DeleteContent(tenant string, id string, principal *models.Principal) error {
+	return s.update(func(s *EmbeddedStore) error {
+		existing, err := s.liveRecord(tenant, id, principal)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return fmt.Errorf("content not found")
+		}
+
+		deletedAt := s.now()
+		existing.scan.DeletedAt = &deletedAt
+		if err := s.data.updateRecord(existing, nil); err != nil {
+			return err
+		}
+		return s.data.recordChange(tenant, &embeddedChange{
+			actor:     principal,
+			action:    models.AuditContentDelete,
+			tableSlug: existing.scan.TableSlug,
+			recordID:  id,
+			before:    existing.scan.Values,
+			at:        deletedAt,
+		}, s.webhookFilter(existing))
+	})
+}
+
+// RestoreContent moves a content record of a tenant's table out of the trash. It returns nil if the
+// record is not in the table's trash or the table's row policy hides it. Records of a table in the
+// trash are restored with the table.
+func (s *EmbeddedStore) RestoreContent(tenant string, tableSlug string, id string, principal *models.Principal) (*models.Content, error) {
+	var content *models.Content
+	err := s.update(func(s *EmbeddedStore) error {
+		record, err := s.data.record(tenant, id)
+		if err != nil || record == nil || record.scan.TableSlug != tableSlug || record.scan.DeletedAt == nil {
+			return err
+		}
+		if schema, err := s.data.schema(tenant, tableSlug, false); err != nil || schema == nil {
+			return err
+		}
+		allowed, err := s.rowAllowed(record, principal)
+		if err != nil || !allowed {
+			return err
+		}
+
+		record.scan.DeletedAt = nil
+		if err := s.data.updateRecord(record, nil); err != nil {
+			return err
+		}
+		err = s.data.recordChange(tenant, &embeddedChange{
+			actor:     principal,
+			action:    models.AuditContentRestore,
+			tableSlug: tableSlug,
+			recordID:  id,
+			after:     record.scan.Values,
+			at:        s.now(),
+		}, s.webhookFilter(record))
+		if err != nil {
+			return err
+		}
+
+		content, err = s.contentOf(record, principal)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// GetRevisions retrieves every revision of a tenant's record, oldest first and ending with its current
+// values. Records hidden by the table's row policy are not found, and fields hidden from the principal
+// are left out of every revision.
+func (s *EmbeddedStore) GetRevisions(tenant string, id string, principal *models.Principal) ([]*models.Revision, error) {
+	var result []*models.Revision
+	err := s.view(func(s *EmbeddedStore) error {
+		var err error
+		result, err = s.revisionsOf(tenant, id, principal)
+		return err
+	})
+	return result, err
+}
+
+// revisionsOf reads the revisions of a record in a view of the data
+func (s *EmbeddedStore) revisionsOf(tenant string, id string, principal *models.Principal) ([]*models.Revision, error) {
+	record, err := s.liveRecord(tenant, id, principal)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	hidden, err := s.relatedHidden(tenant, record.scan.TableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	replaced, err := s.data.revisions(record)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []*models.Revision{}
+	for _, revision := range replaced {
+		values, err := json.Marshal(revision.Values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal values: %v", err)
+		}
+		copied := *revision
+		if copied.Values, err = decodeValues(values); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &copied)
+	}
+	current, err := decodeValues(record.scan.Values)
+	if err != nil {
+		return nil, err
+	}
+	revisions = append(revisions, &models.Revision{
+		Revision:  len(replaced) + 1,
+		Values:    current,
+		CreatedAt: record.scan.UpdatedAt,
+		Current:   true,
+	})
+
+	for _, revision := range revisions {
+		redactValues(revision.Values, hidden)
+	}
+	return revisions, nil
+}
+
+// GetRevision retrieves one revision of a tenant's record, or nil if the record or revision does not exist
+func (s *EmbeddedStore) GetRevision(tenant string, id string, number int, principal *models.Principal) (*models.Revision, error) {
+	revisions, err := s.GetRevisions(tenant, id, principal)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, number), nil
+}
+
+// DiffRevisions compares two revisions of a tenant's record field by field. A to of 0 compares with the current values.
+func (s *EmbeddedStore) DiffRevisions(tenant string, id string, from int, to int, principal *models.Principal) (*models.RevisionDiff, error) {
+	revisions, err := s.GetRevisions(tenant, id, principal)
+	if err != nil || revisions == nil {
+		return nil, err
+	}
+	return diffRevisions(revisions, from, to)
+}
+
+// preloadRelatedData loads related data for relational fields.
+// A nil expand map loads every relation; otherwise only the listed relations are
+// loaded, limited to the given subfields when the list is not empty. Relations to
+// tables the principal cannot read are skipped.
+func (s *EmbeddedStore) preloadRelatedData(tenant string, contents []*models.Content, tableSlug string, expand map[string][]string, principal *models.Principal) ([]*models.Content, error) {
+	schema, err := s.schemaOf(tenant)(tableSlug)
+	if err != nil || schema == nil {
+		return contents, err
+	}
+
+	hidden := hiddenFields(schema.Fields, nil, principal)
+	var relationFields []models.Field
+	for _, field := range schema.Fields {
+		if field.DataType == "relation" && field.RelationConfig != nil && !hidden[field.Name] {
+			if principal != nil && !principal.Can(models.PermissionContentRead, field.RelationConfig.RelatedTable) {
+				continue
+			}
+			if _, requested := expand[field.Name]; expand == nil || requested {
+				relationFields = append(relationFields, field)
+			}
+		}
+	}
+
+	for _, field := range relationFields {
+		relatedHidden, err := s.relatedHidden(tenant, field.RelationConfig.RelatedTable, principal)
+		if err != nil {
+			return nil, err
+		}
+		for _, content := range contents {
+			fieldValue, exists := content.Values[field.Name]
+			if !exists {
+				continue
+			}
+			relatedData, err := s.getRelatedData(tenant, field.RelationConfig, fieldValue, expand[field.Name], principal, relatedHidden)
+			if err != nil {
+				// Log error but continue
+				log.Printf("Failed to load related data for field %s: %v", field.Name, err)
+				continue
+			}
+			content.Values["_"+field.Name+"_related"] = relatedData
+		}
+	}
+
+	return contents, nil
+}
+
+// getRelatedData retrieves the first related row for a field value, optionally projected to subfields,
+// without the related fields in hidden
+func (s *EmbeddedStore) getRelatedData(tenant string, config *models.RelationConfig, fieldValue interface{}, subfields []string, principal *models.Principal, hidden map[string]bool) (interface{}, error) {
+	switch fieldValue.(type) {
+	case []interface{}, map[string]interface{}:
+		return nil, fmt.Errorf("unsupported type %T for a related key", fieldValue)
+	}
+	if len(subfields) > maxProjectedFields {
+		return nil, fmt.Errorf("at most %d fields can be selected", maxProjectedFields)
+	}
+	key, ok := jsonText(fieldValue).(string)
+	if !ok {
+		return nil, nil
+	}
+
+	condition, policyFields, err := s.policyCondition(tenant, config.RelatedTable, principal)
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.data.records(tenant, config.RelatedTable, false, &recordFilter{
+		values: []valueMatch{{field: config.RelatedField, values: []string{key}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		values, err := decodeValues(record.scan.Values)
+		if err != nil {
+			return nil, err
+		}
+		if jsonText(values[config.RelatedField]) != key {
+			continue
+		}
+		if condition != nil {
+			row, err := s.row(record, policyFields, nil)
+			if err != nil {
+				return nil, err
+			}
+			if !passes(condition, row) {
+				continue
+			}
+		}
+
+		if len(subfields) > 0 {
+			values = projectValues(values, subfields)
+		}
+		redactValues(values, hidden)
+		return values, nil
+	}
+	return nil, nil
+}
+
+// GetRelatedDataForField retrieves all related data of a tenant for a specific field configuration that the principal may access
+func (s *EmbeddedStore) GetRelatedDataForField(tenant string, config *models.RelationConfig, principal *models.Principal) ([]map[string]interface{}, error) {
+	var result []map[string]interface{}
+	err := s.view(func(s *EmbeddedStore) error {
+		var err error
+		result, err = s.relatedDataForField(tenant, config, principal)
+		return err
+	})
+	return result, err
+}
+
+// relatedDataForField reads the related data of a field in a view of the data
+func (s *EmbeddedStore) relatedDataForField(tenant string, config *models.RelationConfig, principal *models.Principal) ([]map[string]interface{}, error) {
+	condition, policyFields, err := s.policyCondition(tenant, config.RelatedTable, principal)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := s.relatedHidden(tenant, config.RelatedTable, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := s.data.records(tenant, config.RelatedTable, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []map[string]interface{}
+	for _, record := range records {
+		if condition != nil {
+			row, err := s.row(record, policyFields, nil)
+			if err != nil {
+				return nil, err
+			}
+			if !passes(condition, row) {
+				continue
+			}
+		}
+		values, err := decodeValues(record.scan.Values)
+		if err != nil {
+			return nil, err
+		}
+		redactValues(values, hidden)
+		results = append(results, values)
+	}
+
+	return results, nil
+}
+
+// GetContentsByFieldValues retrieves the contents of a tenant's table whose field matches any of the given values
+// and that the principal may access
+func (s *EmbeddedStore) GetContentsByFieldValues(tenant string, tableSlug string, fieldName string, fieldValues []string, principal *models.Principal) ([]*models.Content, error) {
+	var result []*models.Content
+	err := s.view(func(s *EmbeddedStore) error {
+		var err error
+		result, err = s.contentsByFieldValues(tenant, tableSlug, fieldName, fieldValues, principal)
+		return err
+	})
+	return result, err
+}
+
+// contentsByFieldValues reads the contents matching field values in a view of the data
+func (s *EmbeddedStore) contentsByFieldValues(tenant string, tableSlug string, fieldName string, fieldValues []string, principal *models.Principal) ([]*models.Content, error) {
+	fields, links, err := s.tableFields(tenant, tableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+	condition, policyFields, err := s.policyCondition(tenant, tableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, value := range fieldValues {
+		wanted[value] = true
+	}
+	records, err := s.data.records(tenant, tableSlug, false, &recordFilter{
+		values: []valueMatch{{field: fieldName, values: fieldValues}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var contents []*models.Content
+	for _, record := range records {
+		values, err := decodeValues(record.scan.Values)
+		if err != nil {
+			return nil, err
+		}
+		if text, ok := jsonText(values[fieldName]).(string); !ok || !wanted[text] {
+			continue
+		}
+		if condition != nil {
+			row, err := s.row(record, policyFields, nil)
+			if err != nil {
+				return nil, err
+			}
+			if !passes(condition, row) {
+				continue
+			}
+		}
+
+		content, err := scanToContent(record.scan)
+		if err != nil {
+			return nil, err
+		}
+		content.DeletedAt = nil
+		contents = append(contents, content)
+	}
+
+	if err := s.computeFields(tenant, contents, fields, links); err != nil {
+		return nil, err
+	}
+	redact(contents, hiddenFields(fields, links, principal))
+
+	return contents, nil
+}
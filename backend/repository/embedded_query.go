@@ -0,0 +1,700 @@
+package repository
+
+import (
+	"bytes"
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The embedded store evaluates queries the way PostgreSQL evaluates the SQL the query builder
+// generates: values compare as the text returned by ->>, number fields numerically when their text
+// is a number, comparisons with NULL are unknown and NULLs sort last ascending and first descending.
+
+var (
+	numericRegexp = regexp.MustCompile(numericPattern)
+	dateRegexp    = regexp.MustCompile(datePattern)
+)
+
+// timestampTextLayout is how PostgreSQL prints a timestamp as text
+const timestampTextLayout = "2006-01-02 15:04:05.999999"
+
+// embeddedRow is a record as a query sees it: its stored values along with the lookups,
+// rollups and formulas computed for it
+type embeddedRow struct {
+	record *embeddedRecord
+	stored map[string]interface{}
+	values map[string]interface{}
+}
+
+// embeddedQuery evaluates filters, sorting and aggregates over the rows of a table
+type embeddedQuery struct {
+	fields map[string]models.Field
+	links  map[string]*link
+	hidden map[string]bool // fields the caller may not read, which evaluate to NULL
+}
+
+func newEmbeddedQuery(fields []models.Field, links map[string]*link, hidden map[string]bool) *embeddedQuery {
+	fieldMap := make(map[string]models.Field)
+	for _, field := range fields {
+		fieldMap[field.Name] = field
+	}
+	return &embeddedQuery{fields: fieldMap, links: links, hidden: hidden}
+}
+
+// isNumeric reports whether a field is compared and sorted as a number
+func (q *embeddedQuery) isNumeric(name string) bool {
+	field, ok := q.fields[name]
+	return ok && formula.FieldType(field) == formula.TypeNumber
+}
+
+// computedFormula reports whether a field is a formula evaluated on read
+func (q *embeddedQuery) computedFormula(name string) bool {
+	field, ok := q.fields[name]
+	return ok && field.DataType == formula.DataType && !field.StoreFormula
+}
+
+// Kinds of values a field compares and sorts as
+const (
+	kindText   = "text"
+	kindNumber = "number"
+	kindTime   = "time"
+	kindBool   = "bool"
+	kindNull   = "null"
+)
+
+// kind returns the type of a field's value expression, like the SQL type of queryBuilder.valueExpr
+func (q *embeddedQuery) kind(name string) string {
+	if q.hidden[name] {
+		return kindNull
+	}
+	if _, ok := systemColumns[name]; ok {
+		return kindTime
+	}
+	if l, ok := q.links[name]; ok {
+		if l.field.DataType == formula.RollupDataType && q.isNumeric(name) {
+			return kindNumber
+		}
+		return kindText
+	}
+	if q.computedFormula(name) {
+		switch q.fields[name].FormulaType {
+		case formula.TypeNumber:
+			return kindNumber
+		case formula.TypeDate:
+			return kindTime
+		case formula.TypeBoolean:
+			return kindBool
+		}
+		return kindText
+	}
+	if q.isNumeric(name) {
+		return kindNumber
+	}
+	return kindText
+}
+
+// text returns a field's value as text, like queryBuilder.textExpr; nil is NULL
+func (q *embeddedQuery) text(row *embeddedRow, name string) interface{} {
+	if q.hidden[name] {
+		return nil
+	}
+	if column, ok := systemColumns[name]; ok {
+		return row.column(column).Format(timestampTextLayout)
+	}
+	if _, ok := q.fields[name]; !ok && name == "id" {
+		return row.record.scan.ID
+	}
+	if l, ok := q.links[name]; ok && l.field.DataType == formula.LookupDataType {
+		return lookupText(row.values[name])
+	}
+	return jsonText(row.values[name])
+}
+
+// stored reports whether a field's text is the text of its stored value
+func (q *embeddedQuery) stored(name string) bool {
+	if _, ok := systemColumns[name]; ok {
+		return false
+	}
+	if _, ok := q.fields[name]; !ok && name == "id" {
+		return false
+	}
+	_, ok := q.links[name]
+	return !ok && !q.computedFormula(name)
+}
+
+// value returns the typed value used to compare and sort a field, like queryBuilder.valueExpr:
+// a float64, time.Time, bool or string of the field's kind, or nil for NULL
+func (q *embeddedQuery) value(row *embeddedRow, name string) interface{} {
+	if column, ok := systemColumns[name]; ok && !q.hidden[name] {
+		return row.column(column)
+	}
+	switch q.kind(name) {
+	case kindNumber:
+		text, ok := jsonText(row.values[name]).(string)
+		if !ok || !numericRegexp.MatchString(text) {
+			return nil
+		}
+		n, _ := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		return n
+	case kindTime:
+		if text, ok := row.values[name].(string); ok {
+			if t, err := parseTimestamp(text); err == nil {
+				return t
+			}
+		}
+		return nil
+	case kindBool:
+		if b, ok := row.values[name].(bool); ok {
+			return b
+		}
+		return nil
+	case kindNull:
+		return nil
+	}
+	return q.text(row, name)
+}
+
+// column returns a timestamp column of the row
+func (row *embeddedRow) column(column string) time.Time {
+	if column == "updated_at" {
+		return row.record.scan.UpdatedAt
+	}
+	return row.record.scan.CreatedAt
+}
+
+// comparable converts a filter value into an argument matching the field's type
+func (q *embeddedQuery) comparable(name string, value interface{}) (interface{}, error) {
+	if q.isNumeric(name) {
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		default:
+			n, err := strconv.ParseFloat(strings.TrimSpace(fmt.Sprint(v)), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q for field '%s'", fmt.Sprint(v), name)
+			}
+			return n, nil
+		}
+	}
+	return fmt.Sprint(value), nil
+}
+
+// argument converts a filter value to the kind of the field it is compared with, failing
+// like PostgreSQL does when it binds a parameter of the wrong type
+func (q *embeddedQuery) argument(name string, value interface{}) (interface{}, error) {
+	arg, err := q.comparable(name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch q.kind(name) {
+	case kindNumber:
+		return arg, nil
+	case kindTime:
+		return parseTimestamp(arg.(string))
+	case kindBool:
+		return parseBool(arg.(string))
+	case kindText:
+		if _, ok := arg.(float64); ok {
+			return nil, fmt.Errorf("operator does not exist: text = double precision")
+		}
+	}
+	return arg, nil
+}
+
+// embeddedCondition evaluates a compiled filter against a row with SQL's three-valued logic; nil is unknown
+type embeddedCondition func(row *embeddedRow) *bool
+
+// where compiles a filter expression, like queryBuilder.where
+func (q *embeddedQuery) where(expr *models.FilterExpr) (embeddedCondition, error) {
+	switch expr.Op {
+	case "and", "or":
+		conditions := make([]embeddedCondition, 0, len(expr.Args))
+		for _, arg := range expr.Args {
+			condition, err := q.where(arg)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, condition)
+		}
+		if len(conditions) == 0 {
+			return func(row *embeddedRow) *bool { return truth(true) }, nil
+		}
+		// FALSE decides AND and TRUE decides OR, even when other operands are unknown
+		decisive := expr.Op == "or"
+		return func(row *embeddedRow) *bool {
+			result := truth(!decisive)
+			for _, condition := range conditions {
+				matched := condition(row)
+				if matched == nil {
+					result = nil
+				} else if *matched == decisive {
+					return matched
+				}
+			}
+			return result
+		}, nil
+	case "not":
+		if len(expr.Args) != 1 {
+			return nil, fmt.Errorf("not expects a single operand")
+		}
+		condition, err := q.where(expr.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(row *embeddedRow) *bool {
+			matched := condition(row)
+			return truth(matched == nil || !*matched)
+		}, nil
+	case "eq", "ne":
+		if expr.Value == nil {
+			return func(row *embeddedRow) *bool {
+				isNull := q.text(row, expr.Field) == nil
+				return truth(isNull == (expr.Op == "eq"))
+			}, nil
+		}
+		fallthrough
+	case "gt", "ge", "lt", "le":
+		arg, err := q.argument(expr.Field, expr.Value)
+		if err != nil {
+			return nil, err
+		}
+		return func(row *embeddedRow) *bool {
+			value := q.value(row, expr.Field)
+			if value == nil {
+				return nil
+			}
+			cmp := compareSorted(value, arg)
+			switch expr.Op {
+			case "eq":
+				return truth(cmp == 0)
+			case "ne":
+				return truth(cmp != 0)
+			case "gt":
+				return truth(cmp > 0)
+			case "ge":
+				return truth(cmp >= 0)
+			case "lt":
+				return truth(cmp < 0)
+			}
+			return truth(cmp <= 0)
+		}, nil
+	case "contains", "startswith", "endswith":
+		pattern := escapeLike(fmt.Sprint(expr.Value))
+		switch expr.Op {
+		case "contains":
+			pattern = "%" + pattern + "%"
+		case "startswith":
+			pattern = pattern + "%"
+		case "endswith":
+			pattern = "%" + pattern
+		}
+		return func(row *embeddedRow) *bool {
+			text, ok := q.text(row, expr.Field).(string)
+			if !ok {
+				return nil
+			}
+			return truth(like(text, pattern, false))
+		}, nil
+	case "in":
+		args := make([]interface{}, 0, len(expr.Values))
+		for _, v := range expr.Values {
+			arg, err := q.argument(expr.Field, v)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return func(row *embeddedRow) *bool {
+			if len(args) == 0 {
+				return truth(false)
+			}
+			value := q.value(row, expr.Field)
+			if value == nil {
+				return nil
+			}
+			for _, arg := range args {
+				if compareSorted(value, arg) == 0 {
+					return truth(true)
+				}
+			}
+			return truth(false)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported filter operator '%s'", expr.Op)
+	}
+}
+
+// truth returns a pointer to a known truth value
+func truth(value bool) *bool {
+	return &value
+}
+
+// passes reports whether a condition holds for a row; unknown does not pass
+func passes(condition embeddedCondition, row *embeddedRow) bool {
+	matched := condition(row)
+	return matched != nil && *matched
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case b:
+		return -1
+	}
+	return 1
+}
+
+// compareSorted orders two non-NULL values of the same kind
+func compareSorted(a, b interface{}) int {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return compareFloats(x, y)
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y)
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			return compareBools(x, y)
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// compareNullable orders two values with NULLs last, or first when descending
+func compareNullable(a, b interface{}, desc bool) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		if desc {
+			return -1
+		}
+		return 1
+	case b == nil:
+		if desc {
+			return 1
+		}
+		return -1
+	}
+	cmp := compareSorted(a, b)
+	if desc {
+		return -cmp
+	}
+	return cmp
+}
+
+// parseTimestamp parses text the way it is cast to a timestamp without time zone: a zone in the
+// text is ignored and the wall clock time kept
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	layouts := []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.999999999",
+		"2006-01-02 15:04:05.999999999Z07:00",
+		"2006-01-02 15:04:05.999999999Z07",
+		"2006-01-02T15:04:05.999999999Z07",
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02T15:04",
+		"2006-01-02 15:04",
+		"2006-01-02",
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid input syntax for type timestamp: %q", s)
+}
+
+// parseBool parses text the way it is cast to a boolean
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "t", "true", "y", "yes", "on", "1":
+		return true, nil
+	case "f", "false", "n", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid input syntax for type boolean: %q", s)
+}
+
+// jsonText returns a JSON value as ->> does: strings unquoted, other scalars as their JSON text,
+// arrays and objects as jsonb text, and nil for a missing value or JSON null
+func jsonText(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return v
+	}
+	return jsonbText(value)
+}
+
+// lookupText joins the values of a lookup like string_agg, skipping NULLs; nil if none remain
+func lookupText(value interface{}) interface{} {
+	items, _ := value.([]interface{})
+	var parts []string
+	for _, item := range items {
+		if text, ok := jsonText(item).(string); ok {
+			parts = append(parts, text)
+		}
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	return strings.Join(parts, ", ")
+}
+
+// jsonbText renders a JSON value as PostgreSQL prints jsonb: object keys ordered by length, then
+// bytewise, with a space after every colon and comma
+func jsonbText(value interface{}) string {
+	var b strings.Builder
+	writeJSONB(&b, value)
+	return b.String()
+}
+
+func writeJSONB(b *strings.Builder, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case float64:
+		b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case json.Number:
+		b.WriteString(v.String())
+	case string:
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(v)
+		b.WriteString(strings.TrimSuffix(buf.String(), "\n"))
+	case []interface{}:
+		b.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeJSONB(b, item)
+		}
+		b.WriteString("]")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		b.WriteString("{")
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeJSONB(b, key)
+			b.WriteString(": ")
+			writeJSONB(b, v[key])
+		}
+		b.WriteString("}")
+	default:
+		b.WriteString(fmt.Sprint(v))
+	}
+}
+
+// like matches text against a LIKE pattern with % and _ wildcards and backslash escapes;
+// fold matches case-insensitively like ILIKE
+func like(text string, pattern string, fold bool) bool {
+	if fold {
+		text, pattern = strings.ToLower(text), strings.ToLower(pattern)
+	}
+
+	// Compile the pattern into literal runes and wildcards
+	type token struct {
+		r        rune
+		wildcard rune // '%', '_' or 0 for a literal
+	}
+	var tokens []token
+	for i := 0; i < len(pattern); {
+		r, size := utf8.DecodeRuneInString(pattern[i:])
+		i += size
+		switch r {
+		case '\\':
+			if i < len(pattern) {
+				r, size = utf8.DecodeRuneInString(pattern[i:])
+				i += size
+			}
+			tokens = append(tokens, token{r: r})
+		case '%', '_':
+			tokens = append(tokens, token{wildcard: r})
+		default:
+			tokens = append(tokens, token{r: r})
+		}
+	}
+
+	runes := []rune(text)
+	// matched[j] reports whether the tokens so far match the first j runes
+	matched := make([]bool, len(runes)+1)
+	matched[0] = true
+	for _, t := range tokens {
+		next := make([]bool, len(runes)+1)
+		for j := 0; j <= len(runes); j++ {
+			switch t.wildcard {
+			case '%':
+				next[j] = matched[j] || (j > 0 && next[j-1])
+			case '_':
+				next[j] = j > 0 && matched[j-1]
+			default:
+				next[j] = j > 0 && matched[j-1] && runes[j-1] == t.r
+			}
+		}
+		matched = next
+	}
+	return matched[len(runes)]
+}
+
+// searchText returns the stored values as the text a search matches, without the hidden fields
+func searchText(stored map[string]interface{}, hidden map[string]bool) string {
+	if len(hidden) == 0 {
+		return jsonbText(stored)
+	}
+	visible := make(map[string]interface{}, len(stored))
+	for key, value := range stored {
+		if !hidden[key] {
+			visible[key] = value
+		}
+	}
+	return jsonbText(visible)
+}
+
+// bucket truncates a date field to a bucket and formats it as an ISO date, like queryBuilder.bucketExpr
+func (q *embeddedQuery) bucket(row *embeddedRow, name string, bucket string) (interface{}, error) {
+	var t time.Time
+	switch q.kind(name) {
+	case kindNull:
+		return nil, nil
+	case kindTime:
+		value, ok := q.value(row, name).(time.Time)
+		if !ok {
+			return nil, nil
+		}
+		t = value
+	case kindText, kindNumber:
+		// Stored values and lookups are truncated when their text starts with a date
+		var text interface{}
+		if l, ok := q.links[name]; ok && l.field.DataType == formula.RollupDataType {
+			text = jsonText(row.values[name])
+		} else {
+			text = q.text(row, name)
+		}
+		value, ok := text.(string)
+		if !ok || !dateRegexp.MatchString(value) {
+			return nil, nil
+		}
+		parsed, err := parseTimestamp(value)
+		if err != nil {
+			return nil, err
+		}
+		t = parsed
+	default:
+		return nil, fmt.Errorf("function date_trunc(unknown, boolean) does not exist")
+	}
+
+	switch bucket {
+	case "day":
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "week":
+		t = time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	case "month":
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "year":
+		t = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return nil, fmt.Errorf("unit \"%s\" not recognized", bucket)
+	}
+	return t.Format("2006-01-02"), nil
+}
+
+// metric computes an aggregate over the rows of a group, like queryBuilder.metricExpr
+func (q *embeddedQuery) metric(rows []*embeddedRow, metric models.AggregateMetric) (interface{}, error) {
+	if metric.Func == "count" {
+		return int64(len(rows)), nil
+	}
+	if q.hidden[metric.Field] {
+		return nil, nil
+	}
+
+	switch metric.Func {
+	case "countDistinct":
+		distinct := make(map[string]bool)
+		for _, row := range rows {
+			if text, ok := q.text(row, metric.Field).(string); ok {
+				distinct[text] = true
+			}
+		}
+		return int64(len(distinct)), nil
+	case "sum", "avg":
+		if kind := q.kind(metric.Field); kind != kindNumber {
+			return nil, fmt.Errorf("function %s(%s) does not exist", metric.Func, kind)
+		}
+		var sum float64
+		count := 0
+		for _, row := range rows {
+			if n, ok := q.value(row, metric.Field).(float64); ok {
+				sum += n
+				count++
+			}
+		}
+		if count == 0 {
+			return nil, nil
+		}
+		if metric.Func == "avg" {
+			return sum / float64(count), nil
+		}
+		return sum, nil
+	case "min", "max":
+		var result interface{}
+		for _, row := range rows {
+			value := q.value(row, metric.Field)
+			if value == nil {
+				continue
+			}
+			if result == nil {
+				result = value
+				continue
+			}
+			cmp := compareSorted(value, result)
+			if (metric.Func == "min" && cmp < 0) || (metric.Func == "max" && cmp > 0) {
+				result = value
+			}
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unsupported aggregate function '%s'", metric.Func)
+}
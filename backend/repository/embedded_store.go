@@ -0,0 +1,655 @@
+package repository
+
+import (
+	"crypto/rand"
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/policy"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// EmbeddedStore implements the schema, content, policy and trash stores with the query semantics of the
+// PostgreSQL repositories over schemas, records and row policies kept in memory or in SQLite. Queries
+// the data cannot evaluate itself are evaluated in-process. Changes kept in SQLite are audited, streamed
+// and delivered to webhooks like those of the PostgreSQL repositories; changes kept in memory are not.
+type EmbeddedStore struct {
+	data  embeddedData
+	clock *embeddedClock
+}
+
+// embeddedClock hands out the timestamps of the changes of an EmbeddedStore
+type embeddedClock struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// embeddedData keeps the schemas, records, revisions and row policies of an EmbeddedStore. The store
+// reads in views and changes in transactions of the data, and changes the schemas and records it reads
+// before writing them back.
+type embeddedData interface {
+	// view runs reads on the data; changes to the in-memory data wait for them
+	view(reads func(data embeddedData) error) error
+	// update runs changes in a transaction of the data, which commits if they succeed. Changes run one
+	// at a time; the in-memory data applies them as they are made.
+	update(changes func(data embeddedData) error) error
+
+	// schema returns a tenant's schema in or outside the trash, or nil
+	schema(tenant string, tableSlug string, trashed bool) (*embeddedSchema, error)
+	// schemas returns a tenant's schemas outside the trash, newest first, or in the trash, most recently deleted first
+	schemas(tenant string, trashed bool) ([]*embeddedSchema, error)
+	insertSchema(schema *embeddedSchema) error
+	updateSchema(schema *embeddedSchema) error
+	// trashSchema moves a schema and its live records to the trash, returning the records
+	trashSchema(tenant string, tableSlug string, deletedAt time.Time) ([]*embeddedRecord, error)
+	// restoreSchema moves a schema out of the trash along with the records deleted with it, returning the records
+	restoreSchema(tenant string, tableSlug string) ([]*embeddedRecord, error)
+	// purgeTrash deletes the schemas and records of every tenant deleted before cutoff, returning how many of
+	// each. Purging a schema deletes its records, revisions and row policy with it.
+	purgeTrash(cutoff time.Time) (int64, int64, error)
+
+	// record returns a tenant's record by ID, or nil
+	record(tenant string, id string) (*embeddedRecord, error)
+	// records returns the records of a tenant's table in or outside the trash, newest first. The filter
+	// may leave records that do not pass it, which the store checks again.
+	records(tenant string, tableSlug string, trashed bool, filter *recordFilter) ([]*embeddedRecord, error)
+	insertRecord(record *embeddedRecord) error
+	// updateRecord stores a record's values and timestamps, keeping the replaced values unless replaced is nil
+	updateRecord(record *embeddedRecord, replaced *models.Revision) error
+	// revisions returns the replaced values of a record, oldest first
+	revisions(record *embeddedRecord) ([]*models.Revision, error)
+
+	policy(tenant string, tableSlug string) (*models.RowPolicy, error)
+	setPolicy(tenant string, rowPolicy *models.RowPolicy) error
+	// deletePolicy removes the row policy of a tenant's table and reports whether it had one
+	deletePolicy(tenant string, tableSlug string) (bool, error)
+
+	// recordChange records a change like recordChange does in PostgreSQL: it appends the audit entry and
+	// change event and queues the deliveries of the webhooks subscribed to it whose filter matches.
+	// matches is nil for schema changes, whose webhooks are not filtered.
+	recordChange(tenant string, change *embeddedChange, matches func(filter string) (bool, error)) error
+	// recordEvent appends the change event of a record moved with its table, like recordCascade
+	recordEvent(tenant string, change *embeddedChange) error
+}
+
+// embeddedChange is a schema or record change to record; action is one of the audit actions, and before
+// and after hold the JSON object of the record values or schema around the change
+type embeddedChange struct {
+	actor     *models.Principal
+	action    string
+	tableSlug string
+	recordID  string
+	before    json.RawMessage
+	after     json.RawMessage
+	at        time.Time
+}
+
+// recordFilter narrows down the records a query reads
+type recordFilter struct {
+	search string       // text the stored values contain
+	values []valueMatch // conditions every record must meet
+}
+
+// valueMatch requires a stored value to be one of the given strings, or with elements set, to be
+// such a string or an array containing one. Without elements, values that are not strings are kept.
+type valueMatch struct {
+	field    string
+	values   []string
+	elements bool
+}
+
+// recordQuery is a content query over the records of a table: the records passing the row policy,
+// search, filters and filter expression, ordered by the sorts and then newest first, or most recently
+// deleted first in the trash. It skips offset records and returns at most limit, unless limit is negative.
+type recordQuery struct {
+	query       *embeddedQuery
+	policy      *models.FilterExpr
+	policyQuery *embeddedQuery
+	search      string
+	filters     map[string]string
+	filter      *models.FilterExpr
+	sorts       []models.SortOption
+	trashed     bool
+	offset      int
+	limit       int
+}
+
+// recordSelector is implemented by data that evaluates record queries itself. It returns the records
+// of the query along with how many match in total, or ok false for queries it leaves to the store.
+type recordSelector interface {
+	selectRecords(tenant string, tableSlug string, query *recordQuery) (records []*embeddedRecord, total int, ok bool, err error)
+}
+
+// embeddedSchema is a table schema kept by an EmbeddedStore
+type embeddedSchema struct {
+	tenant    string
+	scan      models.SchemaScan
+	deletedAt *time.Time
+}
+
+// embeddedRecord is a record kept by an EmbeddedStore
+type embeddedRecord struct {
+	tenant string
+	scan   models.ContentScan
+}
+
+// newEmbeddedStore creates a store on its data
+func newEmbeddedStore(data embeddedData) *EmbeddedStore {
+	return &EmbeddedStore{data: data, clock: &embeddedClock{}}
+}
+
+// NewMemoryStore creates a store keeping everything in memory, for tests and demos without a database
+func NewMemoryStore() *EmbeddedStore {
+	return newEmbeddedStore(newMemoryData())
+}
+
+// NewMemoryStores keeps schemas, records and row policies in a new in-memory store. Everything
+// else needs a database and is left nil.
+func NewMemoryStores() *Stores {
+	return newEmbeddedStores(NewMemoryStore())
+}
+
+// newEmbeddedStores uses an embedded store for schemas, records, row policies and the trash
+func newEmbeddedStores(store *EmbeddedStore) *Stores {
+	return &Stores{
+		Schemas:  store,
+		Contents: store,
+		Policies: store,
+		Trash:    store,
+	}
+}
+
+var (
+	_ SchemaStore  = (*EmbeddedStore)(nil)
+	_ ContentStore = (*EmbeddedStore)(nil)
+	_ PolicyStore  = (*EmbeddedStore)(nil)
+	_ TrashStore   = (*EmbeddedStore)(nil)
+)
+
+// view runs reads on the store's data. The store passed to reads shadows the receiver.
+func (s *EmbeddedStore) view(reads func(s *EmbeddedStore) error) error {
+	return s.data.view(func(data embeddedData) error {
+		return reads(&EmbeddedStore{data: data, clock: s.clock})
+	})
+}
+
+// update runs changes in a transaction of the store's data. The store passed to changes shadows the
+// receiver and reads and writes in the transaction.
+func (s *EmbeddedStore) update(changes func(s *EmbeddedStore) error) error {
+	return s.data.update(func(data embeddedData) error {
+		return changes(&EmbeddedStore{data: data, clock: s.clock})
+	})
+}
+
+// now returns the time of a change. Like timestamp columns it has microsecond precision, and
+// it always advances so that the order of changes is the order of their timestamps.
+func (s *EmbeddedStore) now() time.Time {
+	s.clock.mu.Lock()
+	defer s.clock.mu.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if !now.After(s.clock.last) {
+		now = s.clock.last.Add(time.Microsecond)
+	}
+	s.clock.last = now
+	return now
+}
+
+// webhookFilter returns a function evaluating webhook filters against a record, like filterMatches
+func (s *EmbeddedStore) webhookFilter(record *embeddedRecord) func(filter string) (bool, error) {
+	return func(filter string) (bool, error) {
+		node, err := policy.Parse(filter)
+		if err != nil {
+			// Filters are validated when webhooks are created, but a broken one must not block the change
+			log.Printf("Failed to parse webhook filter of table %s: %v", record.scan.TableSlug, err)
+			return false, nil
+		}
+
+		var fields []models.Field
+		if schema, err := s.schemaOf(record.tenant)(record.scan.TableSlug); err != nil {
+			return false, err
+		} else if schema != nil {
+			fields = schema.Fields
+		}
+		condition, err := newEmbeddedQuery(fields, nil, nil).where(policy.Bind(node, nil))
+		if err != nil {
+			return false, err
+		}
+		row, err := s.row(record, fields, nil)
+		if err != nil {
+			return false, err
+		}
+		return passes(condition, row), nil
+	}
+}
+
+// newID returns a random UUID
+func newID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate ID: %v", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// tableExists reports whether a tenant has a table with the slug, in or outside the trash
+func (s *EmbeddedStore) tableExists(tenant string, tableSlug string) (bool, error) {
+	for _, trashed := range []bool{false, true} {
+		schema, err := s.data.schema(tenant, tableSlug, trashed)
+		if err != nil || schema != nil {
+			return schema != nil, err
+		}
+	}
+	return false, nil
+}
+
+// schemaOf returns a function loading the live schemas of a tenant by slug
+func (s *EmbeddedStore) schemaOf(tenant string) func(string) (*models.Schema, error) {
+	return func(tableSlug string) (*models.Schema, error) {
+		schema, err := s.data.schema(tenant, tableSlug, false)
+		if err != nil || schema == nil {
+			return nil, err
+		}
+		return scanToSchema(schema.scan)
+	}
+}
+
+// CreateSchema creates a new table schema in a tenant.
+// The slug of a table in the trash stays taken until the table is restored.
+func (s *EmbeddedStore) CreateSchema(tenant string, schema *models.CreateSchemaRequest, actor *models.Principal) (*models.Schema, error) {
+	fieldsJSON, err := json.Marshal(schema.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal fields: %v", err)
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	var created *embeddedSchema
+	err = s.update(func(s *EmbeddedStore) error {
+		if trashed, err := s.data.schema(tenant, schema.TableSlug, true); err != nil {
+			return err
+		} else if trashed != nil {
+			return fmt.Errorf("a table with this slug is in the trash")
+		}
+		if existing, err := s.data.schema(tenant, schema.TableSlug, false); err != nil {
+			return err
+		} else if existing != nil {
+			return fmt.Errorf("failed to create schema: table %s already exists", schema.TableSlug)
+		}
+
+		now := s.now()
+		created = &embeddedSchema{
+			tenant: tenant,
+			scan: models.SchemaScan{
+				ID:        id,
+				TableSlug: schema.TableSlug,
+				TableName: schema.TableName,
+				Fields:    fieldsJSON,
+				CreatedAt: now,
+				UpdatedAt: now,
+			},
+		}
+		if err := s.data.insertSchema(created); err != nil {
+			return err
+		}
+		return s.data.recordChange(tenant, &embeddedChange{
+			actor:     actor,
+			action:    models.AuditSchemaCreate,
+			tableSlug: schema.TableSlug,
+			after:     schemaAuditJSON(schema.TableName, fieldsJSON),
+			at:        now,
+		}, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return scanToSchema(created.scan)
+}
+
+// GetSchemaBySlug retrieves a tenant's schema by table slug, or nil if it does not exist or is in the trash
+func (s *EmbeddedStore) GetSchemaBySlug(tenant string, tableSlug string) (*models.Schema, error) {
+	var schema *models.Schema
+	err := s.view(func(s *EmbeddedStore) error {
+		var err error
+		schema, err = s.schemaOf(tenant)(tableSlug)
+		return err
+	})
+	return schema, err
+}
+
+// GetAllSchemas retrieves all table schemas of a tenant outside the trash, newest first
+func (s *EmbeddedStore) GetAllSchemas(tenant string) ([]*models.Schema, error) {
+	var scans []*embeddedSchema
+	err := s.view(func(s *EmbeddedStore) error {
+		var err error
+		scans, err = s.data.schemas(tenant, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var schemas []*models.Schema
+	for _, scan := range scans {
+		schema, err := scanToSchema(scan.scan)
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+// UpdateSchema updates an existing schema of a tenant, returning nil if it does not exist
+func (s *EmbeddedStore) UpdateSchema(tenant string, tableSlug string, updateReq *models.UpdateSchemaRequest, actor *models.Principal) (*models.Schema, error) {
+	fieldsJSON, err := json.Marshal(updateReq.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal fields: %v", err)
+	}
+
+	var schema *embeddedSchema
+	err = s.update(func(s *EmbeddedStore) error {
+		var err error
+		schema, err = s.data.schema(tenant, tableSlug, false)
+		if err != nil || schema == nil {
+			return err
+		}
+		before := schemaAuditJSON(schema.scan.TableName, schema.scan.Fields)
+		schema.scan.TableName = updateReq.TableName
+		schema.scan.Fields = fieldsJSON
+		schema.scan.UpdatedAt = s.now()
+		if err := s.data.updateSchema(schema); err != nil {
+			return err
+		}
+		return s.data.recordChange(tenant, &embeddedChange{
+			actor:     actor,
+			action:    models.AuditSchemaUpdate,
+			tableSlug: tableSlug,
+			before:    before,
+			after:     schemaAuditJSON(schema.scan.TableName, schema.scan.Fields),
+			at:        schema.scan.UpdatedAt,
+		}, nil)
+	})
+	if err != nil || schema == nil {
+		return nil, err
+	}
+
+	return scanToSchema(schema.scan)
+}
+
+// DeleteSchema moves a tenant's schema and all its live contents to the trash. The contents are
+// stamped with the schema's deletion time, so that restoring the schema restores exactly them.
+func (s *EmbeddedStore) DeleteSchema(tenant string, tableSlug string, actor *models.Principal) error {
+	return s.update(func(s *EmbeddedStore) error {
+		schema, err := s.data.schema(tenant, tableSlug, false)
+		if err != nil {
+			return err
+		}
+		if schema == nil {
+			return fmt.Errorf("schema not found")
+		}
+
+		deletedAt := s.now()
+		records, err := s.data.trashSchema(tenant, tableSlug, deletedAt)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			err := s.data.recordEvent(tenant, &embeddedChange{
+				action:    models.AuditContentDelete,
+				tableSlug: tableSlug,
+				recordID:  record.scan.ID,
+				before:    record.scan.Values,
+				at:        deletedAt,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return s.data.recordChange(tenant, &embeddedChange{
+			actor:     actor,
+			action:    models.AuditSchemaDelete,
+			tableSlug: tableSlug,
+			before:    schemaAuditJSON(schema.scan.TableName, schema.scan.Fields),
+			at:        deletedAt,
+		}, nil)
+	})
+}
+
+// GetTrashedSchemas retrieves the schemas of a tenant in the trash, most recently deleted first
+func (s *EmbeddedStore) GetTrashedSchemas(tenant string) ([]*models.Schema, error) {
+	var trashed []*embeddedSchema
+	err := s.view(func(s *EmbeddedStore) error {
+		var err error
+		trashed, err = s.data.schemas(tenant, true)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := []*models.Schema{}
+	for _, scan := range trashed {
+		schema, err := scanToSchema(scan.scan)
+		if err != nil {
+			return nil, err
+		}
+		deletedAt := *scan.deletedAt
+		schema.DeletedAt = &deletedAt
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+// RestoreSchema moves a tenant's schema out of the trash together with the contents deleted with it.
+// It returns nil if the schema is not in the trash.
+func (s *EmbeddedStore) RestoreSchema(tenant string, tableSlug string, actor *models.Principal) (*models.Schema, error) {
+	var schema *embeddedSchema
+	err := s.update(func(s *EmbeddedStore) error {
+		var err error
+		schema, err = s.data.schema(tenant, tableSlug, true)
+		if err != nil || schema == nil {
+			return err
+		}
+		// Records deleted on their own before the schema stay in the trash
+		records, err := s.data.restoreSchema(tenant, tableSlug)
+		if err != nil {
+			return err
+		}
+
+		now := s.now()
+		err = s.data.recordChange(tenant, &embeddedChange{
+			actor:     actor,
+			action:    models.AuditSchemaRestore,
+			tableSlug: tableSlug,
+			after:     schemaAuditJSON(schema.scan.TableName, schema.scan.Fields),
+			at:        now,
+		}, nil)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			err := s.data.recordEvent(tenant, &embeddedChange{
+				action:    models.AuditContentRestore,
+				tableSlug: tableSlug,
+				recordID:  record.scan.ID,
+				after:     record.scan.Values,
+				at:        now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || schema == nil {
+		return nil, err
+	}
+
+	return scanToSchema(schema.scan)
+}
+
+// ResolveLinks checks the lookup and rollup fields of a table against the schemas of the
+// tenant they read, recording each result type in LinkConfig.ResultType
+func (s *EmbeddedStore) ResolveLinks(tenant string, tableSlug string, fields []models.Field) error {
+	return s.view(func(s *EmbeddedStore) error {
+		for _, field := range fields {
+			if field.DataType != formula.LookupDataType && field.DataType != formula.RollupDataType {
+				continue
+			}
+			l, err := resolveLink(tableSlug, fields, field, s.schemaOf(tenant))
+			if err != nil {
+				return err
+			}
+			field.LinkConfig.ResultType = l.resultType()
+		}
+		return nil
+	})
+}
+
+// GetPolicy retrieves the row policy of a tenant's table, or nil if it has none
+func (s *EmbeddedStore) GetPolicy(tenant string, tableSlug string) (*models.RowPolicy, error) {
+	var rowPolicy *models.RowPolicy
+	err := s.view(func(s *EmbeddedStore) error {
+		var err error
+		rowPolicy, err = s.data.policy(tenant, tableSlug)
+		return err
+	})
+	return rowPolicy, err
+}
+
+// SetPolicy creates or replaces the row policy of a tenant's table
+func (s *EmbeddedStore) SetPolicy(tenant string, tableSlug string, expression string) (*models.RowPolicy, error) {
+	var rowPolicy *models.RowPolicy
+	err := s.update(func(s *EmbeddedStore) error {
+		exists, err := s.tableExists(tenant, tableSlug)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("failed to set row policy: table %s does not exist", tableSlug)
+		}
+
+		now := s.now()
+		rowPolicy, err = s.data.policy(tenant, tableSlug)
+		if err != nil {
+			return err
+		}
+		if rowPolicy == nil {
+			rowPolicy = &models.RowPolicy{TableSlug: tableSlug, CreatedAt: now}
+		}
+		rowPolicy.Expression = expression
+		rowPolicy.UpdatedAt = now
+		return s.data.setPolicy(tenant, rowPolicy)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rowPolicy, nil
+}
+
+// DeletePolicy removes the row policy of a tenant's table
+func (s *EmbeddedStore) DeletePolicy(tenant string, tableSlug string) error {
+	return s.update(func(s *EmbeddedStore) error {
+		deleted, err := s.data.deletePolicy(tenant, tableSlug)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("row policy not found")
+		}
+		return nil
+	})
+}
+
+// PurgeTrash permanently deletes the schemas and contents of every tenant that have been in the trash
+// longer than the retention, returning how many of each were purged. Purging a schema deletes its
+// contents, row policy and record revisions with it.
+func (s *EmbeddedStore) PurgeTrash(retention time.Duration) (int64, int64, error) {
+	var schemas, contents int64
+	err := s.update(func(s *EmbeddedStore) error {
+		var err error
+		schemas, contents, err = s.data.purgeTrash(time.Now().UTC().Add(-retention))
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return schemas, contents, nil
+}
+
+// rowPolicy returns a table's row policy bound to the principal, or nil when every row is accessible:
+// for internal calls without a principal, for administrators and for tables without a policy.
+func (s *EmbeddedStore) rowPolicy(tenant string, tableSlug string, principal *models.Principal) (*models.FilterExpr, error) {
+	if principal == nil || principal.Can(models.PermissionAdmin, "") {
+		return nil, nil
+	}
+
+	rowPolicy, err := s.data.policy(tenant, tableSlug)
+	if err != nil || rowPolicy == nil {
+		return nil, err
+	}
+
+	node, err := policy.Parse(rowPolicy.Expression)
+	if err != nil {
+		// Policies are validated when they are set, but a broken one must hide rows rather than expose them
+		log.Printf("Failed to parse row policy of table %s: %v", tableSlug, err)
+		return policy.Never(), nil
+	}
+	return policy.Bind(node, principal), nil
+}
+
+// policyQuery returns the row policy of a table for the principal with the fields it sees and the query
+// evaluating it, or a nil policy if the principal may access every row. Like in SQL, the policy sees
+// computed formulas but no lookups or rollups.
+func (s *EmbeddedStore) policyQuery(tenant string, tableSlug string, principal *models.Principal) (*models.FilterExpr, *embeddedQuery, []models.Field, error) {
+	filter, err := s.rowPolicy(tenant, tableSlug, principal)
+	if err != nil || filter == nil {
+		return nil, nil, nil, err
+	}
+
+	var fields []models.Field
+	if schema, err := s.schemaOf(tenant)(tableSlug); err != nil {
+		return nil, nil, nil, err
+	} else if schema != nil {
+		fields = schema.Fields
+	}
+	return filter, newEmbeddedQuery(fields, nil, nil), fields, nil
+}
+
+// policyCondition compiles the row policy of a table for the principal, or returns nil if the
+// principal may access every row
+func (s *EmbeddedStore) policyCondition(tenant string, tableSlug string, principal *models.Principal) (embeddedCondition, []models.Field, error) {
+	filter, q, fields, err := s.policyQuery(tenant, tableSlug, principal)
+	if err != nil || filter == nil {
+		return nil, nil, err
+	}
+
+	condition, err := q.where(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	return condition, fields, nil
+}
+
+// rowAllowed reports whether a record passes its table's row policy for the principal
+func (s *EmbeddedStore) rowAllowed(record *embeddedRecord, principal *models.Principal) (bool, error) {
+	condition, fields, err := s.policyCondition(record.tenant, record.scan.TableSlug, principal)
+	if err != nil || condition == nil {
+		return err == nil, err
+	}
+	row, err := s.row(record, fields, nil)
+	if err != nil {
+		return false, err
+	}
+	return passes(condition, row), nil
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+	"sort"
+)
+
+// hiddenFields returns the fields of a table the principal may not read: fields whose read roles it
+// lacks, lookups and rollups reading hidden fields, and formulas computed from hidden fields.
+// Without a principal nothing is hidden.
+func hiddenFields(fields []models.Field, links map[string]*link, principal *models.Principal) map[string]bool {
+	hidden := make(map[string]bool)
+	if principal == nil {
+		return hidden
+	}
+
+	for _, field := range fields {
+		if !principal.CanReadField(field) {
+			hidden[field.Name] = true
+		}
+	}
+	for name, l := range links {
+		if (l.target.Name != "" && !principal.CanReadField(l.target)) || (!l.reverse && hidden[l.localKey]) {
+			hidden[name] = true
+		}
+	}
+
+	// Formulas would reveal the hidden fields they read, directly or through other formulas
+	for changed := true; changed; {
+		changed = false
+		for _, field := range fields {
+			if hidden[field.Name] || field.DataType != formula.DataType {
+				continue
+			}
+			node, err := formula.Parse(field.Formula)
+			if err != nil {
+				continue
+			}
+			for _, ref := range formula.References(node) {
+				if hidden[ref] {
+					hidden[field.Name] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	return hidden
+}
+
+// hiddenNames lists hidden fields in a stable order
+func hiddenNames(hidden map[string]bool) []string {
+	names := make([]string, 0, len(hidden))
+	for name := range hidden {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// redactValues removes hidden fields, and the related data expanded for them, from record values
+func redactValues(values map[string]interface{}, hidden map[string]bool) {
+	for name := range hidden {
+		delete(values, name)
+		delete(values, "_"+name+"_related")
+	}
+}
+
+// redact removes hidden fields from records
+func redact(contents []*models.Content, hidden map[string]bool) {
+	for _, content := range contents {
+		redactValues(content.Values, hidden)
+	}
+}
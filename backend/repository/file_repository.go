@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/imaging"
+	"dynamic-table-backend/models"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type FileRepository struct {
+	db DB
+}
+
+func NewFileRepository(db DB) *FileRepository {
+	return &FileRepository{db: db}
+}
+
+// fileColumns are the columns scanned by scanFile
+const fileColumns = `id, tenant, table_slug, content_id, field_name, name, size, mime_type, checksum, variants, created_at`
+
+// CreateFile records an upload to a record's file field
+func (r *FileRepository) CreateFile(file *models.File) (*models.File, error) {
+	query := `
+		INSERT INTO files (tenant, table_slug, content_id, field_name, name, size, mime_type, checksum)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING ` + fileColumns
+
+	created, err := r.scanFile(r.db.QueryRow(query, file.Tenant, file.TableSlug, file.ContentID, file.FieldName,
+		file.Name, file.Size, file.MimeType, file.Checksum))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+	return created, nil
+}
+
+// GetFile retrieves a tenant's file, or nil if it does not exist
+func (r *FileRepository) GetFile(tenant string, id string) (*models.File, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE tenant = $1 AND id::text = $2`
+	file, err := r.scanFile(r.db.QueryRow(query, tenant, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get file: %v", err)
+	}
+	return file, nil
+}
+
+// AddVariant records the blob key of an image variant generated from a file, so that it is deleted with the file
+func (r *FileRepository) AddVariant(id string, key string) error {
+	query := `UPDATE files SET variants = array_append(variants, $2) WHERE id = $1 AND NOT $2 = ANY(variants)`
+	if _, err := r.db.Exec(query, id, key); err != nil {
+		return fmt.Errorf("failed to record file variant: %v", err)
+	}
+	return nil
+}
+
+// DeleteFile removes the record of a file whose blob is gone
+func (r *FileRepository) DeleteFile(id string) error {
+	if _, err := r.db.Exec(`DELETE FROM files WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete file: %v", err)
+	}
+	return nil
+}
+
+// GetUnreferencedFiles returns up to limit files older than grace that nothing refers to anymore: their
+// record was purged, their field removed from the schema, or neither the record nor any of its
+// revisions holds them. Files in the trash stay referenced until they are purged.
+func (r *FileRepository) GetUnreferencedFiles(grace time.Duration, limit int) ([]*models.File, error) {
+	query := `
+		SELECT ` + fileColumns + `
+		FROM files f
+		WHERE f.created_at < CURRENT_TIMESTAMP - $1::double precision * INTERVAL '1 second'
+		AND NOT EXISTS (
+			SELECT 1
+			FROM contents c
+			JOIN schemas s ON s.tenant = c.tenant AND s.table_slug = c.table_slug
+			WHERE c.id = f.content_id
+			AND EXISTS (
+				SELECT 1 FROM jsonb_array_elements(s.fields) field
+				WHERE field->>'name' = f.field_name AND field->>'dataType' = 'file'
+			)
+			AND (
+				c.values->f.field_name->>'id' = f.id::text
+				OR EXISTS (
+					SELECT 1 FROM content_revisions rev
+					WHERE rev.content_id = c.id AND rev.values->f.field_name->>'id' = f.id::text
+				)
+			)
+		)
+		ORDER BY f.created_at
+		LIMIT $2`
+
+	rows, err := r.db.Query(query, grace.Seconds(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unreferenced files: %v", err)
+	}
+	defer rows.Close()
+
+	files := []*models.File{}
+	for rows.Next() {
+		file, err := r.scanFile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan file: %v", err)
+		}
+		files = append(files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get unreferenced files: %v", err)
+	}
+	return files, nil
+}
+
+// scanFile scans the fileColumns of a file row
+func (r *FileRepository) scanFile(row interface{ Scan(...interface{}) error }) (*models.File, error) {
+	var file models.File
+	err := row.Scan(&file.ID, &file.Tenant, &file.TableSlug, &file.ContentID, &file.FieldName,
+		&file.Name, &file.Size, &file.MimeType, &file.Checksum, pq.Array(&file.Variants), &file.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// computeFileURLs adds the download URL of the file held by every file field to its value, and the
+// URLs of the field's image variants when the file is an image
+func computeFileURLs(contents []*models.Content, fields []models.Field) {
+	for _, field := range fields {
+		if field.DataType != models.FileDataType {
+			continue
+		}
+		for _, content := range contents {
+			value, ok := content.Values[field.Name].(map[string]interface{})
+			if !ok || value["id"] == nil {
+				continue
+			}
+
+			fileURL := "/api/contents/" + url.PathEscape(content.TableSlug) + "/" + content.ID + "/files/" + url.PathEscape(field.Name)
+			value["url"] = fileURL
+
+			mimeType, _ := value["mimeType"].(string)
+			if field.FileConfig != nil && len(field.FileConfig.Variants) > 0 && imaging.Supported(mimeType) {
+				variants := make(map[string]interface{}, len(field.FileConfig.Variants))
+				for _, variant := range field.FileConfig.Variants {
+					variants[variant.Name] = fileURL + "/variants/" + variant.Name
+				}
+				value["variants"] = variants
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+	"fmt"
+	"strings"
+)
+
+// rollupFuncs are the aggregates a rollup field can apply
+var rollupFuncs = map[string]bool{
+	"count":         true,
+	"countDistinct": true,
+	"sum":           true,
+	"avg":           true,
+	"min":           true,
+	"max":           true,
+}
+
+// link is a lookup or rollup field resolved against the schemas it reads
+type link struct {
+	field     models.Field
+	table     string             // table of the linked rows
+	reverse   bool               // the linked rows hold the relation
+	localKey  string             // value key of this table matched against the linked rows
+	remoteKey string             // value key of the linked rows
+	target    models.Field       // field read from the linked rows, empty for count
+	fields    []models.Field     // fields of the linked table
+	policy    *models.FilterExpr // row policy restricting the linked rows, nil for none
+}
+
+// findField returns the field with the given name
+func findField(fields []models.Field, name string) *models.Field {
+	for i := range fields {
+		if fields[i].Name == name {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// resolveLink follows a lookup or rollup field's relation to the table and field it reads.
+// The fields of tableSlug are taken from fields, other tables are loaded through schemaOf.
+func resolveLink(tableSlug string, fields []models.Field, field models.Field, schemaOf func(string) (*models.Schema, error)) (*link, error) {
+	config := field.LinkConfig
+	if config == nil || config.RelationField == "" {
+		return nil, fmt.Errorf("%s field '%s' needs a linkConfig with a relationField", field.DataType, field.Name)
+	}
+
+	fieldsOf := func(slug string) ([]models.Field, error) {
+		if slug == tableSlug {
+			return fields, nil
+		}
+		schema, err := schemaOf(slug)
+		if err != nil {
+			return nil, err
+		}
+		if schema == nil {
+			return nil, fmt.Errorf("%s field '%s' links unknown table '%s'", field.DataType, field.Name, slug)
+		}
+		return schema.Fields, nil
+	}
+
+	l := &link{field: field, reverse: config.Reverse}
+	var linkedFields []models.Field
+	if config.Reverse {
+		if config.RelatedTable == "" {
+			return nil, fmt.Errorf("%s field '%s' needs a relatedTable to follow a relation in reverse", field.DataType, field.Name)
+		}
+		sourceFields, err := fieldsOf(config.RelatedTable)
+		if err != nil {
+			return nil, err
+		}
+		relation := findField(sourceFields, config.RelationField)
+		if relation == nil || relation.DataType != "relation" || relation.RelationConfig == nil || relation.RelationConfig.RelatedTable != tableSlug {
+			return nil, fmt.Errorf("%s field '%s': '%s.%s' is not a relation to this table", field.DataType, field.Name, config.RelatedTable, config.RelationField)
+		}
+		l.table = config.RelatedTable
+		l.localKey = relation.RelationConfig.RelatedField
+		l.remoteKey = relation.Name
+		linkedFields = sourceFields
+	} else {
+		relation := findField(fields, config.RelationField)
+		if relation == nil || relation.DataType != "relation" || relation.RelationConfig == nil {
+			return nil, fmt.Errorf("%s field '%s': '%s' is not a relation field", field.DataType, field.Name, config.RelationField)
+		}
+		l.table = relation.RelationConfig.RelatedTable
+		l.localKey = relation.Name
+		l.remoteKey = relation.RelationConfig.RelatedField
+		var err error
+		if linkedFields, err = fieldsOf(l.table); err != nil {
+			return nil, err
+		}
+	}
+
+	l.fields = linkedFields
+
+	switch field.DataType {
+	case formula.LookupDataType:
+		if config.Aggregate != "" {
+			return nil, fmt.Errorf("lookup field '%s' cannot aggregate, use a rollup field", field.Name)
+		}
+	case formula.RollupDataType:
+		if !rollupFuncs[config.Aggregate] {
+			return nil, fmt.Errorf("rollup field '%s' has unsupported aggregate '%s'", field.Name, config.Aggregate)
+		}
+		if config.Aggregate == "count" && config.TargetField == "" {
+			return l, nil
+		}
+	}
+
+	target := findField(linkedFields, config.TargetField)
+	if target == nil {
+		return nil, fmt.Errorf("%s field '%s' reads unknown field '%s' of table '%s'", field.DataType, field.Name, config.TargetField, l.table)
+	}
+	// Only stored values can be read across tables
+	if formula.ReadOnly(*target) && !(target.DataType == formula.DataType && target.StoreFormula) {
+		return nil, fmt.Errorf("%s field '%s' cannot read computed field '%s'", field.DataType, field.Name, target.Name)
+	}
+	if (config.Aggregate == "sum" || config.Aggregate == "avg") && formula.FieldType(*target) != formula.TypeNumber {
+		return nil, fmt.Errorf("rollup field '%s' can only %s number fields", field.Name, config.Aggregate)
+	}
+	l.target = *target
+
+	return l, nil
+}
+
+// resultType returns the type of a rollup's value or of each value of a lookup
+func (l *link) resultType() string {
+	switch l.field.LinkConfig.Aggregate {
+	case "count", "countDistinct", "sum", "avg":
+		return formula.TypeNumber
+	}
+	t := formula.FieldType(l.target)
+	if t == formula.TypeBoolean && l.field.DataType == formula.RollupDataType {
+		// min and max compare booleans as text
+		return formula.TypeString
+	}
+	return t
+}
+
+// linkedRows returns the FROM and WHERE clause selecting the rows linked to the outer contents row,
+// which are always taken from the same tenant
+func (b *queryBuilder) linkedRows(l *link) string {
+	table := b.arg(l.table)
+	remote := b.arg(l.remoteKey)
+	local := b.arg(l.localKey)
+	var rows string
+	if l.reverse {
+		// Containment lets the GIN index on values find the rows whose relation holds this row's key
+		rows = fmt.Sprintf(`FROM contents linked WHERE linked.tenant = contents.tenant AND linked.deleted_at IS NULL AND linked.table_slug = %s AND contents.values->>%s IS NOT NULL AND (linked.values @> jsonb_build_object(%s::text, contents.values->>%s) OR linked.values @> jsonb_build_object(%s::text, jsonb_build_array(contents.values->>%s)))`,
+			table, local, remote, local, remote, local)
+	} else {
+		rows = fmt.Sprintf(`FROM contents linked WHERE linked.tenant = contents.tenant AND linked.deleted_at IS NULL AND linked.table_slug = %s AND linked.values->>%s IN (SELECT jsonb_array_elements_text(CASE jsonb_typeof(contents.values->%s) WHEN 'array' THEN contents.values->%s ELSE jsonb_build_array(contents.values->%s) END))`,
+			table, remote, local, local, local)
+	}
+	if l.policy != nil {
+		// Unqualified columns in the policy condition resolve to the linked rows
+		condition, err := b.policyCondition(l.fields, l.policy)
+		if err != nil {
+			condition = "FALSE"
+		}
+		rows += " AND " + condition
+	}
+	return rows
+}
+
+// linkJSON returns the JSON value of a lookup or rollup field; lookups return an array of the linked values
+func (b *queryBuilder) linkJSON(l *link) string {
+	if l.field.DataType == formula.LookupDataType {
+		target := b.arg(l.target.Name)
+		return fmt.Sprintf("(SELECT COALESCE(jsonb_agg(linked.values->%s ORDER BY linked.created_at), '[]'::jsonb) %s)", target, b.linkedRows(l))
+	}
+	return fmt.Sprintf("to_jsonb(%s)", b.rollupExpr(l))
+}
+
+// linkText returns a lookup or rollup field as text; lookups join their values with ", "
+func (b *queryBuilder) linkText(l *link) string {
+	if l.field.DataType == formula.LookupDataType {
+		target := b.arg(l.target.Name)
+		return fmt.Sprintf("(SELECT string_agg(linked.values->>%s, ', ' ORDER BY linked.created_at) %s)", target, b.linkedRows(l))
+	}
+	return "(" + b.rollupExpr(l) + ")::text"
+}
+
+// rollupExpr returns the typed value of a rollup field: float8 for numbers, text otherwise
+func (b *queryBuilder) rollupExpr(l *link) string {
+	config := l.field.LinkConfig
+	var aggregate string
+	switch config.Aggregate {
+	case "count":
+		aggregate = "COUNT(*)::float8"
+	case "countDistinct":
+		aggregate = fmt.Sprintf("COUNT(DISTINCT linked.values->>%s)::float8", b.arg(l.target.Name))
+	default:
+		key := b.arg(l.target.Name)
+		value := "linked.values->>" + key
+		if formula.FieldType(l.target) == formula.TypeNumber {
+			value = fmt.Sprintf("(CASE WHEN linked.values->>%s ~ '%s' THEN (linked.values->>%s)::float8 END)", key, numericPattern, key)
+		}
+		aggregate = fmt.Sprintf("%s(%s)", strings.ToUpper(config.Aggregate), value)
+		if config.Aggregate == "sum" {
+			aggregate = "COALESCE(" + aggregate + ", 0)"
+		}
+	}
+	return fmt.Sprintf("(SELECT %s %s)", aggregate, b.linkedRows(l))
+}
+
+// linkValue returns the SQL expression used to compare and sort a lookup or rollup field
+func (b *queryBuilder) linkValue(l *link) string {
+	if l.field.DataType == formula.RollupDataType {
+		return b.rollupExpr(l)
+	}
+	return b.linkText(l)
+}
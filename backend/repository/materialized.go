@@ -0,0 +1,435 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// materializedSchema is the PostgreSQL schema holding the typed tables of materialized tables
+const materializedSchema = "materialized"
+
+// materializedAlias is the name under which queries join the typed table of a materialized table
+const materializedAlias = "typed"
+
+// Column types of materialized tables. Dates are stored in UTC.
+const (
+	columnText      = "text"
+	columnNumber    = "double precision"
+	columnBoolean   = "boolean"
+	columnDate      = "date"
+	columnTimestamp = "timestamp"
+)
+
+// reservedColumns are the columns of contents, which the columns of a typed table joined to it may not shadow
+var reservedColumns = map[string]bool{
+	"id": true, "tenant": true, "table_slug": true, "values": true,
+	"created_at": true, "updated_at": true, "deleted_at": true,
+}
+
+// timeZonePattern matches date values with a time and a UTC offset, which are converted to UTC
+const timeZonePattern = `[T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}(:?\d{2})?)$`
+
+// ErrValuesDoNotFit is returned when stored values do not fit the columns or constraints of a typed table
+var ErrValuesDoNotFit = errors.New("stored values do not fit the materialized table")
+
+// materializedTable is the typed table a materialized table's queries read. Its columns enforce the types
+// and rules of their fields: required fields are NOT NULL, and options and data validations are CHECKs.
+type materializedTable struct {
+	name    string            // qualified and quoted
+	columns map[string]string // column types by field name
+}
+
+// materializedTableName returns the qualified name of the typed table of a schema
+func materializedTableName(schemaID string) string {
+	return materializedSchema + "." + pq.QuoteIdentifier("t_"+strings.ReplaceAll(schemaID, "-", ""))
+}
+
+// columnType returns the column type of a field in a typed table, or "" for fields computed on read
+func columnType(field models.Field) string {
+	if formula.ReadOnly(field) && !(field.DataType == formula.DataType && field.StoreFormula) {
+		return ""
+	}
+	switch formula.FieldType(field) {
+	case formula.TypeNumber:
+		return columnNumber
+	case formula.TypeBoolean:
+		return columnBoolean
+	case formula.TypeDate:
+		if field.DataType == "date" {
+			return columnDate
+		}
+		return columnTimestamp
+	}
+	return columnText
+}
+
+// materializedColumns returns the column types of a table's stored fields by field name
+func materializedColumns(fields []models.Field) map[string]string {
+	columns := make(map[string]string)
+	for _, field := range fields {
+		if sqlType := columnType(field); sqlType != "" {
+			columns[field.Name] = sqlType
+		}
+	}
+	return columns
+}
+
+// sortedColumns returns the names of columns in a stable order
+func sortedColumns(columns map[string]string) []string {
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// constrained reports whether the column of a field enforces the field's rules. Computed fields have no
+// rules, and files are uploaded once their record exists.
+func constrained(field models.Field) bool {
+	return !formula.ReadOnly(field) && field.DataType != models.FileDataType
+}
+
+// columnConstraints returns whether the column of a field is NOT NULL and the CHECK condition its values
+// must meet, or "" if there is none. Options and data validations apply to text columns, where the empty
+// string stands for no value unless the field is required.
+func columnConstraints(field models.Field, sqlType string) (bool, string) {
+	if !constrained(field) {
+		return false, ""
+	}
+	column := pq.QuoteIdentifier(field.Name)
+	var conditions []string
+	if sqlType == columnText && len(field.Options) > 0 {
+		options := make([]string, 0, len(field.Options))
+		for _, option := range field.Options {
+			options = append(options, pq.QuoteLiteral(option))
+		}
+		conditions = append(conditions, column+" IN ("+strings.Join(options, ", ")+")")
+	}
+	if sqlType == columnText && field.DataValidation != "" {
+		conditions = append(conditions, column+" ~ "+pq.QuoteLiteral(field.DataValidation))
+	}
+	if len(conditions) == 0 {
+		return field.Required, ""
+	}
+	check := strings.Join(conditions, " AND ")
+	if !field.Required {
+		check = column + " = '' OR (" + check + ")"
+	}
+	return field.Required, check
+}
+
+// columnDefinition returns the type and CHECK constraint of a field's column, which replace the column when they change
+func columnDefinition(field models.Field, sqlType string) string {
+	if _, check := columnConstraints(field, sqlType); check != "" {
+		return sqlType + " CHECK (" + check + ")"
+	}
+	return sqlType
+}
+
+// fieldsByName returns the fields with typed columns by name
+func fieldsByName(fields []models.Field) map[string]models.Field {
+	byName := make(map[string]models.Field)
+	for _, field := range fields {
+		if columnType(field) != "" {
+			byName[field.Name] = field
+		}
+	}
+	return byName
+}
+
+// ValidateMaterializedFields checks that every stored field of a table can be a column of its typed table
+func ValidateMaterializedFields(fields []models.Field) error {
+	for _, field := range fields {
+		sqlType := columnType(field)
+		if sqlType == "" {
+			continue
+		}
+		if reservedColumns[field.Name] {
+			return fmt.Errorf("field name '%s' is reserved in materialized tables", field.Name)
+		}
+		if len(field.Name) > 63 || strings.ContainsRune(field.Name, 0) {
+			return fmt.Errorf("field name '%s' cannot be a column of a materialized table", field.Name)
+		}
+		if constrained(field) && sqlType == columnText && field.DataValidation != "" {
+			if _, err := regexp.Compile(field.DataValidation); err != nil {
+				return fmt.Errorf("data validation of field '%s' is not a valid pattern", field.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkColumnRules checks a field's value against the constraints of its column
+func checkColumnRules(field models.Field, sqlType string, value interface{}, sent bool) error {
+	if !constrained(field) {
+		return nil
+	}
+	// Empty strings are stored as NULL in columns other than text
+	if !sent || value == nil || (value == "" && sqlType != columnText) {
+		if field.Required {
+			return fmt.Errorf("field '%s' is required", field.Name)
+		}
+		return nil
+	}
+	if sqlType != columnText {
+		return nil
+	}
+
+	text, _ := jsonText(value).(string)
+	if text == "" && !field.Required {
+		return nil
+	}
+	if len(field.Options) > 0 {
+		found := false
+		for _, option := range field.Options {
+			if option == text {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("value of field '%s' is not one of its options", field.Name)
+		}
+	}
+	if field.DataValidation != "" {
+		if matched, err := regexp.MatchString(field.DataValidation, text); err != nil || !matched {
+			return fmt.Errorf("value of field '%s' does not match its data validation", field.Name)
+		}
+	}
+	return nil
+}
+
+// CheckMaterializedValues checks that record values fit the typed columns of a materialized table and
+// their constraints: numbers, booleans and dates may also be sent as strings, and empty strings are
+// stored as NULL
+func CheckMaterializedValues(fields []models.Field, values map[string]interface{}) error {
+	for _, field := range fields {
+		sqlType := columnType(field)
+		value, ok := values[field.Name]
+		if sqlType == "" {
+			continue
+		}
+		if err := checkColumnRules(field, sqlType, value, ok); err != nil {
+			return err
+		}
+		if sqlType == columnText || !ok || value == nil || value == "" {
+			continue
+		}
+
+		valid := false
+		switch sqlType {
+		case columnNumber:
+			switch v := value.(type) {
+			case float64, int:
+				valid = true
+			case string:
+				_, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				valid = err == nil
+			}
+		case columnBoolean:
+			switch v := value.(type) {
+			case bool:
+				valid = true
+			case string:
+				switch strings.ToLower(strings.TrimSpace(v)) {
+				case "true", "false", "t", "f", "yes", "no", "y", "n", "on", "off", "1", "0":
+					valid = true
+				}
+			}
+		case columnDate, columnTimestamp:
+			_, valid = formula.ParseDate(value)
+		}
+		if !valid {
+			return fmt.Errorf("value of field '%s' is not a valid %s", field.Name, sqlType)
+		}
+	}
+	return nil
+}
+
+// columnSQL returns the SQL casting a field of the JSONB values to its column type. Values that do not
+// fit the type fail the statement.
+func columnSQL(name string, sqlType string, values string) string {
+	text := fmt.Sprintf("%s->>%s", values, pq.QuoteLiteral(name))
+	switch sqlType {
+	case columnText:
+		return text
+	case columnTimestamp:
+		// Values without an offset are taken as UTC, like formulas do
+		return fmt.Sprintf("(CASE WHEN %s ~ '%s' THEN %s::timestamptz AT TIME ZONE 'UTC' ELSE NULLIF(%s, '')::timestamp END)", text, timeZonePattern, text, text)
+	default:
+		return fmt.Sprintf("NULLIF(%s, '')::%s", text, sqlType)
+	}
+}
+
+// fitError returns ErrValuesDoNotFit for an error raised by values that do not fit a typed table
+func fitError(err error, action string) error {
+	if pqErr, ok := err.(*pq.Error); ok && (pqErr.Code.Class() == "22" || pqErr.Code.Class() == "23") {
+		return fmt.Errorf("%w: %v", ErrValuesDoNotFit, err)
+	}
+	return fmt.Errorf("failed to %s: %v", action, err)
+}
+
+// createMaterializedTable creates the typed table of a schema, with a column per stored field and the
+// constraints of its field. Its rows are deleted with their records.
+func createMaterializedTable(tx *sql.Tx, schemaID string, tenant string, tableSlug string, fields []models.Field) error {
+	columns, byName := materializedColumns(fields), fieldsByName(fields)
+	definitions := []string{"id UUID PRIMARY KEY REFERENCES contents(id) ON DELETE CASCADE"}
+	for _, name := range sortedColumns(columns) {
+		definition := pq.QuoteIdentifier(name) + " " + columnDefinition(byName[name], columns[name])
+		if notNull, _ := columnConstraints(byName[name], columns[name]); notNull {
+			definition += " NOT NULL"
+		}
+		definitions = append(definitions, definition)
+	}
+
+	table := materializedTableName(schemaID)
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", table, strings.Join(definitions, ", "))); err != nil {
+		return fmt.Errorf("failed to create materialized table: %v", err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf("COMMENT ON TABLE %s IS %s", table, pq.QuoteLiteral(tenant+"/"+tableSlug))); err != nil {
+		return fmt.Errorf("failed to create materialized table: %v", err)
+	}
+	return nil
+}
+
+// alterMaterializedTable changes the columns of a schema's typed table from the old fields to the new ones.
+// Columns whose type or CHECK constraint changes are replaced, new columns are filled from the records'
+// values, and required columns are made NOT NULL once filled. Records whose values do not fit fail the
+// change with ErrValuesDoNotFit.
+func alterMaterializedTable(tx *sql.Tx, schemaID string, oldFields []models.Field, newFields []models.Field) error {
+	oldColumns, newColumns := materializedColumns(oldFields), materializedColumns(newFields)
+	oldByName, newByName := fieldsByName(oldFields), fieldsByName(newFields)
+	replaced := func(name string) bool {
+		return oldColumns[name] == "" || newColumns[name] == "" ||
+			columnDefinition(oldByName[name], oldColumns[name]) != columnDefinition(newByName[name], newColumns[name])
+	}
+
+	var changes, added, assignments, required []string
+	for _, name := range sortedColumns(oldColumns) {
+		if replaced(name) {
+			changes = append(changes, "DROP COLUMN "+pq.QuoteIdentifier(name))
+		}
+	}
+	for _, name := range sortedColumns(newColumns) {
+		column := pq.QuoteIdentifier(name)
+		wasNotNull, _ := columnConstraints(oldByName[name], oldColumns[name])
+		notNull, _ := columnConstraints(newByName[name], newColumns[name])
+		if replaced(name) {
+			changes = append(changes, "ADD COLUMN "+column+" "+columnDefinition(newByName[name], newColumns[name]))
+			added = append(added, pq.QuoteLiteral(name))
+			assignments = append(assignments, column+" = "+columnSQL(name, newColumns[name], "contents.values"))
+			wasNotNull = false
+		}
+		switch {
+		case notNull && !wasNotNull:
+			required = append(required, "ALTER COLUMN "+column+" SET NOT NULL")
+		case !notNull && wasNotNull:
+			changes = append(changes, "ALTER COLUMN "+column+" DROP NOT NULL")
+		}
+	}
+	if len(changes) == 0 && len(required) == 0 {
+		return nil
+	}
+
+	table := materializedTableName(schemaID)
+	if len(changes) > 0 {
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(changes, ", "))); err != nil {
+			return fitError(err, "alter materialized table")
+		}
+	}
+	if len(added) > 0 {
+		query := fmt.Sprintf("UPDATE %s %s SET %s FROM contents WHERE contents.id = %s.id AND contents.values ?| ARRAY[%s]",
+			table, materializedAlias, strings.Join(assignments, ", "), materializedAlias, strings.Join(added, ", "))
+		if _, err := tx.Exec(query); err != nil {
+			return fitError(err, "fill materialized columns")
+		}
+	}
+	if len(required) > 0 {
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(required, ", "))); err != nil {
+			return fitError(err, "alter materialized table")
+		}
+	}
+	return nil
+}
+
+// copyToMaterialized copies the records of a tenant with the given IDs into a schema's typed table.
+// Rows already there are replaced when replace is set and kept otherwise.
+func copyToMaterialized(tx *sql.Tx, schemaID string, fields []models.Field, tenant string, ids []string, replace bool) error {
+	columns := materializedColumns(fields)
+	names := []string{"id"}
+	selects := []string{"id"}
+	var updates []string
+	for _, name := range sortedColumns(columns) {
+		column := pq.QuoteIdentifier(name)
+		names = append(names, column)
+		selects = append(selects, columnSQL(name, columns[name], "values"))
+		updates = append(updates, column+" = EXCLUDED."+column)
+	}
+
+	conflict := "DO NOTHING"
+	if replace && len(updates) > 0 {
+		conflict = "DO UPDATE SET " + strings.Join(updates, ", ")
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM contents WHERE tenant = $1 AND id = ANY($2::uuid[]) ON CONFLICT (id) %s",
+		materializedTableName(schemaID), strings.Join(names, ", "), strings.Join(selects, ", "), conflict)
+	if _, err := tx.Exec(query, tenant, pq.Array(ids)); err != nil {
+		return fitError(err, "materialize records")
+	}
+	return nil
+}
+
+// syncMaterialized copies a record's values into the typed table of its table, if it has one. Writes to JSONB
+// tables take no lock: SetStorage waits for the writes that saw a table as JSONB before it switches. Otherwise
+// the schema is locked for share, so that the typed table keeps its columns until the write commits.
+func syncMaterialized(tx *sql.Tx, tenant string, tableSlug string, id string) error {
+	var storage string
+	err := tx.QueryRow(`SELECT storage FROM schemas WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL`, tenant, tableSlug).Scan(&storage)
+	if err == sql.ErrNoRows || (err == nil && storage == models.StorageJSONB) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get schema: %v", err)
+	}
+
+	var schemaID string
+	var fieldsJSON json.RawMessage
+	err = tx.QueryRow(`SELECT id, fields, storage FROM schemas WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL FOR SHARE`, tenant, tableSlug).Scan(&schemaID, &fieldsJSON, &storage)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return fmt.Errorf("failed to get schema: %v", err)
+	}
+	if storage == models.StorageJSONB {
+		return nil
+	}
+
+	var fields []models.Field
+	if err := json.Unmarshal(fieldsJSON, &fields); err != nil {
+		return fmt.Errorf("failed to unmarshal fields: %v", err)
+	}
+	return copyToMaterialized(tx, schemaID, fields, tenant, []string{id}, true)
+}
+
+// materialized returns the typed table queries over a tenant's table read, or nil if the table is not materialized
+func (r *ContentRepository) materialized(tenant string, tableSlug string) (*materializedTable, error) {
+	schema, err := r.schemas.GetSchemaBySlug(tenant, tableSlug)
+	if err != nil || schema == nil || schema.Storage != models.StorageMaterialized {
+		return nil, err
+	}
+	return &materializedTable{
+		name:    materializedTableName(schema.ID),
+		columns: materializedColumns(schema.Fields),
+	}, nil
+}
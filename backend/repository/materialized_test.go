@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"testing"
+
+	"dynamic-table-backend/models"
+)
+
+func TestCheckMaterializedValues(t *testing.T) {
+	fields := []models.Field{
+		{Name: "amount", DataType: "number", Required: true},
+		{Name: "status", DataType: "options", Options: []string{"open", "paid"}},
+		{Name: "code", DataType: "text", DataValidation: `^[A-Z]{3}$`, Required: true},
+		{Name: "attachment", DataType: models.FileDataType, Required: true},
+	}
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		valid  bool
+	}{
+		{"valid", map[string]interface{}{"amount": 5.0, "status": "paid", "code": "ABC"}, true},
+		{"empty optional option", map[string]interface{}{"amount": "5", "status": "", "code": "ABC"}, true},
+		{"missing required", map[string]interface{}{"status": "paid", "code": "ABC"}, false},
+		{"empty required number", map[string]interface{}{"amount": "", "code": "ABC"}, false},
+		{"not a number", map[string]interface{}{"amount": "abc", "code": "ABC"}, false},
+		{"unknown option", map[string]interface{}{"amount": 5.0, "status": "void", "code": "ABC"}, false},
+		{"pattern mismatch", map[string]interface{}{"amount": 5.0, "code": "abcd"}, false},
+		{"empty required pattern", map[string]interface{}{"amount": 5.0, "code": ""}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := CheckMaterializedValues(fields, test.values); (err == nil) != test.valid {
+				t.Errorf("CheckMaterializedValues(%v) = %v, want valid %v", test.values, err, test.valid)
+			}
+		})
+	}
+}
+
+func TestColumnConstraints(t *testing.T) {
+	tests := []struct {
+		field   models.Field
+		notNull bool
+		check   string
+	}{
+		{models.Field{Name: "amount", DataType: "number", Required: true}, true, ""},
+		{models.Field{Name: "status", DataType: "options", Options: []string{"open", "it's"}}, false, `"status" = '' OR ("status" IN ('open', 'it''s'))`},
+		{models.Field{Name: "code", DataType: "text", DataValidation: `^[0-9]+$`, Required: true}, true, `"code" ~ '^[0-9]+$'`},
+		{models.Field{Name: "attachment", DataType: models.FileDataType, Required: true}, false, ""},
+		{models.Field{Name: "total", DataType: "formula", Required: true}, false, ""},
+	}
+	for _, test := range tests {
+		notNull, check := columnConstraints(test.field, columnType(test.field))
+		if notNull != test.notNull || check != test.check {
+			t.Errorf("columnConstraints(%s) = %v, %q, want %v, %q", test.field.Name, notNull, check, test.notNull, test.check)
+		}
+	}
+}
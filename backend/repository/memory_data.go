@@ -0,0 +1,231 @@
+package repository
+
+import (
+	"dynamic-table-backend/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryData keeps the data of an in-memory EmbeddedStore. It hands out copies, so that changes
+// only take effect when they are written back. Record filters are left to the store, and changes
+// are not recorded.
+type memoryData struct {
+	mu         sync.RWMutex
+	schemaList []*embeddedSchema
+	recordList []*embeddedRecord
+	replaced   map[string][]*models.Revision // by record ID
+	policies   map[string]*models.RowPolicy  // by tenant and table slug
+}
+
+func newMemoryData() *memoryData {
+	return &memoryData{
+		replaced: make(map[string][]*models.Revision),
+		policies: make(map[string]*models.RowPolicy),
+	}
+}
+
+func (d *memoryData) view(reads func(data embeddedData) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return reads(d)
+}
+
+func (d *memoryData) update(changes func(data embeddedData) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return changes(d)
+}
+
+func (d *memoryData) schema(tenant string, tableSlug string, trashed bool) (*embeddedSchema, error) {
+	for _, schema := range d.schemaList {
+		if schema.tenant == tenant && schema.scan.TableSlug == tableSlug && (schema.deletedAt != nil) == trashed {
+			copied := *schema
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *memoryData) schemas(tenant string, trashed bool) ([]*embeddedSchema, error) {
+	var schemas []*embeddedSchema
+	for i := len(d.schemaList) - 1; i >= 0; i-- {
+		if d.schemaList[i].tenant == tenant && (d.schemaList[i].deletedAt != nil) == trashed {
+			copied := *d.schemaList[i]
+			schemas = append(schemas, &copied)
+		}
+	}
+	if trashed {
+		sort.SliceStable(schemas, func(i, j int) bool {
+			return schemas[i].deletedAt.After(*schemas[j].deletedAt)
+		})
+	}
+	return schemas, nil
+}
+
+func (d *memoryData) insertSchema(schema *embeddedSchema) error {
+	copied := *schema
+	d.schemaList = append(d.schemaList, &copied)
+	return nil
+}
+
+func (d *memoryData) updateSchema(schema *embeddedSchema) error {
+	for i, existing := range d.schemaList {
+		if existing.tenant == schema.tenant && existing.scan.ID == schema.scan.ID {
+			copied := *schema
+			d.schemaList[i] = &copied
+		}
+	}
+	return nil
+}
+
+func (d *memoryData) trashSchema(tenant string, tableSlug string, deletedAt time.Time) ([]*embeddedRecord, error) {
+	for _, schema := range d.schemaList {
+		if schema.tenant == tenant && schema.scan.TableSlug == tableSlug && schema.deletedAt == nil {
+			schema.deletedAt = &deletedAt
+		}
+	}
+	var trashed []*embeddedRecord
+	for _, record := range d.recordList {
+		if record.tenant == tenant && record.scan.TableSlug == tableSlug && record.scan.DeletedAt == nil {
+			record.scan.DeletedAt = &deletedAt
+			copied := *record
+			trashed = append(trashed, &copied)
+		}
+	}
+	return trashed, nil
+}
+
+func (d *memoryData) restoreSchema(tenant string, tableSlug string) ([]*embeddedRecord, error) {
+	var restored []*embeddedRecord
+	for _, schema := range d.schemaList {
+		if schema.tenant != tenant || schema.scan.TableSlug != tableSlug || schema.deletedAt == nil {
+			continue
+		}
+		deletedAt := *schema.deletedAt
+		schema.deletedAt = nil
+		for _, record := range d.recordList {
+			if record.tenant == tenant && record.scan.TableSlug == tableSlug && record.scan.DeletedAt != nil && record.scan.DeletedAt.Equal(deletedAt) {
+				record.scan.DeletedAt = nil
+				copied := *record
+				restored = append(restored, &copied)
+			}
+		}
+	}
+	return restored, nil
+}
+
+func (d *memoryData) purgeTrash(cutoff time.Time) (int64, int64, error) {
+	// Purged schemas take their records and row policies with them
+	purged := make(map[string]bool)
+	var schemas int64
+	kept := d.schemaList[:0]
+	for _, schema := range d.schemaList {
+		if schema.deletedAt != nil && schema.deletedAt.Before(cutoff) {
+			purged[schema.tenant+"/"+schema.scan.TableSlug] = true
+			delete(d.policies, schema.tenant+"/"+schema.scan.TableSlug)
+			schemas++
+			continue
+		}
+		kept = append(kept, schema)
+	}
+	d.schemaList = kept
+
+	var contents int64
+	records := d.recordList[:0]
+	for _, record := range d.recordList {
+		withSchema := purged[record.tenant+"/"+record.scan.TableSlug]
+		if withSchema || (record.scan.DeletedAt != nil && record.scan.DeletedAt.Before(cutoff)) {
+			delete(d.replaced, record.scan.ID)
+			if !withSchema {
+				contents++
+			}
+			continue
+		}
+		records = append(records, record)
+	}
+	d.recordList = records
+
+	return schemas, contents, nil
+}
+
+func (d *memoryData) record(tenant string, id string) (*embeddedRecord, error) {
+	for _, record := range d.recordList {
+		if record.tenant == tenant && record.scan.ID == id {
+			copied := *record
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *memoryData) records(tenant string, tableSlug string, trashed bool, filter *recordFilter) ([]*embeddedRecord, error) {
+	var records []*embeddedRecord
+	for i := len(d.recordList) - 1; i >= 0; i-- {
+		record := d.recordList[i]
+		if record.tenant == tenant && record.scan.TableSlug == tableSlug && (record.scan.DeletedAt != nil) == trashed {
+			copied := *record
+			records = append(records, &copied)
+		}
+	}
+	return records, nil
+}
+
+func (d *memoryData) insertRecord(record *embeddedRecord) error {
+	copied := *record
+	d.recordList = append(d.recordList, &copied)
+	return nil
+}
+
+func (d *memoryData) updateRecord(record *embeddedRecord, replaced *models.Revision) error {
+	for i, existing := range d.recordList {
+		if existing.tenant == record.tenant && existing.scan.ID == record.scan.ID {
+			copied := *record
+			d.recordList[i] = &copied
+		}
+	}
+	if replaced != nil {
+		d.replaced[record.scan.ID] = append(d.replaced[record.scan.ID], replaced)
+	}
+	return nil
+}
+
+func (d *memoryData) revisions(record *embeddedRecord) ([]*models.Revision, error) {
+	var revisions []*models.Revision
+	for _, revision := range d.replaced[record.scan.ID] {
+		copied := *revision
+		revisions = append(revisions, &copied)
+	}
+	return revisions, nil
+}
+
+func (d *memoryData) policy(tenant string, tableSlug string) (*models.RowPolicy, error) {
+	rowPolicy, ok := d.policies[tenant+"/"+tableSlug]
+	if !ok {
+		return nil, nil
+	}
+	copied := *rowPolicy
+	return &copied, nil
+}
+
+func (d *memoryData) setPolicy(tenant string, rowPolicy *models.RowPolicy) error {
+	copied := *rowPolicy
+	d.policies[tenant+"/"+rowPolicy.TableSlug] = &copied
+	return nil
+}
+
+func (d *memoryData) deletePolicy(tenant string, tableSlug string) (bool, error) {
+	if _, ok := d.policies[tenant+"/"+tableSlug]; !ok {
+		return false, nil
+	}
+	delete(d.policies, tenant+"/"+tableSlug)
+	return true, nil
+}
+
+func (d *memoryData) recordChange(tenant string, change *embeddedChange, matches func(filter string) (bool, error)) error {
+	return nil
+}
+
+func (d *memoryData) recordEvent(tenant string, change *embeddedChange) error {
+	return nil
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/models"
+	"fmt"
+)
+
+type PolicyRepository struct {
+	db DB
+}
+
+func NewPolicyRepository(db DB) *PolicyRepository {
+	return &PolicyRepository{db: db}
+}
+
+// GetPolicy retrieves the row policy of a tenant's table, or nil if it has none
+func (r *PolicyRepository) GetPolicy(tenant string, tableSlug string) (*models.RowPolicy, error) {
+	query := `
+		SELECT table_slug, expression, created_at, updated_at
+		FROM row_policies
+		WHERE tenant = $1 AND table_slug = $2`
+
+	var policy models.RowPolicy
+	err := r.db.QueryRow(query, tenant, tableSlug).Scan(
+		&policy.TableSlug,
+		&policy.Expression,
+		&policy.CreatedAt,
+		&policy.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get row policy: %v", err)
+	}
+
+	return &policy, nil
+}
+
+// SetPolicy creates or replaces the row policy of a tenant's table
+func (r *PolicyRepository) SetPolicy(tenant string, tableSlug string, expression string) (*models.RowPolicy, error) {
+	query := `
+		INSERT INTO row_policies (tenant, table_slug, expression)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (tenant, table_slug) DO UPDATE SET expression = EXCLUDED.expression, updated_at = CURRENT_TIMESTAMP
+		RETURNING table_slug, expression, created_at, updated_at`
+
+	var policy models.RowPolicy
+	err := r.db.QueryRow(query, tenant, tableSlug, expression).Scan(
+		&policy.TableSlug,
+		&policy.Expression,
+		&policy.CreatedAt,
+		&policy.UpdatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set row policy: %v", err)
+	}
+
+	return &policy, nil
+}
+
+// DeletePolicy removes the row policy of a tenant's table
+func (r *PolicyRepository) DeletePolicy(tenant string, tableSlug string) error {
+	result, err := r.db.Exec(`DELETE FROM row_policies WHERE tenant = $1 AND table_slug = $2`, tenant, tableSlug)
+	if err != nil {
+		return fmt.Errorf("failed to delete row policy: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("row policy not found")
+	}
+
+	return nil
+}
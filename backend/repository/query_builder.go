@@ -0,0 +1,411 @@
+package repository
+
+import (
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// numericPattern matches JSON text that can safely be cast to numeric
+const numericPattern = `^\s*-?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?\s*$`
+
+// systemColumns maps record attributes to their columns
+var systemColumns = map[string]string{
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+	"createdAt":  "created_at",
+	"updatedAt":  "updated_at",
+}
+
+// queryBuilder accumulates positional arguments for a dynamically built query
+type queryBuilder struct {
+	args   []interface{}
+	fields map[string]models.Field
+	links  map[string]*link
+	hidden map[string]bool    // fields the caller may not read, which compile to NULL
+	table  *materializedTable // typed table joined as materializedAlias, for tables with materialized storage
+}
+
+func newQueryBuilder(fields []models.Field, args ...interface{}) *queryBuilder {
+	fieldMap := make(map[string]models.Field)
+	for _, field := range fields {
+		fieldMap[field.Name] = field
+	}
+	return &queryBuilder{args: args, fields: fieldMap}
+}
+
+// arg appends a positional argument and returns its placeholder
+func (b *queryBuilder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+// isNumeric reports whether a field is compared and sorted as a number
+func (b *queryBuilder) isNumeric(name string) bool {
+	field, ok := b.fields[name]
+	return ok && formula.FieldType(field) == formula.TypeNumber
+}
+
+// textExpr returns the SQL expression for a field's value as text
+func (b *queryBuilder) textExpr(name string) string {
+	if b.hidden[name] {
+		return "NULL::text"
+	}
+	if column, ok := systemColumns[name]; ok {
+		return column + "::text"
+	}
+	if _, ok := b.fields[name]; !ok && name == "id" {
+		return "id::text"
+	}
+	if l, ok := b.links[name]; ok {
+		return b.linkText(l)
+	}
+	if node, ok := b.computedFormula(name); ok {
+		if b.fields[name].FormulaType == formula.TypeDate {
+			return formula.DateTextSQL(b.formulaSQL(node))
+		}
+		return "(" + b.formulaSQL(node) + ")::text"
+	}
+	if column, sqlType := b.typedColumn(name); sqlType == columnText {
+		return column
+	}
+	return fmt.Sprintf("values->>%s", b.arg(name))
+}
+
+// typedColumn returns the column of a field in the typed table the query joins and its type, if there is one
+func (b *queryBuilder) typedColumn(name string) (string, string) {
+	if b.table == nil {
+		return "", ""
+	}
+	sqlType, ok := b.table.columns[name]
+	if !ok {
+		return "", ""
+	}
+	return materializedAlias + "." + pq.QuoteIdentifier(name), sqlType
+}
+
+// valueExpr returns the typed SQL expression used to compare and sort a field
+func (b *queryBuilder) valueExpr(name string) string {
+	if b.hidden[name] {
+		return "NULL::text"
+	}
+	if column, ok := systemColumns[name]; ok {
+		return column
+	}
+	if l, ok := b.links[name]; ok {
+		return b.linkValue(l)
+	}
+	if node, ok := b.computedFormula(name); ok {
+		return b.formulaSQL(node)
+	}
+	// Typed columns compare numbers and dates by value
+	if column, sqlType := b.typedColumn(name); sqlType == columnNumber || sqlType == columnDate || sqlType == columnTimestamp {
+		return column
+	}
+	if b.isNumeric(name) {
+		key := b.arg(name)
+		return fmt.Sprintf("(CASE WHEN values->>%s ~ '%s' THEN (values->>%s)::numeric END)", key, numericPattern, key)
+	}
+	return b.textExpr(name)
+}
+
+// computedFormula returns the parsed formula of a field that is evaluated on read
+func (b *queryBuilder) computedFormula(name string) (formula.Node, bool) {
+	field, ok := b.fields[name]
+	if !ok || field.DataType != formula.DataType || field.StoreFormula {
+		return nil, false
+	}
+	node, err := formula.Parse(field.Formula)
+	return node, err == nil
+}
+
+// formulaSQL compiles a computed formula into a typed SQL expression
+func (b *queryBuilder) formulaSQL(node formula.Node) string {
+	expr, err := formula.SQL(node, formula.SQLContext{
+		Field:     b.formulaOperand,
+		FieldText: b.formulaText,
+		Arg:       b.arg,
+	})
+	if err != nil {
+		// Formulas are validated when the schema is saved
+		return "NULL"
+	}
+	return expr
+}
+
+// formulaOperand returns the typed SQL expression for a field referenced by a formula
+func (b *queryBuilder) formulaOperand(name string) (string, error) {
+	if node, ok := b.computedFormula(name); ok {
+		return b.formulaSQL(node), nil
+	}
+	if l, ok := b.links[name]; ok {
+		value := b.linkValue(l)
+		switch formula.FieldType(b.fields[name]) {
+		case formula.TypeDate:
+			return fmt.Sprintf("(CASE WHEN %s ~ '%s' THEN (%s)::timestamp END)", value, datePattern, value), nil
+		case formula.TypeBoolean:
+			return fmt.Sprintf("(%s = 'true')", value), nil
+		}
+		return value, nil
+	}
+	key := b.arg(name)
+	switch formula.FieldType(b.fields[name]) {
+	case formula.TypeNumber:
+		return fmt.Sprintf("(CASE WHEN values->>%s ~ '%s' THEN (values->>%s)::float8 END)", key, numericPattern, key), nil
+	case formula.TypeDate:
+		return fmt.Sprintf("(CASE WHEN values->>%s ~ '%s' THEN (values->>%s)::timestamp END)", key, datePattern, key), nil
+	case formula.TypeBoolean:
+		return fmt.Sprintf("(values->>%s = 'true')", key), nil
+	default:
+		return fmt.Sprintf("values->>%s", key), nil
+	}
+}
+
+// formulaText returns the text SQL expression for a field referenced by a formula
+func (b *queryBuilder) formulaText(name string) (string, error) {
+	return b.textExpr(name), nil
+}
+
+// comparable converts a filter value into an argument matching the field's SQL type
+func (b *queryBuilder) comparable(name string, value interface{}) (interface{}, error) {
+	if b.isNumeric(name) {
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		default:
+			n, err := strconv.ParseFloat(strings.TrimSpace(fmt.Sprint(v)), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q for field '%s'", fmt.Sprint(v), name)
+			}
+			return n, nil
+		}
+	}
+	if _, sqlType := b.typedColumn(name); sqlType == columnDate || sqlType == columnTimestamp {
+		t, ok := formula.ParseDate(value)
+		if !ok {
+			return nil, fmt.Errorf("invalid date %q for field '%s'", fmt.Sprint(value), name)
+		}
+		if sqlType == columnDate {
+			return t.Format("2006-01-02"), nil
+		}
+		return t.Format("2006-01-02 15:04:05.999999"), nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// where compiles a filter expression into a parameterized SQL condition
+func (b *queryBuilder) where(expr *models.FilterExpr) (string, error) {
+	switch expr.Op {
+	case "and", "or":
+		parts := make([]string, 0, len(expr.Args))
+		for _, arg := range expr.Args {
+			part, err := b.where(arg)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) == 0 {
+			return "TRUE", nil
+		}
+		return "(" + strings.Join(parts, " "+strings.ToUpper(expr.Op)+" ") + ")", nil
+	case "not":
+		if len(expr.Args) != 1 {
+			return "", fmt.Errorf("not expects a single operand")
+		}
+		part, err := b.where(expr.Args[0])
+		if err != nil {
+			return "", err
+		}
+		return "NOT COALESCE(" + part + ", FALSE)", nil
+	case "eq", "ne":
+		if expr.Value == nil {
+			if expr.Op == "eq" {
+				return b.textExpr(expr.Field) + " IS NULL", nil
+			}
+			return b.textExpr(expr.Field) + " IS NOT NULL", nil
+		}
+		fallthrough
+	case "gt", "ge", "lt", "le":
+		operators := map[string]string{"eq": "=", "ne": "<>", "gt": ">", "ge": ">=", "lt": "<", "le": "<="}
+		value, err := b.comparable(expr.Field, expr.Value)
+		if err != nil {
+			return "", err
+		}
+		column := b.valueExpr(expr.Field)
+		return fmt.Sprintf("%s %s %s", column, operators[expr.Op], b.arg(value)), nil
+	case "contains", "startswith", "endswith":
+		pattern := escapeLike(fmt.Sprint(expr.Value))
+		switch expr.Op {
+		case "contains":
+			pattern = "%" + pattern + "%"
+		case "startswith":
+			pattern = pattern + "%"
+		case "endswith":
+			pattern = "%" + pattern
+		}
+		column := b.textExpr(expr.Field)
+		return fmt.Sprintf("%s LIKE %s", column, b.arg(pattern)), nil
+	case "in":
+		if len(expr.Values) == 0 {
+			return "FALSE", nil
+		}
+		column := b.valueExpr(expr.Field)
+		if b.isNumeric(expr.Field) {
+			numbers := make([]float64, 0, len(expr.Values))
+			for _, v := range expr.Values {
+				n, err := b.comparable(expr.Field, v)
+				if err != nil {
+					return "", err
+				}
+				numbers = append(numbers, n.(float64))
+			}
+			return fmt.Sprintf("%s = ANY(%s)", column, b.arg(pq.Array(numbers))), nil
+		}
+		texts := make([]string, 0, len(expr.Values))
+		for _, v := range expr.Values {
+			texts = append(texts, fmt.Sprint(v))
+		}
+		return fmt.Sprintf("%s = ANY(%s)", b.textExpr(expr.Field), b.arg(pq.Array(texts))), nil
+	default:
+		return "", fmt.Errorf("unsupported filter operator '%s'", expr.Op)
+	}
+}
+
+// policyCondition compiles a row policy over the fields of its table, which may differ from the builder's own
+func (b *queryBuilder) policyCondition(fields []models.Field, filter *models.FilterExpr) (string, error) {
+	sub := newQueryBuilder(fields)
+	sub.args = b.args
+	condition, err := sub.where(filter)
+	b.args = sub.args
+	return condition, err
+}
+
+// maxProjectedFields keeps jsonb_build_object within PostgreSQL's 100 argument limit
+const maxProjectedFields = 50
+
+// projection returns a jsonb_build_object expression selecting only the given value keys
+func (b *queryBuilder) projection(keys []string) (string, error) {
+	if len(keys) > maxProjectedFields {
+		return "", fmt.Errorf("at most %d fields can be selected", maxProjectedFields)
+	}
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		placeholder := b.arg(key)
+		parts = append(parts, fmt.Sprintf("%s::text, values->%s", placeholder, placeholder))
+	}
+	return "jsonb_build_object(" + strings.Join(parts, ", ") + ")", nil
+}
+
+// splitProjection separates requested field paths into top-level value keys and
+// the subfields wanted from each expanded relation
+func splitProjection(paths []string) ([]string, map[string][]string) {
+	var keys []string
+	seen := make(map[string]bool)
+	expand := make(map[string][]string)
+
+	for _, path := range paths {
+		name, sub, nested := strings.Cut(path, ".")
+		if !seen[name] {
+			seen[name] = true
+			keys = append(keys, name)
+		}
+		if nested {
+			if sub == "*" {
+				// Keep an empty, non-nil list meaning every related field
+				if expand[name] == nil {
+					expand[name] = []string{}
+				}
+				continue
+			}
+			expand[name] = append(expand[name], sub)
+		}
+	}
+
+	return keys, expand
+}
+
+// datePattern matches JSON text holding a valid ISO date, optionally with a time and a UTC offset, that
+// both PostgreSQL and parseTimestamp accept. Text that only starts like a date, such as 2024-02-30 or
+// 2024-13-45T99, would fail the cast and with it the whole query, so it is taken as no date instead.
+const datePattern = `^(` + isoYear + isoMonthDay + `|` + isoLeapDay + `)` + isoTime + `\s*$`
+
+// Parts of datePattern. Years are 0001 to 9999, and February 29 is only valid in leap years.
+const (
+	isoYear     = `([0-9]{3}[1-9]|[0-9]{2}[1-9]0|[0-9][1-9]00|[1-9]000)`
+	isoMonthDay = `(-(0[1-9]|1[0-2])-(0[1-9]|1[0-9]|2[0-8])|-(0[13-9]|1[0-2])-(29|30)|-(0[13578]|1[02])-31)`
+	isoLeapDay  = `([0-9]{2}(0[48]|[2468][048]|[13579][26])|(0[48]|[2468][048]|[13579][26])00)-02-29`
+	isoTime     = `([T ]([01][0-9]|2[0-3]):[0-5][0-9](:[0-5][0-9](\.[0-9]{1,9})?(Z|[+-](0[0-9]|1[0-5])(:[0-5][0-9])?)?)?)?`
+)
+
+// bucketExpr returns a date field truncated to the given bucket and formatted as an ISO date
+func (b *queryBuilder) bucketExpr(name string, bucket string) string {
+	if b.hidden[name] {
+		return "NULL::text"
+	}
+	timestamp := ""
+	if column, ok := systemColumns[name]; ok {
+		timestamp = column
+	} else if node, ok := b.computedFormula(name); ok {
+		timestamp = b.formulaSQL(node)
+	} else if l, ok := b.links[name]; ok {
+		value := b.linkValue(l)
+		timestamp = fmt.Sprintf("(CASE WHEN %s ~ '%s' THEN (%s)::timestamp END)", value, datePattern, value)
+	} else {
+		key := b.arg(name)
+		timestamp = fmt.Sprintf("(CASE WHEN values->>%s ~ '%s' THEN (values->>%s)::timestamp END)", key, datePattern, key)
+	}
+	return fmt.Sprintf("to_char(date_trunc('%s', %s), 'YYYY-MM-DD')", bucket, timestamp)
+}
+
+// metricExpr returns the SQL aggregate expression for a metric
+func (b *queryBuilder) metricExpr(metric models.AggregateMetric) string {
+	if metric.Func != "count" && b.hidden[metric.Field] {
+		return "NULL"
+	}
+	switch metric.Func {
+	case "count":
+		return "COUNT(*)"
+	case "countDistinct":
+		return fmt.Sprintf("COUNT(DISTINCT %s)", b.textExpr(metric.Field))
+	case "sum", "avg":
+		return fmt.Sprintf("%s(%s)::float8", strings.ToUpper(metric.Func), b.valueExpr(metric.Field))
+	default:
+		expr := fmt.Sprintf("%s(%s)", strings.ToUpper(metric.Func), b.valueExpr(metric.Field))
+		if b.isNumeric(metric.Field) {
+			expr += "::float8"
+		}
+		// Dates of typed columns are returned as text, like the values they are copied from
+		switch _, sqlType := b.typedColumn(metric.Field); sqlType {
+		case columnDate:
+			expr += "::text"
+		case columnTimestamp:
+			expr = formula.DateTextSQL(expr)
+		}
+		return expr
+	}
+}
+
+// orderBy compiles sort options into an ORDER BY list
+func (b *queryBuilder) orderBy(sorts []models.SortOption) string {
+	parts := make([]string, 0, len(sorts))
+	for _, sort := range sorts {
+		dir := "ASC"
+		if sort.Desc {
+			dir = "DESC"
+		}
+		parts = append(parts, fmt.Sprintf("%s %s", b.valueExpr(sort.Field), dir))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// escapeLike escapes LIKE wildcards in a literal pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,38 @@
+package repository
+
+import "testing"
+
+func TestDatePattern(t *testing.T) {
+	tests := []struct {
+		text  string
+		valid bool
+	}{
+		{"2024-02-29", true},
+		{"2000-02-29", true},
+		{"2024-12-31T23:59", true},
+		{"2024-01-10 08:30:00", true},
+		{"2024-01-10T08:30:00.123456Z", true},
+		{"2024-01-10T08:30:00+05:30", true},
+		{"2024-01-10 08:30:00-07", true},
+		{"2024-01-10 ", true},
+		{"2023-02-29", false},
+		{"1900-02-29", false},
+		{"2024-02-30", false},
+		{"2024-04-31", false},
+		{"2024-13-45T99", false},
+		{"0000-01-01", false},
+		{"2024-01-10T24:00", false},
+		{"2024-01-10T08:30:00+16", false},
+		{"2024-01-10 and more", false},
+		{"10/01/2024", false},
+	}
+	for _, test := range tests {
+		if got := dateRegexp.MatchString(test.text); got != test.valid {
+			t.Errorf("datePattern matches %q = %v, want %v", test.text, got, test.valid)
+		}
+		// Whatever the pattern lets through must be a timestamp
+		if _, err := parseTimestamp(test.text); test.valid && err != nil {
+			t.Errorf("parseTimestamp(%q) = %v", test.text, err)
+		}
+	}
+}
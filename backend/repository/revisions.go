@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrRevisionNotFound is returned when a record has no revision with the requested number
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// recordRevision keeps the values of a locked record as its next revision before they are replaced
+func recordRevision(tx *sql.Tx, tenant string, existing *models.ContentScan) error {
+	query := `
+		INSERT INTO content_revisions (content_id, tenant, revision, values, created_at)
+		VALUES ($1, $2, (SELECT COALESCE(MAX(revision), 0) + 1 FROM content_revisions WHERE content_id = $1), $3, $4)`
+	if _, err := tx.Exec(query, existing.ID, tenant, existing.Values, existing.UpdatedAt); err != nil {
+		return fmt.Errorf("failed to record revision: %v", err)
+	}
+	return nil
+}
+
+// GetRevisions retrieves every revision of a tenant's record, oldest first and ending with its current
+// values. Records hidden by the table's row policy are not found, and fields hidden from the principal
+// are left out of every revision.
+func (r *ContentRepository) GetRevisions(tenant string, id string, principal *models.Principal) ([]*models.Revision, error) {
+	var tableSlug string
+	err := r.db.QueryRow(`SELECT table_slug FROM contents WHERE tenant = $1 AND id = $2 AND deleted_at IS NULL`, tenant, id).Scan(&tableSlug)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get content: %v", err)
+	}
+	allowed, err := r.rowAllowed(r.db, tenant, id, tableSlug, principal)
+	if err != nil || !allowed {
+		return nil, err
+	}
+	hidden, err := r.relatedHidden(tenant, tableSlug, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT revision, values, created_at, false
+		FROM content_revisions
+		WHERE tenant = $1 AND content_id = $2
+		UNION ALL
+		SELECT (SELECT COALESCE(MAX(revision), 0) + 1 FROM content_revisions WHERE content_id = $2), values, updated_at, true
+		FROM contents
+		WHERE tenant = $1 AND id = $2 AND deleted_at IS NULL
+		ORDER BY 1`
+
+	rows, err := r.db.Query(query, tenant, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revisions: %v", err)
+	}
+	defer rows.Close()
+
+	revisions := []*models.Revision{}
+	for rows.Next() {
+		var revision models.Revision
+		var valuesJSON json.RawMessage
+		if err := rows.Scan(&revision.Revision, &valuesJSON, &revision.CreatedAt, &revision.Current); err != nil {
+			return nil, fmt.Errorf("failed to scan revision: %v", err)
+		}
+		if err := json.Unmarshal(valuesJSON, &revision.Values); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal values: %v", err)
+		}
+		redactValues(revision.Values, hidden)
+		revisions = append(revisions, &revision)
+	}
+
+	return revisions, nil
+}
+
+// GetRevision retrieves one revision of a tenant's record, or nil if the record or revision does not exist
+func (r *ContentRepository) GetRevision(tenant string, id string, number int, principal *models.Principal) (*models.Revision, error) {
+	revisions, err := r.GetRevisions(tenant, id, principal)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, number), nil
+}
+
+// findRevision returns the revision with the given number, or nil
+func findRevision(revisions []*models.Revision, number int) *models.Revision {
+	for _, revision := range revisions {
+		if revision.Revision == number {
+			return revision
+		}
+	}
+	return nil
+}
+
+// DiffRevisions compares two revisions of a tenant's record field by field. A to of 0 compares with the current values.
+func (r *ContentRepository) DiffRevisions(tenant string, id string, from int, to int, principal *models.Principal) (*models.RevisionDiff, error) {
+	revisions, err := r.GetRevisions(tenant, id, principal)
+	if err != nil || revisions == nil {
+		return nil, err
+	}
+	return diffRevisions(revisions, from, to)
+}
+
+// diffRevisions compares two of a record's revisions; a to of 0 compares with the current values
+func diffRevisions(revisions []*models.Revision, from int, to int) (*models.RevisionDiff, error) {
+	if to == 0 {
+		to = revisions[len(revisions)-1].Revision
+	}
+
+	old, updated := findRevision(revisions, from), findRevision(revisions, to)
+	if old == nil || updated == nil {
+		return nil, ErrRevisionNotFound
+	}
+
+	return &models.RevisionDiff{
+		From:    from,
+		To:      to,
+		Changes: diffValues(old.Values, updated.Values),
+	}, nil
+}
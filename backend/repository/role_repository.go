@@ -0,0 +1,310 @@
+package repository
+
+import (
+	"dynamic-table-backend/models"
+	"fmt"
+	"strings"
+)
+
+type RoleRepository struct {
+	db DB
+}
+
+func NewRoleRepository(db DB) *RoleRepository {
+	return &RoleRepository{db: db}
+}
+
+// CreateRole creates a new role without grants or members
+func (r *RoleRepository) CreateRole(req *models.CreateRoleRequest) (*models.Role, error) {
+	query := `
+		INSERT INTO roles (name, description)
+		VALUES ($1, $2)
+		RETURNING id, name, description, created_at`
+
+	role := models.Role{Grants: []models.Grant{}, Members: []string{}}
+	err := r.db.QueryRow(query, req.Name, req.Description).Scan(
+		&role.ID,
+		&role.Name,
+		&role.Description,
+		&role.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create role: %v", err)
+	}
+
+	return &role, nil
+}
+
+// GetRole retrieves a role with its grants and members
+func (r *RoleRepository) GetRole(id string) (*models.Role, error) {
+	roles, err := r.queryRoles(`WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		return nil, nil
+	}
+	return roles[0], nil
+}
+
+// GetRoleByName retrieves a role by its unique name
+func (r *RoleRepository) GetRoleByName(name string) (*models.Role, error) {
+	roles, err := r.queryRoles(`WHERE name = $1`, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		return nil, nil
+	}
+	return roles[0], nil
+}
+
+// GetAllRoles retrieves every role with its grants and members
+func (r *RoleRepository) GetAllRoles() ([]*models.Role, error) {
+	return r.queryRoles("")
+}
+
+// queryRoles loads the roles matching a WHERE clause together with their grants and members
+func (r *RoleRepository) queryRoles(where string, args ...interface{}) ([]*models.Role, error) {
+	query := fmt.Sprintf(`
+		SELECT id, name, description, created_at
+		FROM roles
+		%s
+		ORDER BY name`, where)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query roles: %v", err)
+	}
+	defer rows.Close()
+
+	roles := []*models.Role{}
+	byID := make(map[string]*models.Role)
+	var ids []string
+	for rows.Next() {
+		role := &models.Role{Grants: []models.Grant{}, Members: []string{}}
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan role: %v", err)
+		}
+		roles = append(roles, role)
+		byID[role.ID] = role
+		ids = append(ids, role.ID)
+	}
+	if len(ids) == 0 {
+		return roles, nil
+	}
+
+	grantRows, err := r.db.Query(`
+		SELECT id, role_id, permission, table_slug
+		FROM role_grants
+		WHERE role_id IN (`+placeholders(1, len(ids))+`)
+		ORDER BY permission, table_slug`, stringArgs(ids)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query grants: %v", err)
+	}
+	defer grantRows.Close()
+	for grantRows.Next() {
+		var grant models.Grant
+		if err := grantRows.Scan(&grant.ID, &grant.RoleID, &grant.Permission, &grant.TableSlug); err != nil {
+			return nil, fmt.Errorf("failed to scan grant: %v", err)
+		}
+		byID[grant.RoleID].Grants = append(byID[grant.RoleID].Grants, grant)
+	}
+
+	memberRows, err := r.db.Query(`
+		SELECT role_id, principal_id
+		FROM role_members
+		WHERE role_id IN (`+placeholders(1, len(ids))+`)
+		ORDER BY created_at`, stringArgs(ids)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query role members: %v", err)
+	}
+	defer memberRows.Close()
+	for memberRows.Next() {
+		var roleID, principalID string
+		if err := memberRows.Scan(&roleID, &principalID); err != nil {
+			return nil, fmt.Errorf("failed to scan role member: %v", err)
+		}
+		byID[roleID].Members = append(byID[roleID].Members, principalID)
+	}
+
+	return roles, nil
+}
+
+// DeleteRole deletes a role with its grants and members
+func (r *RoleRepository) DeleteRole(id string) error {
+	result, err := r.db.Exec(`DELETE FROM roles WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("role not found")
+	}
+
+	return nil
+}
+
+// AddGrant gives a role a permission, on one table or on every table when tableSlug is empty
+func (r *RoleRepository) AddGrant(roleID string, req *models.CreateGrantRequest) (*models.Grant, error) {
+	query := `
+		INSERT INTO role_grants (role_id, permission, table_slug)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (role_id, permission, table_slug) DO UPDATE SET permission = EXCLUDED.permission
+		RETURNING id, role_id, permission, table_slug`
+
+	var grant models.Grant
+	err := r.db.QueryRow(query, roleID, req.Permission, req.TableSlug).Scan(
+		&grant.ID,
+		&grant.RoleID,
+		&grant.Permission,
+		&grant.TableSlug,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add grant: %v", err)
+	}
+
+	return &grant, nil
+}
+
+// DeleteGrant removes a grant from a role
+func (r *RoleRepository) DeleteGrant(roleID string, grantID string) error {
+	result, err := r.db.Exec(`DELETE FROM role_grants WHERE id = $1 AND role_id = $2`, grantID, roleID)
+	if err != nil {
+		return fmt.Errorf("failed to delete grant: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("grant not found")
+	}
+
+	return nil
+}
+
+// AddMember binds a principal to a role
+func (r *RoleRepository) AddMember(roleID string, principalID string) error {
+	query := `
+		INSERT INTO role_members (role_id, principal_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+
+	if _, err := r.db.Exec(query, roleID, principalID); err != nil {
+		return fmt.Errorf("failed to add role member: %v", err)
+	}
+
+	return nil
+}
+
+// RemoveMember unbinds a principal from a role
+func (r *RoleRepository) RemoveMember(roleID string, principalID string) error {
+	result, err := r.db.Exec(`DELETE FROM role_members WHERE role_id = $1 AND principal_id = $2`, roleID, principalID)
+	if err != nil {
+		return fmt.Errorf("failed to remove role member: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("role member not found")
+	}
+
+	return nil
+}
+
+// GetRoleNamesForPrincipal returns the names of the roles bound to a principal, followed by
+// the claimed role names that are not stored roles
+func (r *RoleRepository) GetRoleNamesForPrincipal(principalID string, claimed []string) ([]string, error) {
+	query := `
+		SELECT name
+		FROM roles
+		WHERE id IN (SELECT role_id FROM role_members WHERE principal_id = $1)
+		OR name IN (` + placeholders(2, len(claimed)) + `)
+		ORDER BY name`
+
+	rows, err := r.db.Query(query, append([]interface{}{principalID}, stringArgs(claimed)...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query roles: %v", err)
+	}
+	defer rows.Close()
+
+	names := []string{}
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan role: %v", err)
+		}
+		names = append(names, name)
+		seen[name] = true
+	}
+	for _, name := range claimed {
+		if !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+
+	return names, nil
+}
+
+// GetGrantsForPrincipal returns the grants of every role bound to a principal or named in roleNames
+func (r *RoleRepository) GetGrantsForPrincipal(principalID string, roleNames []string) ([]models.Grant, error) {
+	query := `
+		SELECT g.id, g.role_id, g.permission, g.table_slug
+		FROM role_grants g
+		JOIN roles ro ON ro.id = g.role_id
+		WHERE ro.id IN (SELECT role_id FROM role_members WHERE principal_id = $1)
+		OR ro.name IN (` + placeholders(2, len(roleNames)) + `)`
+
+	rows, err := r.db.Query(query, append([]interface{}{principalID}, stringArgs(roleNames)...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query grants: %v", err)
+	}
+	defer rows.Close()
+
+	grants := []models.Grant{}
+	for rows.Next() {
+		var grant models.Grant
+		if err := rows.Scan(&grant.ID, &grant.RoleID, &grant.Permission, &grant.TableSlug); err != nil {
+			return nil, fmt.Errorf("failed to scan grant: %v", err)
+		}
+		grants = append(grants, grant)
+	}
+
+	return grants, nil
+}
+
+// placeholders returns the numbered placeholders of count arguments starting with $first, for an IN list
+// that runs on PostgreSQL and SQLite alike. Without arguments it is NULL, which IN matches with nothing.
+func placeholders(first int, count int) string {
+	if count == 0 {
+		return "NULL"
+	}
+	list := make([]string, count)
+	for i := range list {
+		list[i] = fmt.Sprintf("$%d", first+i)
+	}
+	return strings.Join(list, ", ")
+}
+
+// stringArgs converts strings to query arguments
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
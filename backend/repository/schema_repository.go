@@ -2,61 +2,107 @@ package repository
 
 import (
 	"database/sql"
-	"dynamic-table-backend/database"
+	"dynamic-table-backend/formula"
 	"dynamic-table-backend/models"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
-type SchemaRepository struct{}
+type SchemaRepository struct {
+	db DB
+}
 
-func NewSchemaRepository() *SchemaRepository {
-	return &SchemaRepository{}
+func NewSchemaRepository(db DB) *SchemaRepository {
+	return &SchemaRepository{db: db}
 }
 
-// CreateSchema creates a new table schema
-func (r *SchemaRepository) CreateSchema(schema *models.CreateSchemaRequest) (*models.Schema, error) {
+// CreateSchema creates a new table schema in a tenant, recording the actor in the audit log.
+// The slug of a table in the trash stays taken until the table is restored or purged.
+func (r *SchemaRepository) CreateSchema(tenant string, schema *models.CreateSchemaRequest, actor *models.Principal) (*models.Schema, error) {
 	fieldsJSON, err := json.Marshal(schema.Fields)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal fields: %v", err)
 	}
 
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var trashed bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schemas WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NOT NULL)`, tenant, schema.TableSlug).Scan(&trashed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check trash: %v", err)
+	}
+	if trashed {
+		return nil, fmt.Errorf("a table with this slug is in the trash")
+	}
+
+	storage := schema.Storage
+	if storage == "" {
+		storage = models.StorageJSONB
+	}
+
 	query := `
-		INSERT INTO schemas (table_slug, table_name, fields)
-		VALUES ($1, $2, $3)
-		RETURNING id, table_slug, table_name, fields, created_at, updated_at`
+		INSERT INTO schemas (tenant, table_slug, table_name, fields, storage)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, table_slug, table_name, fields, created_at, updated_at, storage`
 
 	var schemaScan models.SchemaScan
-	err = database.DB.QueryRow(query, schema.TableSlug, schema.TableName, fieldsJSON).Scan(
+	err = tx.QueryRow(query, tenant, schema.TableSlug, schema.TableName, fieldsJSON, storage).Scan(
 		&schemaScan.ID,
 		&schemaScan.TableSlug,
 		&schemaScan.TableName,
 		&schemaScan.Fields,
 		&schemaScan.CreatedAt,
 		&schemaScan.UpdatedAt,
+		&schemaScan.Storage,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create schema: %v", err)
 	}
 
-	return r.scanToSchema(schemaScan)
+	if storage == models.StorageMaterialized {
+		if err := createMaterializedTable(tx, schemaScan.ID, tenant, schemaScan.TableSlug, schema.Fields); err != nil {
+			return nil, err
+		}
+	}
+
+	err = recordChange(tx, tenant, actor, models.AuditSchemaCreate, schemaScan.TableSlug, "", nil, schemaAuditJSON(schemaScan.TableName, schemaScan.Fields))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit schema: %v", err)
+	}
+
+	return scanToSchema(schemaScan)
+}
+
+// GetSchemaBySlug retrieves a tenant's schema by table slug, or nil if it does not exist or is in the trash
+func (r *SchemaRepository) GetSchemaBySlug(tenant string, tableSlug string) (*models.Schema, error) {
+	return getSchema(r.db, tenant, tableSlug)
 }
 
-// GetSchemaBySlug retrieves a schema by table slug
-func (r *SchemaRepository) GetSchemaBySlug(tableSlug string) (*models.Schema, error) {
+// getSchema retrieves a tenant's schema on the database or in a transaction
+func getSchema(q queryRower, tenant string, tableSlug string) (*models.Schema, error) {
 	query := `
-		SELECT id, table_slug, table_name, fields, created_at, updated_at
+		SELECT id, table_slug, table_name, fields, created_at, updated_at, storage
 		FROM schemas
-		WHERE table_slug = $1`
+		WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL`
 
 	var schemaScan models.SchemaScan
-	err := database.DB.QueryRow(query, tableSlug).Scan(
+	err := q.QueryRow(query, tenant, tableSlug).Scan(
 		&schemaScan.ID,
 		&schemaScan.TableSlug,
 		&schemaScan.TableName,
 		&schemaScan.Fields,
 		&schemaScan.CreatedAt,
 		&schemaScan.UpdatedAt,
+		&schemaScan.Storage,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -65,17 +111,18 @@ func (r *SchemaRepository) GetSchemaBySlug(tableSlug string) (*models.Schema, er
 		return nil, fmt.Errorf("failed to get schema: %v", err)
 	}
 
-	return r.scanToSchema(schemaScan)
+	return scanToSchema(schemaScan)
 }
 
-// GetAllSchemas retrieves all table schemas
-func (r *SchemaRepository) GetAllSchemas() ([]*models.Schema, error) {
+// GetAllSchemas retrieves all table schemas of a tenant outside the trash
+func (r *SchemaRepository) GetAllSchemas(tenant string) ([]*models.Schema, error) {
 	query := `
-		SELECT id, table_slug, table_name, fields, created_at, updated_at
+		SELECT id, table_slug, table_name, fields, created_at, updated_at, storage
 		FROM schemas
+		WHERE tenant = $1 AND deleted_at IS NULL
 		ORDER BY created_at DESC`
 
-	rows, err := database.DB.Query(query)
+	rows, err := r.db.Query(query, tenant)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query schemas: %v", err)
 	}
@@ -91,12 +138,13 @@ func (r *SchemaRepository) GetAllSchemas() ([]*models.Schema, error) {
 			&schemaScan.Fields,
 			&schemaScan.CreatedAt,
 			&schemaScan.UpdatedAt,
+			&schemaScan.Storage,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan schema: %v", err)
 		}
 
-		schema, err := r.scanToSchema(schemaScan)
+		schema, err := scanToSchema(schemaScan)
 		if err != nil {
 			return nil, err
 		}
@@ -106,27 +154,56 @@ func (r *SchemaRepository) GetAllSchemas() ([]*models.Schema, error) {
 	return schemas, nil
 }
 
-// UpdateSchema updates an existing schema
-func (r *SchemaRepository) UpdateSchema(tableSlug string, updateReq *models.UpdateSchemaRequest) (*models.Schema, error) {
+// UpdateSchema updates an existing schema of a tenant, recording the actor in the audit log
+func (r *SchemaRepository) UpdateSchema(tenant string, tableSlug string, updateReq *models.UpdateSchemaRequest, actor *models.Principal) (*models.Schema, error) {
 	fieldsJSON, err := json.Marshal(updateReq.Fields)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal fields: %v", err)
 	}
 
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the schema to record what the update replaces
+	var schemaID, oldName, storage string
+	var oldFields json.RawMessage
+	err = tx.QueryRow(`SELECT id, table_name, fields, storage FROM schemas WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL FOR UPDATE`, tenant, tableSlug).Scan(&schemaID, &oldName, &oldFields, &storage)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get schema: %v", err)
+	}
+
+	// Typed tables follow their fields
+	if storage != models.StorageJSONB {
+		var fields []models.Field
+		if err := json.Unmarshal(oldFields, &fields); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal fields: %v", err)
+		}
+		if err := alterMaterializedTable(tx, schemaID, fields, updateReq.Fields); err != nil {
+			return nil, err
+		}
+	}
+
 	query := `
 		UPDATE schemas
 		SET table_name = $1, fields = $2, updated_at = CURRENT_TIMESTAMP
-		WHERE table_slug = $3
-		RETURNING id, table_slug, table_name, fields, created_at, updated_at`
+		WHERE tenant = $3 AND table_slug = $4
+		RETURNING id, table_slug, table_name, fields, created_at, updated_at, storage`
 
 	var schemaScan models.SchemaScan
-	err = database.DB.QueryRow(query, updateReq.TableName, fieldsJSON, tableSlug).Scan(
+	err = tx.QueryRow(query, updateReq.TableName, fieldsJSON, tenant, tableSlug).Scan(
 		&schemaScan.ID,
 		&schemaScan.TableSlug,
 		&schemaScan.TableName,
 		&schemaScan.Fields,
 		&schemaScan.CreatedAt,
 		&schemaScan.UpdatedAt,
+		&schemaScan.Storage,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -135,31 +212,193 @@ func (r *SchemaRepository) UpdateSchema(tableSlug string, updateReq *models.Upda
 		return nil, fmt.Errorf("failed to update schema: %v", err)
 	}
 
-	return r.scanToSchema(schemaScan)
+	err = recordChange(tx, tenant, actor, models.AuditSchemaUpdate, tableSlug, "", schemaAuditJSON(oldName, oldFields), schemaAuditJSON(schemaScan.TableName, schemaScan.Fields))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit schema: %v", err)
+	}
+
+	return scanToSchema(schemaScan)
 }
 
-// DeleteSchema deletes a schema and all its contents
-func (r *SchemaRepository) DeleteSchema(tableSlug string) error {
-	query := `DELETE FROM schemas WHERE table_slug = $1`
-	result, err := database.DB.Exec(query, tableSlug)
+// DeleteSchema moves a tenant's schema and all its live contents to the trash, recording the actor in the audit log.
+// The contents are stamped with the schema's deletion time, so that restoring the schema restores exactly them.
+func (r *SchemaRepository) DeleteSchema(tenant string, tableSlug string, actor *models.Principal) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	var oldFields json.RawMessage
+	var deletedAt time.Time
+	query := `
+		UPDATE schemas
+		SET deleted_at = CURRENT_TIMESTAMP
+		WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL
+		RETURNING table_name, fields, deleted_at`
+	err = tx.QueryRow(query, tenant, tableSlug).Scan(&oldName, &oldFields, &deletedAt)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("schema not found")
+		}
 		return fmt.Errorf("failed to delete schema: %v", err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	query = `UPDATE contents SET deleted_at = $3 WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL RETURNING id, values`
+	if err := recordCascade(tx, tenant, models.AuditContentDelete, tableSlug, query, tenant, tableSlug, deletedAt); err != nil {
+		return err
+	}
+
+	err = recordChange(tx, tenant, actor, models.AuditSchemaDelete, tableSlug, "", schemaAuditJSON(oldName, oldFields), nil)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit schema: %v", err)
+	}
+
+	return nil
+}
+
+// GetTrashedSchemas retrieves the schemas of a tenant in the trash, most recently deleted first
+func (r *SchemaRepository) GetTrashedSchemas(tenant string) ([]*models.Schema, error) {
+	query := `
+		SELECT id, table_slug, table_name, fields, created_at, updated_at, storage, deleted_at
+		FROM schemas
+		WHERE tenant = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC`
+
+	rows, err := r.db.Query(query, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schemas: %v", err)
+	}
+	defer rows.Close()
+
+	schemas := []*models.Schema{}
+	for rows.Next() {
+		var schemaScan models.SchemaScan
+		var deletedAt time.Time
+		err := rows.Scan(
+			&schemaScan.ID,
+			&schemaScan.TableSlug,
+			&schemaScan.TableName,
+			&schemaScan.Fields,
+			&schemaScan.CreatedAt,
+			&schemaScan.UpdatedAt,
+			&schemaScan.Storage,
+			&deletedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schema: %v", err)
+		}
+
+		schema, err := scanToSchema(schemaScan)
+		if err != nil {
+			return nil, err
+		}
+		schema.DeletedAt = &deletedAt
+		schemas = append(schemas, schema)
+	}
+
+	return schemas, nil
+}
+
+// RestoreSchema moves a tenant's schema out of the trash together with the contents deleted with it,
+// recording the actor in the audit log. It returns nil if the schema is not in the trash.
+func (r *SchemaRepository) RestoreSchema(tenant string, tableSlug string, actor *models.Principal) (*models.Schema, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %v", err)
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
 	}
+	defer tx.Rollback()
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("schema not found")
+	var deletedAt time.Time
+	err = tx.QueryRow(`SELECT deleted_at FROM schemas WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NOT NULL FOR UPDATE`, tenant, tableSlug).Scan(&deletedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get schema: %v", err)
 	}
 
+	query := `
+		UPDATE schemas
+		SET deleted_at = NULL
+		WHERE tenant = $1 AND table_slug = $2
+		RETURNING id, table_slug, table_name, fields, created_at, updated_at, storage`
+
+	var schemaScan models.SchemaScan
+	err = tx.QueryRow(query, tenant, tableSlug).Scan(
+		&schemaScan.ID,
+		&schemaScan.TableSlug,
+		&schemaScan.TableName,
+		&schemaScan.Fields,
+		&schemaScan.CreatedAt,
+		&schemaScan.UpdatedAt,
+		&schemaScan.Storage,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore schema: %v", err)
+	}
+
+	err = recordChange(tx, tenant, actor, models.AuditSchemaRestore, tableSlug, "", nil, schemaAuditJSON(schemaScan.TableName, schemaScan.Fields))
+	if err != nil {
+		return nil, err
+	}
+
+	// Records deleted on their own before the schema stay in the trash
+	query = `UPDATE contents SET deleted_at = NULL WHERE tenant = $1 AND table_slug = $2 AND deleted_at = $3 RETURNING id, values`
+	if err := recordCascade(tx, tenant, models.AuditContentRestore, tableSlug, query, tenant, tableSlug, deletedAt); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit schema: %v", err)
+	}
+
+	return scanToSchema(schemaScan)
+}
+
+// schemaAuditJSON returns the audited properties of a schema as a JSON object
+func schemaAuditJSON(tableName string, fields json.RawMessage) json.RawMessage {
+	properties, _ := json.Marshal(map[string]interface{}{
+		"tableName": tableName,
+		"fields":    fields,
+	})
+	return properties
+}
+
+// ResolveLinks checks the lookup and rollup fields of a table against the schemas of the
+// tenant they read, recording each result type in LinkConfig.ResultType
+func (r *SchemaRepository) ResolveLinks(tenant string, tableSlug string, fields []models.Field) error {
+	for _, field := range fields {
+		if field.DataType != formula.LookupDataType && field.DataType != formula.RollupDataType {
+			continue
+		}
+		l, err := resolveLink(tableSlug, fields, field, r.schemaOf(tenant))
+		if err != nil {
+			return err
+		}
+		field.LinkConfig.ResultType = l.resultType()
+	}
 	return nil
 }
 
+// schemaOf returns a function loading the schemas of a tenant by slug
+func (r *SchemaRepository) schemaOf(tenant string) func(string) (*models.Schema, error) {
+	return func(tableSlug string) (*models.Schema, error) {
+		return r.GetSchemaBySlug(tenant, tableSlug)
+	}
+}
+
 // scanToSchema converts SchemaScan to Schema
-func (r *SchemaRepository) scanToSchema(scan models.SchemaScan) (*models.Schema, error) {
+func scanToSchema(scan models.SchemaScan) (*models.Schema, error) {
 	var fields []models.Field
 	if err := json.Unmarshal(scan.Fields, &fields); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal fields: %v", err)
@@ -172,5 +411,6 @@ func (r *SchemaRepository) scanToSchema(scan models.SchemaScan) (*models.Schema,
 		Fields:    fields,
 		CreatedAt: scan.CreatedAt,
 		UpdatedAt: scan.UpdatedAt,
+		Storage:   scan.Storage,
 	}, nil
 }
@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"fmt"
+)
+
+// recordChange records a change in the transaction making it, like recordChange does in PostgreSQL
+func (d *sqliteData) recordChange(tenant string, change *embeddedChange, matches func(filter string) (bool, error)) error {
+	if err := d.recordAudit(tenant, change); err != nil {
+		return err
+	}
+	if err := d.recordEvent(tenant, change); err != nil {
+		return err
+	}
+	return d.enqueueWebhooks(tenant, change, matches)
+}
+
+// recordAudit appends the audit entry of a change, like recordAudit
+func (d *sqliteData) recordAudit(tenant string, change *embeddedChange) error {
+	changes, err := auditChanges(change.before, change.after)
+	if err != nil {
+		return err
+	}
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit changes: %v", err)
+	}
+
+	actorID, actorName := "system", "system"
+	if change.actor != nil {
+		actorID, actorName = change.actor.ID, change.actor.Name
+	}
+
+	query := `
+		INSERT INTO audit_log (tenant, actor_id, actor_name, action, table_slug, record_id, changes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := d.q.Exec(query, tenant, actorID, actorName, change.action, change.tableSlug, change.recordID,
+		string(changesJSON), sqliteTime(&change.at)); err != nil {
+		return fmt.Errorf("failed to record audit entry: %v", err)
+	}
+	return nil
+}
+
+// recordEvent appends the change event of a change, like recordEvent. Changes hold the write lock
+// until they commit, so event IDs become visible in increasing order.
+func (d *sqliteData) recordEvent(tenant string, change *embeddedChange) error {
+	event, ok := changeEvents[change.action]
+	if !ok {
+		return nil
+	}
+	values := change.after
+	if change.after == nil {
+		values = change.before
+	}
+	var valuesText interface{}
+	if values != nil {
+		valuesText = string(values)
+	}
+
+	query := `
+		INSERT INTO change_events (tenant, table_slug, record_id, event, "values", created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := d.q.Exec(query, tenant, change.tableSlug, change.recordID, event, valuesText, sqliteTime(&change.at)); err != nil {
+		return fmt.Errorf("failed to record change event: %v", err)
+	}
+	return nil
+}
+
+// enqueueWebhooks adds a delivery to the outbox for every webhook of the table that subscribes to the
+// change and whose filter matches, like enqueueWebhooks
+func (d *sqliteData) enqueueWebhooks(tenant string, change *embeddedChange, matches func(filter string) (bool, error)) error {
+	rows, err := d.q.Query(`
+		SELECT id, filter FROM webhooks
+		WHERE tenant = ? AND table_slug = ? AND EXISTS (SELECT 1 FROM json_each(events) WHERE value = ?)`,
+		tenant, change.tableSlug, change.action)
+	if err != nil {
+		return fmt.Errorf("failed to query webhooks: %v", err)
+	}
+	type subscription struct{ id, filter string }
+	var subscriptions []subscription
+	for rows.Next() {
+		var s subscription
+		if err := rows.Scan(&s.id, &s.filter); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan webhook: %v", err)
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	rows.Close()
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(models.WebhookEvent{
+		Event:      change.action,
+		Tenant:     tenant,
+		TableSlug:  change.tableSlug,
+		RecordID:   change.recordID,
+		Before:     change.before,
+		After:      change.after,
+		OccurredAt: change.at,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook event: %v", err)
+	}
+
+	for _, s := range subscriptions {
+		if s.filter != "" && matches != nil {
+			matched, err := matches(s.filter)
+			if err != nil {
+				return err
+			}
+			if !matched {
+				continue
+			}
+		}
+		_, err := d.q.Exec(`
+			INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?)`, s.id, change.action, string(payload), sqliteTime(&change.at), sqliteTime(&change.at))
+		if err != nil {
+			return fmt.Errorf("failed to queue webhook delivery: %v", err)
+		}
+	}
+	return nil
+}
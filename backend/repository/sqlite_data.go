@@ -0,0 +1,429 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqliteTimeLayout stores timestamps as text that sorts chronologically
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000"
+
+// sqlRunner runs statements on a database or in a transaction
+type sqlRunner interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqliteData keeps the data of an EmbeddedStore in SQLite. It evaluates record queries with the JSON1
+// functions where it can and otherwise narrows records down, so that the store only evaluates the
+// records that can match. Reads run on the database and changes in a transaction that takes the write
+// lock when it begins, so that changes are serialized while readers go on.
+type sqliteData struct {
+	db DB
+	q  sqlRunner // the database, or the transaction of an update
+}
+
+// NewSQLiteStore creates a store keeping its data in a SQLite database with the tables of database.InitDB
+func NewSQLiteStore(db DB) *EmbeddedStore {
+	return newEmbeddedStore(&sqliteData{db: db, q: db})
+}
+
+// NewSQLiteStores keeps everything in a SQLite database with the tables of database.InitDB. Only
+// materialized storage needs PostgreSQL and is left nil.
+func NewSQLiteStores(db DB) *Stores {
+	stores := newEmbeddedStores(NewSQLiteStore(db))
+	stores.Files = NewSQLiteFileRepository(db)
+	stores.Audit = NewSQLiteAuditRepository(db)
+	stores.Changes = NewChangeRepository(db)
+	stores.Webhooks = NewSQLiteWebhookRepository(db)
+	stores.Roles = NewRoleRepository(db)
+	stores.APIKeys = NewAPIKeyRepository(db)
+	return stores
+}
+
+func (d *sqliteData) view(reads func(data embeddedData) error) error {
+	return reads(d)
+}
+
+func (d *sqliteData) update(changes func(data embeddedData) error) error {
+	// Nested updates run in the enclosing transaction
+	if d.q != d.db {
+		return changes(d)
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := changes(&sqliteData{db: d.db, q: tx}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// sqliteTime formats a timestamp for a SQLite column
+func sqliteTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// trashedCondition selects the rows in or outside the trash
+func trashedCondition(trashed bool) string {
+	if trashed {
+		return "deleted_at IS NOT NULL"
+	}
+	return "deleted_at IS NULL"
+}
+
+const sqliteSchemaColumns = `tenant, id, table_slug, table_name, fields, created_at, updated_at, deleted_at`
+
+// scanSQLiteSchema scans a row of sqliteSchemaColumns
+func scanSQLiteSchema(scan func(dest ...interface{}) error) (*embeddedSchema, error) {
+	var schema embeddedSchema
+	var fields string
+	if err := scan(
+		&schema.tenant,
+		&schema.scan.ID,
+		&schema.scan.TableSlug,
+		&schema.scan.TableName,
+		&fields,
+		&schema.scan.CreatedAt,
+		&schema.scan.UpdatedAt,
+		&schema.deletedAt,
+	); err != nil {
+		return nil, err
+	}
+	schema.scan.Fields = json.RawMessage(fields)
+	return &schema, nil
+}
+
+func (d *sqliteData) schema(tenant string, tableSlug string, trashed bool) (*embeddedSchema, error) {
+	query := `SELECT ` + sqliteSchemaColumns + ` FROM schemas WHERE tenant = ? AND table_slug = ? AND ` + trashedCondition(trashed)
+	schema, err := scanSQLiteSchema(d.q.QueryRow(query, tenant, tableSlug).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema: %v", err)
+	}
+	return schema, nil
+}
+
+func (d *sqliteData) schemas(tenant string, trashed bool) ([]*embeddedSchema, error) {
+	order := "created_at DESC"
+	if trashed {
+		order = "deleted_at DESC"
+	}
+	query := `SELECT ` + sqliteSchemaColumns + ` FROM schemas WHERE tenant = ? AND ` + trashedCondition(trashed) + ` ORDER BY ` + order
+	rows, err := d.q.Query(query, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schemas: %v", err)
+	}
+	defer rows.Close()
+
+	var schemas []*embeddedSchema
+	for rows.Next() {
+		schema, err := scanSQLiteSchema(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schema: %v", err)
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, rows.Err()
+}
+
+func (d *sqliteData) insertSchema(schema *embeddedSchema) error {
+	_, err := d.q.Exec(`
+		INSERT INTO schemas (tenant, id, table_slug, table_name, fields, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		schema.tenant, schema.scan.ID, schema.scan.TableSlug, schema.scan.TableName, string(schema.scan.Fields),
+		sqliteTime(&schema.scan.CreatedAt), sqliteTime(&schema.scan.UpdatedAt),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create schema: %v", err)
+	}
+	return nil
+}
+
+func (d *sqliteData) updateSchema(schema *embeddedSchema) error {
+	_, err := d.q.Exec(`UPDATE schemas SET table_name = ?, fields = ?, updated_at = ? WHERE tenant = ? AND id = ?`,
+		schema.scan.TableName, string(schema.scan.Fields), sqliteTime(&schema.scan.UpdatedAt), schema.tenant, schema.scan.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update schema: %v", err)
+	}
+	return nil
+}
+
+func (d *sqliteData) trashSchema(tenant string, tableSlug string, deletedAt time.Time) ([]*embeddedRecord, error) {
+	records, err := d.queryRecords(`
+		UPDATE contents SET deleted_at = ?
+		WHERE tenant = ? AND table_slug = ? AND deleted_at IS NULL
+		RETURNING `+sqliteContentColumns, sqliteTime(&deletedAt), tenant, tableSlug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete contents: %v", err)
+	}
+	if _, err := d.q.Exec(`UPDATE schemas SET deleted_at = ? WHERE tenant = ? AND table_slug = ? AND deleted_at IS NULL`,
+		sqliteTime(&deletedAt), tenant, tableSlug); err != nil {
+		return nil, fmt.Errorf("failed to delete schema: %v", err)
+	}
+	return records, nil
+}
+
+func (d *sqliteData) restoreSchema(tenant string, tableSlug string) ([]*embeddedRecord, error) {
+	records, err := d.queryRecords(`
+		UPDATE contents SET deleted_at = NULL
+		WHERE tenant = ? AND table_slug = ?
+		AND deleted_at = (SELECT deleted_at FROM schemas WHERE tenant = ? AND table_slug = ?)
+		RETURNING `+sqliteContentColumns, tenant, tableSlug, tenant, tableSlug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore contents: %v", err)
+	}
+	if _, err := d.q.Exec(`UPDATE schemas SET deleted_at = NULL WHERE tenant = ? AND table_slug = ?`, tenant, tableSlug); err != nil {
+		return nil, fmt.Errorf("failed to restore schema: %v", err)
+	}
+	return records, nil
+}
+
+func (d *sqliteData) purgeTrash(cutoff time.Time) (int64, int64, error) {
+	// Foreign keys delete the records, revisions, row policies and webhooks of purged schemas
+	result, err := d.q.Exec(`DELETE FROM schemas WHERE deleted_at < ?`, sqliteTime(&cutoff))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to purge schemas: %v", err)
+	}
+	schemas, _ := result.RowsAffected()
+
+	result, err = d.q.Exec(`DELETE FROM contents WHERE deleted_at < ?`, sqliteTime(&cutoff))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to purge contents: %v", err)
+	}
+	contents, _ := result.RowsAffected()
+
+	return schemas, contents, nil
+}
+
+const sqliteContentColumns = `tenant, id, table_slug, "values", created_at, updated_at, deleted_at`
+
+// scanSQLiteRecord scans a row of sqliteContentColumns
+func scanSQLiteRecord(scan func(dest ...interface{}) error) (*embeddedRecord, error) {
+	var record embeddedRecord
+	var values string
+	if err := scan(
+		&record.tenant,
+		&record.scan.ID,
+		&record.scan.TableSlug,
+		&values,
+		&record.scan.CreatedAt,
+		&record.scan.UpdatedAt,
+		&record.scan.DeletedAt,
+	); err != nil {
+		return nil, err
+	}
+	record.scan.Values = json.RawMessage(values)
+	return &record, nil
+}
+
+func (d *sqliteData) record(tenant string, id string) (*embeddedRecord, error) {
+	query := `SELECT ` + sqliteContentColumns + ` FROM contents WHERE tenant = ? AND id = ?`
+	record, err := scanSQLiteRecord(d.q.QueryRow(query, tenant, id).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content: %v", err)
+	}
+	return record, nil
+}
+
+func (d *sqliteData) records(tenant string, tableSlug string, trashed bool, filter *recordFilter) ([]*embeddedRecord, error) {
+	conditions := []string{"tenant = ?", "table_slug = ?", trashedCondition(trashed)}
+	args := []interface{}{tenant, tableSlug}
+	if filter != nil {
+		if condition, searchArgs := sqliteSearch(filter.search); condition != "" {
+			conditions = append(conditions, condition)
+			args = append(args, searchArgs...)
+		}
+		for _, match := range filter.values {
+			if condition, matchArgs := sqliteValueMatch(match); condition != "" {
+				conditions = append(conditions, condition)
+				args = append(args, matchArgs...)
+			}
+		}
+	}
+
+	query := `SELECT ` + sqliteContentColumns + ` FROM contents WHERE ` + strings.Join(conditions, " AND ") + ` ORDER BY created_at DESC`
+	records, err := d.queryRecords(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get contents: %v", err)
+	}
+	return records, nil
+}
+
+// queryRecords runs a query returning sqliteContentColumns
+func (d *sqliteData) queryRecords(query string, args ...interface{}) ([]*embeddedRecord, error) {
+	rows, err := d.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*embeddedRecord
+	for rows.Next() {
+		record, err := scanSQLiteRecord(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// sqliteSearch returns a condition keeping the records whose stored JSON may contain the search
+// text, or "" if it cannot narrow them down. Queries match the text of the values as PostgreSQL
+// prints them, which only agrees with the stored JSON on ASCII words: number formatting, escapes
+// and case folding beyond ASCII may differ, so records with non-ASCII text are always kept.
+func sqliteSearch(search string) (string, []interface{}) {
+	letter := false
+	for _, r := range search {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			letter = true
+		case r >= '0' && r <= '9', r == ' ':
+		default:
+			return "", nil
+		}
+	}
+	if !letter {
+		return "", nil
+	}
+	return `("values" LIKE ? OR "values" GLOB ?)`, []interface{}{"%" + search + "%", "*[^\x01-\x7f]*"}
+}
+
+// sqliteValueMatch returns a condition applying a value match with the JSON1 functions, or "" for
+// fields that cannot be addressed by a JSON path
+func sqliteValueMatch(match valueMatch) (string, []interface{}) {
+	if strings.ContainsAny(match.field, `"\`) {
+		return "", nil
+	}
+	path := `$."` + match.field + `"`
+	values, err := json.Marshal(match.values)
+	if err != nil || match.values == nil {
+		values = []byte("[]")
+	}
+
+	if match.elements {
+		return `(CASE json_type("values", ?)
+			WHEN 'text' THEN json_extract("values", ?) IN (SELECT value FROM json_each(?))
+			WHEN 'array' THEN EXISTS (SELECT 1 FROM json_each("values", ?) AS element WHERE element.type = 'text' AND element.value IN (SELECT value FROM json_each(?)))
+			ELSE 0 END)`, []interface{}{path, path, string(values), path, string(values)}
+	}
+	return `(json_type("values", ?) IS NOT 'text' OR json_extract("values", ?) IN (SELECT value FROM json_each(?)))`,
+		[]interface{}{path, path, string(values)}
+}
+
+func (d *sqliteData) insertRecord(record *embeddedRecord) error {
+	_, err := d.q.Exec(`
+		INSERT INTO contents (tenant, id, table_slug, "values", created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		record.tenant, record.scan.ID, record.scan.TableSlug, string(record.scan.Values),
+		sqliteTime(&record.scan.CreatedAt), sqliteTime(&record.scan.UpdatedAt),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create content: %v", err)
+	}
+	return nil
+}
+
+func (d *sqliteData) updateRecord(record *embeddedRecord, replaced *models.Revision) error {
+	if replaced != nil {
+		values, err := json.Marshal(replaced.Values)
+		if err != nil {
+			return fmt.Errorf("failed to marshal values: %v", err)
+		}
+		if _, err := d.q.Exec(`
+			INSERT INTO content_revisions (content_id, tenant, revision, "values", created_at, replaced_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			record.scan.ID, record.tenant, replaced.Revision, string(values),
+			sqliteTime(&replaced.CreatedAt), sqliteTime(&record.scan.UpdatedAt),
+		); err != nil {
+			return fmt.Errorf("failed to save revision: %v", err)
+		}
+	}
+
+	if _, err := d.q.Exec(`UPDATE contents SET "values" = ?, updated_at = ?, deleted_at = ? WHERE tenant = ? AND id = ?`,
+		string(record.scan.Values), sqliteTime(&record.scan.UpdatedAt), sqliteTime(record.scan.DeletedAt),
+		record.tenant, record.scan.ID); err != nil {
+		return fmt.Errorf("failed to update content: %v", err)
+	}
+	return nil
+}
+
+func (d *sqliteData) revisions(record *embeddedRecord) ([]*models.Revision, error) {
+	rows, err := d.q.Query(`SELECT revision, "values", created_at FROM content_revisions WHERE content_id = ? ORDER BY revision`, record.scan.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get revisions: %v", err)
+	}
+	defer rows.Close()
+
+	var revisions []*models.Revision
+	for rows.Next() {
+		var revision models.Revision
+		var values string
+		if err := rows.Scan(&revision.Revision, &values, &revision.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan revision: %v", err)
+		}
+		if revision.Values, err = decodeValues(json.RawMessage(values)); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &revision)
+	}
+	return revisions, rows.Err()
+}
+
+func (d *sqliteData) policy(tenant string, tableSlug string) (*models.RowPolicy, error) {
+	var rowPolicy models.RowPolicy
+	err := d.q.QueryRow(`SELECT table_slug, expression, created_at, updated_at FROM row_policies WHERE tenant = ? AND table_slug = ?`,
+		tenant, tableSlug).Scan(&rowPolicy.TableSlug, &rowPolicy.Expression, &rowPolicy.CreatedAt, &rowPolicy.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get row policy: %v", err)
+	}
+	return &rowPolicy, nil
+}
+
+func (d *sqliteData) setPolicy(tenant string, rowPolicy *models.RowPolicy) error {
+	_, err := d.q.Exec(`
+		INSERT INTO row_policies (tenant, table_slug, expression, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (tenant, table_slug) DO UPDATE SET expression = excluded.expression, updated_at = excluded.updated_at`,
+		tenant, rowPolicy.TableSlug, rowPolicy.Expression, sqliteTime(&rowPolicy.CreatedAt), sqliteTime(&rowPolicy.UpdatedAt),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set row policy: %v", err)
+	}
+	return nil
+}
+
+func (d *sqliteData) deletePolicy(tenant string, tableSlug string) (bool, error) {
+	result, err := d.q.Exec(`DELETE FROM row_policies WHERE tenant = ? AND table_slug = ?`, tenant, tableSlug)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete row policy: %v", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete row policy: %v", err)
+	}
+	return deleted > 0, nil
+}
@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SQLiteFileRepository records uploads in SQLite like FileRepository does in PostgreSQL. The blob keys
+// of a file's variants are a JSON array.
+type SQLiteFileRepository struct {
+	db DB
+}
+
+func NewSQLiteFileRepository(db DB) *SQLiteFileRepository {
+	return &SQLiteFileRepository{db: db}
+}
+
+var _ FileStore = (*SQLiteFileRepository)(nil)
+
+// CreateFile records an upload to a record's file field
+func (r *SQLiteFileRepository) CreateFile(file *models.File) (*models.File, error) {
+	query := `
+		INSERT INTO files (tenant, table_slug, content_id, field_name, name, size, mime_type, checksum)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING ` + fileColumns
+
+	created, err := scanSQLiteFile(r.db.QueryRow(query, file.Tenant, file.TableSlug, file.ContentID, file.FieldName,
+		file.Name, file.Size, file.MimeType, file.Checksum))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+	return created, nil
+}
+
+// GetFile retrieves a tenant's file, or nil if it does not exist
+func (r *SQLiteFileRepository) GetFile(tenant string, id string) (*models.File, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE tenant = ? AND id = ?`
+	file, err := scanSQLiteFile(r.db.QueryRow(query, tenant, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get file: %v", err)
+	}
+	return file, nil
+}
+
+// AddVariant records the blob key of an image variant generated from a file, so that it is deleted with the file
+func (r *SQLiteFileRepository) AddVariant(id string, key string) error {
+	query := `
+		UPDATE files SET variants = json_insert(variants, '$[#]', ?1)
+		WHERE id = ?2 AND NOT EXISTS (SELECT 1 FROM json_each(variants) WHERE value = ?1)`
+	if _, err := r.db.Exec(query, key, id); err != nil {
+		return fmt.Errorf("failed to record file variant: %v", err)
+	}
+	return nil
+}
+
+// DeleteFile removes the record of a file whose blob is gone
+func (r *SQLiteFileRepository) DeleteFile(id string) error {
+	if _, err := r.db.Exec(`DELETE FROM files WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file: %v", err)
+	}
+	return nil
+}
+
+// GetUnreferencedFiles returns up to limit files older than grace that nothing refers to anymore: their
+// record was purged, their field removed from the schema, or neither the record nor any of its
+// revisions holds them. Files in the trash stay referenced until they are purged.
+func (r *SQLiteFileRepository) GetUnreferencedFiles(grace time.Duration, limit int) ([]*models.File, error) {
+	query := `
+		SELECT ` + fileColumns + `
+		FROM files f
+		WHERE f.created_at < ?
+		AND NOT EXISTS (
+			SELECT 1
+			FROM contents c
+			JOIN schemas s ON s.tenant = c.tenant AND s.table_slug = c.table_slug
+			WHERE c.id = f.content_id
+			AND EXISTS (
+				SELECT 1 FROM json_each(s.fields) field
+				WHERE field.value ->> 'name' = f.field_name AND field.value ->> 'dataType' = 'file'
+			)
+			AND (
+				c."values" -> f.field_name ->> 'id' = f.id
+				OR EXISTS (
+					SELECT 1 FROM content_revisions rev
+					WHERE rev.content_id = c.id AND rev."values" -> f.field_name ->> 'id' = f.id
+				)
+			)
+		)
+		ORDER BY f.created_at
+		LIMIT ?`
+
+	cutoff := time.Now().UTC().Add(-grace)
+	rows, err := r.db.Query(query, sqliteTime(&cutoff), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unreferenced files: %v", err)
+	}
+	defer rows.Close()
+
+	files := []*models.File{}
+	for rows.Next() {
+		file, err := scanSQLiteFile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan file: %v", err)
+		}
+		files = append(files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get unreferenced files: %v", err)
+	}
+	return files, nil
+}
+
+// scanSQLiteFile scans the fileColumns of a file row whose variants are a JSON array
+func scanSQLiteFile(row interface{ Scan(...interface{}) error }) (*models.File, error) {
+	var file models.File
+	var variants string
+	err := row.Scan(&file.ID, &file.Tenant, &file.TableSlug, &file.ContentID, &file.FieldName,
+		&file.Name, &file.Size, &file.MimeType, &file.Checksum, &variants, &file.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(variants), &file.Variants); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal file variants: %v", err)
+	}
+	return &file, nil
+}
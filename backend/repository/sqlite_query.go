@@ -0,0 +1,303 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// SQLite evaluates content queries with the JSON1 functions. The functions registered here convert
+// values to text and match patterns the way the embedded query engine does, so that a query
+// evaluated in SQLite returns the same records as one evaluated in-process.
+func init() {
+	// dt_text(json) returns a JSON value as text, like jsonText
+	sqlite.MustRegisterDeterministicScalarFunction("dt_text", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		raw, ok := sqliteText(args[0])
+		if !ok {
+			return nil, nil
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(raw), &value); err != nil {
+			return nil, err
+		}
+		return jsonText(value), nil
+	})
+	// dt_number(text) returns text holding a number as the number, or NULL
+	sqlite.MustRegisterDeterministicScalarFunction("dt_number", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		text, ok := sqliteText(args[0])
+		if !ok || !numericRegexp.MatchString(text) {
+			return nil, nil
+		}
+		n, _ := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		return n, nil
+	})
+	// dt_like(text, pattern) matches text against a LIKE pattern case-sensitively, like like
+	sqlite.MustRegisterDeterministicScalarFunction("dt_like", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		text, ok := sqliteText(args[0])
+		if !ok {
+			return nil, nil
+		}
+		pattern, _ := sqliteText(args[1])
+		return sqliteBool(like(text, pattern, false)), nil
+	})
+	// dt_search(values, hidden, search) reports whether the stored values contain the search text,
+	// leaving out the hidden fields given as a JSON array
+	sqlite.MustRegisterDeterministicScalarFunction("dt_search", 3, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		raw, _ := sqliteText(args[0])
+		stored, err := decodeValues(json.RawMessage(raw))
+		if err != nil {
+			return nil, err
+		}
+		hiddenJSON, _ := sqliteText(args[1])
+		var names []string
+		if err := json.Unmarshal([]byte(hiddenJSON), &names); err != nil {
+			return nil, err
+		}
+		hidden := make(map[string]bool, len(names))
+		for _, name := range names {
+			hidden[name] = true
+		}
+		search, _ := sqliteText(args[2])
+		return sqliteBool(like(searchText(stored, hidden), "%"+search+"%", true)), nil
+	})
+}
+
+// sqliteText returns a function argument holding text, or false for NULL
+func sqliteText(value driver.Value) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	case nil:
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// sqliteBool returns a truth value as SQLite represents it
+func sqliteBool(value bool) int64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// sqliteQuery compiles the parts of a content query to SQLite expressions over the contents table,
+// like queryBuilder does for PostgreSQL. Parts the embedded query engine has to evaluate, such as
+// lookups, rollups and computed formulas, mark the query unsupported.
+type sqliteQuery struct {
+	q           *embeddedQuery
+	args        []interface{}
+	unsupported bool
+}
+
+// arg adds a query argument and returns its placeholder
+func (c *sqliteQuery) arg(value interface{}) string {
+	c.args = append(c.args, value)
+	return "?"
+}
+
+// path returns the placeholder of the JSON path of a stored field
+func (c *sqliteQuery) path(name string) string {
+	if strings.ContainsAny(name, `"\`) {
+		c.unsupported = true
+	}
+	return c.arg(`$."` + name + `"`)
+}
+
+// text returns the expression of a field's value as text, like embeddedQuery.text
+func (c *sqliteQuery) text(name string) string {
+	if c.q.hidden[name] {
+		return "NULL"
+	}
+	if _, ok := systemColumns[name]; ok {
+		// Timestamps print without trailing zeros, which their column does not
+		c.unsupported = true
+		return "NULL"
+	}
+	if _, ok := c.q.fields[name]; !ok && name == "id" {
+		return "id"
+	}
+	if !c.q.stored(name) {
+		c.unsupported = true
+		return "NULL"
+	}
+	// Strings are their own text; numbers, booleans, arrays and objects are printed like PostgreSQL does
+	return fmt.Sprintf(`(CASE json_type("values", %s) WHEN 'text' THEN "values" ->> %s ELSE dt_text("values" -> %s) END)`,
+		c.path(name), c.path(name), c.path(name))
+}
+
+// value returns the expression used to compare and sort a field, like embeddedQuery.value
+func (c *sqliteQuery) value(name string) string {
+	if column, ok := systemColumns[name]; ok && !c.q.hidden[name] {
+		return column
+	}
+	switch c.q.kind(name) {
+	case kindNumber:
+		return "dt_number(" + c.text(name) + ")"
+	case kindTime, kindBool:
+		c.unsupported = true
+		return "NULL"
+	case kindNull:
+		return "NULL"
+	}
+	return c.text(name)
+}
+
+// argument returns the placeholder of a filter value converted to the kind of its field
+func (c *sqliteQuery) argument(name string, value interface{}) string {
+	arg, err := c.q.argument(name, value)
+	if err != nil {
+		c.unsupported = true
+		return "NULL"
+	}
+	if t, ok := arg.(time.Time); ok {
+		// Timestamps are stored with microseconds
+		if t.Nanosecond()%1000 != 0 {
+			c.unsupported = true
+		}
+		return c.arg(sqliteTime(&t))
+	}
+	return c.arg(arg)
+}
+
+// sqliteOperators are the SQL operators of the comparison filters
+var sqliteOperators = map[string]string{"eq": "=", "ne": "<>", "gt": ">", "ge": ">=", "lt": "<", "le": "<="}
+
+// where compiles a filter expression, like embeddedQuery.where
+func (c *sqliteQuery) where(expr *models.FilterExpr) string {
+	switch expr.Op {
+	case "and", "or":
+		if len(expr.Args) == 0 {
+			return "1"
+		}
+		conditions := make([]string, 0, len(expr.Args))
+		for _, arg := range expr.Args {
+			conditions = append(conditions, c.where(arg))
+		}
+		return "(" + strings.Join(conditions, " "+strings.ToUpper(expr.Op)+" ") + ")"
+	case "not":
+		// Unknown operands are negated to true, like embeddedQuery.where does
+		return "(NOT COALESCE(" + c.where(expr.Args[0]) + ", 0))"
+	case "eq", "ne":
+		if expr.Value == nil {
+			if expr.Op == "eq" {
+				return "(" + c.text(expr.Field) + " IS NULL)"
+			}
+			return "(" + c.text(expr.Field) + " IS NOT NULL)"
+		}
+		fallthrough
+	case "gt", "ge", "lt", "le":
+		value := c.value(expr.Field)
+		return "(" + value + " " + sqliteOperators[expr.Op] + " " + c.argument(expr.Field, expr.Value) + ")"
+	case "contains", "startswith", "endswith":
+		pattern := escapeLike(fmt.Sprint(expr.Value))
+		switch expr.Op {
+		case "contains":
+			pattern = "%" + pattern + "%"
+		case "startswith":
+			pattern = pattern + "%"
+		case "endswith":
+			pattern = "%" + pattern
+		}
+		text := c.text(expr.Field)
+		return "dt_like(" + text + ", " + c.arg(pattern) + ")"
+	case "in":
+		if len(expr.Values) == 0 {
+			return "0"
+		}
+		value := c.value(expr.Field)
+		list := make([]string, 0, len(expr.Values))
+		for _, v := range expr.Values {
+			list = append(list, c.argument(expr.Field, v))
+		}
+		return "(" + value + " IN (" + strings.Join(list, ", ") + "))"
+	}
+	c.unsupported = true
+	return "0"
+}
+
+var _ recordSelector = (*sqliteData)(nil)
+
+func (d *sqliteData) selectRecords(tenant string, tableSlug string, query *recordQuery) ([]*embeddedRecord, int, bool, error) {
+	c := &sqliteQuery{q: query.query}
+	conditions := []string{"tenant = " + c.arg(tenant), "table_slug = " + c.arg(tableSlug), trashedCondition(query.trashed)}
+
+	// The row policy sees the fields of the schema without hiding any
+	if query.policy != nil {
+		c.q = query.policyQuery
+		conditions = append(conditions, c.where(query.policy))
+		c.q = query.query
+	}
+
+	// Hidden fields must not match searches
+	if query.search != "" {
+		if condition, args := sqliteSearch(query.search); condition != "" {
+			conditions = append(conditions, condition)
+			c.args = append(c.args, args...)
+		}
+		hidden := []string{}
+		for name, isHidden := range query.query.hidden {
+			if isHidden {
+				hidden = append(hidden, name)
+			}
+		}
+		sort.Strings(hidden)
+		hiddenJSON, err := json.Marshal(hidden)
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("failed to marshal hidden fields: %v", err)
+		}
+		conditions = append(conditions, `dt_search("values", `+c.arg(string(hiddenJSON))+`, `+c.arg(query.search)+`)`)
+	}
+
+	for fieldName, filterValue := range query.filters {
+		if filterValue != "" {
+			conditions = append(conditions, c.text(fieldName)+" = "+c.arg(filterValue))
+		}
+	}
+	if query.filter != nil {
+		conditions = append(conditions, c.where(query.filter))
+	}
+	where := strings.Join(conditions, " AND ")
+	whereArgs := append([]interface{}(nil), c.args...)
+
+	// Rows are newest first; trashed rows are ordered by their deletion
+	var order []string
+	for _, option := range query.sorts {
+		if option.Desc {
+			order = append(order, c.value(option.Field)+" DESC NULLS FIRST")
+		} else {
+			order = append(order, c.value(option.Field)+" ASC NULLS LAST")
+		}
+	}
+	if len(query.sorts) == 0 && query.trashed {
+		order = append(order, "deleted_at DESC")
+	}
+	order = append(order, "created_at DESC")
+
+	if c.unsupported {
+		return nil, 0, false, nil
+	}
+
+	records, err := d.queryRecords(`SELECT `+sqliteContentColumns+` FROM contents WHERE `+where+
+		` ORDER BY `+strings.Join(order, ", ")+` LIMIT `+c.arg(query.limit)+` OFFSET `+c.arg(query.offset), c.args...)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to get contents: %v", err)
+	}
+
+	total := len(records)
+	if query.limit >= 0 || query.offset > 0 {
+		if err := d.q.QueryRow(`SELECT COUNT(*) FROM contents WHERE `+where, whereArgs...).Scan(&total); err != nil {
+			return nil, 0, false, fmt.Errorf("failed to count contents: %v", err)
+		}
+	}
+	return records, total, true, nil
+}
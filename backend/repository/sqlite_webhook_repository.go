@@ -0,0 +1,400 @@
+package repository
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"dynamic-table-backend/models"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SQLiteWebhookRepository stores webhooks and their outbox in SQLite like WebhookRepository does in
+// PostgreSQL. Events are a JSON array, and due times are computed here as SQLite has no intervals.
+type SQLiteWebhookRepository struct {
+	db DB
+}
+
+func NewSQLiteWebhookRepository(db DB) *SQLiteWebhookRepository {
+	return &SQLiteWebhookRepository{db: db}
+}
+
+var _ WebhookStore = (*SQLiteWebhookRepository)(nil)
+
+// CreateWebhook subscribes a URL to events of a tenant's table and returns it with its signing secret
+func (r *SQLiteWebhookRepository) CreateWebhook(tenant string, req *models.CreateWebhookRequest) (*models.Webhook, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate webhook secret: %v", err)
+	}
+	events, err := json.Marshal(req.Events)
+	if err != nil || req.Events == nil {
+		events = []byte("[]")
+	}
+
+	query := `
+		INSERT INTO webhooks (tenant, table_slug, url, events, filter, secret)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id, table_slug, url, events, filter, created_at, secret`
+
+	webhook, err := scanSQLiteWebhook(r.db.QueryRow(query, tenant, req.TableSlug, req.URL, string(events), req.Filter, hex.EncodeToString(secret)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %v", err)
+	}
+	return webhook, nil
+}
+
+// GetWebhooks retrieves the webhooks of a tenant, without their secrets
+func (r *SQLiteWebhookRepository) GetWebhooks(tenant string) ([]*models.Webhook, error) {
+	query := `
+		SELECT id, table_slug, url, events, filter, created_at, ''
+		FROM webhooks
+		WHERE tenant = ?
+		ORDER BY created_at DESC`
+
+	rows, err := r.db.Query(query, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	webhooks := []*models.Webhook{}
+	for rows.Next() {
+		webhook, err := scanSQLiteWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %v", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// GetWebhook retrieves a webhook of a tenant without its secret, or nil if it does not exist
+func (r *SQLiteWebhookRepository) GetWebhook(tenant string, id string) (*models.Webhook, error) {
+	query := `
+		SELECT id, table_slug, url, events, filter, created_at, ''
+		FROM webhooks
+		WHERE tenant = ? AND id = ?`
+
+	webhook, err := scanSQLiteWebhook(r.db.QueryRow(query, tenant, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get webhook: %v", err)
+	}
+	return webhook, nil
+}
+
+// DeleteWebhook removes a webhook of a tenant together with its deliveries
+func (r *SQLiteWebhookRepository) DeleteWebhook(tenant string, id string) error {
+	result, err := r.db.Exec(`DELETE FROM webhooks WHERE tenant = ? AND id = ?`, tenant, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("webhook not found")
+	}
+	return nil
+}
+
+// Ping queues a test delivery for a webhook of a tenant, or returns nil if the webhook does not exist
+func (r *SQLiteWebhookRepository) Ping(tenant string, id string) (*models.WebhookDelivery, error) {
+	webhook, err := r.GetWebhook(tenant, id)
+	if err != nil || webhook == nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	payload, err := json.Marshal(models.WebhookEvent{
+		Event:      models.WebhookPing,
+		Tenant:     tenant,
+		TableSlug:  webhook.TableSlug,
+		OccurredAt: now,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook event: %v", err)
+	}
+
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		RETURNING ` + deliveryColumns
+
+	delivery, err := scanSQLiteDelivery(r.db.QueryRow(query, id, models.WebhookPing, string(payload), sqliteTime(&now), sqliteTime(&now)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue webhook delivery: %v", err)
+	}
+	return delivery, nil
+}
+
+// GetDeliveries retrieves a page of a webhook's deliveries with their attempts, newest first.
+// An empty webhook ID lists the deliveries of every webhook of the tenant and an empty status every status.
+func (r *SQLiteWebhookRepository) GetDeliveries(tenant string, webhookID string, status string, page int, pageSize int) (*models.WebhookDeliveryResponse, error) {
+	where := `webhook_id IN (SELECT id FROM webhooks WHERE tenant = ?)`
+	args := []interface{}{tenant}
+	if webhookID != "" {
+		where += " AND webhook_id = ?"
+		args = append(args, webhookID)
+	}
+	if status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("failed to count webhook deliveries: %v", err)
+	}
+
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = 20
+	}
+	if pageSize > 100 {
+		pageSize = 100
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM webhook_deliveries
+		WHERE %s
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?`, deliveryColumns, where)
+
+	rows, err := r.db.Query(query, append(args, pageSize, (page-1)*pageSize)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	deliveries := []*models.WebhookDelivery{}
+	byID := make(map[int64]*models.WebhookDelivery)
+	ids := []interface{}{}
+	for rows.Next() {
+		delivery, err := scanSQLiteDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+		byID[delivery.ID] = delivery
+		ids = append(ids, delivery.ID)
+	}
+	rows.Close()
+
+	// Attach the attempt log
+	attemptQuery := `
+		SELECT delivery_id, attempt, status_code, error, duration_ms, created_at
+		FROM webhook_attempts
+		WHERE delivery_id IN (` + placeholders(1, len(ids)) + `)
+		ORDER BY delivery_id, attempt`
+	attemptRows, err := r.db.Query(attemptQuery, ids...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook attempts: %v", err)
+	}
+	defer attemptRows.Close()
+
+	for attemptRows.Next() {
+		var deliveryID int64
+		var attempt models.WebhookAttempt
+		err := attemptRows.Scan(&deliveryID, &attempt.Attempt, &attempt.StatusCode, &attempt.Error, &attempt.DurationMs, &attempt.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook attempt: %v", err)
+		}
+		byID[deliveryID].AttemptLog = append(byID[deliveryID].AttemptLog, &attempt)
+	}
+
+	return &models.WebhookDeliveryResponse{
+		Deliveries: deliveries,
+		Total:      total,
+		Page:       page,
+		PageSize:   pageSize,
+		TotalPages: (total + pageSize - 1) / pageSize,
+	}, nil
+}
+
+// RetryDelivery moves a dead delivery of a tenant's webhook back to the outbox, with a fresh set of attempts
+func (r *SQLiteWebhookRepository) RetryDelivery(tenant string, webhookID string, deliveryID int64) (*models.WebhookDelivery, error) {
+	now := time.Now().UTC()
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = ?
+		WHERE id = ? AND webhook_id = ? AND status = 'dead'
+		AND webhook_id IN (SELECT id FROM webhooks WHERE tenant = ?)
+		RETURNING ` + deliveryColumns
+
+	delivery, err := scanSQLiteDelivery(r.db.QueryRow(query, sqliteTime(&now), deliveryID, webhookID, tenant))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retry webhook delivery: %v", err)
+	}
+	return delivery, nil
+}
+
+// ClaimDeliveries picks up to limit due deliveries of every tenant for dispatching. The claimed deliveries are
+// not due again until lease has passed. The claim holds the write lock, so concurrent dispatchers claim different deliveries.
+func (r *SQLiteWebhookRepository) ClaimDeliveries(limit int, lease time.Duration) ([]*models.WebhookDelivery, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	due := now.Add(lease)
+	rows, err := tx.Query(`
+		UPDATE webhook_deliveries
+		SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= ?
+			ORDER BY id
+			LIMIT ?
+		)
+		RETURNING id`, sqliteTime(&due), sqliteTime(&now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %v", err)
+	}
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// RETURNING cannot read the webhooks, so the claimed deliveries are read with them afterwards
+	rows, err = tx.Query(`
+		SELECT d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at, d.last_error, d.created_at, d.delivered_at, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.id IN (`+placeholders(1, len(ids))+`)
+		ORDER BY d.id`, ids...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*models.WebhookDelivery
+	for rows.Next() {
+		var delivery models.WebhookDelivery
+		var payload string
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastError,
+			&delivery.CreatedAt,
+			&delivery.DeliveredAt,
+			&delivery.URL,
+			&delivery.Secret,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+		}
+		delivery.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, &delivery)
+	}
+	rows.Close()
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit webhook claim: %v", err)
+	}
+	return deliveries, nil
+}
+
+// RecordAttempt logs an attempt of a delivery and moves it to its new status. Pending deliveries are
+// retried after retryIn.
+func (r *SQLiteWebhookRepository) RecordAttempt(deliveryID int64, attempt *models.WebhookAttempt, status string, retryIn time.Duration) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, duration_ms, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, deliveryID, attempt.Attempt, attempt.StatusCode, attempt.Error, attempt.DurationMs, sqliteTime(&now)); err != nil {
+		return fmt.Errorf("failed to record webhook attempt: %v", err)
+	}
+
+	var nextAttemptAt, deliveredAt *time.Time
+	switch status {
+	case "pending":
+		next := now.Add(retryIn)
+		nextAttemptAt = &next
+	case "delivered":
+		deliveredAt = &now
+	}
+	query = `
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, delivered_at = ?
+		WHERE id = ?`
+	if _, err := tx.Exec(query, status, attempt.Attempt, attempt.Error, sqliteTime(nextAttemptAt), sqliteTime(deliveredAt), deliveryID); err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit webhook attempt: %v", err)
+	}
+	return nil
+}
+
+// scanSQLiteWebhook scans a webhook row whose events are a JSON array
+func scanSQLiteWebhook(row interface{ Scan(...interface{}) error }) (*models.Webhook, error) {
+	var webhook models.Webhook
+	var events string
+	err := row.Scan(&webhook.ID, &webhook.TableSlug, &webhook.URL, &events, &webhook.Filter, &webhook.CreatedAt, &webhook.Secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(events), &webhook.Events); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal webhook events: %v", err)
+	}
+	return &webhook, nil
+}
+
+// scanSQLiteDelivery scans the deliveryColumns of a webhook delivery row
+func scanSQLiteDelivery(row interface{ Scan(...interface{}) error }) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	var payload string
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.LastError,
+		&delivery.CreatedAt,
+		&delivery.DeliveredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Payload = json.RawMessage(payload)
+	return &delivery, nil
+}
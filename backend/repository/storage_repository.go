@@ -0,0 +1,209 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/models"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type StorageRepository struct {
+	db DB
+}
+
+func NewStorageRepository(db DB) *StorageRepository {
+	return &StorageRepository{db: db}
+}
+
+// SetStorage switches a tenant's table between JSONB and materialized storage, returning nil if the table
+// does not exist. Switching to materialized creates the typed table and leaves the table materializing
+// until MaterializePending has copied its records; until then queries keep reading the JSONB values.
+// Writes to JSONB tables do not lock their schema, so the switch locks contents for share, which waits
+// for the writes running now to commit; writes starting later see the table materializing and copy
+// their records themselves.
+func (r *StorageRepository) SetStorage(tenant string, tableSlug string, storage string) (*models.Schema, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the schema, which waits for writes syncing records to the typed table to finish
+	var schemaID, current string
+	var fieldsJSON json.RawMessage
+	err = tx.QueryRow(`SELECT id, fields, storage FROM schemas WHERE tenant = $1 AND table_slug = $2 AND deleted_at IS NULL FOR UPDATE`, tenant, tableSlug).Scan(&schemaID, &fieldsJSON, &current)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get schema: %v", err)
+	}
+
+	next := current
+	switch {
+	case storage == models.StorageMaterialized && current == models.StorageJSONB:
+		var fields []models.Field
+		if err := json.Unmarshal(fieldsJSON, &fields); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal fields: %v", err)
+		}
+		if err := createMaterializedTable(tx, schemaID, tenant, tableSlug, fields); err != nil {
+			return nil, err
+		}
+		// Writes queue behind the lock until the switch commits, so waiting is bounded
+		if _, err := tx.Exec(`SET LOCAL lock_timeout = '5s'`); err != nil {
+			return nil, fmt.Errorf("failed to set lock timeout: %v", err)
+		}
+		if _, err := tx.Exec(`LOCK TABLE contents IN SHARE MODE`); err != nil {
+			return nil, fmt.Errorf("failed to wait for running writes: %v", err)
+		}
+		next = models.StorageMaterializing
+	case storage == models.StorageJSONB && current != models.StorageJSONB:
+		if _, err := tx.Exec(`DROP TABLE IF EXISTS ` + materializedTableName(schemaID)); err != nil {
+			return nil, fmt.Errorf("failed to drop materialized table: %v", err)
+		}
+		next = models.StorageJSONB
+	}
+
+	if next != current {
+		if _, err := tx.Exec(`UPDATE schemas SET storage = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, next, schemaID); err != nil {
+			return nil, fmt.Errorf("failed to set storage: %v", err)
+		}
+	}
+
+	schema, err := getSchema(tx, tenant, tableSlug)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit storage: %v", err)
+	}
+	return schema, nil
+}
+
+// MaterializePending copies the records of every materializing table into its typed table in batches and
+// switches the table to materialized once all are copied, returning how many tables it switched. Records
+// written meanwhile are copied by their writes, so batches never replace rows already there. A table whose
+// records do not fit its columns stays materializing, and the error is returned with the others'.
+func (r *StorageRepository) MaterializePending(batchSize int) (int, error) {
+	rows, err := r.db.Query(`SELECT id, tenant, table_slug FROM schemas WHERE storage = $1 AND deleted_at IS NULL`, models.StorageMaterializing)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get materializing schemas: %v", err)
+	}
+	type pending struct{ id, tenant, tableSlug string }
+	var schemas []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.tenant, &p.tableSlug); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan materializing schema: %v", err)
+		}
+		schemas = append(schemas, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to get materializing schemas: %v", err)
+	}
+
+	count := 0
+	var errs []string
+	for _, p := range schemas {
+		done, err := r.materialize(p.id, p.tenant, p.tableSlug, batchSize)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s/%s: %v", p.tenant, p.tableSlug, err))
+			continue
+		}
+		if done {
+			count++
+		}
+	}
+	if len(errs) > 0 {
+		return count, fmt.Errorf("failed to materialize tables: %s", strings.Join(errs, "; "))
+	}
+	return count, nil
+}
+
+// materialize copies the records of a materializing table batch by batch in ID order and reports whether
+// it switched the table to materialized. It stops if the table's storage changes meanwhile.
+func (r *StorageRepository) materialize(schemaID string, tenant string, tableSlug string, batchSize int) (bool, error) {
+	cursor := ""
+	for {
+		tx, err := r.db.Begin()
+		if err != nil {
+			return false, fmt.Errorf("failed to begin transaction: %v", err)
+		}
+
+		var storage string
+		var fieldsJSON json.RawMessage
+		err = tx.QueryRow(`SELECT fields, storage FROM schemas WHERE id = $1 AND deleted_at IS NULL FOR SHARE`, schemaID).Scan(&fieldsJSON, &storage)
+		if err == sql.ErrNoRows || (err == nil && storage != models.StorageMaterializing) {
+			tx.Rollback()
+			return false, nil
+		}
+		if err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("failed to get schema: %v", err)
+		}
+
+		ids, err := r.nextBatch(tx, tenant, tableSlug, cursor, batchSize)
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+
+		if len(ids) == 0 {
+			_, err = tx.Exec(`UPDATE schemas SET storage = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2 AND storage = $3`, models.StorageMaterialized, schemaID, models.StorageMaterializing)
+			if err != nil {
+				tx.Rollback()
+				return false, fmt.Errorf("failed to set storage: %v", err)
+			}
+		} else {
+			var fields []models.Field
+			if err := json.Unmarshal(fieldsJSON, &fields); err != nil {
+				tx.Rollback()
+				return false, fmt.Errorf("failed to unmarshal fields: %v", err)
+			}
+			if err := copyToMaterialized(tx, schemaID, fields, tenant, ids, false); err != nil {
+				tx.Rollback()
+				return false, err
+			}
+			cursor = ids[len(ids)-1]
+		}
+
+		if err := tx.Commit(); err != nil {
+			return false, fmt.Errorf("failed to commit materialization: %v", err)
+		}
+		if len(ids) == 0 {
+			return true, nil
+		}
+	}
+}
+
+// nextBatch returns the IDs of a table's records after the cursor, live or in the trash, in ID order
+func (r *StorageRepository) nextBatch(tx *sql.Tx, tenant string, tableSlug string, cursor string, batchSize int) ([]string, error) {
+	query := `SELECT id FROM contents WHERE tenant = $1 AND table_slug = $2 ORDER BY id LIMIT $3`
+	args := []interface{}{tenant, tableSlug, batchSize}
+	if cursor != "" {
+		query = `SELECT id FROM contents WHERE tenant = $1 AND table_slug = $2 AND id > $4 ORDER BY id LIMIT $3`
+		args = append(args, cursor)
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get records: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan record: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get records: %v", err)
+	}
+	return ids, nil
+}
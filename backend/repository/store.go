@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"database/sql"
+	"dynamic-table-backend/models"
+	"time"
+)
+
+// DB is the database connection the repositories run their queries and transactions on; *sql.DB implements it
+type DB interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Begin() (*sql.Tx, error)
+}
+
+// SchemaStore stores the table schemas of every tenant
+type SchemaStore interface {
+	CreateSchema(tenant string, schema *models.CreateSchemaRequest, actor *models.Principal) (*models.Schema, error)
+	GetSchemaBySlug(tenant string, tableSlug string) (*models.Schema, error)
+	GetAllSchemas(tenant string) ([]*models.Schema, error)
+	UpdateSchema(tenant string, tableSlug string, updateReq *models.UpdateSchemaRequest, actor *models.Principal) (*models.Schema, error)
+	DeleteSchema(tenant string, tableSlug string, actor *models.Principal) error
+	GetTrashedSchemas(tenant string) ([]*models.Schema, error)
+	RestoreSchema(tenant string, tableSlug string, actor *models.Principal) (*models.Schema, error)
+	ResolveLinks(tenant string, tableSlug string, fields []models.Field) error
+}
+
+// ContentStore stores the records of every tenant's tables along with their revisions
+type ContentStore interface {
+	CreateContent(tenant string, tableSlug string, content *models.CreateContentRequest, principal *models.Principal) (*models.Content, error)
+	GetContentByID(tenant string, id string, principal *models.Principal) (*models.Content, error)
+	GetContentsByTableSlug(tenant string, tableSlug string, params *models.ContentQueryParams) (*models.ContentResponse, error)
+	GetContentsByFieldValues(tenant string, tableSlug string, fieldName string, fieldValues []string, principal *models.Principal) ([]*models.Content, error)
+	GetRelatedDataForField(tenant string, config *models.RelationConfig, principal *models.Principal) ([]map[string]interface{}, error)
+	AggregateContents(tenant string, tableSlug string, params *models.ContentQueryParams, aggregate *models.AggregateRequest) (*models.AggregateResponse, error)
+	UpdateContent(tenant string, id string, updateReq *models.UpdateContentRequest, principal *models.Principal) (*models.Content, error)
+	DeleteContent(tenant string, id string, principal *models.Principal) error
+	RestoreContent(tenant string, tableSlug string, id string, principal *models.Principal) (*models.Content, error)
+	GetRevisions(tenant string, id string, principal *models.Principal) ([]*models.Revision, error)
+	GetRevision(tenant string, id string, number int, principal *models.Principal) (*models.Revision, error)
+	DiffRevisions(tenant string, id string, from int, to int, principal *models.Principal) (*models.RevisionDiff, error)
+}
+
+// PolicyStore stores the row policies of every tenant's tables
+type PolicyStore interface {
+	GetPolicy(tenant string, tableSlug string) (*models.RowPolicy, error)
+	SetPolicy(tenant string, tableSlug string, expression string) (*models.RowPolicy, error)
+	DeletePolicy(tenant string, tableSlug string) error
+}
+
+// RoleStore stores the roles, their grants and the principals bound to them
+type RoleStore interface {
+	CreateRole(req *models.CreateRoleRequest) (*models.Role, error)
+	GetRole(id string) (*models.Role, error)
+	GetRoleByName(name string) (*models.Role, error)
+	GetAllRoles() ([]*models.Role, error)
+	DeleteRole(id string) error
+	AddGrant(roleID string, req *models.CreateGrantRequest) (*models.Grant, error)
+	DeleteGrant(roleID string, grantID string) error
+	AddMember(roleID string, principalID string) error
+	RemoveMember(roleID string, principalID string) error
+	GetRoleNamesForPrincipal(principalID string, claimed []string) ([]string, error)
+	GetGrantsForPrincipal(principalID string, roleNames []string) ([]models.Grant, error)
+}
+
+// APIKeyStore stores API keys by the hash of their secret
+type APIKeyStore interface {
+	CreateAPIKey(name string, tenant string) (*models.APIKey, string, error)
+	GetAllAPIKeys() ([]*models.APIKey, error)
+	AuthenticateAPIKey(key string) (*models.APIKey, error)
+	RevokeAPIKey(id string) error
+}
+
+// AuditStore reads the audit log that schema and record changes are recorded in
+type AuditStore interface {
+	GetAuditEntries(tenant string, params *models.AuditQueryParams) (*models.AuditResponse, error)
+}
+
+// ChangeStore reads the change events that schema and record changes append
+type ChangeStore interface {
+	GetChanges(tenant string, since int64, limit int) (*models.ChangeFeedResponse, error)
+	GetEvents(since int64, limit int) ([]*models.ChangeEvent, error)
+	GetTableEvents(tenant string, tableSlug string, since int64, limit int) ([]*models.ChangeEvent, error)
+	LatestEventID() (int64, error)
+}
+
+// WebhookStore stores the webhooks of every tenant's tables and the outbox of their deliveries
+type WebhookStore interface {
+	CreateWebhook(tenant string, req *models.CreateWebhookRequest) (*models.Webhook, error)
+	GetWebhooks(tenant string) ([]*models.Webhook, error)
+	GetWebhook(tenant string, id string) (*models.Webhook, error)
+	DeleteWebhook(tenant string, id string) error
+	Ping(tenant string, id string) (*models.WebhookDelivery, error)
+	GetDeliveries(tenant string, webhookID string, status string, page int, pageSize int) (*models.WebhookDeliveryResponse, error)
+	RetryDelivery(tenant string, webhookID string, deliveryID int64) (*models.WebhookDelivery, error)
+	ClaimDeliveries(limit int, lease time.Duration) ([]*models.WebhookDelivery, error)
+	RecordAttempt(deliveryID int64, attempt *models.WebhookAttempt, status string, retryIn time.Duration) error
+}
+
+// FileStore records the files uploaded to the file fields of every tenant's records
+type FileStore interface {
+	CreateFile(file *models.File) (*models.File, error)
+	GetFile(tenant string, id string) (*models.File, error)
+	AddVariant(id string, key string) error
+	DeleteFile(id string) error
+	GetUnreferencedFiles(grace time.Duration, limit int) ([]*models.File, error)
+}
+
+// TrashStore purges the schemas and records that have been in the trash too long
+type TrashStore interface {
+	PurgeTrash(retention time.Duration) (int64, int64, error)
+}
+
+var (
+	_ SchemaStore  = (*SchemaRepository)(nil)
+	_ ContentStore = (*ContentRepository)(nil)
+	_ PolicyStore  = (*PolicyRepository)(nil)
+	_ RoleStore    = (*RoleRepository)(nil)
+	_ APIKeyStore  = (*APIKeyRepository)(nil)
+	_ AuditStore   = (*AuditRepository)(nil)
+	_ ChangeStore  = (*ChangeRepository)(nil)
+	_ WebhookStore = (*WebhookRepository)(nil)
+	_ FileStore    = (*FileRepository)(nil)
+	_ TrashStore   = (*TrashRepository)(nil)
+)
+
+// Stores bundles the storage the handlers work with. Every store but Storage is an interface that may
+// be replaced, e.g. by fakes in tests. Materialized storage needs PostgreSQL and is nil on other backends.
+type Stores struct {
+	Schemas  SchemaStore
+	Contents ContentStore
+	Policies PolicyStore
+	Files    FileStore
+	Audit    AuditStore
+	Changes  ChangeStore
+	Webhooks WebhookStore
+	Roles    RoleStore
+	APIKeys  APIKeyStore
+	Trash    TrashStore
+	Storage  *StorageRepository
+}
+
+// NewStores creates every repository on the database
+func NewStores(db DB) *Stores {
+	schemas := NewSchemaRepository(db)
+	policies := NewPolicyRepository(db)
+	return &Stores{
+		Schemas:  schemas,
+		Contents: NewContentRepository(db, schemas, policies),
+		Policies: policies,
+		Files:    NewFileRepository(db),
+		Audit:    NewAuditRepository(db),
+		Changes:  NewChangeRepository(db),
+		Webhooks: NewWebhookRepository(db),
+		Roles:    NewRoleRepository(db),
+		APIKeys:  NewAPIKeyRepository(db),
+		Trash:    NewTrashRepository(db),
+		Storage:  NewStorageRepository(db),
+	}
+}
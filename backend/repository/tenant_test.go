@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"testing"
+
+	"dynamic-table-backend/models"
+)
+
+var testAdmin = &models.Principal{
+	ID:     "admin",
+	Name:   "admin",
+	Roles:  []string{"admin"},
+	Grants: []models.Grant{{Permission: models.PermissionAdmin}},
+}
+
+// mustCreateSchema creates a table of a tenant with the given fields
+func mustCreateSchema(t *testing.T, stores *Stores, tenant string, tableSlug string, fields ...models.Field) *models.Schema {
+	t.Helper()
+	schema, err := stores.Schemas.CreateSchema(tenant, &models.CreateSchemaRequest{
+		TableName: tableSlug,
+		TableSlug: tableSlug,
+		Fields:    fields,
+	}, testAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+// mustCreateContent creates a record of a tenant's table
+func mustCreateContent(t *testing.T, stores *Stores, tenant string, tableSlug string, values map[string]interface{}) *models.Content {
+	t.Helper()
+	content, err := stores.Contents.CreateContent(tenant, tableSlug, &models.CreateContentRequest{Values: values}, testAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestStoresIsolateTenants(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, stores *Stores) {
+		customer := models.Field{Name: "customer", Label: "Customer", DataType: "text"}
+		mustCreateSchema(t, stores, "acme", "orders", customer)
+		mustCreateSchema(t, stores, "acme", "invoices", customer)
+		mustCreateSchema(t, stores, "globex", "orders", customer)
+		order := mustCreateContent(t, stores, "acme", "orders", map[string]interface{}{"customer": "Wile E. Coyote"})
+
+		// Schemas
+		if schema, err := stores.Schemas.GetSchemaBySlug("globex", "invoices"); err != nil || schema != nil {
+			t.Errorf("GetSchemaBySlug of another tenant's table = %v, %v", schema, err)
+		}
+		if schemas, err := stores.Schemas.GetAllSchemas("globex"); err != nil || len(schemas) != 1 {
+			t.Errorf("GetAllSchemas = %d schemas, %v, want only the tenant's own", len(schemas), err)
+		}
+		renamed := &models.UpdateSchemaRequest{TableName: "Stolen", Fields: []models.Field{customer}}
+		if schema, err := stores.Schemas.UpdateSchema("globex", "invoices", renamed, testAdmin); err == nil && schema != nil {
+			t.Errorf("UpdateSchema of another tenant's table succeeded")
+		}
+		if err := stores.Schemas.DeleteSchema("globex", "invoices", testAdmin); err == nil {
+			t.Errorf("DeleteSchema of another tenant's table succeeded")
+		}
+		if schema, err := stores.Schemas.GetSchemaBySlug("acme", "invoices"); err != nil || schema == nil || schema.TableName != "invoices" {
+			t.Errorf("another tenant changed the table to %+v, %v", schema, err)
+		}
+
+		// Records
+		if content, err := stores.Contents.GetContentByID("globex", order.ID, testAdmin); err != nil || content != nil {
+			t.Errorf("GetContentByID of another tenant's record = %v, %v", content, err)
+		}
+		update := &models.UpdateContentRequest{Values: map[string]interface{}{"customer": "Road Runner"}}
+		if content, err := stores.Contents.UpdateContent("globex", order.ID, update, testAdmin); err == nil && content != nil {
+			t.Errorf("UpdateContent of another tenant's record succeeded")
+		}
+		if err := stores.Contents.DeleteContent("globex", order.ID, testAdmin); err == nil {
+			t.Errorf("DeleteContent of another tenant's record succeeded")
+		}
+		if revisions, err := stores.Contents.GetRevisions("globex", order.ID, testAdmin); err != nil || revisions != nil {
+			t.Errorf("GetRevisions of another tenant's record = %v, %v", revisions, err)
+		}
+		list, err := stores.Contents.GetContentsByTableSlug("globex", "orders", &models.ContentQueryParams{Page: 1, PageSize: 10, Principal: testAdmin})
+		if err != nil || list.Total != 0 {
+			t.Errorf("GetContentsByTableSlug lists %+v, %v, want none of another tenant's records", list, err)
+		}
+		matches, err := stores.Contents.GetContentsByFieldValues("globex", "orders", "customer", []string{"Wile E. Coyote"}, testAdmin)
+		if err != nil || len(matches) != 0 {
+			t.Errorf("GetContentsByFieldValues = %d records, %v, want none of another tenant's", len(matches), err)
+		}
+		related, err := stores.Contents.GetRelatedDataForField("globex", &models.RelationConfig{RelatedTable: "orders", RelatedField: "id", DisplayField: "customer"}, testAdmin)
+		if err != nil || len(related) != 0 {
+			t.Errorf("GetRelatedDataForField = %v, %v, want none of another tenant's records", related, err)
+		}
+		if content, err := stores.Contents.GetContentByID("acme", order.ID, testAdmin); err != nil || content == nil || content.Values["customer"] != "Wile E. Coyote" {
+			t.Errorf("another tenant changed the record to %+v, %v", content, err)
+		}
+
+		// Records in the trash
+		if err := stores.Contents.DeleteContent("acme", order.ID, testAdmin); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := stores.Contents.RestoreContent("globex", "orders", order.ID, testAdmin); err != nil || content != nil {
+			t.Errorf("RestoreContent of another tenant's record = %v, %v", content, err)
+		}
+
+		// Row policies
+		if _, err := stores.Policies.SetPolicy("acme", "orders", "values.customer == 'nobody'"); err != nil {
+			t.Fatal(err)
+		}
+		if rowPolicy, err := stores.Policies.GetPolicy("globex", "orders"); err != nil || rowPolicy != nil {
+			t.Errorf("GetPolicy of another tenant's table = %v, %v", rowPolicy, err)
+		}
+		if err := stores.Policies.DeletePolicy("globex", "orders"); err == nil {
+			t.Errorf("DeletePolicy of a table without a policy succeeded")
+		}
+		if rowPolicy, err := stores.Policies.GetPolicy("acme", "orders"); err != nil || rowPolicy == nil {
+			t.Errorf("another tenant removed the row policy: %v, %v", rowPolicy, err)
+		}
+	})
+}
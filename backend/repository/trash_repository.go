@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"dynamic-table-backend/models"
+	"fmt"
+	"time"
+)
+
+type TrashRepository struct {
+	db DB
+}
+
+func NewTrashRepository(db DB) *TrashRepository {
+	return &TrashRepository{db: db}
+}
+
+// PurgeTrash permanently deletes the schemas and contents of every tenant that have been in the trash
+// longer than the retention, returning how many of each were purged. Purging a schema deletes its
+// contents, row policy and record revisions with it.
+func (r *TrashRepository) PurgeTrash(retention time.Duration) (int64, int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	cutoff := `CURRENT_TIMESTAMP - $1::double precision * INTERVAL '1 second'`
+
+	rows, err := tx.Query(`DELETE FROM schemas WHERE deleted_at < `+cutoff+` RETURNING id, storage`, retention.Seconds())
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to purge schemas: %v", err)
+	}
+	var schemas int64
+	var typed []string
+	for rows.Next() {
+		var id, storage string
+		if err := rows.Scan(&id, &storage); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan purged schema: %v", err)
+		}
+		schemas++
+		if storage != models.StorageJSONB {
+			typed = append(typed, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to purge schemas: %v", err)
+	}
+
+	// Purged materialized tables take their typed tables with them
+	for _, id := range typed {
+		if _, err := tx.Exec(`DROP TABLE IF EXISTS ` + materializedTableName(id)); err != nil {
+			return 0, 0, fmt.Errorf("failed to drop materialized table: %v", err)
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM contents WHERE deleted_at < `+cutoff, retention.Seconds())
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to purge contents: %v", err)
+	}
+	contents, _ := result.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit purge: %v", err)
+	}
+
+	return schemas, contents, nil
+}
@@ -0,0 +1,435 @@
+package repository
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/policy"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type WebhookRepository struct {
+	db DB
+}
+
+func NewWebhookRepository(db DB) *WebhookRepository {
+	return &WebhookRepository{db: db}
+}
+
+// CreateWebhook subscribes a URL to events of a tenant's table and returns it with its signing secret
+func (r *WebhookRepository) CreateWebhook(tenant string, req *models.CreateWebhookRequest) (*models.Webhook, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate webhook secret: %v", err)
+	}
+
+	query := `
+		INSERT INTO webhooks (tenant, table_slug, url, events, filter, secret)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, table_slug, url, events, filter, created_at, secret`
+
+	webhook, err := r.scanWebhook(r.db.QueryRow(query, tenant, req.TableSlug, req.URL, pq.Array(req.Events), req.Filter, hex.EncodeToString(secret)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %v", err)
+	}
+	return webhook, nil
+}
+
+// GetWebhooks retrieves the webhooks of a tenant, without their secrets
+func (r *WebhookRepository) GetWebhooks(tenant string) ([]*models.Webhook, error) {
+	query := `
+		SELECT id, table_slug, url, events, filter, created_at, ''
+		FROM webhooks
+		WHERE tenant = $1
+		ORDER BY created_at DESC`
+
+	rows, err := r.db.Query(query, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	webhooks := []*models.Webhook{}
+	for rows.Next() {
+		webhook, err := r.scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %v", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// GetWebhook retrieves a webhook of a tenant without its secret, or nil if it does not exist
+func (r *WebhookRepository) GetWebhook(tenant string, id string) (*models.Webhook, error) {
+	query := `
+		SELECT id, table_slug, url, events, filter, created_at, ''
+		FROM webhooks
+		WHERE tenant = $1 AND id = $2`
+
+	webhook, err := r.scanWebhook(r.db.QueryRow(query, tenant, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get webhook: %v", err)
+	}
+	return webhook, nil
+}
+
+// DeleteWebhook removes a webhook of a tenant together with its deliveries
+func (r *WebhookRepository) DeleteWebhook(tenant string, id string) error {
+	result, err := r.db.Exec(`DELETE FROM webhooks WHERE tenant = $1 AND id = $2`, tenant, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("webhook not found")
+	}
+	return nil
+}
+
+// Ping queues a test delivery for a webhook of a tenant, or returns nil if the webhook does not exist
+func (r *WebhookRepository) Ping(tenant string, id string) (*models.WebhookDelivery, error) {
+	webhook, err := r.GetWebhook(tenant, id)
+	if err != nil || webhook == nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(models.WebhookEvent{
+		Event:      models.WebhookPing,
+		Tenant:     tenant,
+		TableSlug:  webhook.TableSlug,
+		OccurredAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook event: %v", err)
+	}
+
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		VALUES ($1, $2, $3)
+		RETURNING ` + deliveryColumns
+
+	delivery, err := r.scanDelivery(r.db.QueryRow(query, id, models.WebhookPing, payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue webhook delivery: %v", err)
+	}
+	return delivery, nil
+}
+
+// deliveryColumns are the columns scanned by scanDelivery
+const deliveryColumns = `id, webhook_id, event, payload, status, attempts, next_attempt_at, last_error, created_at, delivered_at`
+
+// GetDeliveries retrieves a page of a webhook's deliveries with their attempts, newest first.
+// An empty webhook ID lists the deliveries of every webhook of the tenant and an empty status every status.
+func (r *WebhookRepository) GetDeliveries(tenant string, webhookID string, status string, page int, pageSize int) (*models.WebhookDeliveryResponse, error) {
+	qb := newQueryBuilder(nil, tenant)
+	where := `webhook_id IN (SELECT id FROM webhooks WHERE tenant = $1)`
+	if webhookID != "" {
+		where += " AND webhook_id = " + qb.arg(webhookID)
+	}
+	if status != "" {
+		where += " AND status = " + qb.arg(status)
+	}
+
+	var total int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE "+where, qb.args...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("failed to count webhook deliveries: %v", err)
+	}
+
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = 20
+	}
+	if pageSize > 100 {
+		pageSize = 100
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM webhook_deliveries
+		WHERE %s
+		ORDER BY id DESC
+		LIMIT %s OFFSET %s`, deliveryColumns, where, qb.arg(pageSize), qb.arg((page-1)*pageSize))
+
+	rows, err := r.db.Query(query, qb.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	deliveries := []*models.WebhookDelivery{}
+	byID := make(map[int64]*models.WebhookDelivery)
+	ids := []int64{}
+	for rows.Next() {
+		delivery, err := r.scanDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+		byID[delivery.ID] = delivery
+		ids = append(ids, delivery.ID)
+	}
+	rows.Close()
+
+	// Attach the attempt log
+	attemptQuery := `
+		SELECT delivery_id, attempt, status_code, error, duration_ms, created_at
+		FROM webhook_attempts
+		WHERE delivery_id = ANY($1)
+		ORDER BY delivery_id, attempt`
+	attemptRows, err := r.db.Query(attemptQuery, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook attempts: %v", err)
+	}
+	defer attemptRows.Close()
+
+	for attemptRows.Next() {
+		var deliveryID int64
+		var attempt models.WebhookAttempt
+		err := attemptRows.Scan(&deliveryID, &attempt.Attempt, &attempt.StatusCode, &attempt.Error, &attempt.DurationMs, &attempt.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook attempt: %v", err)
+		}
+		byID[deliveryID].AttemptLog = append(byID[deliveryID].AttemptLog, &attempt)
+	}
+
+	return &models.WebhookDeliveryResponse{
+		Deliveries: deliveries,
+		Total:      total,
+		Page:       page,
+		PageSize:   pageSize,
+		TotalPages: (total + pageSize - 1) / pageSize,
+	}, nil
+}
+
+// RetryDelivery moves a dead delivery of a tenant's webhook back to the outbox, with a fresh set of attempts
+func (r *WebhookRepository) RetryDelivery(tenant string, webhookID string, deliveryID int64) (*models.WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND webhook_id = $2 AND status = 'dead'
+		AND webhook_id IN (SELECT id FROM webhooks WHERE tenant = $3)
+		RETURNING ` + deliveryColumns
+
+	delivery, err := r.scanDelivery(r.db.QueryRow(query, deliveryID, webhookID, tenant))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retry webhook delivery: %v", err)
+	}
+	return delivery, nil
+}
+
+// ClaimDeliveries picks up to limit due deliveries of every tenant for dispatching. The claimed deliveries are
+// not due again until lease has passed, so that concurrent dispatchers do not send them twice meanwhile.
+func (r *WebhookRepository) ClaimDeliveries(limit int, lease time.Duration) ([]*models.WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = CURRENT_TIMESTAMP + $2::double precision * INTERVAL '1 second'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at, d.last_error, d.created_at, d.delivered_at, w.url, w.secret`
+
+	rows, err := r.db.Query(query, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*models.WebhookDelivery
+	for rows.Next() {
+		var delivery models.WebhookDelivery
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastError,
+			&delivery.CreatedAt,
+			&delivery.DeliveredAt,
+			&delivery.URL,
+			&delivery.Secret,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	return deliveries, nil
+}
+
+// RecordAttempt logs an attempt of a delivery and moves it to its new status. Pending deliveries are
+// retried after retryIn.
+func (r *WebhookRepository) RecordAttempt(deliveryID int64, attempt *models.WebhookAttempt, status string, retryIn time.Duration) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, duration_ms)
+		VALUES ($1, $2, $3, $4, $5)`
+	if _, err := tx.Exec(query, deliveryID, attempt.Attempt, attempt.StatusCode, attempt.Error, attempt.DurationMs); err != nil {
+		return fmt.Errorf("failed to record webhook attempt: %v", err)
+	}
+
+	query = `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, last_error = $4,
+			next_attempt_at = CASE WHEN $2 = 'pending' THEN CURRENT_TIMESTAMP + $5::double precision * INTERVAL '1 second' END,
+			delivered_at = CASE WHEN $2 = 'delivered' THEN CURRENT_TIMESTAMP END
+		WHERE id = $1`
+	if _, err := tx.Exec(query, deliveryID, status, attempt.Attempt, attempt.Error, retryIn.Seconds()); err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit webhook attempt: %v", err)
+	}
+	return nil
+}
+
+// enqueueWebhooks adds a delivery to the outbox for every webhook of the tenant's table that subscribes
+// to the event, inside the transaction making the change. Record events are only queued for webhooks
+// whose filter matches the record as it is after the change, or before it for deletes.
+func enqueueWebhooks(tx *sql.Tx, tenant string, event string, tableSlug string, recordID string, before, after json.RawMessage) error {
+	rows, err := tx.Query(`SELECT id, filter FROM webhooks WHERE tenant = $1 AND table_slug = $2 AND $3 = ANY(events)`, tenant, tableSlug, event)
+	if err != nil {
+		return fmt.Errorf("failed to query webhooks: %v", err)
+	}
+	type subscription struct{ id, filter string }
+	var subscriptions []subscription
+	for rows.Next() {
+		var s subscription
+		if err := rows.Scan(&s.id, &s.filter); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan webhook: %v", err)
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	rows.Close()
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(models.WebhookEvent{
+		Event:      event,
+		Tenant:     tenant,
+		TableSlug:  tableSlug,
+		RecordID:   recordID,
+		Before:     before,
+		After:      after,
+		OccurredAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook event: %v", err)
+	}
+
+	for _, s := range subscriptions {
+		if s.filter != "" && recordID != "" {
+			matched, err := filterMatches(tx, tenant, tableSlug, recordID, s.filter)
+			if err != nil {
+				return err
+			}
+			if !matched {
+				continue
+			}
+		}
+		_, err := tx.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, payload) VALUES ($1, $2, $3)`, s.id, event, payload)
+		if err != nil {
+			return fmt.Errorf("failed to queue webhook delivery: %v", err)
+		}
+	}
+	return nil
+}
+
+// filterMatches evaluates a webhook filter against a record as the transaction sees it
+func filterMatches(tx *sql.Tx, tenant string, tableSlug string, recordID string, filter string) (bool, error) {
+	node, err := policy.Parse(filter)
+	if err != nil {
+		// Filters are validated when webhooks are created, but a broken one must not block the change
+		log.Printf("Failed to parse webhook filter of table %s: %v", tableSlug, err)
+		return false, nil
+	}
+
+	schema, err := getSchema(tx, tenant, tableSlug)
+	if err != nil {
+		return false, err
+	}
+	var fields []models.Field
+	if schema != nil {
+		fields = schema.Fields
+	}
+
+	qb := newQueryBuilder(fields, tenant, recordID)
+	condition, err := qb.policyCondition(fields, policy.Bind(node, nil))
+	if err != nil {
+		return false, err
+	}
+
+	var matched bool
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM contents WHERE tenant = $1 AND id = $2 AND %s)`, condition)
+	if err := tx.QueryRow(query, qb.args...).Scan(&matched); err != nil {
+		return false, fmt.Errorf("failed to evaluate webhook filter: %v", err)
+	}
+	return matched, nil
+}
+
+// scanWebhook scans a webhook row
+func (r *WebhookRepository) scanWebhook(row interface{ Scan(...interface{}) error }) (*models.Webhook, error) {
+	var webhook models.Webhook
+	var events pq.StringArray
+	err := row.Scan(&webhook.ID, &webhook.TableSlug, &webhook.URL, &events, &webhook.Filter, &webhook.CreatedAt, &webhook.Secret)
+	if err != nil {
+		return nil, err
+	}
+	webhook.Events = []string(events)
+	return &webhook, nil
+}
+
+// scanDelivery scans the deliveryColumns of a webhook delivery row
+func (r *WebhookRepository) scanDelivery(row interface{ Scan(...interface{}) error }) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.LastError,
+		&delivery.CreatedAt,
+		&delivery.DeliveredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
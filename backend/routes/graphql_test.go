@@ -0,0 +1,145 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+)
+
+// graphQLResult is the response of a GraphQL request
+type graphQLResult struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []interface{}          `json:"errors"`
+}
+
+// countingContents counts the relation lookups made through a content store
+type countingContents struct {
+	repository.ContentStore
+	lookups int
+}
+
+func (c *countingContents) GetContentsByFieldValues(tenant string, tableSlug string, fieldName string, fieldValues []string, principal *models.Principal) ([]*models.Content, error) {
+	c.lookups++
+	return c.ContentStore.GetContentsByFieldValues(tenant, tableSlug, fieldName, fieldValues, principal)
+}
+
+func TestGraphQLNamesDoNotCollide(t *testing.T) {
+	r := newTestRouter(t)
+	for _, slug := range []string{"order-items", "order_items", "foo", "foo_page"} {
+		schema := models.CreateSchemaRequest{TableName: slug, TableSlug: slug, Fields: []models.Field{{Name: "name", Label: "Name", DataType: "text"}}}
+		if code := do(t, r, http.MethodPost, "/api/schemas", schema, nil, nil); code != http.StatusCreated {
+			t.Fatalf("create schema %s = %d", slug, code)
+		}
+	}
+	people := models.CreateSchemaRequest{TableName: "People", TableSlug: "people", Fields: []models.Field{
+		{Name: "first name", Label: "First name", DataType: "text"},
+		{Name: "first_name", Label: "First name", DataType: "text"},
+		{Name: "__x", Label: "X", DataType: "text"},
+	}}
+	if code := do(t, r, http.MethodPost, "/api/schemas", people, nil, nil); code != http.StatusCreated {
+		t.Fatalf("create schema people = %d", code)
+	}
+	person := models.CreateContentRequest{Values: map[string]interface{}{"first name": "Ada", "first_name": "Grace", "__x": "x"}}
+	if code := do(t, r, http.MethodPost, "/api/contents/people", person, nil, nil); code != http.StatusCreated {
+		t.Fatalf("create content = %d", code)
+	}
+
+	var result graphQLResult
+	query := map[string]string{"query": "{ __schema { queryType { fields { name } } } }"}
+	if code := do(t, r, http.MethodPost, "/graphql", query, nil, &result); code != http.StatusOK || len(result.Errors) > 0 {
+		t.Fatalf("graphql = %d, errors %v", code, result.Errors)
+	}
+	fields := result.Data["__schema"].(map[string]interface{})["queryType"].(map[string]interface{})["fields"].([]interface{})
+	if len(fields) != 10 {
+		t.Errorf("query fields = %v, want a record and a list field per table", fields)
+	}
+
+	result = graphQLResult{}
+	query = map[string]string{"query": "{ peopleList { contents { first_name first_name_2 _x } } }"}
+	if code := do(t, r, http.MethodPost, "/graphql", query, nil, &result); code != http.StatusOK || len(result.Errors) > 0 {
+		t.Fatalf("graphql = %d, errors %v", code, result.Errors)
+	}
+	contents := result.Data["peopleList"].(map[string]interface{})["contents"].([]interface{})
+	got := contents[0].(map[string]interface{})
+	if got["first_name"] != "Ada" || got["first_name_2"] != "Grace" || got["_x"] != "x" {
+		t.Errorf("person = %v, want each field under its own name", got)
+	}
+}
+
+func TestGraphQLGetRejectsMutations(t *testing.T) {
+	r := newTestRouter(t)
+	schema := models.CreateSchemaRequest{TableName: "Notes", TableSlug: "notes", Fields: []models.Field{{Name: "text", Label: "Text", DataType: "text"}}}
+	if code := do(t, r, http.MethodPost, "/api/schemas", schema, nil, nil); code != http.StatusCreated {
+		t.Fatalf("create schema = %d", code)
+	}
+
+	mutation := url.QueryEscape(`mutation { createNotes(values: {text: "hi"}) { id } }`)
+	if code := do(t, r, http.MethodGet, "/graphql?query="+mutation, nil, nil, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET mutation = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	named := url.QueryEscape(`query list { notesList { total } } mutation add { createNotes(values: {text: "hi"}) { id } }`)
+	if code := do(t, r, http.MethodGet, "/graphql?operationName=list&query="+named, nil, nil, nil); code != http.StatusOK {
+		t.Errorf("GET query of a document with a mutation = %d, want %d", code, http.StatusOK)
+	}
+
+	var result graphQLResult
+	query := url.QueryEscape(`{ notesList { total } }`)
+	if code := do(t, r, http.MethodGet, "/graphql?query="+query, nil, nil, &result); code != http.StatusOK || len(result.Errors) > 0 {
+		t.Fatalf("GET query = %d, errors %v", code, result.Errors)
+	}
+	if total := result.Data["notesList"].(map[string]interface{})["total"]; total != float64(0) {
+		t.Errorf("notes after GET mutations = %v, want none", total)
+	}
+}
+
+func TestGraphQLBatchesRelations(t *testing.T) {
+	t.Setenv("AUTH_DISABLED", "true")
+	stores := repository.NewMemoryStores()
+	contents := &countingContents{ContentStore: stores.Contents}
+	stores.Contents = contents
+	r, err := SetupRoutes(stores, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	customers := models.CreateSchemaRequest{TableName: "Customers", TableSlug: "customers", Fields: []models.Field{{Name: "code", Label: "Code", DataType: "text"}}}
+	orders := models.CreateSchemaRequest{TableName: "Orders", TableSlug: "orders", Fields: []models.Field{{
+		Name: "customer", Label: "Customer", DataType: "relation",
+		RelationConfig: &models.RelationConfig{RelationType: "many-to-one", RelatedTable: "customers", RelatedField: "code"},
+	}}}
+	for _, schema := range []models.CreateSchemaRequest{customers, orders} {
+		if code := do(t, r, http.MethodPost, "/api/schemas", schema, nil, nil); code != http.StatusCreated {
+			t.Fatalf("create schema %s = %d", schema.TableSlug, code)
+		}
+	}
+	for i, code := range []string{"a", "b", "c", "a"} {
+		if i < 3 {
+			customer := models.CreateContentRequest{Values: map[string]interface{}{"code": code}}
+			if status := do(t, r, http.MethodPost, "/api/contents/customers", customer, nil, nil); status != http.StatusCreated {
+				t.Fatalf("create customer = %d", status)
+			}
+		}
+		order := models.CreateContentRequest{Values: map[string]interface{}{"customer": code}}
+		if status := do(t, r, http.MethodPost, "/api/contents/orders", order, nil, nil); status != http.StatusCreated {
+			t.Fatalf("create order = %d", status)
+		}
+	}
+
+	var result graphQLResult
+	query := map[string]string{"query": "{ ordersList { contents { customer { code } } } }"}
+	if code := do(t, r, http.MethodPost, "/graphql", query, nil, &result); code != http.StatusOK || len(result.Errors) > 0 {
+		t.Fatalf("graphql = %d, errors %v", code, result.Errors)
+	}
+	if contents.lookups != 1 {
+		t.Errorf("relation lookups = %d, want one for the page", contents.lookups)
+	}
+	for _, item := range result.Data["ordersList"].(map[string]interface{})["contents"].([]interface{}) {
+		customer, _ := item.(map[string]interface{})["customer"].(map[string]interface{})
+		if customer == nil || customer["code"] == nil {
+			t.Errorf("order %v has no customer", item)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package routes
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+)
+
+// odataResult is the response of an OData entity set request
+type odataResult struct {
+	Value []map[string]interface{} `json:"value"`
+}
+
+// projectingContents records the fields requested from a content store and counts its relation lookups
+type projectingContents struct {
+	repository.ContentStore
+	fields  [][]string
+	lookups int
+}
+
+func (c *projectingContents) GetContentsByTableSlug(tenant string, tableSlug string, params *models.ContentQueryParams) (*models.ContentResponse, error) {
+	c.fields = append(c.fields, params.Fields)
+	return c.ContentStore.GetContentsByTableSlug(tenant, tableSlug, params)
+}
+
+func (c *projectingContents) GetContentsByFieldValues(tenant string, tableSlug string, fieldName string, fieldValues []string, principal *models.Principal) ([]*models.Content, error) {
+	c.lookups++
+	return c.ContentStore.GetContentsByFieldValues(tenant, tableSlug, fieldName, fieldValues, principal)
+}
+
+func TestODataNames(t *testing.T) {
+	r := newTestRouter(t)
+	people := models.CreateSchemaRequest{TableName: "People", TableSlug: "people", Fields: []models.Field{
+		{Name: "id", Label: "Id", DataType: "text"},
+		{Name: "createdAt", Label: "Created", DataType: "text"},
+		{Name: "first name", Label: "First name", DataType: "text"},
+		{Name: "first_name", Label: "First name", DataType: "text"},
+		{Name: "e-mail", Label: "E-mail", DataType: "text"},
+	}}
+	if code := do(t, r, http.MethodPost, "/api/schemas", people, nil, nil); code != http.StatusCreated {
+		t.Fatalf("create schema = %d", code)
+	}
+	person := models.CreateContentRequest{Values: map[string]interface{}{
+		"id": "p-1", "createdAt": "yesterday", "first name": "Ada", "first_name": "Grace", "e-mail": "ada@example.com",
+	}}
+	if code := do(t, r, http.MethodPost, "/api/contents/people", person, nil, nil); code != http.StatusCreated {
+		t.Fatalf("create content = %d", code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/odata/$metadata", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var doc struct {
+		Types []struct {
+			Properties []struct {
+				Name string `xml:"Name,attr"`
+			} `xml:"Property"`
+		} `xml:"DataServices>Schema>EntityType"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil || len(doc.Types) != 1 {
+		t.Fatalf("metadata = %s, %v", w.Body.String(), err)
+	}
+	var names []string
+	for _, property := range doc.Types[0].Properties {
+		names = append(names, property.Name)
+	}
+	want := []string{"id", "createdAt", "updatedAt", "id_2", "createdAt_2", "first_name", "first_name_2", "e_mail"}
+	if len(names) != len(want) {
+		t.Fatalf("properties = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("properties = %v, want %v", names, want)
+		}
+	}
+
+	var result odataResult
+	if code := do(t, r, http.MethodGet, "/odata/people?$filter="+url.QueryEscape("first_name_2 eq 'Grace'"), nil, nil, &result); code != http.StatusOK {
+		t.Fatalf("filter = %d", code)
+	}
+	if len(result.Value) != 1 {
+		t.Fatalf("entities = %v, want one", result.Value)
+	}
+	entity := result.Value[0]
+	if entity["id_2"] != "p-1" || entity["createdAt_2"] != "yesterday" || entity["first_name"] != "Ada" || entity["e_mail"] != "ada@example.com" {
+		t.Errorf("entity = %v, want each field under its property name", entity)
+	}
+	if entity["id"] == "p-1" || entity["createdAt"] == "yesterday" {
+		t.Errorf("entity = %v, want the system properties kept", entity)
+	}
+
+	for _, filter := range []string{"createdAt_2 eq 'yesterday'", "id eq 'p-1'", "e-mail eq 'x'"} {
+		if code := do(t, r, http.MethodGet, "/odata/people?$filter="+url.QueryEscape(filter), nil, nil, nil); code != http.StatusBadRequest {
+			t.Errorf("filter %q = %d, want %d", filter, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestODataSelectAndExpand(t *testing.T) {
+	t.Setenv("AUTH_DISABLED", "true")
+	stores := repository.NewMemoryStores()
+	contents := &projectingContents{ContentStore: stores.Contents}
+	stores.Contents = contents
+	r, err := SetupRoutes(stores, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	customers := models.CreateSchemaRequest{TableName: "Customers", TableSlug: "customers", Fields: []models.Field{{Name: "code", Label: "Code", DataType: "text"}}}
+	orders := models.CreateSchemaRequest{TableName: "Orders", TableSlug: "orders", Fields: []models.Field{
+		{Name: "number", Label: "Number", DataType: "number"},
+		{Name: "note", Label: "Note", DataType: "text"},
+		{Name: "customer", Label: "Customer", DataType: "relation",
+			RelationConfig: &models.RelationConfig{RelationType: "many-to-one", RelatedTable: "customers", RelatedField: "code"}},
+	}}
+	for _, schema := range []models.CreateSchemaRequest{customers, orders} {
+		if code := do(t, r, http.MethodPost, "/api/schemas", schema, nil, nil); code != http.StatusCreated {
+			t.Fatalf("create schema %s = %d", schema.TableSlug, code)
+		}
+	}
+	for i, code := range []string{"a", "b", "c", "a"} {
+		if i < 3 {
+			customer := models.CreateContentRequest{Values: map[string]interface{}{"code": code}}
+			if status := do(t, r, http.MethodPost, "/api/contents/customers", customer, nil, nil); status != http.StatusCreated {
+				t.Fatalf("create customer = %d", status)
+			}
+		}
+		order := models.CreateContentRequest{Values: map[string]interface{}{"number": i, "note": "n", "customer": code}}
+		if status := do(t, r, http.MethodPost, "/api/contents/orders", order, nil, nil); status != http.StatusCreated {
+			t.Fatalf("create order = %d", status)
+		}
+	}
+
+	contents.fields = nil
+	var result odataResult
+	if code := do(t, r, http.MethodGet, "/odata/orders?$select=number&$expand=customer", nil, nil, &result); code != http.StatusOK {
+		t.Fatalf("select and expand = %d", code)
+	}
+	if len(contents.fields) != 1 || len(contents.fields[0]) != 2 || contents.fields[0][0] != "number" || contents.fields[0][1] != "customer" {
+		t.Errorf("fetched fields = %v, want the selected field and the expanded relation", contents.fields)
+	}
+	if contents.lookups != 1 {
+		t.Errorf("relation lookups = %d, want one for the page", contents.lookups)
+	}
+	if len(result.Value) != 4 {
+		t.Fatalf("entities = %v, want four", result.Value)
+	}
+	for _, entity := range result.Value {
+		if _, ok := entity["note"]; ok {
+			t.Errorf("entity %v has an unselected property", entity)
+		}
+		if _, ok := entity["customer"]; ok {
+			t.Errorf("entity %v has the unselected relation key", entity)
+		}
+		customer, _ := entity["_customer_related"].(map[string]interface{})
+		if customer == nil || customer["code"] == nil {
+			t.Errorf("entity %v has no customer", entity)
+		}
+	}
+}
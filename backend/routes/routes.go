@@ -1,19 +1,27 @@
 package routes
 
 import (
+	"log"
+
+	"dynamic-table-backend/auth"
 	"dynamic-table-backend/handlers"
+	"dynamic-table-backend/repository"
+	"dynamic-table-backend/storage"
+	"dynamic-table-backend/stream"
 
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRoutes() *gin.Engine {
+// SetupRoutes registers every route on handlers working with the given stores. Uploaded files are kept in the blob store.
+// The hub streams the change log of the stores; it is nil when they have none.
+func SetupRoutes(stores *repository.Stores, blobStore storage.BlobStore, hub *stream.Hub) (*gin.Engine, error) {
 	r := gin.Default()
 
 	// Enable CORS
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key, X-Tenant, Last-Event-ID")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -23,36 +31,149 @@ func SetupRoutes() *gin.Engine {
 		c.Next()
 	})
 
+	// Every route except the health check requires an API key or JWT
+	authenticator, err := auth.NewAuthenticator(stores)
+	if err != nil {
+		return nil, err
+	}
+	api := r.Group("", authenticator.Middleware())
+
 	// Initialize handlers
-	schemaHandler := handlers.NewSchemaHandler()
-	contentHandler := handlers.NewContentHandler()
+	authHandler := handlers.NewAuthHandler(stores)
+	roleHandler := handlers.NewRoleHandler(stores)
+	schemaHandler := handlers.NewSchemaHandler(stores)
+	contentHandler := handlers.NewContentHandler(stores)
+	graphQLHandler := handlers.NewGraphQLHandler(stores)
+	odataHandler := handlers.NewODataHandler(stores)
+	auditHandler := handlers.NewAuditHandler(stores)
+	changeHandler := handlers.NewChangeHandler(stores)
+	webhookHandler := handlers.NewWebhookHandler(stores)
+	fileHandler := handlers.NewFileHandler(stores, blobStore)
+
+	// Regenerate the GraphQL schema whenever a table schema changes, here or, as the change log tells, on another replica
+	schemaHandler.OnSchemaChange(graphQLHandler.Invalidate)
+	if hub != nil {
+		if err := hub.WatchSchemas(graphQLHandler.InvalidateTenant); err != nil {
+			// Schemas generated before another replica's change then expire on their own
+			log.Println("Failed to watch schema changes:", err)
+		}
+	}
 
 	// Schema routes
-	schemas := r.Group("/api/schemas")
+	schemas := api.Group("/api/schemas")
 	{
 		schemas.POST("", schemaHandler.CreateSchema)
 		schemas.GET("", schemaHandler.GetAllSchemas)
 		schemas.GET("/:tableSlug", schemaHandler.GetSchema)
 		schemas.PUT("/:tableSlug", schemaHandler.UpdateSchema)
 		schemas.DELETE("/:tableSlug", schemaHandler.DeleteSchema)
+		schemas.GET("/:tableSlug/jsonschema", schemaHandler.GetJSONSchema)
+		schemas.GET("/:tableSlug/policy", schemaHandler.GetRowPolicy)
+		schemas.PUT("/:tableSlug/policy", schemaHandler.SetRowPolicy)
+		schemas.DELETE("/:tableSlug/policy", schemaHandler.DeleteRowPolicy)
 	}
 
 	// Content routes
-	contents := r.Group("/api/contents")
+	contents := api.Group("/api/contents")
 	{
 		contents.POST("/:tableSlug", contentHandler.CreateContent)
 		contents.GET("/:tableSlug", contentHandler.GetContents)
+		contents.GET("/:tableSlug/aggregate", contentHandler.AggregateContents)
 		contents.GET("/:tableSlug/:id", contentHandler.GetContent)
 		contents.PUT("/:tableSlug/:id", contentHandler.UpdateContent)
 		contents.DELETE("/:tableSlug/:id", contentHandler.DeleteContent)
+		contents.GET("/:tableSlug/:id/revisions", contentHandler.GetRevisions)
+		contents.GET("/:tableSlug/:id/revisions/diff", contentHandler.DiffRevisions)
+		contents.POST("/:tableSlug/:id/revisions/:revision/restore", contentHandler.RestoreRevision)
 		// Add route for related data
 		contents.GET("/:tableSlug/related/:fieldName", contentHandler.GetRelatedData)
 	}
 
+	// The remaining routes need storage only a database provides, so the memory backend leaves them out
+	if hub != nil {
+		streamHandler := handlers.NewStreamHandler(stores, hub)
+		contents.GET("/:tableSlug/stream", streamHandler.StreamContents)
+	}
+	if stores.Files != nil {
+		contents.POST("/:tableSlug/:id/files/:fieldName", fileHandler.UploadFile)
+		contents.GET("/:tableSlug/:id/files/:fieldName", fileHandler.DownloadFile)
+		contents.GET("/:tableSlug/:id/files/:fieldName/variants/:variant", fileHandler.DownloadVariant)
+	}
+	if stores.Storage != nil {
+		schemas.PUT("/:tableSlug/storage", schemaHandler.SetStorage)
+	}
+
+	// GraphQL endpoint generated from the table schemas
+	api.GET("/graphql", graphQLHandler.Query)
+	api.POST("/graphql", graphQLHandler.Query)
+
+	// OData v4 service exposing each table as an entity set
+	odataRoutes := api.Group("/odata")
+	{
+		odataRoutes.GET("", odataHandler.ServiceDocument)
+		odataRoutes.GET("/:resource", odataHandler.Resource)
+		odataRoutes.GET("/:resource/$count", odataHandler.Count)
+	}
+
+	// Generated API description, rebuilt from the stored schemas on every request
+	api.GET("/api/openapi.json", schemaHandler.GetOpenAPI)
+
+	// Authentication routes
+	authRoutes := api.Group("/api/auth")
+	authRoutes.GET("/me", authHandler.Me)
+	if stores.APIKeys != nil {
+		authRoutes.POST("/keys", authHandler.CreateAPIKey)
+		authRoutes.GET("/keys", authHandler.GetAPIKeys)
+		authRoutes.DELETE("/keys/:id", authHandler.RevokeAPIKey)
+	}
+
+	// Trash of deleted schemas and records
+	trash := api.Group("/api/trash")
+	{
+		trash.GET("/schemas", schemaHandler.GetTrashedSchemas)
+		trash.POST("/schemas/:tableSlug/restore", schemaHandler.RestoreSchema)
+		trash.GET("/contents/:tableSlug", contentHandler.GetTrashedContents)
+		trash.POST("/contents/:tableSlug/:id/restore", contentHandler.RestoreContent)
+	}
+
+	// Webhook subscriptions and their delivery log
+	if stores.Webhooks != nil {
+		webhooks := api.Group("/api/webhooks")
+		webhooks.POST("", webhookHandler.CreateWebhook)
+		webhooks.GET("", webhookHandler.GetWebhooks)
+		webhooks.GET("/dead-letters", webhookHandler.GetDeadLetters)
+		webhooks.GET("/:id", webhookHandler.GetWebhook)
+		webhooks.DELETE("/:id", webhookHandler.DeleteWebhook)
+		webhooks.POST("/:id/ping", webhookHandler.PingWebhook)
+		webhooks.GET("/:id/deliveries", webhookHandler.GetDeliveries)
+		webhooks.POST("/:id/deliveries/:deliveryId/retry", webhookHandler.RetryDelivery)
+	}
+
+	// Audit log and change feed of schema and content changes
+	if stores.Audit != nil {
+		api.GET("/api/audit", auditHandler.GetAuditLog)
+	}
+	if stores.Changes != nil {
+		api.GET("/api/changes", changeHandler.GetChanges)
+	}
+
+	// Role administration
+	if stores.Roles != nil {
+		roles := api.Group("/api/admin/roles")
+		roles.GET("", roleHandler.GetRoles)
+		roles.POST("", roleHandler.CreateRole)
+		roles.GET("/:id", roleHandler.GetRole)
+		roles.DELETE("/:id", roleHandler.DeleteRole)
+		roles.POST("/:id/grants", roleHandler.AddGrant)
+		roles.DELETE("/:id/grants/:grantId", roleHandler.DeleteGrant)
+		roles.POST("/:id/members", roleHandler.AddMember)
+		roles.DELETE("/:id/members/:principalId", roleHandler.RemoveMember)
+	}
+
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
-	return r
+	return r, nil
 }
@@ -0,0 +1,206 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/database"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRouter serves the routes on in-memory stores, with authentication disabled
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("AUTH_DISABLED", "true")
+	r, err := SetupRoutes(repository.NewMemoryStores(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// do sends a request with a JSON body to the router and decodes the JSON response into out, if given
+func do(t *testing.T, r http.Handler, method, path string, body interface{}, header http.Header, out interface{}) int {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if out != nil && w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: invalid response %s: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func TestSmoke(t *testing.T) {
+	r := newTestRouter(t)
+
+	if code := do(t, r, http.MethodGet, "/health", nil, nil, nil); code != http.StatusOK {
+		t.Fatalf("health = %d", code)
+	}
+
+	schema := models.CreateSchemaRequest{
+		TableName: "Products",
+		TableSlug: "products",
+		Fields: []models.Field{
+			{Name: "name", Label: "Name", DataType: "text", Required: true},
+			{Name: "price", Label: "Price", DataType: "number"},
+		},
+	}
+	if code := do(t, r, http.MethodPost, "/api/schemas", schema, nil, nil); code != http.StatusCreated {
+		t.Fatalf("create schema = %d", code)
+	}
+
+	var created models.Content
+	values := models.CreateContentRequest{Values: map[string]interface{}{"name": "Lamp", "price": 25}}
+	if code := do(t, r, http.MethodPost, "/api/contents/products", values, nil, &created); code != http.StatusCreated {
+		t.Fatalf("create content = %d", code)
+	}
+	if created.ID == "" || created.Values["name"] != "Lamp" {
+		t.Fatalf("unexpected record %+v", created)
+	}
+
+	cheap := models.CreateContentRequest{Values: map[string]interface{}{"name": "Bulb", "price": 5}}
+	if code := do(t, r, http.MethodPost, "/api/contents/products", cheap, nil, nil); code != http.StatusCreated {
+		t.Fatalf("create content = %d", code)
+	}
+
+	missing := models.CreateContentRequest{Values: map[string]interface{}{"price": 3}}
+	if code := do(t, r, http.MethodPost, "/api/contents/products", missing, nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("create content without a required field = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	var fetched models.Content
+	if code := do(t, r, http.MethodGet, "/api/contents/products/"+created.ID, nil, nil, &fetched); code != http.StatusOK {
+		t.Fatalf("get content = %d", code)
+	}
+	if fetched.Values["price"] != float64(25) {
+		t.Fatalf("unexpected record %+v", fetched)
+	}
+
+	var list models.ContentResponse
+	if code := do(t, r, http.MethodGet, "/api/contents/products?filters=name%3DLamp", nil, nil, &list); code != http.StatusOK {
+		t.Fatalf("list contents = %d", code)
+	}
+	if list.Total != 1 || len(list.Contents) != 1 || list.Contents[0].ID != created.ID {
+		t.Fatalf("unexpected list %+v", list)
+	}
+
+	var result struct {
+		Data struct {
+			ProductsList struct {
+				Contents []struct {
+					Name string `json:"name"`
+				} `json:"contents"`
+			} `json:"productsList"`
+		} `json:"data"`
+		Errors []interface{} `json:"errors"`
+	}
+	query := map[string]string{"query": "{ productsList { contents { name } } }"}
+	if code := do(t, r, http.MethodPost, "/graphql", query, nil, &result); code != http.StatusOK || len(result.Errors) > 0 {
+		t.Fatalf("graphql = %d, errors %v", code, result.Errors)
+	}
+	if len(result.Data.ProductsList.Contents) != 2 {
+		t.Fatalf("unexpected graphql result %+v", result.Data)
+	}
+
+	// Another tenant sees none of it
+	other := http.Header{auth.TenantHeader: {"other"}}
+	if code := do(t, r, http.MethodGet, "/api/contents/products/"+created.ID, nil, other, nil); code != http.StatusNotFound {
+		t.Fatalf("get content of another tenant = %d, want %d", code, http.StatusNotFound)
+	}
+
+	if code := do(t, r, http.MethodDelete, "/api/contents/products/"+created.ID, nil, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete content = %d", code)
+	}
+	if code := do(t, r, http.MethodGet, "/api/contents/products/"+created.ID, nil, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("get deleted content = %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+// TestSQLiteAuthentication serves the routes on SQLite with authentication enabled, as SQLite stores API keys and roles
+func TestSQLiteAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("AUTH_DISABLED", "")
+	db, err := database.OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := database.NewMigrator(db, database.SQLite).MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	stores := repository.NewSQLiteStores(db)
+	r, err := SetupRoutes(stores, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := stores.Roles.GetRoleByName("admin")
+	if err != nil || admin == nil {
+		t.Fatalf("admin role = %v, %v", admin, err)
+	}
+	apiKey, key, err := stores.APIKeys.CreateAPIKey("smoke", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Roles.AddMember(admin.ID, apiKey.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	schema := models.CreateSchemaRequest{
+		TableName: "Products",
+		TableSlug: "products",
+		Fields:    []models.Field{{Name: "name", Label: "Name", DataType: "text"}},
+	}
+	if code := do(t, r, http.MethodPost, "/api/schemas", schema, nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("create schema without a key = %d, want %d", code, http.StatusUnauthorized)
+	}
+	withKey := http.Header{"X-Api-Key": {key}}
+	if code := do(t, r, http.MethodPost, "/api/schemas", schema, withKey, nil); code != http.StatusCreated {
+		t.Fatalf("create schema = %d", code)
+	}
+	values := models.CreateContentRequest{Values: map[string]interface{}{"name": "Lamp"}}
+	if code := do(t, r, http.MethodPost, "/api/contents/products", values, withKey, nil); code != http.StatusCreated {
+		t.Fatalf("create content = %d", code)
+	}
+
+	var audit models.AuditResponse
+	if code := do(t, r, http.MethodGet, "/api/audit?tableSlug=products", nil, withKey, &audit); code != http.StatusOK {
+		t.Fatalf("audit log = %d", code)
+	}
+	if audit.Total != 2 || audit.Entries[0].ActorID != apiKey.ID {
+		t.Fatalf("unexpected audit log %+v", audit)
+	}
+	var changes models.ChangeFeedResponse
+	if code := do(t, r, http.MethodGet, "/api/changes", nil, withKey, &changes); code != http.StatusOK {
+		t.Fatalf("change feed = %d", code)
+	}
+	if len(changes.Changes) != 2 {
+		t.Fatalf("unexpected change feed %+v", changes)
+	}
+}
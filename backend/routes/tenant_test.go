@@ -0,0 +1,140 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+
+	"dynamic-table-backend/auth"
+	"dynamic-table-backend/internal/testutil/fakes"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTenantTestRouter serves the routes on in-memory stores to an administrator of each of the tenants
+// acme and globex, and to a reader of every table not bound to a tenant
+func newTenantTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	stores := repository.NewMemoryStores()
+	stores.APIKeys = &fakes.APIKeys{Keys: map[string]*models.APIKey{
+		"dtk_acme":   {ID: "acme", Tenant: "acme"},
+		"dtk_globex": {ID: "globex", Tenant: "globex"},
+		"dtk_reader": {ID: "reader"},
+	}}
+	stores.Roles = &fakes.Roles{
+		Grants: map[string][]models.Grant{
+			"admin":  {{Permission: models.PermissionAdmin}},
+			"reader": {{Permission: models.PermissionContentRead}},
+		},
+		Members: map[string][]string{
+			"acme":   {"admin"},
+			"globex": {"admin"},
+			"reader": {"reader"},
+		},
+	}
+	r, err := SetupRoutes(stores, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func withKey(key string, tenant string) http.Header {
+	header := http.Header{"X-Api-Key": {key}}
+	if tenant != "" {
+		header.Set(auth.TenantHeader, tenant)
+	}
+	return header
+}
+
+func TestRoutesIsolateTenants(t *testing.T) {
+	r := newTenantTestRouter(t)
+	acme, globex := withKey("dtk_acme", ""), withKey("dtk_globex", "")
+
+	// Both tenants have a table with the same slug
+	schema := models.CreateSchemaRequest{
+		TableName: "Orders",
+		TableSlug: "orders",
+		Fields:    []models.Field{{Name: "customer", Label: "Customer", DataType: "text"}},
+	}
+	var acmeOrder, globexOrder models.Content
+	for _, tenant := range []struct {
+		header   http.Header
+		customer string
+		order    *models.Content
+	}{{acme, "Wile E. Coyote", &acmeOrder}, {globex, "Hank Scorpio", &globexOrder}} {
+		if code := do(t, r, http.MethodPost, "/api/schemas", schema, tenant.header, nil); code != http.StatusCreated {
+			t.Fatalf("create schema = %d", code)
+		}
+		values := models.CreateContentRequest{Values: map[string]interface{}{"customer": tenant.customer}}
+		if code := do(t, r, http.MethodPost, "/api/contents/orders", values, tenant.header, tenant.order); code != http.StatusCreated {
+			t.Fatalf("create content = %d", code)
+		}
+	}
+	acmePath := "/api/contents/orders/" + acmeOrder.ID
+
+	// Another tenant's records are not found, neither for reading nor for writing
+	update := models.UpdateContentRequest{Values: map[string]interface{}{"customer": "Road Runner"}}
+	for _, request := range []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{http.MethodGet, acmePath, nil},
+		{http.MethodPut, acmePath, update},
+		{http.MethodDelete, acmePath, nil},
+		{http.MethodGet, acmePath + "/revisions", nil},
+		{http.MethodPost, acmePath + "/revisions/1/restore", nil},
+	} {
+		if code := do(t, r, request.method, request.path, request.body, globex, nil); code != http.StatusNotFound {
+			t.Errorf("%s %s of another tenant = %d, want %d", request.method, request.path, code, http.StatusNotFound)
+		}
+	}
+
+	var list models.ContentResponse
+	if code := do(t, r, http.MethodGet, "/api/contents/orders", nil, globex, &list); code != http.StatusOK {
+		t.Fatalf("list contents = %d", code)
+	}
+	if list.Total != 1 || list.Contents[0].ID != globexOrder.ID {
+		t.Fatalf("globex lists %+v, want only its own order", list.Contents)
+	}
+
+	var result struct {
+		Data struct {
+			OrdersList struct {
+				Contents []struct {
+					ID string `json:"id"`
+				} `json:"contents"`
+			} `json:"ordersList"`
+		} `json:"data"`
+	}
+	query := map[string]string{"query": "{ ordersList { contents { id } } }"}
+	if code := do(t, r, http.MethodPost, "/graphql", query, globex, &result); code != http.StatusOK {
+		t.Fatalf("graphql = %d", code)
+	}
+	if contents := result.Data.OrdersList.Contents; len(contents) != 1 || contents[0].ID != globexOrder.ID {
+		t.Fatalf("globex queries %+v, want only its own order", contents)
+	}
+
+	// Credentials cannot switch to another tenant
+	if code := do(t, r, http.MethodGet, acmePath, nil, withKey("dtk_globex", "acme"), nil); code != http.StatusForbidden {
+		t.Errorf("bound key naming another tenant = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := do(t, r, http.MethodGet, acmePath, nil, withKey("dtk_reader", "acme"), nil); code != http.StatusForbidden {
+		t.Errorf("unbound reader naming a tenant = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := do(t, r, http.MethodGet, acmePath, nil, withKey("dtk_reader", ""), nil); code != http.StatusNotFound {
+		t.Errorf("unbound reader reading another tenant's record in the default tenant = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// The record is untouched
+	var fetched models.Content
+	if code := do(t, r, http.MethodGet, acmePath, nil, acme, &fetched); code != http.StatusOK {
+		t.Fatalf("get content = %d", code)
+	}
+	if fetched.Values["customer"] != "Wile E. Coyote" {
+		t.Fatalf("record of acme changed to %+v", fetched.Values)
+	}
+}
@@ -0,0 +1,68 @@
+package routes
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"dynamic-table-backend/database"
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newSQLiteTestRouter serves the routes on a new SQLite database, which stores webhooks, with
+// authentication disabled
+func newSQLiteTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("AUTH_DISABLED", "true")
+	db, err := database.OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := database.NewMigrator(db, database.SQLite).MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	r, err := SetupRoutes(repository.NewSQLiteStores(db), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestWebhookPrivateURLs(t *testing.T) {
+	urls := []string{
+		"http://127.0.0.1:9000/hook",
+		"http://localhost/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.5/hook",
+		"http://[::1]/hook",
+	}
+	tests := []struct {
+		name  string
+		allow string
+		want  int
+	}{
+		{"rejected", "", http.StatusBadRequest},
+		{"allowed by WEBHOOK_ALLOW_PRIVATE", "true", http.StatusCreated},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("WEBHOOK_ALLOW_PRIVATE", test.allow)
+			r := newSQLiteTestRouter(t)
+			schema := models.CreateSchemaRequest{TableName: "Orders", TableSlug: "orders", Fields: []models.Field{{Name: "total", Label: "Total", DataType: "number"}}}
+			if code := do(t, r, http.MethodPost, "/api/schemas", schema, nil, nil); code != http.StatusCreated {
+				t.Fatalf("create schema = %d", code)
+			}
+			for _, url := range urls {
+				req := models.CreateWebhookRequest{TableSlug: "orders", URL: url, Events: []string{models.AuditContentCreate}}
+				if code := do(t, r, http.MethodPost, "/api/webhooks", req, nil, nil); code != test.want {
+					t.Errorf("create webhook for %s = %d, want %d", url, code, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package spec
+
+import (
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+)
+
+// JSONSchemaDraft is the dialect advertised by generated JSON Schema documents
+const JSONSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// JSONSchema builds a standalone JSON Schema document describing the values of a table record
+func JSONSchema(schema *models.Schema) map[string]interface{} {
+	doc := ValuesSchema(schema)
+	doc["$schema"] = JSONSchemaDraft
+	doc["$id"] = "/api/schemas/" + schema.TableSlug + "/jsonschema"
+	doc["title"] = schema.TableName
+	return doc
+}
+
+// ValuesSchema builds the object schema for the values of a table record
+func ValuesSchema(schema *models.Schema) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	for _, field := range schema.Fields {
+		properties[field.Name] = FieldSchema(field)
+		if field.Required && !formula.ReadOnly(field) {
+			required = append(required, field.Name)
+		}
+	}
+
+	doc := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		doc["required"] = required
+	}
+
+	return doc
+}
+
+// FieldSchema maps a single field definition to its JSON Schema representation
+func FieldSchema(field models.Field) map[string]interface{} {
+	prop := make(map[string]interface{})
+
+	switch field.DataType {
+	case "number":
+		prop["type"] = "number"
+	case "checkbox":
+		prop["type"] = "boolean"
+	case "date":
+		prop["type"] = "string"
+		prop["format"] = "date"
+	case "time":
+		prop["type"] = "string"
+		prop["format"] = "time"
+	case "datetime":
+		prop["type"] = "string"
+		prop["format"] = "date-time"
+	case "email":
+		prop["type"] = "string"
+		prop["format"] = "email"
+	case "url":
+		prop["type"] = "string"
+		prop["format"] = "uri"
+	case "options", "radio":
+		prop["type"] = "string"
+		if len(field.Options) > 0 {
+			prop["enum"] = field.Options
+		}
+	case formula.DataType:
+		// Formula values are computed by the server from the expression
+		switch field.FormulaType {
+		case formula.TypeNumber:
+			prop["type"] = "number"
+		case formula.TypeBoolean:
+			prop["type"] = "boolean"
+		case formula.TypeDate:
+			prop["type"] = "string"
+			prop["format"] = "date-time"
+		default:
+			prop["type"] = "string"
+		}
+		prop["readOnly"] = true
+		prop["x-formula"] = field.Formula
+	case formula.LookupDataType, formula.RollupDataType:
+		// Lookups list the values read from the linked rows, rollups aggregate them
+		item := map[string]interface{}{"type": "string"}
+		resultType := ""
+		if field.LinkConfig != nil {
+			resultType = field.LinkConfig.ResultType
+		}
+		switch resultType {
+		case formula.TypeNumber:
+			item["type"] = "number"
+		case formula.TypeBoolean:
+			item["type"] = "boolean"
+		}
+		if field.DataType == formula.LookupDataType {
+			prop["type"] = "array"
+			prop["items"] = item
+		} else {
+			for key, value := range item {
+				prop[key] = value
+			}
+		}
+		prop["readOnly"] = true
+		if field.LinkConfig != nil {
+			prop["x-link"] = field.LinkConfig
+		}
+	case "relation":
+		// Relations store the value of the related field, one or many
+		if field.RelationConfig != nil && field.RelationConfig.AllowMultiple {
+			prop["type"] = "array"
+			prop["items"] = map[string]interface{}{"type": "string"}
+		} else {
+			prop["type"] = "string"
+		}
+		if field.RelationConfig != nil {
+			prop["x-relation"] = field.RelationConfig
+		}
+	case models.FileDataType:
+		// Files are set by uploading them; reads add the download URLs
+		prop["type"] = []string{"object", "null"}
+		prop["properties"] = map[string]interface{}{
+			"id":       map[string]interface{}{"type": "string"},
+			"name":     map[string]interface{}{"type": "string"},
+			"size":     map[string]interface{}{"type": "integer"},
+			"mimeType": map[string]interface{}{"type": "string"},
+			"checksum": map[string]interface{}{"type": "string"},
+			"url":      map[string]interface{}{"type": "string", "readOnly": true},
+			"variants": map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}, "readOnly": true},
+		}
+		if field.FileConfig != nil {
+			prop["x-file"] = field.FileConfig
+		}
+	default:
+		// text, textarea, phone and unknown types are stored as strings
+		prop["type"] = "string"
+	}
+
+	if field.DataValidation != "" && prop["type"] == "string" && !formula.ReadOnly(field) {
+		prop["pattern"] = field.DataValidation
+	}
+	if field.Label != "" {
+		prop["title"] = field.Label
+	}
+	prop["x-dataType"] = field.DataType
+
+	return prop
+}
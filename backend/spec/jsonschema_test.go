@@ -0,0 +1,144 @@
+package spec
+
+import (
+	"reflect"
+	"testing"
+
+	"dynamic-table-backend/formula"
+	"dynamic-table-backend/models"
+)
+
+func TestFieldSchema(t *testing.T) {
+	relation := &models.RelationConfig{RelatedTable: "customers", RelatedField: "code"}
+	many := &models.RelationConfig{RelatedTable: "tags", RelatedField: "name", AllowMultiple: true}
+	link := &models.LinkConfig{RelationField: "customer", TargetField: "score", ResultType: formula.TypeNumber}
+	tests := []struct {
+		field models.Field
+		want  map[string]interface{}
+	}{
+		{
+			field: models.Field{Name: "name", Label: "Name", DataType: "text", DataValidation: "^[A-Z]"},
+			want:  map[string]interface{}{"type": "string", "pattern": "^[A-Z]", "title": "Name", "x-dataType": "text"},
+		},
+		{
+			field: models.Field{Name: "price", DataType: "number", DataValidation: "^[0-9]+$"},
+			want:  map[string]interface{}{"type": "number", "x-dataType": "number"},
+		},
+		{
+			field: models.Field{Name: "done", DataType: "checkbox"},
+			want:  map[string]interface{}{"type": "boolean", "x-dataType": "checkbox"},
+		},
+		{
+			field: models.Field{Name: "due", DataType: "datetime"},
+			want:  map[string]interface{}{"type": "string", "format": "date-time", "x-dataType": "datetime"},
+		},
+		{
+			field: models.Field{Name: "mail", DataType: "email"},
+			want:  map[string]interface{}{"type": "string", "format": "email", "x-dataType": "email"},
+		},
+		{
+			field: models.Field{Name: "status", DataType: "options", Options: []string{"open", "paid"}},
+			want:  map[string]interface{}{"type": "string", "enum": []string{"open", "paid"}, "x-dataType": "options"},
+		},
+		{
+			field: models.Field{Name: "total", DataType: formula.DataType, Formula: "{price} * 2", FormulaType: formula.TypeNumber, DataValidation: "x"},
+			want:  map[string]interface{}{"type": "number", "readOnly": true, "x-formula": "{price} * 2", "x-dataType": formula.DataType},
+		},
+		{
+			field: models.Field{Name: "label", DataType: formula.DataType, Formula: "upper({name})", FormulaType: formula.TypeString, DataValidation: "x"},
+			want:  map[string]interface{}{"type": "string", "readOnly": true, "x-formula": "upper({name})", "x-dataType": formula.DataType},
+		},
+		{
+			field: models.Field{Name: "scores", DataType: formula.LookupDataType, LinkConfig: link},
+			want: map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "number"},
+				"readOnly": true, "x-link": link, "x-dataType": formula.LookupDataType},
+		},
+		{
+			field: models.Field{Name: "best", DataType: formula.RollupDataType, LinkConfig: link},
+			want:  map[string]interface{}{"type": "number", "readOnly": true, "x-link": link, "x-dataType": formula.RollupDataType},
+		},
+		{
+			field: models.Field{Name: "customer", DataType: "relation", RelationConfig: relation},
+			want:  map[string]interface{}{"type": "string", "x-relation": relation, "x-dataType": "relation"},
+		},
+		{
+			field: models.Field{Name: "tags", DataType: "relation", RelationConfig: many},
+			want: map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"},
+				"x-relation": many, "x-dataType": "relation"},
+		},
+		{
+			field: models.Field{Name: "notes", DataType: "unknown"},
+			want:  map[string]interface{}{"type": "string", "x-dataType": "unknown"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.field.Name, func(t *testing.T) {
+			if got := FieldSchema(test.field); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("FieldSchema(%s) = %v, want %v", test.field.Name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFieldSchemaFile(t *testing.T) {
+	got := FieldSchema(models.Field{Name: "attachment", DataType: models.FileDataType, DataValidation: "x"})
+	if !reflect.DeepEqual(got["type"], []string{"object", "null"}) {
+		t.Errorf("type = %v, want an object or null", got["type"])
+	}
+	properties, _ := got["properties"].(map[string]interface{})
+	for _, name := range []string{"id", "name", "size", "mimeType", "checksum", "url", "variants"} {
+		if properties[name] == nil {
+			t.Errorf("file schema has no %s property", name)
+		}
+	}
+	if _, ok := got["pattern"]; ok {
+		t.Error("file schema has a pattern")
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []models.Field
+		required []string
+	}{
+		{
+			name: "required stored fields",
+			fields: []models.Field{
+				{Name: "name", DataType: "text", Required: true},
+				{Name: "price", DataType: "number"},
+				{Name: "total", DataType: formula.DataType, Formula: "{price}", Required: true},
+				{Name: "code", DataType: "text", Required: true},
+			},
+			required: []string{"name", "code"},
+		},
+		{
+			name:   "no required fields",
+			fields: []models.Field{{Name: "name", DataType: "text"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc := JSONSchema(&models.Schema{TableName: "Products", TableSlug: "products", Fields: test.fields})
+			if doc["$schema"] != JSONSchemaDraft || doc["$id"] != "/api/schemas/products/jsonschema" || doc["title"] != "Products" {
+				t.Errorf("header = %v, %v, %v", doc["$schema"], doc["$id"], doc["title"])
+			}
+			if doc["type"] != "object" || doc["additionalProperties"] != false {
+				t.Errorf("document = %v, want a closed object", doc)
+			}
+			if properties := doc["properties"].(map[string]interface{}); len(properties) != len(test.fields) {
+				t.Errorf("properties = %v, want one per field", properties)
+			}
+			required, ok := doc["required"]
+			if test.required == nil {
+				if ok {
+					t.Errorf("required = %v, want none", required)
+				}
+				return
+			}
+			if !reflect.DeepEqual(required, test.required) {
+				t.Errorf("required = %v, want %v", required, test.required)
+			}
+		})
+	}
+}
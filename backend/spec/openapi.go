@@ -0,0 +1,198 @@
+package spec
+
+import (
+	"regexp"
+
+	"dynamic-table-backend/models"
+)
+
+var componentNamePattern = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// ComponentName returns the OpenAPI component name used for a table's values
+func ComponentName(tableSlug string) string {
+	return componentNamePattern.ReplaceAllString(tableSlug, "_") + "Values"
+}
+
+// OpenAPI builds an OpenAPI 3 document covering the content endpoints of every table
+func OpenAPI(schemas []*models.Schema) map[string]interface{} {
+	paths := make(map[string]interface{})
+	components := map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"error": map[string]interface{}{"type": "string"},
+			},
+		},
+	}
+
+	for _, schema := range schemas {
+		name := ComponentName(schema.TableSlug)
+		components[name] = ValuesSchema(schema)
+		components[name+"Record"] = recordSchema(name)
+		components[name+"Page"] = pageSchema(name)
+
+		collection, item := contentPaths(schema, name)
+		paths["/api/contents/"+schema.TableSlug] = collection
+		paths["/api/contents/"+schema.TableSlug+"/{id}"] = item
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Dynamic Tables API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": components,
+		},
+	}
+}
+
+// recordSchema wraps a table's values component in the content envelope
+func recordSchema(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"id":        map[string]interface{}{"type": "string", "format": "uuid"},
+			"tableSlug": map[string]interface{}{"type": "string"},
+			"values":    ref(name),
+			"createdAt": map[string]interface{}{"type": "string", "format": "date-time"},
+			"updatedAt": map[string]interface{}{"type": "string", "format": "date-time"},
+		},
+	}
+}
+
+// pageSchema describes the paginated list response for a table
+func pageSchema(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"contents": map[string]interface{}{
+				"type":  "array",
+				"items": ref(name + "Record"),
+			},
+			"total":      map[string]interface{}{"type": "integer"},
+			"page":       map[string]interface{}{"type": "integer"},
+			"pageSize":   map[string]interface{}{"type": "integer"},
+			"totalPages": map[string]interface{}{"type": "integer"},
+		},
+	}
+}
+
+// contentPaths builds the collection and item path items for a table
+func contentPaths(schema *models.Schema, name string) (map[string]interface{}, map[string]interface{}) {
+	tags := []string{schema.TableSlug}
+	body := map[string]interface{}{
+		"required": true,
+		"content": jsonContent(map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"values": ref(name),
+			},
+			"required": []string{"values"},
+		}),
+	}
+	idParam := map[string]interface{}{
+		"name":     "id",
+		"in":       "path",
+		"required": true,
+		"schema":   map[string]interface{}{"type": "string", "format": "uuid"},
+	}
+
+	collection := map[string]interface{}{
+		"get": map[string]interface{}{
+			"tags":        tags,
+			"summary":     "List " + schema.TableName + " records",
+			"operationId": "list_" + name,
+			"parameters": []interface{}{
+				queryParam("search", "string"),
+				queryParam("filters", "string"),
+				queryParam("sortBy", "string"),
+				queryParam("sortDir", "string"),
+				queryParam("page", "integer"),
+				queryParam("pageSize", "integer"),
+			},
+			"responses": map[string]interface{}{
+				"200": response("Paginated records", ref(name+"Page")),
+				"500": errorResponse(),
+			},
+		},
+		"post": map[string]interface{}{
+			"tags":        tags,
+			"summary":     "Create a " + schema.TableName + " record",
+			"operationId": "create_" + name,
+			"requestBody": body,
+			"responses": map[string]interface{}{
+				"201": response("Created record", ref(name+"Record")),
+				"400": errorResponse(),
+				"404": errorResponse(),
+			},
+		},
+	}
+
+	item := map[string]interface{}{
+		"parameters": []interface{}{idParam},
+		"get": map[string]interface{}{
+			"tags":        tags,
+			"summary":     "Get a " + schema.TableName + " record",
+			"operationId": "get_" + name,
+			"responses": map[string]interface{}{
+				"200": response("Record", ref(name+"Record")),
+				"404": errorResponse(),
+			},
+		},
+		"put": map[string]interface{}{
+			"tags":        tags,
+			"summary":     "Update a " + schema.TableName + " record",
+			"operationId": "update_" + name,
+			"requestBody": body,
+			"responses": map[string]interface{}{
+				"200": response("Updated record", ref(name+"Record")),
+				"400": errorResponse(),
+				"404": errorResponse(),
+			},
+		},
+		"delete": map[string]interface{}{
+			"tags":        tags,
+			"summary":     "Delete a " + schema.TableName + " record",
+			"operationId": "delete_" + name,
+			"responses": map[string]interface{}{
+				"200": response("Deleted", nil),
+				"500": errorResponse(),
+			},
+		},
+	}
+
+	return collection, item
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+func queryParam(name, typ string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":   name,
+		"in":     "query",
+		"schema": map[string]interface{}{"type": typ},
+	}
+}
+
+func response(description string, schema map[string]interface{}) map[string]interface{} {
+	resp := map[string]interface{}{"description": description}
+	if schema != nil {
+		resp["content"] = jsonContent(schema)
+	}
+	return resp
+}
+
+func errorResponse() map[string]interface{} {
+	return response("Error", ref("Error"))
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Timeouts of requests to the S3 service. Bodies are streamed and have no deadline, but a service that
+// does not accept connections or answer requests fails them rather than blocking uploads and cleanup.
+const (
+	s3DialTimeout           = 10 * time.Second
+	s3ResponseHeaderTimeout = 30 * time.Second
+)
+
+// S3Store keeps blobs in a bucket of S3 or an S3-compatible service such as MinIO. Requests are signed
+// with AWS Signature Version 4; payloads are sent unsigned so that uploads can be streamed.
+type S3Store struct {
+	// Endpoint is the service URL, e.g. "http://localhost:9000"; it defaults to AWS S3 in Region
+	Endpoint string
+	// Region defaults to "us-east-1"
+	Region      string
+	Bucket      string
+	AccessKeyID string
+	SecretKey   string
+	// ForcePathStyle addresses the bucket in the path ("<endpoint>/<bucket>/<key>") rather than the
+	// host name, as most S3-compatible services expect
+	ForcePathStyle bool
+
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// init validates the configuration
+func (s *S3Store) init() error {
+	if s.Bucket == "" || s.AccessKeyID == "" || s.SecretKey == "" {
+		return fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for the s3 blob store")
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid S3_ENDPOINT %q", s.Endpoint)
+	}
+	s.endpoint = endpoint
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = s3DialTimeout
+	transport.ResponseHeaderTimeout = s3ResponseHeaderTimeout
+	s.client = &http.Client{Transport: transport}
+	return nil
+}
+
+func (s *S3Store) Put(key string, body io.Reader, size int64, contentType string) error {
+	resp, err := s.do(http.MethodPut, key, body, size, contentType)
+	if err != nil {
+		return fmt.Errorf("failed to store blob: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to store blob: %s", s3Error(resp))
+	}
+	return nil
+}
+
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("failed to get blob: %s", s3Error(resp))
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return fmt.Errorf("failed to delete blob: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete blob: %s", s3Error(resp))
+	}
+	return nil
+}
+
+// do sends a signed request for an object
+func (s *S3Store) do(method string, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	target := *s.endpoint
+	path := "/" + key
+	if s.ForcePathStyle {
+		path = "/" + s.Bucket + path
+	} else {
+		target.Host = s.Bucket + "." + target.Host
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/") + path
+	target.RawPath = uriEncode(target.Path)
+
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the Signature Version 4 authorization header to a request
+func (s *S3Store) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" + "x-amz-content-sha256:" + payloadHash + "\n" + "x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signature := hex.EncodeToString(hmacSHA256(signingKey(s.SecretKey, date, s.Region, "s3"), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// signingKey derives the Signature Version 4 key of a day, region and service from the secret key
+func signingKey(secretKey string, date string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes a path as Signature Version 4 expects: every byte except unreserved characters and '/'
+func uriEncode(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Error describes an unexpected response, including the start of its error document
+func s3Error(resp *http.Response) string {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Sprintf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKeyID = "AKIDEXAMPLE"
+	testSecretKey   = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// fakeS3 is a local stand-in for an S3 bucket that rejects requests whose signature it cannot verify
+type fakeS3 struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := verifySignature(r); err != "" {
+		f.t.Errorf("%s %s: %s", r.Method, r.RequestURI, err)
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[path] = body
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		body, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	case http.MethodDelete:
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verifySignature checks a request's Signature Version 4 authorization the way the service does,
+// from the request as it arrives, and returns what is wrong with it
+func verifySignature(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	algorithm, rest, _ := strings.Cut(auth, " ")
+	if algorithm != "AWS4-HMAC-SHA256" {
+		return "unexpected authorization " + auth
+	}
+	params := map[string]string{}
+	for _, part := range strings.Split(rest, ", ") {
+		name, value, _ := strings.Cut(part, "=")
+		params[name] = value
+	}
+	credential := strings.Split(params["Credential"], "/")
+	if len(credential) != 5 || credential[0] != testAccessKeyID || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return "unexpected credential " + params["Credential"]
+	}
+	date, region := credential[1], credential[2]
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, date) || time.Since(signedAt).Abs() > 15*time.Minute {
+		return "invalid X-Amz-Date " + amzDate
+	}
+
+	var headers strings.Builder
+	for _, name := range strings.Split(params["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	path, query, _ := strings.Cut(r.RequestURI, "?")
+	canonicalRequest := strings.Join([]string{
+		r.Method, path, query, headers.String(), params["SignedHeaders"], r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + date + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(requestHash[:])
+	want := hex.EncodeToString(hmacSHA256(signingKey(testSecretKey, date, region, "s3"), stringToSign))
+	if params["Signature"] != want {
+		return "signature " + params["Signature"] + " does not match " + want
+	}
+	return ""
+}
+
+func newTestS3Store(t *testing.T, endpoint string) *S3Store {
+	store := &S3Store{
+		Endpoint:       endpoint,
+		Region:         "eu-west-1",
+		Bucket:         "uploads",
+		AccessKeyID:    testAccessKeyID,
+		SecretKey:      testSecretKey,
+		ForcePathStyle: true,
+	}
+	if err := store.init(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestSigningKey checks the key derivation against the example of the Signature Version 4 documentation
+func TestSigningKey(t *testing.T) {
+	got := hex.EncodeToString(signingKey(testSecretKey, "20120215", "us-east-1", "iam"))
+	if want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Fatalf("signing key = %s, want %s", got, want)
+	}
+}
+
+func TestS3StoreRoundTrip(t *testing.T) {
+	fake := &fakeS3{t: t, objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newTestS3Store(t, server.URL)
+
+	// Keys with characters that must be escaped are signed as they are sent
+	key := "acme/report 2024 (final)+é.pdf"
+	content := "%PDF-1.4 hello"
+	if err := store.Put(key, strings.NewReader(content), int64(len(content)), "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["/uploads/"+key]; !ok {
+		t.Fatalf("object not stored under the bucket path, have %v", fake.objects)
+	}
+
+	body, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if string(got) != content {
+		t.Fatalf("got %q, want %q", got, content)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(key); err != ErrNotFound {
+		t.Fatalf("Get after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3StoreRejectsWrongSecret(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if verifySignature(r) != "" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	store := newTestS3Store(t, server.URL)
+	store.SecretKey = "wrong"
+	err := store.Put("acme/file", strings.NewReader("x"), 1, "text/plain")
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("Put with wrong secret = %v, want signature error", err)
+	}
+}
+
+func TestS3StoreTimesOutHungEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	store := newTestS3Store(t, server.URL)
+	store.client.Transport.(*http.Transport).ResponseHeaderTimeout = 50 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Delete("acme/file")
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Delete of a hung endpoint succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Delete of a hung endpoint did not time out")
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrNotFound is returned when a blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps the contents of uploaded files under keys such as "<tenant>/<file id>"
+type BlobStore interface {
+	// Put stores a blob of the given size, replacing any blob with the same key
+	Put(key string, body io.Reader, size int64, contentType string) error
+	// Get opens a blob for reading, or returns ErrNotFound
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes a blob; deleting a missing blob is not an error
+	Delete(key string) error
+}
+
+// NewBlobStore creates the blob store selected by BLOB_STORE: "local" (default) keeps blobs in BLOB_DIR,
+// "s3" in the S3_BUCKET of an S3-compatible service
+func NewBlobStore() (BlobStore, error) {
+	switch backend := os.Getenv("BLOB_STORE"); backend {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		return NewLocalStore(dir)
+	case "s3":
+		store := &S3Store{
+			Endpoint:       os.Getenv("S3_ENDPOINT"),
+			Region:         os.Getenv("S3_REGION"),
+			Bucket:         os.Getenv("S3_BUCKET"),
+			AccessKeyID:    os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretKey:      os.Getenv("S3_SECRET_ACCESS_KEY"),
+			ForcePathStyle: strings.EqualFold(os.Getenv("S3_FORCE_PATH_STYLE"), "true"),
+		}
+		if err := store.init(); err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", backend)
+	}
+}
@@ -0,0 +1,197 @@
+package stream
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+
+	"github.com/lib/pq"
+)
+
+// ChangeLog is the log of committed change events the hub reads
+type ChangeLog interface {
+	GetEvents(since int64, limit int) ([]*models.ChangeEvent, error)
+	LatestEventID() (int64, error)
+}
+
+var _ ChangeLog = (*repository.ChangeRepository)(nil)
+
+// Hub fans committed change events out to the subscribers of their table. It listens for the
+// notifications sent when changes commit, so changes made through any replica reach the subscribers
+// of every replica, and reads the events themselves from the change log in ID order.
+type Hub struct {
+	repo        ChangeLog
+	connStr     string
+	mu          sync.Mutex
+	started     bool
+	subscribers map[*Subscription]bool
+	// schemaWatchers are called with the tenant of every schema event
+	schemaWatchers []func(tenant string)
+	lastID         int64
+	// BufferSize is how many events a subscriber may fall behind before it is dropped
+	BufferSize int
+	// PollInterval is how often the change log is read without a notification, e.g. while the listener reconnects
+	PollInterval time.Duration
+	// BatchSize is how many events are read at once
+	BatchSize int
+}
+
+// Subscription receives the change events of a tenant's table. Events is closed when the
+// subscriber is dropped for falling behind.
+type Subscription struct {
+	Tenant    string
+	TableSlug string
+	Events    <-chan *models.ChangeEvent
+	events    chan *models.ChangeEvent
+	hub       *Hub
+}
+
+// NewHub reads events from the change log and listens for change notifications on the PostgreSQL database
+// of connStr. Without a connection string it only polls the log.
+func NewHub(repo ChangeLog, connStr string) *Hub {
+	return &Hub{
+		repo:         repo,
+		connStr:      connStr,
+		subscribers:  make(map[*Subscription]bool),
+		BufferSize:   256,
+		PollInterval: 30 * time.Second,
+		BatchSize:    500,
+	}
+}
+
+// Subscribe registers a subscriber of a tenant's table; it receives the events committed from now on.
+// The hub starts listening with the first subscriber.
+func (h *Hub) Subscribe(tenant string, tableSlug string) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.ensureStarted(); err != nil {
+		return nil, err
+	}
+
+	events := make(chan *models.ChangeEvent, h.BufferSize)
+	sub := &Subscription{Tenant: tenant, TableSlug: tableSlug, Events: events, events: events, hub: h}
+	h.subscribers[sub] = true
+	return sub, nil
+}
+
+// WatchSchemas calls fn with the tenant of every schema change committed from now on, through any
+// replica. fn runs while events are dispatched, so it must not block. The hub starts listening if needed.
+func (h *Hub) WatchSchemas(fn func(tenant string)) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.ensureStarted(); err != nil {
+		return err
+	}
+	h.schemaWatchers = append(h.schemaWatchers, fn)
+	return nil
+}
+
+// Close unregisters the subscriber
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.drop(s)
+}
+
+// ensureStarted starts the hub unless it is running; the caller holds the lock
+func (h *Hub) ensureStarted() error {
+	if h.started {
+		return nil
+	}
+	if err := h.start(); err != nil {
+		return err
+	}
+	h.started = true
+	return nil
+}
+
+// start listens for change notifications and dispatches the events committed after the current last one
+func (h *Hub) start() error {
+	lastID, err := h.repo.LatestEventID()
+	if err != nil {
+		return err
+	}
+
+	h.lastID = lastID
+	if h.connStr == "" {
+		go h.run(nil)
+		return nil
+	}
+
+	listener := pq.NewListener(h.connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Change listener:", err)
+		}
+	})
+	if err := listener.Listen(repository.ChangeChannel); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to listen for changes: %v", err)
+	}
+	go h.run(listener.Notify)
+	return nil
+}
+
+// run dispatches new events on every notification. Notifications only signal that events exist: after
+// a reconnect, when some may have been missed, Notify yields nil and the log is read all the same.
+// Without notifications, i.e. a nil channel, the log is polled.
+func (h *Hub) run(notify <-chan *pq.Notification) {
+	for {
+		select {
+		case <-notify:
+		case <-time.After(h.PollInterval):
+		}
+		h.dispatch()
+	}
+}
+
+// dispatch sends the events after the last dispatched one to their subscribers
+func (h *Hub) dispatch() {
+	for {
+		events, err := h.repo.GetEvents(h.lastID, h.BatchSize)
+		if err != nil {
+			log.Println("Failed to read change events:", err)
+			return
+		}
+
+		h.mu.Lock()
+		for _, event := range events {
+			if event.RecordID == "" {
+				for _, fn := range h.schemaWatchers {
+					fn(event.Tenant)
+				}
+			}
+			for sub := range h.subscribers {
+				if sub.Tenant != event.Tenant || sub.TableSlug != event.TableSlug {
+					continue
+				}
+				select {
+				case sub.events <- event:
+				default:
+					// A subscriber that cannot keep up is dropped rather than slowing down the others;
+					// it can resume from its last event
+					h.drop(sub)
+				}
+			}
+			h.lastID = event.ID
+		}
+		h.mu.Unlock()
+
+		if len(events) < h.BatchSize {
+			return
+		}
+	}
+}
+
+// drop unregisters a subscriber and closes its channel; the caller holds the lock
+func (h *Hub) drop(sub *Subscription) {
+	if h.subscribers[sub] {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,131 @@
+package stream
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"dynamic-table-backend/models"
+)
+
+// fakeChangeLog is a change log held in memory
+type fakeChangeLog struct {
+	mu     sync.Mutex
+	events []*models.ChangeEvent
+}
+
+func (l *fakeChangeLog) append(event *models.ChangeEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event.ID = int64(len(l.events) + 1)
+	l.events = append(l.events, event)
+}
+
+func (l *fakeChangeLog) GetEvents(since int64, limit int) ([]*models.ChangeEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []*models.ChangeEvent
+	for _, event := range l.events {
+		if event.ID > since && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (l *fakeChangeLog) LatestEventID() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(len(l.events)), nil
+}
+
+func newTestHub(log *fakeChangeLog) *Hub {
+	hub := NewHub(log, "")
+	hub.PollInterval = 10 * time.Millisecond
+	return hub
+}
+
+func receive(t *testing.T, sub *Subscription) *models.ChangeEvent {
+	t.Helper()
+	select {
+	case event := <-sub.Events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func TestHubDispatchesEventsOfTheSubscribedTable(t *testing.T) {
+	log := &fakeChangeLog{}
+	log.append(&models.ChangeEvent{Tenant: "acme", TableSlug: "orders", RecordID: "old", Event: "content.create"})
+	hub := newTestHub(log)
+
+	sub, err := hub.Subscribe("acme", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	log.append(&models.ChangeEvent{Tenant: "other", TableSlug: "orders", RecordID: "1", Event: "content.create"})
+	log.append(&models.ChangeEvent{Tenant: "acme", TableSlug: "invoices", RecordID: "2", Event: "content.create"})
+	log.append(&models.ChangeEvent{Tenant: "acme", TableSlug: "orders", RecordID: "3", Event: "content.update"})
+
+	// Events committed before subscribing and those of other tables and tenants are not received
+	if event := receive(t, sub); event.RecordID != "3" {
+		t.Fatalf("received %+v, want the update of record 3", event)
+	}
+}
+
+func TestHubDropsSubscribersFallingBehind(t *testing.T) {
+	log := &fakeChangeLog{}
+	hub := newTestHub(log)
+	hub.BufferSize = 1
+	// Both events are dispatched at once
+	hub.PollInterval = time.Hour
+
+	sub, err := hub.Subscribe("acme", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	log.append(&models.ChangeEvent{Tenant: "acme", TableSlug: "orders", RecordID: "1"})
+	log.append(&models.ChangeEvent{Tenant: "acme", TableSlug: "orders", RecordID: "2"})
+	hub.dispatch()
+	receive(t, sub)
+	select {
+	case _, ok := <-sub.Events:
+		if ok {
+			t.Fatal("subscriber falling behind received another event")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber falling behind was not dropped")
+	}
+}
+
+func TestHubWatchesSchemaChanges(t *testing.T) {
+	log := &fakeChangeLog{}
+	hub := newTestHub(log)
+
+	tenants := make(chan string, 10)
+	if err := hub.WatchSchemas(func(tenant string) { tenants <- tenant }); err != nil {
+		t.Fatal(err)
+	}
+
+	log.append(&models.ChangeEvent{Tenant: "acme", TableSlug: "orders", RecordID: "1", Event: "content.create"})
+	log.append(&models.ChangeEvent{Tenant: "acme", TableSlug: "orders", Event: "schema.update"})
+	select {
+	case tenant := <-tenants:
+		if tenant != "acme" {
+			t.Fatalf("schema change reported for tenant %q, want acme", tenant)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("schema change not reported")
+	}
+	select {
+	case tenant := <-tenants:
+		t.Fatalf("record change reported as a schema change of %q", tenant)
+	default:
+	}
+}
@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+)
+
+// ErrPrivateAddress is returned for webhook URLs that reach a loopback, private or link-local address,
+// such as a cloud metadata endpoint, rather than another service on the internet
+var ErrPrivateAddress = errors.New("webhook URLs must not reach loopback, private or link-local addresses")
+
+// sharedAddressSpace is the carrier-grade NAT range, which net.IP does not count as private
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// AllowPrivateAddresses reports whether WEBHOOK_ALLOW_PRIVATE permits webhooks to reach private
+// addresses, e.g. a stub on localhost during development
+func AllowPrivateAddresses() bool {
+	return os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+}
+
+// PublicIP reports whether an address is a public unicast address webhooks may reach
+func PublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// CheckURL resolves the host of a webhook URL and returns ErrPrivateAddress if any of its addresses is
+// not public. Deliveries check the address again when they connect, as the host may resolve differently
+// by then.
+func CheckURL(ctx context.Context, target *url.URL) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, target.Hostname())
+	if err != nil {
+		return fmt.Errorf("cannot resolve webhook host: %v", err)
+	}
+	for _, addr := range addrs {
+		if !PublicIP(addr.IP) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
+
+// dialControl rejects connections to addresses that are not public, after the host has been resolved
+func dialControl(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !PublicIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"dynamic-table-backend/models"
+	"dynamic-table-backend/repository"
+)
+
+// Headers sent with every delivery
+const (
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+	TimestampHeader = "X-Webhook-Timestamp"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// leaseMargin is added to the time a batch of deliveries can take at most, covering the recording of its attempts
+const leaseMargin = 30 * time.Second
+
+// Outbox is the queue of webhook deliveries the dispatcher works off
+type Outbox interface {
+	// ClaimDeliveries picks up to limit due deliveries that are not due again until lease has passed
+	ClaimDeliveries(limit int, lease time.Duration) ([]*models.WebhookDelivery, error)
+	// RecordAttempt logs an attempt of a delivery and moves it to its new status
+	RecordAttempt(deliveryID int64, attempt *models.WebhookAttempt, status string, retryIn time.Duration) error
+}
+
+var _ Outbox = repository.WebhookStore(nil)
+
+// Dispatcher sends the deliveries queued in the outbox, retrying failures with exponential backoff
+// until MaxAttempts is reached and the delivery is dead-lettered. Deliveries only connect to public
+// addresses and do not follow redirects.
+type Dispatcher struct {
+	repo   Outbox
+	client *http.Client
+	// AllowPrivateAddresses lets deliveries connect to loopback, private and link-local addresses,
+	// e.g. to a stub on localhost; it is set by WEBHOOK_ALLOW_PRIVATE
+	AllowPrivateAddresses bool
+	// MaxAttempts is how often a delivery is tried before it is dead-lettered
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry; every further retry waits twice as long, up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// PollInterval is how often the outbox is checked for due deliveries
+	PollInterval time.Duration
+	// BatchSize is how many deliveries are claimed at once
+	BatchSize int
+}
+
+func NewDispatcher(repo Outbox) *Dispatcher {
+	d := &Dispatcher{
+		repo:                  repo,
+		AllowPrivateAddresses: AllowPrivateAddresses(),
+		MaxAttempts:           8,
+		BaseDelay:             10 * time.Second,
+		MaxDelay:              time.Hour,
+		PollInterval:          time.Second,
+		BatchSize:             50,
+	}
+
+	// The address is checked when connecting, after the host has been resolved, so that a host cannot
+	// pass a check and then resolve to a private address. Proxies are not used, as they would connect
+	// on the dispatcher's behalf.
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			if d.AllowPrivateAddresses {
+				return nil
+			}
+			return dialControl(network, address, conn)
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		// A redirect could lead to a private address; the 3xx response counts as a failed attempt
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// Start dispatches deliveries in the background
+func (d *Dispatcher) Start() {
+	go func() {
+		for {
+			if err := d.DispatchDue(); err != nil {
+				log.Println("Failed to dispatch webhooks:", err)
+			}
+			time.Sleep(d.PollInterval)
+		}
+	}()
+}
+
+// DispatchDue sends the deliveries that are due and records the outcome of each
+func (d *Dispatcher) DispatchDue() error {
+	deliveries, err := d.repo.ClaimDeliveries(d.BatchSize, d.lease())
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		attempt := d.send(delivery)
+		attempt.Attempt = delivery.Attempts + 1
+
+		status := models.DeliveryDelivered
+		var retryIn time.Duration
+		if attempt.Error != "" {
+			status = models.DeliveryPending
+			retryIn = Backoff(attempt.Attempt, d.BaseDelay, d.MaxDelay)
+			if attempt.Attempt >= d.MaxAttempts {
+				status = models.DeliveryDead
+			}
+		}
+
+		if err := d.repo.RecordAttempt(delivery.ID, attempt, status, retryIn); err != nil {
+			log.Printf("Failed to record webhook delivery %d: %v", delivery.ID, err)
+		}
+	}
+	return nil
+}
+
+// lease returns how long claimed deliveries are kept from other dispatchers. The deliveries of a batch
+// are sent one after the other, so the lease covers every one of them timing out.
+func (d *Dispatcher) lease() time.Duration {
+	return time.Duration(d.BatchSize)*d.client.Timeout + leaseMargin
+}
+
+// send posts a delivery to its webhook; any response other than 2xx is a failure
+func (d *Dispatcher) send(delivery *models.WebhookDelivery) *models.WebhookAttempt {
+	attempt := &models.WebhookAttempt{}
+	start := time.Now()
+	defer func() {
+		attempt.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// Sign returns the signature header of a payload: "sha256=" followed by the hex HMAC-SHA256 of
+// "<timestamp>.<payload>" keyed with the webhook secret
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns the wait before retrying after the given failed attempt
+func Backoff(attempt int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
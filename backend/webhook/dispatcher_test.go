@@ -0,0 +1,259 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dynamic-table-backend/models"
+)
+
+// fakeOutbox hands out its deliveries once and keeps the attempts recorded for them
+type fakeOutbox struct {
+	mu         sync.Mutex
+	deliveries []*models.WebhookDelivery
+	lease      time.Duration
+	recorded   []recordedAttempt
+}
+
+type recordedAttempt struct {
+	deliveryID int64
+	attempt    *models.WebhookAttempt
+	status     string
+	retryIn    time.Duration
+}
+
+func (o *fakeOutbox) ClaimDeliveries(limit int, lease time.Duration) ([]*models.WebhookDelivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lease = lease
+	claimed := o.deliveries
+	if len(claimed) > limit {
+		claimed = claimed[:limit]
+	}
+	o.deliveries = o.deliveries[len(claimed):]
+	return claimed, nil
+}
+
+func (o *fakeOutbox) RecordAttempt(deliveryID int64, attempt *models.WebhookAttempt, status string, retryIn time.Duration) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.recorded = append(o.recorded, recordedAttempt{deliveryID, attempt, status, retryIn})
+	return nil
+}
+
+func newTestDispatcher(outbox *fakeOutbox) *Dispatcher {
+	d := NewDispatcher(outbox)
+	// The receivers are local stubs
+	d.AllowPrivateAddresses = true
+	d.BaseDelay = time.Second
+	d.MaxDelay = 8 * time.Second
+	d.MaxAttempts = 3
+	return d
+}
+
+func TestDispatchSignsDeliveries(t *testing.T) {
+	const secret = "s3cret"
+	payload := []byte(`{"event":"content.create","recordId":"1"}`)
+
+	var gotBody []byte
+	var gotHeader http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Clone()
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	outbox := &fakeOutbox{deliveries: []*models.WebhookDelivery{{
+		ID: 42, Event: "content.create", Payload: payload, URL: server.URL, Secret: secret,
+	}}}
+	if err := newTestDispatcher(outbox).DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(gotBody) != string(payload) {
+		t.Fatalf("body = %s, want %s", gotBody, payload)
+	}
+	if gotHeader.Get(EventHeader) != "content.create" || gotHeader.Get(DeliveryHeader) != "42" {
+		t.Fatalf("unexpected headers %v", gotHeader)
+	}
+
+	// The receiver verifies the signature from the timestamp header and the raw body
+	timestamp, err := strconv.ParseInt(gotHeader.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid timestamp header: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", timestamp, gotBody)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := gotHeader.Get(SignatureHeader); got != want {
+		t.Fatalf("signature = %s, want %s", got, want)
+	}
+
+	if len(outbox.recorded) != 1 {
+		t.Fatalf("recorded %d attempts, want 1", len(outbox.recorded))
+	}
+	recorded := outbox.recorded[0]
+	if recorded.status != models.DeliveryDelivered || recorded.attempt.StatusCode != http.StatusNoContent || recorded.attempt.Attempt != 1 {
+		t.Fatalf("unexpected attempt %+v with status %s", recorded.attempt, recorded.status)
+	}
+}
+
+func TestDispatchRetriesWithBackoffAndDeadLetters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	outbox := &fakeOutbox{deliveries: []*models.WebhookDelivery{
+		{ID: 1, Event: "content.update", Payload: []byte(`{}`), URL: server.URL, Secret: "a", Attempts: 0},
+		{ID: 2, Event: "content.update", Payload: []byte(`{}`), URL: server.URL, Secret: "a", Attempts: 1},
+		{ID: 3, Event: "content.update", Payload: []byte(`{}`), URL: server.URL, Secret: "a", Attempts: 2},
+	}}
+	if err := newTestDispatcher(outbox).DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		status  string
+		retryIn time.Duration
+	}{
+		{models.DeliveryPending, time.Second},
+		{models.DeliveryPending, 2 * time.Second},
+		{models.DeliveryDead, 4 * time.Second},
+	}
+	if len(outbox.recorded) != len(want) {
+		t.Fatalf("recorded %d attempts, want %d", len(outbox.recorded), len(want))
+	}
+	for i, recorded := range outbox.recorded {
+		if recorded.status != want[i].status || recorded.retryIn != want[i].retryIn {
+			t.Errorf("delivery %d: status %s retrying in %v, want %s in %v",
+				recorded.deliveryID, recorded.status, recorded.retryIn, want[i].status, want[i].retryIn)
+		}
+		if recorded.attempt.StatusCode != http.StatusServiceUnavailable || recorded.attempt.Error == "" {
+			t.Errorf("delivery %d: unexpected attempt %+v", recorded.deliveryID, recorded.attempt)
+		}
+	}
+}
+
+func TestDispatchFailsUnreachableEndpoints(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	outbox := &fakeOutbox{deliveries: []*models.WebhookDelivery{{ID: 7, Payload: []byte(`{}`), URL: url}}}
+	if err := newTestDispatcher(outbox).DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox.recorded) != 1 || outbox.recorded[0].status != models.DeliveryPending || outbox.recorded[0].attempt.Error == "" {
+		t.Fatalf("unexpected attempts %+v", outbox.recorded)
+	}
+}
+
+func TestDispatchRejectsPrivateAddresses(t *testing.T) {
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer server.Close()
+
+	outbox := &fakeOutbox{deliveries: []*models.WebhookDelivery{{ID: 1, Payload: []byte(`{}`), URL: server.URL}}}
+	d := newTestDispatcher(outbox)
+	d.AllowPrivateAddresses = false
+	if err := d.DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	if hits != 0 {
+		t.Errorf("a loopback receiver got %d requests", hits)
+	}
+	if len(outbox.recorded) != 1 || !strings.Contains(outbox.recorded[0].attempt.Error, ErrPrivateAddress.Error()) {
+		t.Fatalf("unexpected attempts %+v", outbox.recorded)
+	}
+}
+
+func TestDispatchDoesNotFollowRedirects(t *testing.T) {
+	var redirected bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer server.Close()
+
+	outbox := &fakeOutbox{deliveries: []*models.WebhookDelivery{{ID: 1, Payload: []byte(`{}`), URL: server.URL}}}
+	if err := newTestDispatcher(outbox).DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	if redirected {
+		t.Error("the delivery followed a redirect")
+	}
+	if len(outbox.recorded) != 1 || outbox.recorded[0].status != models.DeliveryPending || outbox.recorded[0].attempt.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("unexpected attempts %+v", outbox.recorded)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+	}
+	for _, test := range tests {
+		if got := PublicIP(net.ParseIP(test.ip)); got != test.public {
+			t.Errorf("PublicIP(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
+
+func TestLeaseCoversBatch(t *testing.T) {
+	outbox := &fakeOutbox{}
+	d := NewDispatcher(outbox)
+	if err := d.DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	if min := time.Duration(d.BatchSize) * d.client.Timeout; outbox.lease <= min {
+		t.Fatalf("lease %v does not cover a batch of %d deliveries timing out after %v", outbox.lease, d.BatchSize, d.client.Timeout)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempt, 10*time.Second, time.Hour); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,40 @@
-import axios from 'axios';
+import axios, { AxiosError, InternalAxiosRequestConfig } from 'axios';
 import { Content, ContentQueryParams, ContentResponse, CreateContentRequest, CreateSchemaRequest, Schema, UpdateContentRequest, UpdateSchemaRequest } from '../types';
 
 const api = axios.create({
     baseURL: (import.meta.env.VITE_API_URL || 'http://localhost:8080') + '/api',
     headers: {
         'Content-Type': 'application/json',
+        ...(import.meta.env.VITE_TENANT ? { 'X-Tenant': import.meta.env.VITE_TENANT } : {}),
     },
 });
 
+// The API key is entered by the user and kept for the browser session, never built into the bundle
+const API_KEY_STORAGE = 'apiKey';
+
+api.interceptors.request.use((config) => {
+    const apiKey = sessionStorage.getItem(API_KEY_STORAGE);
+    if (apiKey) {
+        config.headers['X-API-Key'] = apiKey;
+    }
+    return config;
+});
+
+// Ask for a key when the backend rejects the request, and retry once with it
+api.interceptors.response.use(undefined, async (error: AxiosError) => {
+    const config = error.config as (InternalAxiosRequestConfig & { _retried?: boolean }) | undefined;
+    if (error.response?.status !== 401 || !config || config._retried) {
+        throw error;
+    }
+    const apiKey = window.prompt('Enter your API key');
+    if (!apiKey) {
+        throw error;
+    }
+    sessionStorage.setItem(API_KEY_STORAGE, apiKey.trim());
+    config._retried = true;
+    return api(config);
+});
+
 // Schema API calls
 export const schemaAPI = {
     create: async (data: CreateSchemaRequest): Promise<Schema> => {